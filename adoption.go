@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adoptionGraphWidth is the width of the bars drawn by mota history graph.
+const adoptionGraphWidth = 40
+
+// FleetSnapshot records the firmware version of every device found by a
+// daemon run, to track the adoption of firmware versions over time.
+type FleetSnapshot struct {
+	Time    time.Time        `json:"time"`
+	Devices []SnapshotDevice `json:"devices"`
+}
+
+// SnapshotDevice holds the firmware version of a device in a snapshot.
+type SnapshotDevice struct {
+	Device   string `json:"device"`
+	Model    string `json:"model"`
+	Version  string `json:"version"`
+	UpToDate bool   `json:"up_to_date"`
+}
+
+// AdoptionPoint summarizes a snapshot: how many devices were found, how
+// many were up-to-date and how many ran each firmware release.
+type AdoptionPoint struct {
+	Time     time.Time      `json:"time"`
+	Devices  int            `json:"devices"`
+	UpToDate int            `json:"up_to_date"`
+	Versions map[string]int `json:"versions"`
+}
+
+// defaultHistoryPath returns the history file path on the OS cache or
+// temp directories.
+func defaultHistoryPath() string {
+	return filepath.Join(stateDir(), "history.json")
+}
+
+// Snapshot adds the firmware versions of the devices found to the
+// history.
+func (h *History) Snapshot(devices map[string]*Device, now time.Time) {
+	snapshot := FleetSnapshot{Time: now, Devices: []SnapshotDevice{}}
+
+	for _, device := range sortedDevices(devices) {
+		snapshot.Devices = append(snapshot.Devices, SnapshotDevice{
+			Device:   device.ID(),
+			Model:    device.Model,
+			Version:  device.CurrentFWVersion,
+			UpToDate: device.CurrentFWVersion == device.NewFWVersion,
+		})
+	}
+
+	h.Snapshots = append(h.Snapshots, snapshot)
+}
+
+// LastSnapshot returns the time of the most recent snapshot, or the
+// zero time if there is none.
+func (h *History) LastSnapshot() time.Time {
+	if len(h.Snapshots) == 0 {
+		return time.Time{}
+	}
+
+	return h.Snapshots[len(h.Snapshots)-1].Time
+}
+
+// Adoption summarizes every snapshot, limited to the devices of a model
+// (or Gen2 application) if given. Versions are grouped by release (e.g.
+// v1.14.0) rather than by build.
+func (h *History) Adoption(model string) []AdoptionPoint {
+	points := []AdoptionPoint{}
+
+	for _, snapshot := range h.Snapshots {
+		point := AdoptionPoint{Time: snapshot.Time, Versions: map[string]int{}}
+
+		for _, device := range snapshot.Devices {
+			if model != "" && !strings.EqualFold(device.Model, model) {
+				continue
+			}
+
+			point.Devices++
+			point.Versions[adoptionRelease(device.Version)]++
+
+			if device.UpToDate {
+				point.UpToDate++
+			}
+		}
+
+		points = append(points, point)
+	}
+
+	return points
+}
+
+// adoptionRelease returns the release of a firmware version, without
+// its build date or commit (e.g. v1.14.0 for
+// 20230913-112003/v1.14.0-gcb84623).
+func adoptionRelease(version string) string {
+	version = releaseVersion(version)
+	if index := strings.Index(version, "-g"); index >= 0 {
+		version = version[:index]
+	}
+
+	return version
+}
+
+// writeAdoptionGraph draws the share of up-to-date devices in each
+// snapshot as a bar, followed by the most common releases.
+func writeAdoptionGraph(out io.Writer, points []AdoptionPoint) {
+	if len(points) == 0 {
+		fmt.Fprintln(out, "No snapshots recorded yet, they are taken by mota daemon.")
+		return
+	}
+
+	for _, point := range points {
+		filled := 0
+		if point.Devices > 0 {
+			filled = point.UpToDate * adoptionGraphWidth / point.Devices
+		}
+
+		bar := strings.Repeat("█", filled) + strings.Repeat("░", adoptionGraphWidth-filled)
+		fmt.Fprintf(out, "%v %v %3d%% up-to-date (%v/%v)  %v\n", point.Time.Local().Format("2006-01-02 15:04"), bar, percentage(point.UpToDate, point.Devices), point.UpToDate, point.Devices, topVersions(point.Versions, 3))
+	}
+}
+
+func percentage(part int, total int) int {
+	if total == 0 {
+		return 0
+	}
+
+	return part * 100 / total
+}
+
+// topVersions returns the most common releases, with their number of
+// devices.
+func topVersions(versions map[string]int, limit int) string {
+	var names []string
+	for version := range versions {
+		names = append(names, version)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if versions[names[i]] != versions[names[j]] {
+			return versions[names[i]] > versions[names[j]]
+		}
+
+		return names[i] < names[j]
+	})
+
+	var top []string
+	for index, version := range names {
+		if index == limit {
+			top = append(top, fmt.Sprintf("+%v more", len(names)-limit))
+			break
+		}
+
+		top = append(top, fmt.Sprintf("%v: %v", version, versions[version]))
+	}
+
+	return strings.Join(top, ", ")
+}
+
+// snapshot records the firmware versions of the devices found by a run
+// in the history, if the last snapshot is older than the snapshot
+// interval.
+func (d *Daemon) snapshot(historyPath string, devices map[string]*Device, now time.Time) error {
+	if d.snapshotInterval <= 0 || len(devices) == 0 {
+		return nil
+	}
+
+	history, err := LoadHistory(historyPath)
+	if err != nil {
+		return err
+	}
+
+	if now.Sub(history.LastSnapshot()) < d.snapshotInterval {
+		return nil
+	}
+
+	history.Snapshot(devices, now)
+
+	return history.Save()
+}
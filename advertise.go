@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+
+	zeroconf "github.com/grandcat/zeroconf"
+)
+
+// advertisedService is the DNS-SD service type firmware mirrors are
+// advertised under.
+const advertisedService = "_http._tcp"
+
+// firmwareTXTRecords returns the TXT records describing a firmware
+// mirror: the mota version and the firmware version of each mirrored
+// model (and its beta version, if mirrored), sorted by model.
+func firmwareTXTRecords(firmwares map[string]Firmware) []string {
+	records := []string{"txtvers=1", "mota=" + version, "path=/files/firmware"}
+
+	var models []string
+	for model := range firmwares {
+		models = append(models, model)
+	}
+
+	sort.Strings(models)
+
+	for _, model := range models {
+		firmware := firmwares[model]
+		records = append(records, fmt.Sprintf("fw.%v=%v", model, firmware.Version))
+
+		if firmware.BetaVersion != "" {
+			records = append(records, fmt.Sprintf("fw.%v.beta=%v", model, firmware.BetaVersion))
+		}
+	}
+
+	return records
+}
+
+// advertiseMirror advertises a firmware mirror listening on an address
+// (e.g. :8080) via mDNS, so that other tools and mota instances on the
+// local network can find it.
+func advertiseMirror(listen string, firmwares map[string]Firmware) (*zeroconf.Server, error) {
+	_, portString, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "localhost"
+	}
+
+	return zeroconf.Register(fmt.Sprintf("mota mirror on %v", hostName), advertisedService, "local.", port, firmwareTXTRecords(firmwares), nil)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Agent runs discovery on a remote site and periodically reports the
+// devices found to a controller, connecting out so that no inbound
+// access to the site is required. Devices the controller asks for are
+// upgraded without prompting.
+type Agent struct {
+	client        *http.Client
+	controllerURL string
+	failed        []string
+	interval      time.Duration
+	options       []OTAUpdaterOption
+	site          string
+	token         string
+	tracer        *Tracer
+	upgraded      []string
+}
+
+// AgentOption is an option interface for Agent.
+type AgentOption func(*Agent)
+
+// WithControllerURL is an Agent option that sets the base URL of the
+// controller to report to.
+func WithControllerURL(controllerURL string) AgentOption {
+	return func(a *Agent) {
+		a.controllerURL = strings.TrimSuffix(controllerURL, "/")
+	}
+}
+
+// WithSite is an Agent option that sets the name the site is reported
+// as to the controller.
+func WithSite(site string) AgentOption {
+	return func(a *Agent) {
+		a.site = site
+	}
+}
+
+// WithAgentTracer is an Agent option that sets the tracer recording a
+// trace of each run.
+func WithAgentTracer(tracer *Tracer) AgentOption {
+	return func(a *Agent) {
+		a.tracer = tracer
+	}
+}
+
+// WithAgentToken is an Agent option that sets the bearer token used to
+// authenticate with the controller.
+func WithAgentToken(token string) AgentOption {
+	return func(a *Agent) {
+		a.token = token
+	}
+}
+
+// WithAgentInterval is an Agent option that sets the time between
+// reports to the controller.
+func WithAgentInterval(interval time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.interval = interval
+	}
+}
+
+// WithAgentUpdaterOptions is an Agent option that sets the options used
+// to create the OTAUpdater on each run.
+func WithAgentUpdaterOptions(options ...OTAUpdaterOption) AgentOption {
+	return func(a *Agent) {
+		a.options = options
+	}
+}
+
+// NewAgent returns an instance of Agent with the default options.
+func NewAgent(options ...AgentOption) (*Agent, error) {
+	agent := &Agent{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		interval: time.Minute,
+	}
+
+	for _, option := range options {
+		option(agent)
+	}
+
+	if agent.controllerURL == "" {
+		return nil, errors.New("a controller URL is required")
+	}
+
+	if agent.site == "" {
+		return nil, errors.New("a site name is required")
+	}
+
+	return agent, nil
+}
+
+// Run reports to the controller forever, waiting for the configured
+// interval between reports.
+func (a *Agent) Run() {
+	for {
+		err := a.RunOnce()
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		time.Sleep(a.interval)
+	}
+}
+
+// RunOnce discovers devices, reports them to the controller along with
+// the results of the previous upgrades and upgrades the devices the
+// controller asks for.
+func (a *Agent) RunOnce() (err error) {
+	a.tracer.StartRun("agent.run")
+	defer func() { endTrace(a.tracer, err) }()
+
+	otaUpdater, err := NewOTAUpdater(a.options...)
+	if err != nil {
+		return err
+	}
+	defer otaUpdater.Close()
+
+	err = otaUpdater.Start()
+	if err != nil {
+		return err
+	}
+
+	devices, err := otaUpdater.Devices()
+	if err != nil {
+		return err
+	}
+
+	commands, err := a.report(devices)
+	if err != nil {
+		return err
+	}
+
+	a.upgraded, a.failed = nil, nil
+
+	if len(commands.Upgrade) == 0 {
+		return nil
+	}
+
+	log.Infof("Controller requested upgrading %v device(s)", len(commands.Upgrade))
+
+	var selected []*Device
+	for _, device := range sortedDevices(devices) {
+		for _, id := range commands.Upgrade {
+			if device.ID() == id {
+				selected = append(selected, device)
+			}
+		}
+	}
+
+	err = otaUpdater.UpgradeDevices(selected)
+
+	for _, device := range otaUpdater.UpgradedDevices() {
+		a.upgraded = append(a.upgraded, device.ID())
+	}
+
+	for _, device := range otaUpdater.FailedDevices() {
+		a.failed = append(a.failed, device.ID())
+	}
+
+	return err
+}
+
+// report sends the devices found and the results of the previous
+// upgrades to the controller, returning the upgrades it requests.
+func (a *Agent) report(devices map[string]*Device) (SiteCommands, error) {
+	var commands SiteCommands
+
+	report := SiteReport{
+		Site:     a.site,
+		Devices:  []SiteDevice{},
+		Upgraded: a.upgraded,
+		Failed:   a.failed,
+	}
+
+	status := map[string]string{}
+	for _, id := range a.upgraded {
+		status[id] = "upgraded"
+	}
+	for _, id := range a.failed {
+		status[id] = "failed"
+	}
+
+	for _, device := range sortedDevices(devices) {
+		siteDevice := newSiteDevice(device)
+		siteDevice.Status = status[device.ID()]
+		report.Devices = append(report.Devices, siteDevice)
+	}
+
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return commands, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, a.controllerURL+"/agents/report", bytes.NewReader(payload))
+	if err != nil {
+		return commands, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		request.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	response, err := a.client.Do(request)
+	if err != nil {
+		return commands, fmt.Errorf("unable to report to controller %v (%v)", a.controllerURL, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return commands, fmt.Errorf("unable to report to controller %v (unexpected status %v)", a.controllerURL, response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&commands)
+	if err != nil {
+		return commands, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return commands, nil
+}
+
+// UpgradeDevices upgrades the given devices without prompting, such as
+// when requested by a controller, and verifies they come back online.
+func (o *OTAUpdater) UpgradeDevices(devices []*Device) error {
+	history, err := LoadHistory(o.historyPath)
+	if err != nil {
+		return err
+	}
+
+	force := o.force
+	o.force = true
+	upgradedDevices, err := o.upgradeDevices(devices, history, map[string]int{}, map[string]int{})
+	o.force = force
+	if err != nil {
+		return err
+	}
+
+	if o.verifyTimeout > 0 {
+		return o.reportVerificationFailures(o.VerifyDevices(upgradedDevices))
+	}
+
+	return nil
+}
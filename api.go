@@ -2,28 +2,52 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
 // Firmware is a structure that holds information about a specific
 // remote firmware file.
 type Firmware struct {
-	Model       string
-	URL         string
-	Version     string
-	BetaURL     string `json:"beta_url"`
-	BetaVersion string `json:"beta_ver"`
+	Model       string `json:"model"`
+	URL         string `json:"url"`
+	Version     string `json:"version"`
+	BetaURL     string `json:"beta_url,omitempty"`
+	BetaVersion string `json:"beta_ver,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	BetaSHA256  string `json:"beta_sha256,omitempty"`
 }
 
 // APIClient is a struct that represents an API client that fetches
 // information from the Shelly Cloud APIs.
 type APIClient struct {
-	baseURL      string
-	includeBetas bool
-	firmwares    map[string]Firmware
-	httpClient   *http.Client
+	baseURL          string
+	blocked          map[string]bool
+	blocklist        map[string][]string
+	blocklistApplied map[string]bool
+	clock            Clock
+	failed           map[string]error
+	gen2BaseURL      string
+	gen2Apps         map[string]bool
+	includeBetas     bool
+	firmwares        map[string]Firmware
+	fwcdnBaseURL     string
+	httpClient       *http.Client
+	incomplete       bool
+	indexCache       string
+	pins             map[string][]string
+	replaced         map[string]bool
+	retries          int
+	retryDelay       time.Duration
+	tracer           *Tracer
+	unavailable      map[string]bool
 }
 
 type response struct {
@@ -31,6 +55,80 @@ type response struct {
 	Data map[string]Firmware `json:"data"`
 }
 
+// maxRetryAfter caps the delay honoured from a Retry-After header, so
+// that a misbehaving server cannot stall the run indefinitely.
+const maxRetryAfter = time.Minute
+
+// cloudError is an unexpected status returned by the Shelly Cloud API,
+// along with the delay it asked to wait before retrying (if any).
+type cloudError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *cloudError) Error() string {
+	return fmt.Sprintf("unexpected status %v", e.status)
+}
+
+// newCloudError returns the error for an unexpected status, parsing its
+// Retry-After header.
+func newCloudError(apiResponse *http.Response, now time.Time) *cloudError {
+	return &cloudError{
+		status:     apiResponse.StatusCode,
+		retryAfter: parseRetryAfter(apiResponse.Header.Get("Retry-After"), now),
+	}
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given either
+// in seconds or as an HTTP date, or zero if it is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+
+	return 0
+}
+
+// backoff returns the delay before retrying after a failed attempt: the
+// delay asked for by the Shelly Cloud API, up to maxRetryAfter, or the
+// retry delay doubled after each attempt.
+func (client *APIClient) backoff(attempt int, err error) time.Duration {
+	var cloudErr *cloudError
+	if errors.As(err, &cloudErr) && cloudErr.retryAfter > 0 {
+		if cloudErr.retryAfter > maxRetryAfter {
+			return maxRetryAfter
+		}
+
+		return cloudErr.retryAfter
+	}
+
+	return client.retryDelay * time.Duration(1<<uint(attempt-1))
+}
+
+type gen2Release struct {
+	Version string `json:"version"`
+	BuildID string `json:"build_id"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+type gen2Response struct {
+	Stable gen2Release `json:"stable"`
+	Beta   gen2Release `json:"beta"`
+}
+
 // APIClientOption is an option interface for APIClient.
 type APIClientOption func(*APIClient)
 
@@ -42,6 +140,54 @@ func WithAPIHTTPClient(httpClient *http.Client) APIClientOption {
 	}
 }
 
+// WithPinnedKeys is an APIClient option that pins the public keys of
+// the certificates presented by specific hosts (e.g. api.shelly.cloud),
+// so that a compromised network cannot serve malicious firmware even
+// with a certificate trusted by the system.
+func WithPinnedKeys(pins map[string][]string) APIClientOption {
+	return func(client *APIClient) {
+		client.pins = pins
+		client.httpClient = pinnedHTTPClient(pins, nil)
+	}
+}
+
+// WithIndexCache is an APIClient option that sets the path where the
+// Gen1 firmware index is cached, to be used when the Shelly Cloud API
+// is unavailable.
+func WithIndexCache(indexCache string) APIClientOption {
+	return func(client *APIClient) {
+		client.indexCache = indexCache
+	}
+}
+
+// WithRetries is an APIClient option that sets how many times fetching
+// firmware information is attempted and the initial delay between
+// attempts, which doubles after each one unless the Shelly Cloud API
+// asks to retry after a specific delay.
+func WithRetries(retries int, retryDelay time.Duration) APIClientOption {
+	return func(client *APIClient) {
+		client.retries = retries
+		client.retryDelay = retryDelay
+	}
+}
+
+// WithAPIClock is an APIClient option that sets the clock used to wait
+// between attempts, e.g. in tests.
+func WithAPIClock(clock Clock) APIClientOption {
+	return func(client *APIClient) {
+		client.clock = clock
+	}
+}
+
+// WithBlocklist is an APIClient option that sets firmware versions per
+// model that must never be installed. The newest non-blocked version
+// from the firmware archive is used instead.
+func WithBlocklist(blocklist map[string][]string) APIClientOption {
+	return func(client *APIClient) {
+		client.blocklist = blocklist
+	}
+}
+
 // WithBaseURL is an APIClient option that allows overriding the
 // base URL used for remote calls.
 func WithBaseURL(baseURL string) APIClientOption {
@@ -50,6 +196,14 @@ func WithBaseURL(baseURL string) APIClientOption {
 	}
 }
 
+// WithGen2BaseURL is an APIClient option that allows overriding the
+// base URL used to fetch Gen2 firmware information.
+func WithGen2BaseURL(gen2BaseURL string) APIClientOption {
+	return func(client *APIClient) {
+		client.gen2BaseURL = gen2BaseURL
+	}
+}
+
 // WithBetaFirmware is an APIClient option that enables beta firmware
 // support when available
 func WithBetaFirmware(includeBetas bool) APIClientOption {
@@ -62,10 +216,22 @@ func WithBetaFirmware(includeBetas bool) APIClientOption {
 // options.
 func NewAPIClient(options ...APIClientOption) *APIClient {
 	client := &APIClient{
-		baseURL: "https://api.shelly.cloud",
+		baseURL:          "https://api.shelly.cloud",
+		blocked:          map[string]bool{},
+		blocklistApplied: map[string]bool{},
+		clock:            realClock{},
+		failed:           map[string]error{},
+		gen2BaseURL:      "https://updates.shelly.cloud",
+		gen2Apps:         map[string]bool{},
+		fwcdnBaseURL:     "https://fwcdn.shelly.cloud",
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
-		}}
+		},
+		replaced:    map[string]bool{},
+		retries:     3,
+		retryDelay:  2 * time.Second,
+		unavailable: map[string]bool{},
+	}
 
 	for _, option := range options {
 		option(client)
@@ -74,26 +240,257 @@ func NewAPIClient(options ...APIClientOption) *APIClient {
 	return client
 }
 
+// AddGen2App registers a Gen2 application name (e.g. Plus1PM) whose
+// firmware information should be fetched alongside the Gen1 list.
+// Applications registered after versions have been fetched are fetched
+// on the next call to FetchVersions.
+func (client *APIClient) AddGen2App(app string) {
+	client.gen2Apps[app] = true
+}
+
 // FetchVersions returns a list of remotely available firmwares.
 func (client *APIClient) FetchVersions() (map[string]Firmware, error) {
-	if len(client.firmwares) > 0 {
-		return client.firmwares, nil
+	if client.firmwares == nil {
+		client.firmwares = client.fetchGen1Versions()
+	}
+
+	for app := range client.gen2Apps {
+		if _, ok := client.firmwares[app]; ok || client.blocked[app] {
+			continue
+		}
+
+		if client.unavailable[app] {
+			continue
+		}
+
+		firmware, err := client.fetchGen2Version(app)
+		if err != nil {
+			cached, cacheErr := client.readIndexCache()
+			if cached, ok := cached[app]; cacheErr == nil && ok {
+				apiLog.Warnf("Using cached firmware information for %v (%v)", app, err)
+				client.firmwares[app] = cached
+				continue
+			}
+
+			apiLog.Warnf("Firmware information is unavailable for %v (%v)", app, err)
+			client.unavailable[app] = true
+			client.failed[app] = err
+			continue
+		}
+
+		client.firmwares[app] = firmware
+
+		if firmware.Version != "" {
+			client.writeIndexCache(map[string]Firmware{app: firmware})
+		}
+	}
+
+	client.applyBlocklist(client.firmwares)
+
+	return client.firmwares, nil
+}
+
+// FailedModels returns the error fetching the firmware information of
+// each model it could not be fetched for, which are skipped while the
+// remaining models are upgraded as usual.
+func (client *APIClient) FailedModels() map[string]error {
+	return client.failed
+}
+
+// fetchGen1Versions returns the Gen1 firmware index. Fetching is
+// retried if the Shelly Cloud API fails or reports an error, falling
+// back to the cached index and then to whatever data was returned. In
+// that case, models missing from the index are reported as unavailable
+// instead of failing the whole run.
+func (client *APIClient) fetchGen1Versions() map[string]Firmware {
+	var decoded response
+	var err error
+
+	for attempt := 1; attempt <= client.retries; attempt++ {
+		decoded, err = client.fetchIndex()
+		if err == nil {
+			break
+		}
+
+		apiLog.Warnf("Unable to fetch firmware index from %v (attempt %v of %v): %v", client.baseURL, attempt, client.retries, err)
+
+		if attempt < client.retries {
+			client.clock.Sleep(client.backoff(attempt, err))
+		}
+	}
+
+	// Models without a version or download URL cannot be upgraded.
+	for model, firmware := range decoded.Data {
+		if firmware.Version == "" || firmware.URL == "" {
+			apiLog.Warnf("Firmware index has incomplete information for %v", model)
+			delete(decoded.Data, model)
+			client.unavailable[model] = true
+		}
+	}
+
+	if decoded.Data == nil {
+		decoded.Data = map[string]Firmware{}
+	}
+
+	if err == nil {
+		client.writeIndexCache(decoded.Data)
+
+		return decoded.Data
 	}
 
+	client.incomplete = true
+
+	cached, cacheErr := client.readIndexCache()
+	if cacheErr == nil {
+		apiLog.Warnf("Using cached firmware index from %v", client.indexCache)
+
+		return cached
+	}
+
+	if len(decoded.Data) > 0 {
+		apiLog.Warnf("Using partial firmware index with %v models", len(decoded.Data))
+
+		return decoded.Data
+	}
+
+	apiLog.Errorf("Firmware information is unavailable for all Gen1 models")
+
+	return map[string]Firmware{}
+}
+
+// fetchIndex fetches the Gen1 firmware index, returning any data decoded
+// even if the API reports an error.
+func (client *APIClient) fetchIndex() (decoded response, err error) {
+	span := client.tracer.StartSpan("cloud_api.firmware_index", "url", client.baseURL)
+	defer func() { span.End(err) }()
+
 	apiResponse, err := client.httpClient.Get(client.baseURL + "/files/firmware")
 	if err != nil {
-		return nil, err
+		return decoded, err
+	}
+
+	defer apiResponse.Body.Close()
+
+	if apiResponse.StatusCode != 200 {
+		return decoded, newCloudError(apiResponse, client.clock.Now())
 	}
 
-	var decoded response
 	err = json.NewDecoder(apiResponse.Body).Decode(&decoded)
+	if err != nil {
+		return decoded, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	if !decoded.IsOk {
+		return decoded, errors.New("API reported an error (isok=false)")
+	}
+
+	return decoded, nil
+}
+
+func (client *APIClient) readIndexCache() (map[string]Firmware, error) {
+	if client.indexCache == "" {
+		return nil, errors.New("no index cache configured")
+	}
+
+	data, err := ioutil.ReadFile(client.indexCache)
 	if err != nil {
 		return nil, err
 	}
 
-	client.firmwares = decoded.Data
+	var firmwares map[string]Firmware
+	err = json.Unmarshal(data, &firmwares)
+	if err != nil {
+		return nil, err
+	}
 
-	return client.firmwares, nil
+	return firmwares, nil
+}
+
+// writeIndexCache records firmware information in the index cache,
+// keeping the cached information of other models.
+func (client *APIClient) writeIndexCache(firmwares map[string]Firmware) {
+	if client.indexCache == "" {
+		return
+	}
+
+	cached, err := client.readIndexCache()
+	if err != nil {
+		cached = map[string]Firmware{}
+	}
+
+	for model, firmware := range firmwares {
+		cached[model] = firmware
+	}
+
+	data, err := json.Marshal(cached)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(client.indexCache), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(client.indexCache, data, 0600)
+	}
+	if err != nil {
+		apiLog.Warnf("Unable to cache firmware index to %v (%v)", client.indexCache, err)
+	}
+}
+
+// fetchGen2Version returns the stable and beta firmware information
+// published for a Gen2 application, retrying if the update server fails.
+func (client *APIClient) fetchGen2Version(app string) (firmware Firmware, err error) {
+	for attempt := 1; attempt <= client.retries; attempt++ {
+		firmware, err = client.fetchGen2Update(app)
+		if err == nil {
+			return firmware, nil
+		}
+
+		apiLog.Warnf("Unable to fetch firmware information for %v from %v (attempt %v of %v): %v", app, client.gen2BaseURL, attempt, client.retries, err)
+
+		if attempt < client.retries {
+			client.clock.Sleep(client.backoff(attempt, err))
+		}
+	}
+
+	return Firmware{}, err
+}
+
+// fetchGen2Update fetches the firmware information published for a Gen2
+// application once.
+func (client *APIClient) fetchGen2Update(app string) (firmware Firmware, err error) {
+	span := client.tracer.StartSpan("cloud_api.gen2_version", "app", app)
+	defer func() { span.End(err) }()
+
+	apiResponse, err := client.httpClient.Get(client.gen2BaseURL + "/update/" + app)
+	if err != nil {
+		return Firmware{}, err
+	}
+
+	defer apiResponse.Body.Close()
+
+	// Applications unknown to the update server are kept in the index
+	// without a version, so that their devices are reported as such.
+	if apiResponse.StatusCode == http.StatusNotFound {
+		return Firmware{Model: app}, nil
+	}
+
+	if apiResponse.StatusCode != http.StatusOK {
+		return Firmware{}, newCloudError(apiResponse, client.clock.Now())
+	}
+
+	var decoded gen2Response
+	err = json.NewDecoder(apiResponse.Body).Decode(&decoded)
+	if err != nil {
+		return Firmware{}, err
+	}
+
+	return Firmware{
+		Model:       app,
+		URL:         decoded.Stable.URL,
+		Version:     decoded.Stable.Version,
+		BetaURL:     decoded.Beta.URL,
+		BetaVersion: decoded.Beta.Version,
+		SHA256:      decoded.Stable.SHA256,
+		BetaSHA256:  decoded.Beta.SHA256,
+	}, nil
 }
 
 // FetchFirmware returns the binary data of a remote firmware for
@@ -104,11 +501,21 @@ func (client *APIClient) FetchFirmware(model string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	response, err := client.httpClient.Get(url)
+	return client.FetchFirmwareURL(url)
+}
+
+// FetchFirmwareURL returns the binary data of a remote firmware file.
+func (client *APIClient) FetchFirmwareURL(url string) (io.ReadCloser, error) {
+	response, err := client.httpClient.Get(securePinnedURL(url, client.pins))
 	if err != nil {
 		return nil, err
 	}
 
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected status %v while downloading %v", response.StatusCode, url)
+	}
+
 	return response.Body, nil
 }
 
@@ -119,15 +526,42 @@ func (client *APIClient) GetVersion(model string) (string, error) {
 		return "", err
 	}
 
+	if _, ok := firmwares[model]; !ok {
+		return "", client.missingFirmwareError(model)
+	}
+
 	version := firmwares[model].Version
 
 	if client.includeBetas && firmwares[model].BetaVersion != "" {
 		version = firmwares[model].BetaVersion
 	}
 
+	// An empty version would otherwise match devices that do not report
+	// one either, or be offered as an upgrade to all others.
+	if version == "" {
+		return "", fmt.Errorf("%w: %v", ErrModelNotIndexed, model)
+	}
+
 	return version, nil
 }
 
+// GetBetaVersion returns the beta firmware version available for a
+// model if it is newer than the stable version, regardless of whether
+// beta firmware is enabled.
+func (client *APIClient) GetBetaVersion(model string) string {
+	firmwares, err := client.FetchVersions()
+	if err != nil {
+		return ""
+	}
+
+	firmware := firmwares[model]
+	if firmware.BetaVersion == "" || firmware.BetaURL == "" || compareFirmwareVersions(firmware.BetaVersion, firmware.Version) <= 0 {
+		return ""
+	}
+
+	return firmware.BetaVersion
+}
+
 // GetURL returns the most recent firmware download URL available for a model
 func (client *APIClient) GetURL(model string) (string, error) {
 	firmwares, err := client.FetchVersions()
@@ -135,6 +569,10 @@ func (client *APIClient) GetURL(model string) (string, error) {
 		return "", err
 	}
 
+	if _, ok := firmwares[model]; !ok {
+		return "", client.missingFirmwareError(model)
+	}
+
 	version := firmwares[model].URL
 
 	if client.includeBetas && firmwares[model].BetaURL != "" {
@@ -143,3 +581,50 @@ func (client *APIClient) GetURL(model string) (string, error) {
 
 	return version, nil
 }
+
+// GetChecksum returns the SHA-256 checksum of the most recent firmware
+// available for a model, if published (e.g. by a mota mirror).
+func (client *APIClient) GetChecksum(model string) (string, error) {
+	firmwares, err := client.FetchVersions()
+	if err != nil {
+		return "", err
+	}
+
+	checksum := firmwares[model].SHA256
+
+	if client.includeBetas && firmwares[model].BetaURL != "" {
+		checksum = firmwares[model].BetaSHA256
+	}
+
+	return checksum, nil
+}
+
+// missingFirmwareError returns the error for a model missing from the
+// firmware index, distinguishing models without published firmware from
+// those missing due to an incomplete index or the blocklist.
+func (client *APIClient) missingFirmwareError(model string) error {
+	if client.blocked[model] {
+		return fmt.Errorf("%w for model %v", ErrFirmwareBlocked, model)
+	}
+
+	if err, ok := client.failed[model]; ok {
+		return fmt.Errorf("%w for model %v (%v)", ErrFirmwareInfoUnavailable, model, err)
+	}
+
+	if client.unavailable[model] || (client.incomplete && !client.gen2Apps[model]) {
+		return fmt.Errorf("%w for model %v", ErrFirmwareInfoUnavailable, model)
+	}
+
+	return fmt.Errorf("%w for model %v", ErrFirmwareNotFound, model)
+}
+
+// defaultIndexCachePath returns the path of the firmware index cache on
+// the OS cache or temp directories.
+func defaultIndexCachePath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	return filepath.Join(cacheDir, "com.github.ruimarinho.mota", "firmware-index.json")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// FleetSettings are the settings pushed to devices by mota apply,
+// beyond firmware. Unset settings are left as they are on each device.
+type FleetSettings struct {
+	// Devices lists the devices (by IP address, hostname or MAC
+	// address) the settings are applied to. If empty, they are applied
+	// to every device found.
+	Devices []string `yaml:"devices"`
+
+	NTPServer string        `yaml:"ntp_server"`
+	MQTT      *MQTTSettings `yaml:"mqtt"`
+	EcoMode   *bool         `yaml:"eco_mode"`
+
+	// Password enables authentication with the admin user and this
+	// password.
+	Password string `yaml:"password"`
+}
+
+// MQTTSettings holds the MQTT broker devices are connected to.
+type MQTTSettings struct {
+	Server   string `yaml:"server"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// selects returns true if the settings apply to a device.
+func (s FleetSettings) selects(device *Device) bool {
+	if len(s.Devices) == 0 {
+		return true
+	}
+
+	for _, identifier := range s.Devices {
+		if device.Matches(identifier) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ApplySettings pushes settings to the selected devices (after
+// confirmation, unless forced), returning the devices they were applied
+// to and the devices that failed.
+func (o *OTAUpdater) ApplySettings(devices map[string]*Device, settings FleetSettings) ([]*Device, []*Device, error) {
+	var applied, failed []*Device
+
+	for _, device := range sortedDevices(devices) {
+		if !settings.selects(device) {
+			continue
+		}
+
+		if !o.force {
+			apply, err := o.confirm(device, fmt.Sprintf("Would you like to apply the fleet settings to %v (%v)?", device.ModelName(), device.IP))
+			if err != nil {
+				return applied, failed, err
+			}
+
+			audit.Prompted(auditApplySettings, device, apply, false)
+
+			if !apply {
+				continue
+			}
+		} else {
+			audit.Prompted(auditApplySettings, device, true, true)
+		}
+
+		restartRequired, err := applySettings(device.HTTPClient(o.deviceTimeout), device, settings)
+		audit.Acted(auditApplySettings, device, err)
+		if err != nil {
+			log.Error(err.Error())
+			failed = append(failed, device)
+			continue
+		}
+
+		log.Infof("Applied fleet settings to %v (%v)", device.ModelName(), device.IP)
+
+		if restartRequired {
+			log.Warnf("%v (%v) requires a restart to apply its new settings (use --restart on the next run to restart it)", device.ModelName(), device.IP)
+		}
+
+		applied = append(applied, device)
+	}
+
+	return applied, failed, nil
+}
+
+// applySettings pushes settings to a device via the Gen1 settings
+// endpoints or the Gen2 RPC methods, returning whether the device must
+// be restarted for them to take effect. Authentication is set last, as
+// the device requires the new password afterwards.
+func applySettings(client *http.Client, device *Device, settings FleetSettings) (bool, error) {
+	var requests []string
+
+	if device.IsGen2() {
+		sys := map[string]interface{}{}
+		if settings.NTPServer != "" {
+			sys["sntp"] = map[string]interface{}{"server": settings.NTPServer}
+		}
+		if settings.EcoMode != nil {
+			sys["device"] = map[string]interface{}{"eco_mode": *settings.EcoMode}
+		}
+		if len(sys) > 0 {
+			requests = append(requests, gen2SetConfig(device, "Sys.SetConfig", sys))
+		}
+
+		if settings.MQTT != nil {
+			requests = append(requests, gen2SetConfig(device, "MQTT.SetConfig", map[string]interface{}{
+				"enable": true,
+				"server": settings.MQTT.Server,
+				"user":   settings.MQTT.User,
+				"pass":   settings.MQTT.Password,
+			}))
+		}
+	} else {
+		values := url.Values{}
+		if settings.NTPServer != "" {
+			values.Set("sntp_server", settings.NTPServer)
+		}
+		if settings.EcoMode != nil {
+			values.Set("eco_mode_enabled", fmt.Sprint(*settings.EcoMode))
+		}
+		if settings.MQTT != nil {
+			values.Set("mqtt_enable", "true")
+			values.Set("mqtt_server", settings.MQTT.Server)
+			values.Set("mqtt_user", settings.MQTT.User)
+			values.Set("mqtt_pass", settings.MQTT.Password)
+		}
+		if len(values) > 0 {
+			requests = append(requests, fmt.Sprintf("%s/settings?%s", device.GetBaseURL(), values.Encode()))
+		}
+	}
+
+	if settings.Password != "" {
+		loginURL, err := authURL(client, device, settings.Password)
+		if err != nil {
+			return false, &DeviceError{Device: device, Op: "apply settings", Err: err}
+		}
+
+		requests = append(requests, loginURL)
+	}
+
+	restartRequired := false
+	for _, request := range requests {
+		restart, err := requestSettings(client, request)
+		if err != nil {
+			return restartRequired, &DeviceError{Device: device, Op: "apply settings", Err: err}
+		}
+
+		restartRequired = restartRequired || restart
+	}
+
+	if settings.Password != "" {
+		device.AuthDisabled = false
+		device.Username = authUser
+		device.Password = settings.Password
+	}
+
+	return restartRequired, nil
+}
+
+// gen2SetConfig returns the URL calling a Gen2 RPC method setting a
+// configuration.
+func gen2SetConfig(device *Device, method string, config map[string]interface{}) string {
+	encoded, _ := json.Marshal(config)
+
+	return fmt.Sprintf("%s/rpc/%s?config=%s", device.GetBaseURL(), method, url.QueryEscape(string(encoded)))
+}
+
+// requestSettings makes a request changing the settings of a device,
+// returning whether the device reports it must be restarted for them to
+// take effect. The URL is left out of errors, as its query may hold
+// passwords (e.g. of the device or of its MQTT broker).
+func requestSettings(client *http.Client, settingsURL string) (bool, error) {
+	response, err := client.Get(settingsURL)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		return false, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		return false, ErrAuthRequired
+	case response.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("unexpected status %v", response.StatusCode)
+	}
+
+	var result struct {
+		RestartRequired bool `json:"restart_required"`
+	}
+
+	json.NewDecoder(response.Body).Decode(&result)
+
+	return result.RestartRequired, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// Audit log events, as recorded in the event field.
+const (
+	auditConsidered = "considered"
+	auditSkipped    = "skipped"
+	auditPrompted   = "prompted"
+	auditPerformed  = "performed"
+	auditFailed     = "failed"
+)
+
+// Actions taken on devices, as recorded in the action field.
+const (
+	auditUpgrade           = "upgrade"
+	auditRestart           = "restart"
+	auditApplySettings     = "apply_settings"
+	auditSetPassword       = "set_password"
+	auditVerify            = "verify"
+	auditSoak              = "soak"
+	auditResetUpdateServer = "reset_update_server"
+)
+
+// Responses to prompts, as recorded in the response field. Forced
+// actions are not prompted for.
+const (
+	auditAccepted = "accepted"
+	auditDeclined = "declined"
+	auditForced   = "forced"
+)
+
+var audit = NewAuditLog(nil)
+
+// AuditEntry is a decision made by mota about a device, along with who
+// ran mota and where. Fields that do not apply to an entry are omitted.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	Host        string    `json:"host"`
+	Profile     string    `json:"profile,omitempty"`
+	Event       string    `json:"event"`
+	Action      string    `json:"action,omitempty"`
+	Device      string    `json:"device"`
+	IP          string    `json:"ip"`
+	Model       string    `json:"model"`
+	FromVersion string    `json:"from_version,omitempty"`
+	ToVersion   string    `json:"to_version,omitempty"`
+	Policy      string    `json:"policy,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// AuditLog appends every decision made about devices (devices
+// considered, policies applied, responses to prompts and actions taken)
+// to a file as JSON lines, to demonstrate change control. An AuditLog
+// without a writer discards every entry.
+type AuditLog struct {
+	out   io.Writer
+	user  string
+	host  string
+	mutex sync.Mutex
+}
+
+// NewAuditLog returns an AuditLog writing entries to out, or discarding
+// them if out is nil.
+func NewAuditLog(out io.Writer) *AuditLog {
+	auditLog := &AuditLog{out: out}
+
+	if current, err := user.Current(); err == nil {
+		auditLog.user = current.Username
+	}
+
+	auditLog.host, _ = os.Hostname()
+
+	return auditLog
+}
+
+// OpenAuditLog returns an AuditLog appending entries to the file at
+// path, creating it if needed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAuditLog(file), nil
+}
+
+func (a *AuditLog) record(entry AuditEntry) {
+	if a.out == nil {
+		return
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.User = a.user
+	entry.Host = a.host
+	entry.Profile = activeProfile
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	_, err = a.out.Write(append(data, '\n'))
+	if err != nil {
+		upgradeLog.Warnf("Unable to write to the audit log (%v)", err)
+	}
+}
+
+// auditEntry returns an entry about a device.
+func auditEntry(event string, action string, device *Device) AuditEntry {
+	return AuditEntry{
+		Event:       event,
+		Action:      action,
+		Device:      device.ID(),
+		IP:          device.IP.String(),
+		Model:       device.Model,
+		FromVersion: device.CurrentFWVersion,
+		ToVersion:   device.NewFWVersion,
+	}
+}
+
+// Considered records a device evaluated for an upgrade.
+func (a *AuditLog) Considered(device *Device) {
+	a.record(auditEntry(auditConsidered, auditUpgrade, device))
+}
+
+// Skipped records a device not acted upon because of a policy (e.g.
+// rollout, read-only or skip_if), with the reason given.
+func (a *AuditLog) Skipped(action string, device *Device, policy string, reason string) {
+	entry := auditEntry(auditSkipped, action, device)
+	entry.Policy = policy
+	entry.Reason = reason
+
+	a.record(entry)
+}
+
+// Prompted records the response to a prompt to act on a device, or
+// that it was not prompted for as the action was forced.
+func (a *AuditLog) Prompted(action string, device *Device, accepted bool, forced bool) {
+	entry := auditEntry(auditPrompted, action, device)
+
+	switch {
+	case forced:
+		entry.Response = auditForced
+	case accepted:
+		entry.Response = auditAccepted
+	default:
+		entry.Response = auditDeclined
+	}
+
+	a.record(entry)
+}
+
+// Acted records the outcome of an action taken on a device.
+func (a *AuditLog) Acted(action string, device *Device, err error) {
+	entry := auditEntry(auditPerformed, action, device)
+	if err != nil {
+		entry.Event = auditFailed
+		entry.Error = err.Error()
+	}
+
+	a.record(entry)
+}
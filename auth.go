@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/jdxcode/netrc"
+)
+
+// authUser is the user authentication is enabled with, the only one
+// supported by Gen2 devices.
+const authUser = "admin"
+
+// authURL returns the URL enabling authentication on a device with the
+// admin user and a password, via the Gen1 /settings/login endpoint or
+// the Gen2 Shelly.SetAuth RPC method. Gen2 devices only accept the
+// digest of the password, computed with their ID as the realm.
+func authURL(client *http.Client, device *Device, password string) (string, error) {
+	if !device.IsGen2() {
+		return fmt.Sprintf("%s/settings/login?enabled=1&username=%s&password=%s", device.GetBaseURL(), authUser, url.QueryEscape(password)), nil
+	}
+
+	info, err := probeDevice(client, device)
+	if err != nil {
+		return "", err
+	}
+
+	ha1 := sha256.Sum256([]byte(strings.Join([]string{authUser, info.ID, password}, ":")))
+
+	return fmt.Sprintf("%s/rpc/Shelly.SetAuth?user=%s&realm=%s&ha1=%s", device.GetBaseURL(), authUser, url.QueryEscape(info.ID), hex.EncodeToString(ha1[:])), nil
+}
+
+// SetPassword sets the admin password of a device, which is then used
+// for further requests to it.
+func SetPassword(client *http.Client, device *Device, password string) error {
+	loginURL, err := authURL(client, device, password)
+	if err != nil {
+		return &DeviceError{Device: device, Op: "set password", Err: err}
+	}
+
+	_, err = requestSettings(client, loginURL)
+	if err != nil {
+		return &DeviceError{Device: device, Op: "set password", Err: err}
+	}
+
+	device.AuthDisabled = false
+	device.Username = authUser
+	device.Password = password
+
+	return nil
+}
+
+// storeCredentials records the username/password of a device in the
+// netrc file at path, keyed by its IP address as read during discovery,
+// creating the file if needed.
+func storeCredentials(path string, device *Device, username string, password string) error {
+	credentials := &netrc.Netrc{Path: path}
+
+	_, err := os.Stat(path)
+	if err == nil {
+		credentials, err = netrc.Parse(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	credentials.AddMachine(device.IP.String(), username, password)
+
+	return credentials.Save()
+}
+
+// RotatePasswords sets the admin password of the devices matching any of
+// the given identifiers, or of every device if none are given (after
+// confirmation, unless forced), recording each new password in the
+// netrc file as soon as it is set. It returns the devices whose password
+// was set and the devices that failed.
+func (o *OTAUpdater) RotatePasswords(devices map[string]*Device, identifiers []string, password string) ([]*Device, []*Device, error) {
+	credentialsPath, err := netrcPath()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selection := FleetSettings{Devices: identifiers}
+
+	var rotated, failed []*Device
+	for _, device := range sortedDevices(devices) {
+		if !selection.selects(device) {
+			continue
+		}
+
+		if !o.force {
+			rotate := false
+			prompt := &survey.Confirm{
+				Message: fmt.Sprintf("Would you like to set the password of %v (%v)?", device.ModelName(), device.IP),
+			}
+
+			err := survey.AskOne(prompt, &rotate)
+			if err != nil {
+				return rotated, failed, err
+			}
+
+			audit.Prompted(auditSetPassword, device, rotate, false)
+
+			if !rotate {
+				continue
+			}
+		} else {
+			audit.Prompted(auditSetPassword, device, true, true)
+		}
+
+		err := SetPassword(device.HTTPClient(o.deviceTimeout), device, password)
+		audit.Acted(auditSetPassword, device, err)
+		if err != nil {
+			log.Error(err.Error())
+			failed = append(failed, device)
+			continue
+		}
+
+		// The device no longer accepts its previous password, so failing
+		// to record the new one is reported as loudly as possible.
+		err = storeCredentials(credentialsPath, device, authUser, password)
+		if err != nil {
+			log.Errorf("Set the password of %v (%v) but could not record it in %v (%v)", device.ModelName(), device.IP, credentialsPath, err)
+			failed = append(failed, device)
+			continue
+		}
+
+		log.Infof("Set the password of %v (%v)", device.ModelName(), device.IP)
+
+		rotated = append(rotated, device)
+	}
+
+	return rotated, failed, nil
+}
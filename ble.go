@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// allterco is the Bluetooth company identifier of Allterco Robotics, the
+// manufacturer of Shelly devices.
+const allterco = 0x0BA9
+
+// bthomeUUID is the 16-bit service UUID of BTHome advertisements, which
+// Shelly BLU devices broadcast their readings with.
+const bthomeUUID = 0xFCD2
+
+// scanBLE scans for Bluetooth advertisements for a duration, calling
+// handle for each one received. mota does not depend on a Bluetooth
+// stack, so it is unset unless one is wired in.
+var scanBLE func(duration time.Duration, handle func(BLEAdvertisement)) error
+
+// BLEAdvertisement holds the fields of a Bluetooth advertisement used to
+// identify Shelly devices.
+type BLEAdvertisement struct {
+	Address          string
+	Name             string
+	RSSI             int
+	ManufacturerData map[uint16][]byte
+	ServiceData      map[uint16][]byte
+}
+
+// BLEDevice is a Shelly device found over Bluetooth, such as Shelly BLU
+// devices and Gen2 devices or newer that are not yet on Wi-Fi.
+type BLEDevice struct {
+	Address   string
+	Name      string
+	RSSI      int
+	MAC       string
+	ModelID   uint16
+	FWVersion string
+	Encrypted bool
+}
+
+// bthomeObjectSizes are the sizes of the BTHome objects sent by Shelly
+// BLU devices, needed to skip over them while looking for the firmware
+// version. Parsing stops at the first unknown object.
+var bthomeObjectSizes = map[byte]int{
+	0x00: 1, // packet id
+	0x01: 1, // battery
+	0x02: 2, // temperature
+	0x03: 2, // humidity
+	0x05: 3, // illuminance
+	0x0C: 2, // voltage
+	0x21: 1, // motion
+	0x2D: 1, // window
+	0x2E: 1, // humidity
+	0x3A: 1, // button
+	0x3F: 2, // rotation
+	0x45: 2, // temperature
+	0xF0: 2, // device type id
+	0xF1: 4, // firmware version
+	0xF2: 3, // firmware version
+}
+
+// ScanBLEDevices scans for Shelly devices advertising over Bluetooth for
+// a duration.
+func ScanBLEDevices(duration time.Duration) ([]BLEDevice, error) {
+	if scanBLE == nil {
+		return nil, errors.New("mota was built without Bluetooth support")
+	}
+
+	var mutex sync.Mutex
+	found := map[string]BLEDevice{}
+
+	err := scanBLE(duration, func(advertisement BLEAdvertisement) {
+		device, ok := parseShellyAdvertisement(advertisement)
+		if !ok {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		found[device.Address] = device
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]BLEDevice, 0, len(found))
+	for _, device := range found {
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Address < devices[j].Address
+	})
+
+	return devices, nil
+}
+
+// parseShellyAdvertisement returns the Shelly device that sent an
+// advertisement, identified by the Allterco manufacturer data of Gen2
+// devices and newer or the BTHome service data of Shelly BLU devices.
+func parseShellyAdvertisement(advertisement BLEAdvertisement) (BLEDevice, bool) {
+	device := BLEDevice{
+		Address: advertisement.Address,
+		Name:    advertisement.Name,
+		RSSI:    advertisement.RSSI,
+	}
+
+	data, shelly := advertisement.ManufacturerData[allterco]
+	if shelly {
+		parseAllterco(data, &device)
+	}
+
+	data, bthome := advertisement.ServiceData[bthomeUUID]
+	if bthome && (shelly || strings.HasPrefix(advertisement.Name, "SB")) {
+		parseBTHome(data, &device)
+		shelly = true
+	}
+
+	return device, shelly
+}
+
+// parseAllterco decodes the type-length-value fields of the Allterco
+// manufacturer data: flags (0x01), MAC address (0x0A) and model ID
+// (0x0B).
+func parseAllterco(data []byte, device *BLEDevice) {
+	for len(data) > 0 {
+		size := 0
+		switch data[0] {
+		case 0x01:
+			size = 2
+		case 0x0A:
+			size = 6
+		case 0x0B:
+			size = 2
+		default:
+			return
+		}
+
+		if len(data) < 1+size {
+			return
+		}
+
+		value := data[1 : 1+size]
+		switch data[0] {
+		case 0x0A:
+			device.MAC = strings.ToUpper(strings.Replace(net.HardwareAddr(value).String(), ":", "", -1))
+		case 0x0B:
+			device.ModelID = binary.LittleEndian.Uint16(value)
+		}
+
+		data = data[1+size:]
+	}
+}
+
+// parseBTHome decodes the firmware version from BTHome v2 service data.
+// Encrypted advertisements cannot be decoded without their key.
+func parseBTHome(data []byte, device *BLEDevice) {
+	if len(data) == 0 {
+		return
+	}
+
+	if data[0]&0x01 != 0 {
+		device.Encrypted = true
+		return
+	}
+
+	data = data[1:]
+	for len(data) > 0 {
+		size, ok := bthomeObjectSizes[data[0]]
+		if !ok || len(data) < 1+size {
+			return
+		}
+
+		value := data[1 : 1+size]
+		switch data[0] {
+		case 0xF1:
+			device.FWVersion = fmt.Sprintf("%v.%v.%v.%v", value[3], value[2], value[1], value[0])
+		case 0xF2:
+			device.FWVersion = fmt.Sprintf("%v.%v.%v", value[2], value[1], value[0])
+		}
+
+		data = data[1+size:]
+	}
+}
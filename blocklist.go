@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type archiveResponse struct {
+	IsOk bool       `json:"isok"`
+	Data []Firmware `json:"data"`
+}
+
+// isBlocked returns true if a firmware version is in the blocklist of a
+// model. Blocked versions may be given as the full build (e.g.
+// 20210122-154345/v1.10.0@00eeaa9b) or as the release only (v1.10.0).
+func (client *APIClient) isBlocked(model string, version string) bool {
+	if version == "" {
+		return false
+	}
+
+	for _, blocked := range client.blocklist[model] {
+		if blocked == version || blocked == releaseVersion(version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyBlocklist replaces blocked firmware versions with the newest
+// non-blocked version from the firmware archive. If no such version is
+// available, the model is removed from the firmware list.
+func (client *APIClient) applyBlocklist(firmwares map[string]Firmware) {
+	for model := range client.blocklist {
+		firmware, ok := firmwares[model]
+		if !ok || client.blocklistApplied[model] {
+			continue
+		}
+
+		client.blocklistApplied[model] = true
+
+		if client.isBlocked(model, firmware.BetaVersion) {
+			apiLog.Infof("Ignoring blocked beta firmware %v for %v", firmware.BetaVersion, model)
+			firmware.BetaURL = ""
+			firmware.BetaVersion = ""
+			firmware.BetaSHA256 = ""
+		}
+
+		if client.isBlocked(model, firmware.Version) {
+			apiLog.Infof("Firmware %v for %v is blocked, looking for an alternative in the archive", firmware.Version, model)
+
+			alternative, err := client.newestAllowedVersion(model)
+			if err != nil {
+				apiLog.Warnf("Skipping %v as firmware %v is blocked and no alternative is available (%v)", model, firmware.Version, err)
+				delete(firmwares, model)
+				client.blocked[model] = true
+				continue
+			}
+
+			apiLog.Infof("Using firmware %v for %v instead of blocked %v", alternative.Version, model, firmware.Version)
+
+			firmware.URL = alternative.URL
+			firmware.Version = alternative.Version
+			firmware.SHA256 = alternative.SHA256
+			client.replaced[model] = true
+		}
+
+		firmwares[model] = firmware
+	}
+}
+
+// newestAllowedVersion returns the newest firmware for a model from the
+// archive that is not blocked.
+func (client *APIClient) newestAllowedVersion(model string) (Firmware, error) {
+	archive, err := client.FetchArchive(model)
+	if err != nil {
+		return Firmware{}, err
+	}
+
+	sort.Slice(archive, func(i, j int) bool {
+		return compareFirmwareVersions(archive[i].Version, archive[j].Version) > 0
+	})
+
+	for _, firmware := range archive {
+		if firmware.URL != "" && !client.isBlocked(model, firmware.Version) {
+			return firmware, nil
+		}
+	}
+
+	return Firmware{}, fmt.Errorf("all %v archived versions are blocked", len(archive))
+}
+
+// FetchArchive returns all firmware versions published for a model or,
+// for Gen2 applications, listed by the firmware CDN.
+func (client *APIClient) FetchArchive(model string) ([]Firmware, error) {
+	if client.gen2Apps[model] {
+		return client.FetchGen2Builds(model)
+	}
+
+	apiResponse, err := client.httpClient.Get(client.baseURL + "/files/firmware/archive?type=" + url.QueryEscape(model))
+	if err != nil {
+		return nil, err
+	}
+
+	defer apiResponse.Body.Close()
+
+	if apiResponse.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %v fetching firmware archive", apiResponse.StatusCode)
+	}
+
+	var decoded archiveResponse
+	err = json.NewDecoder(apiResponse.Body).Decode(&decoded)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	if !decoded.IsOk {
+		return nil, fmt.Errorf("firmware archive for %v is unavailable (isok=false)", model)
+	}
+
+	return decoded.Data, nil
+}
+
+// releaseVersion returns the release part of a Gen1 firmware build (e.g.
+// v1.10.0 for 20210122-154345/v1.10.0@00eeaa9b). Other versions are
+// returned as is.
+func releaseVersion(version string) string {
+	if i := strings.Index(version, "/"); i >= 0 {
+		version = version[i+1:]
+	}
+
+	if i := strings.Index(version, "@"); i >= 0 {
+		version = version[:i]
+	}
+
+	return version
+}
+
+// compareFirmwareVersions compares two firmware versions, returning a
+// positive number if a is newer than b, a negative number if it is older
+// and zero if they are the same. Builds prefixed by their build date
+// (e.g. 20231219-133956/1.1.0-g34b5d4f) sort chronologically against
+// each other; other versions are compared by their dot-separated numeric
+// components, missing ones counting as zero (so 1.4 is 1.4.0), and then
+// by pre-release suffix, which makes them older than the release (so
+// 1.14.1-rc1 is older than 1.14.1).
+func compareFirmwareVersions(a string, b string) int {
+	aVersion := parseFirmwareVersion(a)
+	bVersion := parseFirmwareVersion(b)
+
+	if aVersion.build != "" && bVersion.build != "" {
+		if c := strings.Compare(aVersion.build, bVersion.build); c != 0 {
+			return c
+		}
+	}
+
+	for i := 0; i < len(aVersion.release) || i < len(bVersion.release); i++ {
+		aPart, bPart := "", ""
+		if i < len(aVersion.release) {
+			aPart = aVersion.release[i]
+		}
+		if i < len(bVersion.release) {
+			bPart = bVersion.release[i]
+		}
+
+		if c := compareNumbers(aPart, bPart); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case aVersion.prerelease == bVersion.prerelease:
+		return 0
+	case aVersion.prerelease == "":
+		return 1
+	case bVersion.prerelease == "":
+		return -1
+	}
+
+	return compareNatural(aVersion.prerelease, bVersion.prerelease)
+}
+
+// firmwareVersion is a firmware version broken down into the build date
+// prefixing it, if any, its numeric release components (without leading
+// zeros, so that numbers of any length compare without overflowing) and
+// its pre-release suffix (e.g. rc1 or beta2).
+type firmwareVersion struct {
+	build      string
+	release    []string
+	prerelease string
+}
+
+// gitHashPattern matches the commit a firmware was built from, appended
+// to its version (e.g. g34b5d4f in 1.1.0-g34b5d4f, or the bare hash used
+// by some devices such as the Wall Display).
+var gitHashPattern = regexp.MustCompile(`^g?[0-9a-f]{7,}$`)
+
+// parseFirmwareVersion parses the versions reported by devices and the
+// firmware index, which come in several shapes: Gen1 builds (e.g.
+// 20230913-112234/v1.14.0-gcb84623 or 20191127-095418/v1.5.6@0d769d69),
+// Gen2 builds and versions (20231219-133956/1.1.0-g34b5d4f, 1.1.0,
+// 1.4.0-beta2), versions without a patch number (1.4) and anything else
+// a device may report, which never fails to parse.
+func parseFirmwareVersion(version string) firmwareVersion {
+	var parsed firmwareVersion
+
+	version = strings.TrimSpace(version)
+	if i := strings.Index(version, "/"); i >= 0 {
+		parsed.build = version[:i]
+		version = version[i+1:]
+	}
+
+	if i := strings.Index(version, "@"); i >= 0 {
+		version = version[:i]
+	}
+
+	version = strings.TrimLeft(version, "vV")
+
+	end := strings.IndexFunc(version, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	})
+	if end < 0 {
+		end = len(version)
+	}
+
+	for _, part := range strings.Split(version[:end], ".") {
+		parsed.release = append(parsed.release, strings.TrimLeft(part, "0"))
+	}
+
+	var suffix []string
+	for _, part := range strings.FieldsFunc(version[end:], func(r rune) bool {
+		return r == '-' || r == '+' || r == '_' || r == '.'
+	}) {
+		if !gitHashPattern.MatchString(strings.ToLower(part)) {
+			suffix = append(suffix, strings.ToLower(part))
+		}
+	}
+	parsed.prerelease = strings.Join(suffix, "-")
+
+	return parsed
+}
+
+// compareNumbers compares two strings of digits without leading zeros
+// by value, an empty string being zero.
+func compareNumbers(a string, b string) int {
+	if len(a) != len(b) {
+		if len(a) > len(b) {
+			return 1
+		}
+
+		return -1
+	}
+
+	return strings.Compare(a, b)
+}
+
+// compareNatural compares two strings with their runs of digits compared
+// by value, so that beta10 is newer than beta2.
+func compareNatural(a string, b string) int {
+	for a != "" && b != "" {
+		aChunk, aRest := splitChunk(a)
+		bChunk, bRest := splitChunk(b)
+
+		var c int
+		if isDigit(aChunk[0]) && isDigit(bChunk[0]) {
+			c = compareNumbers(strings.TrimLeft(aChunk, "0"), strings.TrimLeft(bChunk, "0"))
+		} else {
+			c = strings.Compare(aChunk, bChunk)
+		}
+
+		if c != 0 {
+			return c
+		}
+
+		a, b = aRest, bRest
+	}
+
+	return strings.Compare(a, b)
+}
+
+// splitChunk splits the leading run of digits or non-digits off a
+// non-empty string.
+func splitChunk(s string) (string, string) {
+	i := 1
+	for i < len(s) && isDigit(s[i]) == isDigit(s[0]) {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
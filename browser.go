@@ -3,10 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -17,28 +17,75 @@ import (
 
 	zeroconf "github.com/grandcat/zeroconf"
 	"github.com/jdxcode/netrc"
-	log "github.com/sirupsen/logrus"
 )
 
+// DeviceDiscoverer is the interface implemented by types that can
+// find devices on the network, either via discovery or from a list
+// of hosts.
+type DeviceDiscoverer interface {
+	DiscoverDevices(hosts []string) ([]Device, error)
+}
+
 // Browser holds information about the discovery request, including the
-// domain where the search is performed, the service type (usually
-// the Shelly's integrated web server) and wait time.
+// domains where the search is performed, the service type (usually
+// the Shelly's integrated web server) and wait time. Domains other than
+// local are browsed via unicast DNS-SD using the system nameservers, and
+// the local domain on each of the given network interfaces (or every one
+// supporting multicast).
 type Browser struct {
-	domain   string
-	service  string
-	waitTime int
+	domains       []string
+	service       string
+	waitTime      int
+	concurrency   int
+	deviceTimeout time.Duration
+	fetchStatus   bool
+	interfaces    []net.Interface
+	mutex         sync.Mutex
+	probeCache    *ProbeCache
+	hostEntries   []HostEntry
+	skipped       []SkippedDevice
+	tracer        *Tracer
+}
+
+// DeviceStreamer is the interface implemented by discoverers that can
+// hand out devices as soon as they are found, instead of waiting for
+// discovery to finish. Discovery can be stopped early via the returned
+// cancel function.
+type DeviceStreamer interface {
+	StreamDevices(hosts []string) (<-chan Device, context.CancelFunc, error)
 }
 
 // DiscoverDevices performs discovery of local devices using the zeroconf (or
 // bonjour) protocol. The lookup is executed against a domain and Shellies
-// are discovered via their web browser service announcement.
+// are discovered via their web browser service announcement. Settings are
+// fetched from at most concurrency devices at a time.
 func (b *Browser) DiscoverDevices(hosts []string) ([]Device, error) {
 	devices := make([]Device, 0)
+
+	fetchedDevicesChan, cancel, err := b.StreamDevices(hosts)
+	if err != nil {
+		return devices, err
+	}
+	defer cancel()
+
+	for device := range fetchedDevicesChan {
+		devices = append(devices, device)
+	}
+
+	discoveryLog.Debug("All device settings fetched!")
+
+	return devices, nil
+}
+
+// StreamDevices performs the same discovery as DiscoverDevices, but sends
+// each device on the returned channel as soon as its settings have been
+// fetched. The channel is closed once discovery finishes, either after
+// the wait time or when cancelled.
+func (b *Browser) StreamDevices(hosts []string) (<-chan Device, context.CancelFunc, error) {
 	entriesChan := make(chan *zeroconf.ServiceEntry)
 	devicesChan := make(chan Device)
 	fetchedDevicesChan := make(chan Device)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(b.waitTime))
-	defer cancel()
 
 	// Filter devices found to shellies only.
 	go b.filterShellies(entriesChan, devicesChan)
@@ -46,75 +93,281 @@ func (b *Browser) DiscoverDevices(hosts []string) ([]Device, error) {
 	// Fetch settings as soon as devices are found.
 	go b.fetchSettings(devicesChan, fetchedDevicesChan)
 
-	if len(hosts) == 0 {
-		log.Infof("Discovering devices on the network for %v seconds...", b.waitTime)
+	expandedHosts, globs := expandHosts(hosts)
 
-		resolver, err := zeroconf.NewResolver(nil)
+	switch {
+	case len(hosts) == 0:
+		discoveryLog.Infof("Discovering devices on the network for %v seconds...", b.waitTime)
+
+		err := b.browse(ctx, b.domains, entriesChan)
 		if err != nil {
-			return devices, err
+			close(entriesChan)
+			cancel()
+			return nil, nil, err
 		}
+	case len(globs) == 0:
+		discoveryLog.Infof("Preparing to update devices with hosts %v", expandedHosts)
+
+		go b.resolveHosts(ctx, expandedHosts, entriesChan)
+	default:
+		// Globs are expanded by discovering devices in their domains
+		// and keeping the ones whose hostname matches.
+		discoveryLog.Infof("Discovering devices matching %v for %v seconds...", globs, b.waitTime)
 
-		err = resolver.Browse(ctx, b.service, b.domain, entriesChan)
+		browsedChan := make(chan *zeroconf.ServiceEntry)
+		err := b.browse(ctx, globDomains(globs), browsedChan)
 		if err != nil {
-			return devices, err
+			close(entriesChan)
+			cancel()
+			return nil, nil, err
 		}
-	} else {
-		log.Infof("Preparing to update devices with hosts %v", hosts)
 
-		for _, host := range hosts {
-			if !strings.Contains(host, ":") {
-				host = fmt.Sprintf("%s:80", host)
-			}
+		matchedChan := make(chan *zeroconf.ServiceEntry)
+		go filterHostGlobs(browsedChan, matchedChan, globs)
+
+		hostsChan := make(chan *zeroconf.ServiceEntry)
+		go b.resolveHosts(ctx, expandedHosts, hostsChan)
+
+		go mergeEntries([]chan *zeroconf.ServiceEntry{matchedChan, hostsChan}, entriesChan)
+	}
+
+	return fetchedDevicesChan, cancel, nil
+}
 
-			hostString, portString, err := net.SplitHostPort(host)
+// browse discovers devices in every domain concurrently, merging the
+// service entries found into entriesChan.
+func (b *Browser) browse(ctx context.Context, domains []string, entriesChan chan *zeroconf.ServiceEntry) error {
+	var domainChans []chan *zeroconf.ServiceEntry
+
+	for _, domain := range domains {
+		domainChan := make(chan *zeroconf.ServiceEntry)
+
+		if isMulticastDomain(domain) {
+			err := b.browseMulticast(ctx, domain, domainChan)
 			if err != nil {
-				log.Errorf("Host %v is invalid (%v), skipping", host, err)
-				continue
+				return err
 			}
-
-			port, err := strconv.Atoi(portString)
+		} else {
+			nameservers, err := systemNameservers()
 			if err != nil {
-				log.Errorf("Port for host %v is invalid (%v), skipping", host, err)
-				continue
+				return err
+			}
+
+			go browseUnicast(ctx, nameservers, b.service, domain, domainChan)
+		}
+
+		domainChans = append(domainChans, domainChan)
+	}
+
+	go mergeEntries(domainChans, entriesChan)
+
+	return nil
+}
+
+// browseMulticast browses a multicast domain with a resolver per network
+// interface, rather than a single resolver joining every interface, as
+// devices may only announce themselves on some of them (e.g. Pro devices
+// on Ethernet while the host is also on Wi-Fi) and an interface failing
+// to join the multicast group must not go unnoticed.
+func (b *Browser) browseMulticast(ctx context.Context, domain string, entriesChan chan *zeroconf.ServiceEntry) error {
+	interfaces := b.interfaces
+	if len(interfaces) == 0 {
+		var err error
+		interfaces, err = multicastInterfaces(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ifaceChans []chan *zeroconf.ServiceEntry
+	var err error
+
+	for _, iface := range interfaces {
+		var resolver *zeroconf.Resolver
+		resolver, err = zeroconf.NewResolver(zeroconf.SelectIfaces([]net.Interface{iface}), zeroconf.SelectIPTraffic(zeroconf.IPv4))
+		if err != nil {
+			discoveryLog.Warnf("Unable to browse %v on network interface %v (%v)", domain, iface.Name, err)
+			continue
+		}
+
+		ifaceChan := make(chan *zeroconf.ServiceEntry)
+		err = resolver.Browse(ctx, b.service, domain, ifaceChan)
+		if err != nil {
+			discoveryLog.Warnf("Unable to browse %v on network interface %v (%v)", domain, iface.Name, err)
+			continue
+		}
+
+		discoveryLog.Debugf("Browsing %v on network interface %v", domain, iface.Name)
+		ifaceChans = append(ifaceChans, ifaceChan)
+	}
+
+	if len(ifaceChans) == 0 {
+		return fmt.Errorf("unable to browse %v on any network interface (%v)", domain, err)
+	}
+
+	go mergeEntries(ifaceChans, entriesChan)
+
+	return nil
+}
+
+// multicastInterfaces returns the network interfaces with the given
+// names, or every interface that is up and supports multicast if none
+// are given.
+func multicastInterfaces(names []string) ([]net.Interface, error) {
+	var interfaces []net.Interface
+
+	if len(names) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+				interfaces = append(interfaces, iface)
 			}
+		}
+
+		if len(interfaces) == 0 {
+			return nil, errors.New("no network interface supporting multicast is up")
+		}
+
+		return interfaces, nil
+	}
 
-			var resolvedIPs []net.IP
-			parsedIP := net.ParseIP(hostString)
-			if parsedIP != nil {
-				resolvedIPs = append(resolvedIPs, parsedIP)
-			} else {
-				log.Debugf("Host %v does not look like an IP, attempting to resolve as host...", host)
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown network interface %q", name)
+		}
+
+		if iface.Flags&net.FlagUp == 0 {
+			return nil, fmt.Errorf("network interface %v is down", name)
+		}
 
-				resolvedIPs, err = net.LookupIP(host)
-				if err != nil {
-					log.Errorf("Host %v is invalid (%v), skipping...", host, err)
+		if iface.Flags&net.FlagMulticast == 0 {
+			return nil, fmt.Errorf("network interface %v does not support multicast", name)
+		}
+
+		interfaces = append(interfaces, *iface)
+	}
+
+	return interfaces, nil
+}
+
+// mergeEntries forwards the service entries found in each domain to
+// entriesChan, which is closed once browsing every domain finishes.
+// Devices found in several domains are only forwarded once.
+func mergeEntries(domainChans []chan *zeroconf.ServiceEntry, entriesChan chan<- *zeroconf.ServiceEntry) {
+	var done sync.WaitGroup
+	var mutex sync.Mutex
+	seen := map[string]bool{}
+
+	for _, domainChan := range domainChans {
+		done.Add(1)
+		go func(domainChan chan *zeroconf.ServiceEntry) {
+			defer done.Done()
+
+			for entry := range domainChan {
+				if len(entry.AddrIPv4) == 0 {
 					continue
 				}
+
+				mutex.Lock()
+				duplicate := seen[entry.AddrIPv4[0].String()]
+				seen[entry.AddrIPv4[0].String()] = true
+				mutex.Unlock()
+
+				if duplicate {
+					continue
+				}
+
+				entriesChan <- entry
 			}
+		}(domainChan)
+	}
+
+	done.Wait()
+	close(entriesChan)
+}
+
+// resolveHosts turns each host into a service entry, as if it had been
+// discovered, until all hosts are processed or the context is done.
+func (b *Browser) resolveHosts(ctx context.Context, hosts []string, entriesChan chan *zeroconf.ServiceEntry) {
+	defer close(entriesChan)
+
+	for _, target := range hosts {
+		scheme, host := splitScheme(target)
+		if scheme != "" && scheme != "http" && scheme != "https" && scheme != "https+insecure" {
+			discoveryLog.Errorf("Scheme of host %v is invalid, skipping", target)
+			continue
+		}
 
-			entriesChan <- &zeroconf.ServiceEntry{
-				HostName: host,
-				Port:     port,
-				AddrIPv4: resolvedIPs,
-				Text:     []string{fmt.Sprintf("id=shelly-%s", host)},
+		// Hosts without a port (including bare IPv6 addresses) are
+		// reached on the default port of their scheme.
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			port := "80"
+			if strings.HasPrefix(scheme, "https") {
+				port = "443"
 			}
+
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
 		}
 
-		close(entriesChan)
-	}
+		hostString, portString, err := net.SplitHostPort(host)
+		if err != nil {
+			discoveryLog.Errorf("Host %v is invalid (%v), skipping", host, err)
+			continue
+		}
 
-	for device := range fetchedDevicesChan {
-		devices = append(devices, device)
-	}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			discoveryLog.Errorf("Port for host %v is invalid (%v), skipping", host, err)
+			continue
+		}
 
-	log.Debug("All device settings fetched!")
+		var resolvedIPs []net.IP
+		parsedIP := net.ParseIP(hostString)
+		if parsedIP != nil {
+			resolvedIPs = append(resolvedIPs, parsedIP)
+		} else {
+			discoveryLog.Debugf("Host %v does not look like an IP, attempting to resolve as host...", host)
 
-	return devices, nil
+			resolvedIPs, err = net.LookupIP(hostString)
+			if err != nil {
+				discoveryLog.Errorf("Host %v is invalid (%v), skipping...", host, err)
+				continue
+			}
+		}
+
+		entry := &zeroconf.ServiceEntry{
+			HostName: host,
+			Port:     port,
+			AddrIPv4: resolvedIPs,
+			Text:     []string{fmt.Sprintf("id=shelly-%s", host)},
+		}
+
+		// Devices behind a reverse proxy are reached by hostname, so that
+		// its certificate can be verified.
+		if strings.HasPrefix(scheme, "https") {
+			entry.HostName = hostString
+			entry.Text = append(entry.Text, fmt.Sprintf("scheme=%s", scheme))
+		}
+
+		select {
+		case entriesChan <- entry:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 // fetchSettings retrieves the model name and current firmware version
-// via the Settings API from each Shelly discovered. If authentication
-// is required, .netrc authentication is used, if available.
+// via the Settings API (or the Shelly.GetDeviceInfo RPC method on Gen2
+// devices) from each Shelly discovered, along with whether cloud access
+// and eco mode are enabled. If authentication is required, the
+// username/password from the hosts file or .netrc authentication is
+// used, if available.
 func (b *Browser) fetchSettings(foundDevicesChan chan Device, fetchedDevicesChan chan Device) {
 	var done sync.WaitGroup
 	var netrcFile *netrc.Netrc
@@ -122,83 +375,529 @@ func (b *Browser) fetchSettings(foundDevicesChan chan Device, fetchedDevicesChan
 	if err == nil {
 		netrcFile, err = netrc.Parse(netrcPath)
 	}
+
+	concurrency := b.concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+
+	deviceTimeout := b.deviceTimeout
+	if deviceTimeout <= 0 {
+		deviceTimeout = 5 * time.Second
+	}
+
 	for device := range foundDevicesChan {
 		done.Add(1)
+		slots <- struct{}{}
 		go func(device Device, fetchedDevicesChan chan Device) {
-			log.Infof("Fetching settings from %v", device.String())
+			discoveryLog.Debugf("Fetching settings from %v", device.String())
 			defer done.Done()
+			defer func() { <-slots }()
+
+			var err error
+			span := b.tracer.StartSpan("fetch_settings", "device", device.String())
+			defer func() { span.End(err) }()
 
 			if netrcFile != nil && netrcFile.Machine(device.IP.String()) != nil {
-				log.Debugf("Found netrc entry for device %v", device.String())
+				discoveryLog.Debugf("Found netrc entry for device %v", device.String())
 
 				device.Username = netrcFile.Machine(device.IP.String()).Get("login")
-				device.Password = url.QueryEscape(netrcFile.Machine(device.IP.String()).Get("password"))
+				device.Password = netrcFile.Machine(device.IP.String()).Get("password")
 			}
 
-			client := http.Client{
-				Timeout: 5 * time.Second,
+			expectedModel := applyHostEntry(b.hostEntries, &device)
+
+			client := device.HTTPClient(deviceTimeout)
+
+			// The unauthenticated /shelly endpoint is probed first, as it
+			// is available on every generation, to tell the generation of
+			// the device and whether it requires a username/password before
+			// calling its generation-specific endpoint.
+			info, probeErr := b.probe(client, &device)
+			switch {
+			case probeErr == nil:
+				discoveryLog.Debugf("Device %v is Gen%v", device.String(), info.Generation())
+				device.Generation = info.Generation()
+
+				if info.AuthRequired() && device.Username == "" {
+					err = ErrAuthRequired
+					discoveryLog.Errorf("Unable to fetch settings from %v as it requires a username/password", device.String())
+					b.skip(device, err)
+					return
+				}
+			case device.Generation == 0:
+				err = probeErr
+				discoveryLog.Debug(err.Error())
+				if errors.Is(err, ErrDeviceUnreachable) {
+					b.skip(device, err)
+				}
+				return
+			default:
+				discoveryLog.Debugf("Unable to probe %v, assuming it is Gen%v (%v)", device.String(), device.Generation, probeErr)
 			}
 
-			response, err := client.Get(device.GetBaseURL() + "/settings")
+			err = fetchDeviceSettings(client, &device)
 			if err != nil {
-				log.Debug(err)
+				b.probeCache.Forget(&device)
+			}
+
+			if errors.Is(err, ErrAuthRequired) {
+				discoveryLog.Errorf("Unable to fetch settings from %v due to incorrect or missing username/password", device.String())
+				b.skip(device, err)
+				return
+			} else if err != nil {
+				discoveryLog.Debug(err.Error())
+				if errors.Is(err, ErrDeviceUnreachable) {
+					b.skip(device, err)
+				}
 				return
 			}
 
-			defer response.Body.Close()
+			if probeErr == nil {
+				b.probeCache.Store(&device, info)
+			}
 
-			if response.StatusCode != 200 {
-				log.Errorf("Unable to fetch settings from %v due to incorrect or missing username/password", device.String())
+			if expectedModel != "" && !strings.EqualFold(expectedModel, device.Model) {
+				err = fmt.Errorf("%w: %v is a %v, not a %v", ErrUnexpectedModel, device.String(), device.Model, expectedModel)
+				discoveryLog.Errorf("Skipping %v as it is a %v rather than the %v given in the hosts file", device.String(), device.Model, expectedModel)
+				b.skip(device, err)
 				return
 			}
 
-			var settings Settings
-			err = json.NewDecoder(response.Body).Decode(&settings)
-			if err != nil {
-				fmt.Println("Error parsing JSON: ", err)
-				return
+			if device.IsGen2() {
+				configErr := fetchDeviceConfig(client, &device)
+				if configErr != nil {
+					discoveryLog.Debugf("Unable to fetch configuration from %v (%v)", device.String(), configErr)
+				}
+
+				if device.RangeExtender {
+					clientsErr := fetchExtenderClients(client, &device)
+					if clientsErr != nil {
+						discoveryLog.Debugf("Unable to fetch the devices connected through range extender %v (%v)", device.String(), clientsErr)
+					}
+				}
 			}
 
-			// Update the device's model type (e.g. SHSW-25) and current firmware.
-			device.Model = settings.Device.Type
-			device.CurrentFWVersion = settings.FW
+			// Gen2 devices report whether they must be restarted to apply
+			// a previous upgrade in their status, so it is always fetched
+			// from them, but the snapshot is only kept if requested.
+			if b.fetchStatus || device.IsGen2() {
+				statusErr := fetchDeviceStatus(client, &device)
+				if statusErr != nil {
+					discoveryLog.Debugf("Unable to fetch status from %v (%v)", device.String(), statusErr)
+				}
+
+				if !b.fetchStatus {
+					device.Status = nil
+				}
+			}
+
+			// Gen1 devices only connect over Wi-Fi.
+			if !device.IsGen2() {
+				device.Link = linkWiFi
+			}
+
+			if device.EcoMode {
+				discoveryLog.Debugf("Device %v is in eco mode, allowing more time for requests", device.String())
+			}
 
-			log.Debugf("Parsed settings from device %v", device.String())
+			discoveryLog.Debugf("Parsed settings from device %v", device.String())
+			span.SetAttribute("generation", strconv.Itoa(device.Generation))
 
 			fetchedDevicesChan <- device
 		}(device, fetchedDevicesChan)
 	}
 
 	done.Wait()
+
+	err = b.probeCache.Save()
+	if err != nil {
+		discoveryLog.Warnf("Unable to save probe cache (%v)", err)
+	}
+
 	close(fetchedDevicesChan)
 }
 
+// probe returns the generation, model and authentication requirements
+// of a device from the probe cache or, if it has not been probed before
+// or requires credentials that are missing, by probing it via /shelly.
+func (b *Browser) probe(client *http.Client, device *Device) (ShellyInfo, error) {
+	if result, ok := b.probeCache.Lookup(device); ok && (!result.Auth || device.Username != "") {
+		discoveryLog.Debugf("Using cached probe results for %v", device.String())
+
+		return ShellyInfo{Type: result.Model, Gen: result.Generation, Auth: result.Auth}, nil
+	}
+
+	return probeDevice(client, device)
+}
+
+// fetchDeviceSettings retrieves the model name, MAC address and current
+// firmware version of a device via the Settings API (or the
+// Shelly.GetDeviceInfo RPC method on Gen2 devices).
+func fetchDeviceSettings(client *http.Client, device *Device) error {
+	path := "/settings"
+	if device.IsGen2() {
+		path = "/rpc/Shelly.GetDeviceInfo"
+	}
+
+	response, err := client.Get(device.GetBaseURL() + path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return ErrAuthRequired
+	} else if response.StatusCode != http.StatusOK {
+		return &DeviceError{Device: device, Op: "fetch settings", Err: fmt.Errorf("unexpected status %v", response.StatusCode)}
+	}
+
+	if device.IsGen2() {
+		var info DeviceInfo
+		err = json.NewDecoder(response.Body).Decode(&info)
+		if err != nil {
+			return fmt.Errorf("error parsing JSON: %v", err)
+		}
+
+		// Gen2 firmwares are published per application (e.g. Plus1PM)
+		// instead of per hardware model. Some Gen3 and Gen4 firmwares do
+		// not report it, in which case it is looked up in the registry.
+		device.Model = info.App
+		if device.Model == "" {
+			device.Model = registry.App(info.Model)
+		}
+		device.MAC = info.MAC
+		device.CurrentFWVersion = info.Ver
+		device.AuthDisabled = !info.Auth
+		device.Profile = info.Profile
+
+		if info.Gen > device.Generation {
+			device.Generation = info.Gen
+		}
+	} else {
+		// Very old firmwares return some fields with other types, which
+		// are skipped while the remaining ones are still decoded.
+		var settings Settings
+		var typeErr *json.UnmarshalTypeError
+		err = json.NewDecoder(response.Body).Decode(&settings)
+		if errors.As(err, &typeErr) {
+			discoveryLog.Debugf("Ignoring unexpected settings field %v from %v (%v)", typeErr.Field, device.String(), err)
+		} else if err != nil {
+			return fmt.Errorf("error parsing JSON: %v", err)
+		}
+
+		// Update the device's model type (e.g. SHSW-25) and current firmware.
+		device.Model = settings.Device.Type
+		device.MAC = settings.Device.MAC
+		device.CurrentFWVersion = settings.FW
+		device.Generation = 1
+		device.CloudDisabled = settings.Cloud.Enabled != nil && !*settings.Cloud.Enabled
+		device.AuthDisabled = settings.Login.Enabled != nil && !*settings.Login.Enabled
+		device.EcoMode = settings.EcoModeEnabled
+		device.Profile = settings.Mode
+
+		if device.Model == "" || device.MAC == "" || device.CurrentFWVersion == "" {
+			fetchMissingSettings(client, device)
+		}
+	}
+
+	return nil
+}
+
+// fetchMissingSettings fills in the model, MAC address and firmware
+// version missing from the settings of Gen1 devices running very old
+// firmwares, first via the /shelly endpoint and then via /status. Errors
+// are ignored as devices whose model cannot be determined are reported
+// when checked for upgrades.
+func fetchMissingSettings(client *http.Client, device *Device) {
+	discoveryLog.Debugf("Settings of %v are incomplete, falling back to /shelly and /status", device.String())
+
+	var info struct {
+		Type string `json:"type"`
+		MAC  string `json:"mac"`
+		FW   string `json:"fw"`
+	}
+
+	response, err := client.Get(device.URL("/shelly"))
+	if err == nil {
+		json.NewDecoder(response.Body).Decode(&info)
+		response.Body.Close()
+	}
+
+	if device.Model == "" {
+		device.Model = info.Type
+	}
+
+	if device.MAC == "" {
+		device.MAC = info.MAC
+	}
+
+	if device.CurrentFWVersion == "" {
+		device.CurrentFWVersion = info.FW
+	}
+
+	if device.MAC != "" && device.CurrentFWVersion != "" {
+		return
+	}
+
+	var status Gen1Status
+	response, err = client.Get(device.GetBaseURL() + "/status")
+	if err == nil {
+		json.NewDecoder(response.Body).Decode(&status)
+		response.Body.Close()
+	}
+
+	if device.MAC == "" {
+		device.MAC = status.MAC
+	}
+
+	if device.CurrentFWVersion == "" {
+		device.CurrentFWVersion = status.Update.OldVersion
+	}
+}
+
+// fetchDeviceConfig retrieves whether cloud access and eco mode are
+// enabled on a Gen2 device via the Shelly.GetConfig RPC method.
+func fetchDeviceConfig(client *http.Client, device *Device) error {
+	response, err := client.Get(device.GetBaseURL() + "/rpc/Shelly.GetConfig")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %v fetching configuration", response.StatusCode)
+	}
+
+	var config DeviceConfig
+	err = json.NewDecoder(response.Body).Decode(&config)
+	if err != nil {
+		return fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	device.CloudDisabled = config.Cloud.Enable != nil && !*config.Cloud.Enable
+	device.EcoMode = config.Sys.Device.EcoMode
+	device.RangeExtender = config.WiFi.AP.Enable && config.WiFi.AP.RangeExtender.Enable
+
+	return nil
+}
+
+// fetchDeviceStatus retrieves the WiFi signal, uptime and free memory
+// of a device via the /status endpoint (or the Shelly.GetStatus RPC
+// method on Gen2 devices, along with whether a restart is pending).
+func fetchDeviceStatus(client *http.Client, device *Device) error {
+	path := "/status"
+	if device.IsGen2() {
+		path = "/rpc/Shelly.GetStatus"
+	}
+
+	response, err := client.Get(device.GetBaseURL() + path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %v fetching status", response.StatusCode)
+	}
+
+	if device.IsGen2() {
+		var status Gen2Status
+		err = json.NewDecoder(response.Body).Decode(&status)
+		if err != nil {
+			return fmt.Errorf("error parsing JSON: %v", err)
+		}
+
+		device.Status = &DeviceStatus{
+			FreeHeap: status.Sys.RAMFree,
+			RSSI:     status.WiFi.RSSI,
+			SSID:     status.WiFi.SSID,
+			Uptime:   time.Duration(status.Sys.Uptime) * time.Second,
+		}
+		device.RestartRequired = status.Sys.RestartRequired
+		device.Link = gen2Link(status, device.IP.String())
+
+		return nil
+	}
+
+	var status Gen1Status
+	err = json.NewDecoder(response.Body).Decode(&status)
+	if err != nil {
+		return fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	device.Status = &DeviceStatus{
+		FreeHeap: status.RAMFree,
+		RSSI:     status.WiFi.RSSI,
+		SSID:     status.WiFi.SSID,
+		Uptime:   time.Duration(status.Uptime) * time.Second,
+	}
+
+	return nil
+}
+
+// probeDevice retrieves the generation, model and authentication
+// requirements of a device via the /shelly endpoint, which is available
+// without authentication on all devices.
+func probeDevice(client *http.Client, device *Device) (ShellyInfo, error) {
+	var info ShellyInfo
+
+	response, err := client.Get(device.URL("/shelly"))
+	if err != nil {
+		return info, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return info, fmt.Errorf("unexpected status %v fetching /shelly", response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&info)
+	if err != nil {
+		return info, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return info, nil
+}
+
+// fetchOTAStatus retrieves the state of a firmware update from a Gen1
+// device.
+func fetchOTAStatus(client *http.Client, device *Device) (OTAStatus, error) {
+	var status OTAStatus
+
+	response, err := client.Get(device.GetBaseURL() + "/ota")
+	if err != nil {
+		return status, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return status, ErrAuthRequired
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&status)
+	if err != nil {
+		return status, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return status, nil
+}
+
+// fetchGen2Status retrieves the status of a Gen2 device via the
+// Shelly.GetStatus RPC method.
+func fetchGen2Status(client *http.Client, device *Device) (Gen2Status, error) {
+	var status Gen2Status
+
+	response, err := client.Get(device.GetBaseURL() + "/rpc/Shelly.GetStatus")
+	if err != nil {
+		return status, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return status, ErrAuthRequired
+	} else if response.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("unexpected status %v fetching status", response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&status)
+	if err != nil {
+		return status, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return status, nil
+}
+
 // filterShellies rejects any non-Shelly devices from the discovered
 // devices. Shellies announce their identifier (which always starts
 // with shelly*) on the service metadata.
 func (b *Browser) filterShellies(entriesChan <-chan *zeroconf.ServiceEntry, devicesChan chan Device) {
 	for entry := range entriesChan {
+		shelly := false
+		announced := false
+		generation := 0
+		scheme := ""
+
 		for _, str := range entry.Text {
 			if strings.HasPrefix(str, "id=shelly") {
-				IP := entry.AddrIPv4[0]
+				shelly = true
+			}
 
-				log.Infof("Found device %v (%v)", entry.HostName, IP.String())
+			if strings.HasPrefix(str, "fw_id=") {
+				announced = true
+			}
 
-				devicesChan <- Device{IP: IP, HostName: entry.HostName, Port: entry.Port}
-				break
+			// Hosts given with an https scheme are behind a reverse proxy.
+			if strings.HasPrefix(str, "scheme=") {
+				scheme = strings.TrimPrefix(str, "scheme=")
+			}
+
+			// Gen2 devices and newer announce their generation on the
+			// service metadata.
+			if strings.HasPrefix(str, "gen=") {
+				if gen, err := strconv.Atoi(strings.TrimPrefix(str, "gen=")); err == nil {
+					generation = gen
+				}
 			}
 		}
+
+		if !shelly {
+			continue
+		}
+
+		if generation == 0 {
+			generation = inferGeneration(entry.Instance)
+		}
+
+		if generation == 0 {
+			generation = inferGeneration(entry.HostName)
+		}
+
+		// Devices announcing their firmware without a generation are Gen1.
+		// Otherwise (e.g. hosts given on the command line), the generation
+		// is determined when fetching the device settings.
+		if generation == 0 && announced {
+			generation = 1
+		}
+
+		IP := entry.AddrIPv4[0]
+
+		discoveryLog.Debugf("Found device %v (%v)", entry.HostName, IP.String())
+
+		device := Device{IP: IP, HostName: entry.HostName, Port: entry.Port, Generation: generation}
+		if scheme == "https+insecure" {
+			device.Scheme = "https"
+			device.Insecure = true
+		} else if scheme == "https" {
+			device.Scheme = scheme
+		}
+
+		devicesChan <- device
 	}
 
-	log.Debug("No more discovered devices left to filter")
+	discoveryLog.Debug("No more discovered devices left to filter")
 
 	close(devicesChan)
 }
 
+// netrcFile is the netrc file set in the configuration file (or
+// profile), used instead of the default one.
+var netrcFile string
+
 // netrcPath attempts to find the .netrc file path depending
 // on the OS. Code extracted from
 // https://golang.org/src/cmd/go/internal/auth/netrc.go.
 func netrcPath() (string, error) {
+	if netrcFile != "" {
+		return netrcFile, nil
+	}
 	if env := os.Getenv("NETRC"); env != "" {
 		return env, nil
 	}
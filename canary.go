@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var errInterrupted = errors.New("upgrade interrupted")
+
+// partitionCanaries splits devices into canaries, which are upgraded
+// first, and all other devices.
+func (o *OTAUpdater) partitionCanaries(devices map[string]*Device) ([]*Device, []*Device) {
+	var canaries, others []*Device
+
+	for _, device := range devices {
+		if o.isCanary(device) {
+			canaries = append(canaries, device)
+		} else {
+			others = append(others, device)
+		}
+	}
+
+	return canaries, others
+}
+
+// isCanary returns true if a device has been designated as a canary
+// by its IP address, hostname or MAC address.
+func (o *OTAUpdater) isCanary(device *Device) bool {
+	for _, canary := range o.canaries {
+		if device.Matches(canary) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// soakCanaries polls the upgraded canaries for the duration of the soak
+// period. Canaries are expected to reboot after an upgrade, so they are
+// only considered healthy once they report the new firmware version.
+// The rollout is aborted if a healthy canary goes offline or if any
+// canary is not healthy by the end of the soak period.
+func (o *OTAUpdater) soakCanaries(canaries []*Device) error {
+	if len(canaries) == 0 {
+		return nil
+	}
+
+	upgradeLog.Infof("Soaking %v canary device(s) for %v", len(canaries), o.canarySoak)
+
+	interval := 15 * time.Second
+	if o.canarySoak < interval {
+		interval = o.canarySoak
+	}
+
+	healthy := map[string]bool{}
+	deadline := o.clock.Now().Add(o.canarySoak)
+
+	for {
+		for _, canary := range canaries {
+			err := checkHealth(canary.HTTPClient(5*time.Second), canary)
+			if err != nil && healthy[canary.ID()] {
+				return fmt.Errorf("canary %v failed after upgrade (%v), aborting rollout", canary.String(), err)
+			} else if err != nil {
+				upgradeLog.Debugf("Canary %v is not healthy yet (%v)", canary.String(), err)
+				continue
+			}
+
+			if !healthy[canary.ID()] {
+				upgradeLog.Infof("Canary %v is healthy on firmware %v", canary.String(), canary.NewFWVersion)
+			}
+
+			healthy[canary.ID()] = true
+		}
+
+		if !o.clock.Now().Before(deadline) {
+			break
+		}
+
+		o.clock.Sleep(interval)
+	}
+
+	for _, canary := range canaries {
+		if !healthy[canary.ID()] {
+			return fmt.Errorf("canary %v did not come back with firmware %v, aborting rollout", canary.String(), canary.NewFWVersion)
+		}
+	}
+
+	upgradeLog.Info("All canaries are healthy, continuing rollout")
+
+	return nil
+}
+
+// checkHealth verifies that a device is reachable and running the
+// firmware version it has been upgraded to.
+func checkHealth(client *http.Client, device *Device) error {
+	current := *device
+
+	err := fetchDeviceSettings(client, &current)
+	if err != nil {
+		return err
+	}
+
+	if current.CurrentFWVersion != device.NewFWVersion {
+		return fmt.Errorf("running firmware %v", current.CurrentFWVersion)
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// changelogJSON is the built-in list of known firmware releases, with
+// the changes that may break existing setups. It can be replaced at
+// runtime with a remote manifest in the same format.
+const changelogJSON = `{
+  "releases": [
+    {"gen": 1, "version": "1.5.0"},
+    {"gen": 1, "version": "1.5.2"},
+    {"gen": 1, "version": "1.5.5"},
+    {"gen": 1, "version": "1.5.6"},
+    {"gen": 1, "version": "1.5.7"},
+    {"gen": 1, "version": "1.5.10"},
+    {"gen": 1, "version": "1.6.0"},
+    {"gen": 1, "version": "1.6.2"},
+    {"gen": 1, "version": "1.6.5"},
+    {"gen": 1, "version": "1.7.0"},
+    {"gen": 1, "version": "1.8.0"},
+    {"gen": 1, "version": "1.8.3"},
+    {"gen": 1, "version": "1.9.0"},
+    {"gen": 1, "version": "1.9.2"},
+    {"gen": 1, "version": "1.9.3"},
+    {"gen": 1, "version": "1.9.4"},
+    {"gen": 1, "version": "1.10.0", "breaking": "MQTT topics and payloads changed, review MQTT integrations"},
+    {"gen": 1, "version": "1.10.1"},
+    {"gen": 1, "version": "1.10.2"},
+    {"gen": 1, "version": "1.10.3"},
+    {"gen": 1, "version": "1.10.4"},
+    {"gen": 1, "version": "1.11.0"},
+    {"gen": 1, "version": "1.11.4"},
+    {"gen": 1, "version": "1.11.7"},
+    {"gen": 1, "version": "1.11.8"},
+    {"gen": 1, "version": "1.12.0"},
+    {"gen": 1, "version": "1.12.1"},
+    {"gen": 1, "version": "1.13.0"},
+    {"gen": 1, "version": "1.14.0"},
+    {"gen": 2, "version": "1.0.0"},
+    {"gen": 2, "version": "1.0.3"},
+    {"gen": 2, "version": "1.0.8"},
+    {"gen": 2, "version": "1.1.0"},
+    {"gen": 2, "version": "1.2.0"},
+    {"gen": 2, "version": "1.2.2"},
+    {"gen": 2, "version": "1.3.0"},
+    {"gen": 2, "version": "1.3.3"},
+    {"gen": 2, "version": "1.4.0", "breaking": "authentication changed, review clients using digest authentication"},
+    {"gen": 2, "version": "1.4.2"},
+    {"gen": 2, "version": "1.4.4"}
+  ]
+}`
+
+var changelog = mustParseChangelog(changelogJSON)
+
+// ChangelogEntry describes a firmware release and, if the release may
+// break existing setups, the reason why. Breaking changes limited to
+// some device profiles (e.g. roller) only apply to devices running one
+// of them, or whose profile is unknown.
+type ChangelogEntry struct {
+	Generation int      `json:"gen"`
+	Version    string   `json:"version"`
+	Breaking   string   `json:"breaking,omitempty"`
+	Profiles   []string `json:"profiles,omitempty"`
+}
+
+// appliesTo returns true if the breaking change of a release applies to
+// devices running a profile.
+func (e ChangelogEntry) appliesTo(profile string) bool {
+	if len(e.Profiles) == 0 || profile == "" {
+		return true
+	}
+
+	for _, entryProfile := range e.Profiles {
+		if strings.EqualFold(entryProfile, profile) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FirmwareDiff summarizes the releases between an installed and a target
+// firmware version.
+type FirmwareDiff struct {
+	Skipped  int
+	Breaking []ChangelogEntry
+}
+
+// Changelog is a list of known firmware releases.
+type Changelog struct {
+	entries []ChangelogEntry
+	mutex   sync.RWMutex
+}
+
+// ParseChangelog parses a changelog in JSON format.
+func ParseChangelog(data []byte) (*Changelog, error) {
+	var document struct {
+		Releases []ChangelogEntry `json:"releases"`
+	}
+
+	err := json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing changelog: %v", err)
+	}
+
+	return &Changelog{entries: document.Releases}, nil
+}
+
+func mustParseChangelog(data string) *Changelog {
+	changelog, err := ParseChangelog([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+
+	return changelog
+}
+
+// Diff returns the number of known releases skipped when upgrading a
+// device of the given generation and profile from one firmware version
+// to another, and the breaking changes crossed by the upgrade.
+func (c *Changelog) Diff(generation int, profile string, from string, to string) FirmwareDiff {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if generation == 0 {
+		generation = 1
+	}
+
+	var diff FirmwareDiff
+	for _, entry := range c.entries {
+		if entry.Generation != generation {
+			continue
+		}
+
+		if compareFirmwareVersions(entry.Version, from) <= 0 || compareFirmwareVersions(entry.Version, to) > 0 {
+			continue
+		}
+
+		if compareFirmwareVersions(entry.Version, to) < 0 {
+			diff.Skipped++
+		}
+
+		if entry.Breaking != "" && entry.appliesTo(profile) {
+			diff.Breaking = append(diff.Breaking, entry)
+		}
+	}
+
+	return diff
+}
+
+// Refresh replaces the changelog with a remote manifest.
+func (c *Changelog) Refresh(client *http.Client, url string) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %v fetching changelog", response.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	other, err := ParseChangelog(data)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.entries = other.entries
+	c.mutex.Unlock()
+
+	return nil
+}
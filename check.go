@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// otaCheckDelay is how long Gen1 devices are given to check for updates
+// after being asked to, as /ota/check returns before the check ends.
+const otaCheckDelay = 5 * time.Second
+
+// DeviceCheck is the firmware a device is offered by the firmware index
+// and, if the device has been asked, the firmware the device sees
+// itself through its own update channel or OTA server.
+type DeviceCheck struct {
+	Device    *Device
+	Offered   string
+	Err       error
+	Seen      string
+	DeviceErr error
+}
+
+// Differs returns true if the device sees a different firmware than the
+// one offered by the firmware index.
+func (c DeviceCheck) Differs() bool {
+	return c.Err == nil && c.DeviceErr == nil && c.Seen != "" && compareFirmwareVersions(c.Seen, c.Offered) != 0
+}
+
+// Gen2UpdateCheck is the structure returned by the Shelly.CheckForUpdate
+// RPC method on Gen2 devices, listing the updates available on each
+// channel, if any.
+type Gen2UpdateCheck struct {
+	Stable struct {
+		Version string `json:"version"`
+	} `json:"stable"`
+	Beta struct {
+		Version string `json:"version"`
+	} `json:"beta"`
+}
+
+// CheckDevices fetches the firmware offered to each device by the
+// firmware index and, if askDevice is set, asks each device which update
+// it sees (via /ota/check on Gen1 devices and Shelly.CheckForUpdate on
+// Gen2 devices), to highlight discrepancies caused by device-side update
+// channels or custom OTA servers. No device is upgraded.
+func (o *OTAUpdater) CheckDevices(devices map[string]*Device, askDevice bool) ([]DeviceCheck, error) {
+	sorted := sortedDevices(devices)
+
+	for _, device := range sorted {
+		if device.IsGen2() {
+			o.api.AddGen2App(device.Model)
+		}
+	}
+
+	_, err := o.api.FetchVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]DeviceCheck, len(sorted))
+	for i, device := range sorted {
+		checks[i].Device = device
+		checks[i].Offered, checks[i].Err = o.newVersionFor(device)
+	}
+
+	if !askDevice {
+		return checks, nil
+	}
+
+	// Gen1 devices are all asked to check for updates before any result
+	// is read, so that they are only waited for once.
+	asked := false
+	for i, check := range checks {
+		if check.Device.IsGen2() {
+			continue
+		}
+
+		checks[i].DeviceErr = requestOTACheck(check.Device.HTTPClient(o.deviceTimeout), check.Device)
+		asked = asked || checks[i].DeviceErr == nil
+	}
+
+	if asked {
+		discoveryLog.Debugf("Waiting %v for Gen1 devices to check for updates", otaCheckDelay)
+		o.clock.Sleep(otaCheckDelay)
+	}
+
+	for i, check := range checks {
+		if check.DeviceErr != nil {
+			continue
+		}
+
+		checks[i].Seen, checks[i].DeviceErr = o.seenVersion(check.Device)
+	}
+
+	return checks, nil
+}
+
+// seenVersion returns the firmware a device sees as available, which is
+// its current firmware if it sees no update.
+func (o *OTAUpdater) seenVersion(device *Device) (string, error) {
+	client := device.HTTPClient(o.deviceTimeout)
+
+	if !device.IsGen2() {
+		status, err := fetchOTAStatus(client, device)
+		if err != nil {
+			return "", err
+		}
+
+		if !status.HasUpdate || status.NewVersion == "" {
+			return device.CurrentFWVersion, nil
+		}
+
+		return status.NewVersion, nil
+	}
+
+	update, err := fetchGen2UpdateCheck(client, device)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case o.includeBetas && update.Beta.Version != "":
+		return update.Beta.Version, nil
+	case update.Stable.Version != "":
+		return update.Stable.Version, nil
+	}
+
+	return device.CurrentFWVersion, nil
+}
+
+// requestOTACheck asks a Gen1 device to check for updates.
+func requestOTACheck(client *http.Client, device *Device) error {
+	response, err := client.Get(device.GetBaseURL() + "/ota/check")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return ErrAuthRequired
+	} else if response.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %v checking for updates", response.StatusCode)
+	}
+
+	return nil
+}
+
+// fetchGen2UpdateCheck asks a Gen2 device which updates it sees via the
+// Shelly.CheckForUpdate RPC method.
+func fetchGen2UpdateCheck(client *http.Client, device *Device) (Gen2UpdateCheck, error) {
+	var update Gen2UpdateCheck
+
+	response, err := client.Get(device.GetBaseURL() + "/rpc/Shelly.CheckForUpdate")
+	if err != nil {
+		return update, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return update, ErrAuthRequired
+	} else if response.StatusCode != 200 {
+		return update, fmt.Errorf("unexpected status %v checking for updates", response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&update)
+	if err != nil {
+		return update, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return update, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+// Clock abstracts the passage of time so that waits between upgrade
+// steps can be controlled, e.g. in tests.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is a Clock backed by the time package.
+type realClock struct{}
+
+// Now returns the current local time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep pauses the current goroutine for at least the duration d.
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CloudConfig holds the Shelly Cloud account whose firmware state is
+// reconciled with the devices found on the network. The server and
+// authorization key are shown in the Shelly Cloud app under User
+// settings > Authorization cloud key.
+type CloudConfig struct {
+	Server  string `yaml:"server"`
+	AuthKey string `yaml:"auth_key"`
+}
+
+// CloudClient fetches the state of the devices of a Shelly Cloud
+// account.
+type CloudClient struct {
+	server     string
+	authKey    string
+	httpClient *http.Client
+}
+
+// CloudClientOption is a functional option for the CloudClient.
+type CloudClientOption func(*CloudClient)
+
+// WithCloudServer is a CloudClient option that sets the Shelly Cloud
+// server of the account (e.g. https://shelly-49-eu.shelly.cloud).
+func WithCloudServer(server string) CloudClientOption {
+	return func(client *CloudClient) {
+		client.server = strings.TrimSuffix(server, "/")
+	}
+}
+
+// WithCloudAuthKey is a CloudClient option that sets the authorization
+// key of the account.
+func WithCloudAuthKey(authKey string) CloudClientOption {
+	return func(client *CloudClient) {
+		client.authKey = authKey
+	}
+}
+
+// NewCloudClient returns a new instance of the CloudClient.
+func NewCloudClient(options ...CloudClientOption) *CloudClient {
+	client := &CloudClient{
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+
+	for _, option := range options {
+		option(client)
+	}
+
+	return client
+}
+
+// CloudDevice is the firmware state of a device as reported by the
+// Shelly Cloud.
+type CloudDevice struct {
+	ID      string
+	Model   string
+	Version string
+}
+
+// cloudStatusResponse is the structure returned by the /device/all_status
+// endpoint of the Shelly Cloud, limited to the fields describing the
+// firmware of each device.
+type cloudStatusResponse struct {
+	IsOK   bool        `json:"isok"`
+	Errors interface{} `json:"errors"`
+	Data   struct {
+		DevicesStatus map[string]struct {
+			DevInfo struct {
+				ID   string `json:"id"`
+				Code string `json:"code"`
+			} `json:"_dev_info"`
+			GetInfo struct {
+				FWInfo struct {
+					FW string `json:"fw"`
+				} `json:"fw_info"`
+			} `json:"getinfo"`
+			Update struct {
+				OldVersion string `json:"old_version"`
+			} `json:"update"`
+		} `json:"devices_status"`
+	} `json:"data"`
+}
+
+// FetchDevices returns the firmware state of every device of the
+// account, by device ID (its MAC address in upper case).
+func (client *CloudClient) FetchDevices() (map[string]CloudDevice, error) {
+	form := url.Values{"auth_key": {client.authKey}, "show_info": {"true"}, "no_shared": {"true"}}
+
+	response, err := client.httpClient.PostForm(client.server+"/device/all_status", form)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %v fetching the state of Shelly Cloud devices", response.StatusCode)
+	}
+
+	var status cloudStatusResponse
+	err = json.NewDecoder(response.Body).Decode(&status)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	if !status.IsOK {
+		return nil, fmt.Errorf("the Shelly Cloud rejected the request (%v)", status.Errors)
+	}
+
+	devices := map[string]CloudDevice{}
+	for id, state := range status.Data.DevicesStatus {
+		if state.DevInfo.ID != "" {
+			id = state.DevInfo.ID
+		}
+
+		version := state.GetInfo.FWInfo.FW
+		if version == "" {
+			version = state.Update.OldVersion
+		}
+
+		id = strings.ToUpper(id)
+		devices[id] = CloudDevice{ID: id, Model: state.DevInfo.Code, Version: version}
+	}
+
+	return devices, nil
+}
+
+// CloudDiscrepancy is a device whose firmware version differs from the
+// one reported by the Shelly Cloud. Devices the cloud reports as
+// running the firmware offered while still running an older one are
+// likely stuck.
+type CloudDiscrepancy struct {
+	Device       *Device
+	CloudVersion string
+	Stuck        bool
+}
+
+// reconcileCloudDevices compares the firmware of the devices found on
+// the network with the firmware reported by the Shelly Cloud, returning
+// the discrepancies and the cloud devices not found on the network.
+func reconcileCloudDevices(devices map[string]*Device, cloudDevices map[string]CloudDevice) ([]CloudDiscrepancy, []CloudDevice) {
+	var discrepancies []CloudDiscrepancy
+	found := map[string]bool{}
+
+	for _, device := range sortedDevices(devices) {
+		cloudDevice, ok := cloudDevices[strings.ToUpper(device.MAC)]
+		if !ok {
+			continue
+		}
+
+		found[cloudDevice.ID] = true
+
+		if cloudDevice.Version == "" || cloudDevice.Version == device.CurrentFWVersion {
+			continue
+		}
+
+		discrepancies = append(discrepancies, CloudDiscrepancy{
+			Device:       device,
+			CloudVersion: cloudDevice.Version,
+			Stuck:        cloudDevice.Version == device.NewFWVersion,
+		})
+	}
+
+	var missing []CloudDevice
+	for id, cloudDevice := range cloudDevices {
+		if !found[id] {
+			missing = append(missing, cloudDevice)
+		}
+	}
+
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].ID < missing[j].ID
+	})
+
+	return discrepancies, missing
+}
+
+// reconcileCloud warns about the devices whose firmware differs from the
+// one reported by the Shelly Cloud, if an account is configured. Failing
+// to reach the cloud does not prevent upgrades.
+func (o *OTAUpdater) reconcileCloud(devices map[string]*Device) {
+	if o.cloud == nil {
+		return
+	}
+
+	cloudDevices, err := o.cloud.FetchDevices()
+	if err != nil {
+		apiLog.Warnf("Unable to fetch the state of Shelly Cloud devices (%v)", err)
+		return
+	}
+
+	discrepancies, missing := reconcileCloudDevices(devices, cloudDevices)
+
+	for _, discrepancy := range discrepancies {
+		device := discrepancy.Device
+
+		if discrepancy.Stuck {
+			apiLog.Warnf("%v (%v) reports firmware %v but the Shelly Cloud reports %v, it is likely stuck and may need to be restarted or upgraded manually", device.ModelName(), device.IP, device.CurrentFWVersion, discrepancy.CloudVersion)
+			continue
+		}
+
+		apiLog.Warnf("%v (%v) reports firmware %v but the Shelly Cloud reports %v", device.ModelName(), device.IP, device.CurrentFWVersion, discrepancy.CloudVersion)
+	}
+
+	if len(missing) > 0 {
+		apiLog.Infof("%v Shelly Cloud device(s) were not found on the network", len(missing))
+
+		for _, cloudDevice := range missing {
+			apiLog.Debugf("Shelly Cloud device %v (%v) was not found on the network", cloudDevice.ID, cloudDevice.Model)
+		}
+	}
+
+	apiLog.Debugf("Reconciled %v device(s) with the Shelly Cloud, %v discrepancies found", len(devices), len(discrepancies))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings read from the mota configuration file,
+// which complement the command line flags.
+type Config struct {
+	// Upstream is the base URL of another mota instance running in
+	// mirror mode, used instead of the Shelly Cloud to fetch firmware.
+	Upstream string `yaml:"upstream"`
+
+	// Rollout limits how many devices of each model are upgraded per
+	// run, either as a percentage (e.g. 20%) or an absolute count.
+	Rollout map[string]string `yaml:"rollout"`
+
+	// Canaries lists devices (by IP address, hostname or MAC address)
+	// upgraded before all others, which must remain healthy for the
+	// soak period (e.g. 10m) for the rollout to continue.
+	Canaries   []string `yaml:"canaries"`
+	CanarySoak string   `yaml:"canary_soak"`
+
+	// Critical lists devices (by IP address, hostname, MAC address,
+	// model or group name) whose upgrades, restarts and settings must be
+	// confirmed by typing their name instead of answering y/N.
+	Critical []string `yaml:"critical"`
+
+	// Groups lists named groups of devices (by IP address, hostname or
+	// MAC address), upgraded in the order listed with --order=group.
+	Groups []DeviceGroup `yaml:"groups"`
+
+	// Priorities maps devices (by IP address, hostname or MAC address)
+	// or models to their priority with --order=priority. Devices are
+	// upgraded in ascending priority, 0 unless given.
+	Priorities map[string]int `yaml:"priorities"`
+
+	// SkipIf lists expressions evaluated against the status of each
+	// device right before upgrading it (e.g. status.switch0.apower >
+	// 100), deferring it to a later run if any holds.
+	SkipIf StringList `yaml:"skip_if"`
+
+	// Inventory lists the devices (by IP address, hostname or MAC
+	// address) expected on the network, allowing discovery to stop
+	// early once all of them are found.
+	Inventory []string `yaml:"inventory"`
+
+	// Blocklist maps models to firmware versions that must never be
+	// installed (e.g. v1.10.0), in which case the newest non-blocked
+	// version from the firmware archive is offered instead.
+	Blocklist map[string][]string `yaml:"blocklist"`
+
+	// Registry is the URL of a device registry in JSON format, adding
+	// to or replacing the built-in list of known Shelly products.
+	Registry string `yaml:"registry"`
+
+	// Changelog is the URL of a firmware changelog in JSON format,
+	// replacing the built-in list of known releases and breaking changes.
+	Changelog string `yaml:"changelog"`
+
+	// Templates maps the names of customizable outputs (upgraded, failed
+	// and webhook) to Go templates rendering them.
+	Templates map[string]string `yaml:"templates"`
+
+	// Pins maps hosts (e.g. api.shelly.cloud) to the base64-encoded
+	// SHA-256 hashes of the public keys their certificates must chain
+	// to. Plain HTTP firmware links to pinned hosts are upgraded to HTTPS.
+	Pins map[string][]string `yaml:"pins"`
+
+	// UpdateCheck, if set to false, disables checking for a newer mota
+	// release when showing the version.
+	UpdateCheck *bool `yaml:"update_check"`
+
+	// Settings are pushed to devices by mota apply.
+	Settings FleetSettings `yaml:"settings"`
+
+	// Cloud is the Shelly Cloud account whose firmware state is
+	// reconciled with the devices found, flagging devices likely stuck.
+	Cloud CloudConfig `yaml:"cloud"`
+
+	// AuditLog is the path of the file every decision made about devices
+	// is appended to, unless given with --audit-log.
+	AuditLog string `yaml:"audit_log"`
+
+	// Netrc is the path of the netrc file holding the username/password
+	// of devices, instead of ~/.netrc.
+	Netrc string `yaml:"netrc"`
+
+	// Profiles maps names given with --profile (e.g. one per customer)
+	// to settings overriding the ones above.
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+
+	data []byte
+}
+
+// StringList is a list of strings that may also be given as a single
+// string in the configuration file.
+type StringList []string
+
+// UnmarshalYAML decodes a single string or a list of strings.
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+
+	var list []string
+	err := value.Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	*l = list
+
+	return nil
+}
+
+// LoadConfig parses the configuration file at path. A missing file
+// is not considered an error and results in an empty configuration.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (Config, error) {
+	var config Config
+
+	err := yaml.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+
+	config.data = data
+
+	return config, nil
+}
+
+// configPath returns the default configuration file path, which can
+// be overridden via the MOTA_CONFIG environment variable.
+func configPath() (string, error) {
+	if env := os.Getenv("MOTA_CONFIG"); env != "" {
+		return env, nil
+	}
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ".mota.yml"), nil
+}
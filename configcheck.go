@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigProblem is an issue found validating the configuration file, at
+// the line it was found on, if known.
+type ConfigProblem struct {
+	Line    int
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+
+	return fmt.Sprintf("line %v: %v", p.Line, p.Message)
+}
+
+var (
+	yamlNodeType        = reflect.TypeOf(yaml.Node{})
+	yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+)
+
+// ValidateConfig returns the problems found in a configuration file, and
+// in each of its profiles: unknown keys (usually typos, which are
+// otherwise silently ignored), invalid values, missing credentials and
+// conflicting rules. Syntax errors are returned as an error.
+func ValidateConfig(data []byte) ([]ConfigProblem, error) {
+	var document yaml.Node
+	err := yaml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	root := document.Content[0]
+	problems := unknownKeys(root, reflect.TypeOf(Config{}), "")
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "profiles" || root.Content[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+
+		profiles := root.Content[i+1]
+		for j := 0; j+1 < len(profiles.Content); j += 2 {
+			problems = append(problems, unknownKeys(profiles.Content[j+1], reflect.TypeOf(Config{}), "profiles."+profiles.Content[j].Value)...)
+		}
+	}
+
+	for _, message := range checkConfig(config) {
+		problems = append(problems, ConfigProblem{Message: message})
+	}
+
+	var names []string
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		profile, err := config.Profile(name)
+		if err != nil {
+			problems = append(problems, ConfigProblem{Line: config.Profiles[name].Line, Message: err.Error()})
+			continue
+		}
+
+		for _, message := range checkConfig(profile) {
+			problems = append(problems, ConfigProblem{Message: fmt.Sprintf("profile %v: %v", name, message)})
+		}
+	}
+
+	return problems, nil
+}
+
+// unknownKeys returns the keys of a node that do not match any setting
+// of the type it is decoded into, recursively.
+func unknownKeys(node *yaml.Node, t reflect.Type, path string) []ConfigProblem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Types decoding themselves (e.g. StringList) and raw nodes (e.g.
+	// profiles) are not checked.
+	if t == yamlNodeType || reflect.PtrTo(t).Implements(yamlUnmarshalerType) {
+		return nil
+	}
+
+	var problems []ConfigProblem
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+
+			field, ok := fields[key.Value]
+			if !ok && key.Value != "<<" {
+				message := fmt.Sprintf("unknown key %q", joinConfigPath(path, key.Value))
+				if suggestion := closestKey(key.Value, fields); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+
+				problems = append(problems, ConfigProblem{Line: key.Line, Message: message})
+				continue
+			}
+
+			if ok {
+				problems = append(problems, unknownKeys(node.Content[i+1], field, joinConfigPath(path, key.Value))...)
+			}
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			problems = append(problems, unknownKeys(node.Content[i+1], t.Elem(), joinConfigPath(path, node.Content[i].Value))...)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			problems = append(problems, unknownKeys(item, t.Elem(), fmt.Sprintf("%v[%v]", path, i))...)
+		}
+	}
+
+	return problems
+}
+
+func joinConfigPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// closestKey returns the known key a typo most likely meant, if any is
+// within two edits of it.
+func closestKey(key string, fields map[string]reflect.Type) string {
+	closest := ""
+	best := 3
+
+	for field := range fields {
+		distance := editDistance(key, field)
+		if distance < best || (distance == best && field < closest) {
+			closest = field
+			best = distance
+		}
+	}
+
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// checkConfig returns the invalid values, missing credentials and
+// conflicting rules of a configuration.
+func checkConfig(config Config) []string {
+	var problems []string
+
+	var models []string
+	for model := range config.Rollout {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	for _, model := range models {
+		_, err := rolloutLimit(config.Rollout[model], 1)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("rollout.%v: %v", model, err))
+		}
+	}
+
+	if config.CanarySoak != "" {
+		_, err := time.ParseDuration(config.CanarySoak)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("canary_soak: invalid duration %q", config.CanarySoak))
+		}
+	}
+
+	_, err := parseSkipRules(config.SkipIf)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	_, err = ParseTemplates(config.Templates)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("templates: %v", err))
+	}
+
+	if (config.Cloud.Server == "") != (config.Cloud.AuthKey == "") {
+		problems = append(problems, "cloud: server and auth_key must be given together, the Shelly Cloud is not reconciled")
+	}
+
+	if config.Settings.MQTT != nil && config.Settings.MQTT.User != "" && config.Settings.MQTT.Password == "" {
+		problems = append(problems, "settings.mqtt: user is given without a password")
+	}
+
+	if config.Netrc != "" {
+		_, err := os.Stat(config.Netrc)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("netrc: %v, devices requiring authentication cannot be reached", err))
+		}
+	}
+
+	groups := map[string]string{}
+	names := map[string]bool{}
+	for _, group := range config.Groups {
+		if names[group.Name] {
+			problems = append(problems, fmt.Sprintf("groups: %v is defined more than once", group.Name))
+		}
+		names[group.Name] = true
+
+		for _, device := range group.Devices {
+			if other, ok := groups[strings.ToLower(device)]; ok && other != group.Name {
+				problems = append(problems, fmt.Sprintf("groups: %v is listed in both %v and %v, it is upgraded with %v", device, other, group.Name, other))
+				continue
+			}
+
+			groups[strings.ToLower(device)] = group.Name
+		}
+	}
+
+	if len(config.Inventory) > 0 {
+		inventory := map[string]bool{}
+		for _, device := range config.Inventory {
+			inventory[strings.ToLower(device)] = true
+		}
+
+		for _, canary := range config.Canaries {
+			if !inventory[strings.ToLower(canary)] {
+				problems = append(problems, fmt.Sprintf("canaries: %v is not in the inventory", canary))
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkHostsFile returns the problems found in the entries of a hosts
+// file: usernames given without a password.
+func checkHostsFile(entries []HostEntry) []string {
+	var problems []string
+
+	for _, entry := range entries {
+		if entry.Username != "" && entry.Password == "" {
+			problems = append(problems, fmt.Sprintf("hosts file: %v has a username without a password", entry.Host))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// volatileConfigKeys lists the configuration keys (and their children)
+// expected to change on every upgrade or over time, which are left out
+// of configuration diffs.
+var volatileConfigKeys = []string{
+	"build_info",
+	"fw",
+	"hwinfo",
+	"sys.device.fw_id",
+	"time",
+	"unixtime",
+}
+
+// ConfigChange describes a setting changed, lost or added by an upgrade.
+// Before is empty for added settings and After for lost ones.
+type ConfigChange struct {
+	Key    string
+	Before string
+	After  string
+}
+
+// fetchConfig returns the configuration of a device via the Gen1
+// /settings endpoint or the Gen2 Shelly.GetConfig RPC method, flattened
+// into dotted keys (e.g. mqtt.server) mapped to their JSON values.
+func fetchConfig(client *http.Client, device *Device) (map[string]string, error) {
+	path := "/settings"
+	if device.IsGen2() {
+		path = "/rpc/Shelly.GetConfig"
+	}
+
+	response, err := client.Get(device.GetBaseURL() + path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		return nil, ErrAuthRequired
+	case response.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %v", response.StatusCode)
+	}
+
+	var document interface{}
+	err = json.NewDecoder(response.Body).Decode(&document)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	config := map[string]string{}
+	flattenConfig("", document, config)
+
+	return config, nil
+}
+
+// flattenConfig adds the leaves of a decoded JSON document to config,
+// under their dotted path. Arrays are kept as a single value.
+func flattenConfig(prefix string, value interface{}, config map[string]string) {
+	if isVolatileConfigKey(prefix) {
+		return
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		for key, child := range object {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+
+			flattenConfig(path, child, config)
+		}
+
+		return
+	}
+
+	encoded, _ := json.Marshal(value)
+	config[prefix] = string(encoded)
+}
+
+func isVolatileConfigKey(key string) bool {
+	for _, volatile := range volatileConfigKeys {
+		if key == volatile || strings.HasPrefix(key, volatile+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diffConfigs returns the settings changed, lost or added between two
+// flattened configurations, sorted by key.
+func diffConfigs(before map[string]string, after map[string]string) []ConfigChange {
+	var changes []ConfigChange
+
+	for key, value := range before {
+		if value != after[key] {
+			changes = append(changes, ConfigChange{Key: key, Before: value, After: after[key]})
+		}
+	}
+
+	for key, value := range after {
+		if _, ok := before[key]; !ok {
+			changes = append(changes, ConfigChange{Key: key, After: value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+
+	return changes
+}
+
+// snapshotConfig records the configuration of a device before it is
+// upgraded, to be compared with its configuration once verified.
+func (o *OTAUpdater) snapshotConfig(device *Device) {
+	if !o.configDiff {
+		return
+	}
+
+	config, err := fetchConfig(device.HTTPClient(o.deviceTimeout), device)
+	if err != nil {
+		upgradeLog.Warnf("Unable to fetch the configuration of %v (%v) before upgrading it (%v)", device.ModelName(), device.IP, err)
+		return
+	}
+
+	o.configs[device.ID()] = config
+}
+
+// compareConfig prints the settings of an upgraded device changed, lost
+// or added by the upgrade.
+func (o *OTAUpdater) compareConfig(device *Device) {
+	before, ok := o.configs[device.ID()]
+	if !ok {
+		return
+	}
+
+	after, err := fetchConfig(device.HTTPClient(o.deviceTimeout), device)
+	if err != nil {
+		upgradeLog.Warnf("Unable to fetch the configuration of %v (%v) after upgrading it (%v)", device.ModelName(), device.IP, err)
+		return
+	}
+
+	console.PrintConfigChanges(device, diffConfigs(before, after))
+}
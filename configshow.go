@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// exampleConfig is the configuration file written by mota config init,
+// listing every supported key with its default value and an example.
+const exampleConfig = `# Configuration of mota, read from ~/.mota.yml (or the path in the
+# MOTA_CONFIG environment variable, or --config). Every key is optional and
+# set to its default value below; the commented lines show examples.
+# Run mota config validate after editing it.
+
+# Base URL of another mota instance running in mirror mode, used instead of
+# the Shelly Cloud to fetch firmware.
+upstream: ""
+# upstream: http://site-a.lan:8080
+
+# Maximum number of devices of each model upgraded per run, either as a
+# percentage or as an absolute count.
+rollout: {}
+# rollout:
+#   SHSW-25: 20%
+#   SHPLG-S: 5
+
+# Devices (by IP address, hostname or MAC address) upgraded before all
+# others, which must remain healthy for the soak period for the rollout to
+# continue.
+canaries: []
+# canaries:
+#   - 192.168.100.10
+#   - shellyswitch25-1CAAB5.local.
+canary_soak: 5m
+
+# Devices (by IP address, hostname, MAC address, model or group name) whose
+# upgrades, restarts and settings must be confirmed by typing their name.
+critical: []
+# critical:
+#   - shelly1pm-heating.local
+#   - SHTRV-01
+
+# Named groups of devices, upgraded in the order listed with --order=group.
+groups: []
+# groups:
+#   - name: lights
+#     devices:
+#       - 192.168.100.10
+#       - shellydimmer2-98CDAC1F03B3
+
+# Priorities of devices or models with --order=priority, upgraded in
+# ascending priority (0 unless given).
+priorities: {}
+# priorities:
+#   SHSW-25: 5
+#   192.168.100.20: -1
+
+# Expressions evaluated against the status of each device right before
+# upgrading it, deferring it to a later run if any holds.
+skip_if: []
+# skip_if:
+#   - status.switch0.apower > 100
+
+# Devices expected on the network, allowing discovery to stop early with
+# --early-exit once all of them are found.
+inventory: []
+# inventory:
+#   - 192.168.100.10
+#   - 1C:AA:B5:05:9F:90
+
+# Firmware versions of each model that must never be installed.
+blocklist: {}
+# blocklist:
+#   SHSW-25:
+#     - v1.10.0
+
+# URL of a device registry in JSON format, adding to or replacing the
+# built-in list of known Shelly products.
+registry: ""
+# registry: https://example.com/shelly-registry.json
+
+# URL of a firmware changelog in JSON format, replacing the built-in list of
+# known releases and breaking changes.
+changelog: ""
+# changelog: https://example.com/mota/changelog.json
+
+# Go templates rendering the upgraded and failed messages and the webhook
+# payload of the daemon.
+templates: {}
+# templates:
+#   upgraded: "{{.Device.Name}} upgraded from {{.FromVersion}} to {{.ToVersion}} in {{.Duration}}"
+#   failed: "{{.Device.Name}} failed to upgrade to {{.ToVersion}}: {{.Error}}"
+
+# Hashes of the public keys the certificates of each host must chain to.
+pins: {}
+# pins:
+#   api.shelly.cloud:
+#     - sha256/<base64 hash>
+
+# Whether to check for a newer mota release when showing the version.
+update_check: true
+
+# Settings pushed to devices by mota apply.
+settings:
+  # Devices the settings are applied to, every device found if empty.
+  devices: []
+  ntp_server: ""
+  # ntp_server: pool.ntp.org
+  mqtt: null
+  # mqtt:
+  #   server: broker.lan:1883
+  #   user: shelly
+  #   password: secret
+  eco_mode: null
+  # eco_mode: true
+  # Enables authentication with the admin user and this password.
+  password: ""
+
+# Shelly Cloud account whose firmware state is reconciled with the devices
+# found. The server and authorization key are given together.
+cloud:
+  server: ""
+  auth_key: ""
+  # server: https://shelly-49-eu.shelly.cloud
+  # auth_key: <authorization cloud key>
+
+# File every decision made about devices is appended to, unless given with
+# --audit-log.
+audit_log: ""
+# audit_log: /var/log/mota/audit.jsonl
+
+# netrc file holding the username/password of devices, instead of ~/.netrc.
+netrc: ""
+# netrc: /etc/mota/site.netrc
+
+# Settings overriding the ones above, selected with --profile.
+profiles: {}
+# profiles:
+#   customerA:
+#     netrc: /etc/mota/customerA.netrc
+#     rollout:
+#       SHSW-25: 20%
+`
+
+// writeExampleConfig writes the example configuration file to path,
+// unless a file already exists there and overwriting it is not forced.
+func writeExampleConfig(path string, force bool) error {
+	if !force {
+		_, err := os.Stat(path)
+		if err == nil {
+			return fmt.Errorf("%v already exists, use --force to overwrite it", path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(exampleConfig), 0600)
+}
+
+// flagSources returns where each flag that is not at its default value
+// was set: on the command line (given), or otherwise via its MOTA_<FLAG>
+// environment variable or the Home Assistant add-on options.
+func flagSources(flags *flag.FlagSet, given map[string]bool) map[string]string {
+	sources := map[string]string{}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		switch {
+		case !f.Changed:
+		case given[f.Name]:
+			sources[f.Name] = "--" + f.Name
+		default:
+			sources[f.Name] = "add-on options"
+			if _, ok := os.LookupEnv(addonEnv(f.Name)); ok {
+				sources[f.Name] = addonEnv(f.Name)
+			}
+		}
+	})
+
+	return sources
+}
+
+// effectiveFile is the path of a file used by mota, and where it was set
+// if not by default.
+type effectiveFile struct {
+	Name   string
+	Path   string
+	Source string
+}
+
+// EffectiveConfig returns the configuration actually in use as YAML: the
+// paths of the files used, the value of every flag and the settings of
+// the configuration file, merged with the profile if any. Flags that are
+// not at their default value are commented with where they were set
+// (e.g. --beta or MOTA_BETA), as given by sources.
+func EffectiveConfig(files []effectiveFile, flags *flag.FlagSet, config Config, sources map[string]string) ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	add := func(key string, value *yaml.Node, source string) {
+		value.LineComment = source
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	}
+
+	for _, file := range files {
+		add(file.Name, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: file.Path}, file.Source)
+	}
+
+	values := &yaml.Node{Kind: yaml.MappingNode}
+	flags.VisitAll(func(f *flag.Flag) {
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: f.Value.String(), LineComment: sources[f.Name]}
+
+		switch f.Value.Type() {
+		case "bool", "int", "float64":
+		default:
+			value.Tag = "!!str"
+		}
+
+		// Flags that can be specified multiple times are listed as such.
+		if slice, ok := f.Value.(flag.SliceValue); ok {
+			value = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle, LineComment: sources[f.Name]}
+			for _, item := range slice.GetSlice() {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+			}
+		}
+
+		values.Content = append(values.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.Name}, value)
+	})
+	add("flags", values, "")
+
+	settings := &yaml.Node{}
+	err := settings.Encode(config)
+	if err != nil {
+		return nil, err
+	}
+	add("file", settings, "")
+
+	return yaml.Marshal(root)
+}
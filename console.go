@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+var console = NewConsole(os.Stdout)
+
+// Console renders human-friendly output, such as device tables and
+// upgrade results, on top of the log output. Colors and the discovery
+// spinner are only used when writing to a terminal.
+type Console struct {
+	out       io.Writer
+	color     bool
+	terminal  bool
+	quiet     bool
+	verbose   bool
+	spinning  bool
+	templates *Templates
+	mutex     sync.Mutex
+}
+
+// NewConsole returns a Console writing to out. Colors are disabled if
+// out is not a terminal or the NO_COLOR environment variable is set.
+func NewConsole(out io.Writer) *Console {
+	terminal := isTerminal(out)
+
+	return &Console{
+		out:      out,
+		color:    terminal && os.Getenv("NO_COLOR") == "",
+		terminal: terminal,
+	}
+}
+
+// SetVerbose disables the spinner, which would otherwise be
+// interleaved with debug messages.
+func (c *Console) SetVerbose(verbose bool) {
+	c.verbose = verbose
+}
+
+// SetTemplates replaces the lines printed for upgraded and failed
+// devices with custom templates, if set.
+func (c *Console) SetTemplates(templates *Templates) {
+	c.templates = templates
+}
+
+// SetQuiet suppresses all output except failures.
+func (c *Console) SetQuiet(quiet bool) {
+	c.quiet = quiet
+}
+
+// StartSpinner shows an animated message until the returned function
+// is called.
+func (c *Console) StartSpinner(message string) func() {
+	if !c.terminal || c.verbose || c.quiet {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	c.mutex.Lock()
+	c.spinning = true
+	c.mutex.Unlock()
+
+	go func() {
+		defer close(finished)
+
+		frames := `|/-\`
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			c.mutex.Lock()
+			fmt.Fprintf(c.out, "\r%c %v", frames[i%len(frames)], message)
+			c.mutex.Unlock()
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		fmt.Fprint(c.out, "\r\x1b[K")
+		c.spinning = false
+	}
+}
+
+// PrintDevices prints a table of devices with their current and
+// available firmware versions, along with their MAC address, link
+// (Ethernet or WiFi), WiFi network and signal, uptime and free memory if
+// their status has been fetched, and their notes if any device has one.
+func (c *Console) PrintDevices(devices map[string]*Device) {
+	if c.quiet {
+		return
+	}
+
+	sorted := sortedDevices(devices)
+
+	health := false
+	notes := false
+	for _, device := range sorted {
+		if device.Status != nil {
+			health = true
+		}
+
+		if device.Note != "" {
+			notes = true
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// The status is the last column as color codes would break the
+	// alignment of any column following it.
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	header := []string{"DEVICE", "IP", "MODEL", "CURRENT", "AVAILABLE"}
+	if health {
+		header = []string{"DEVICE", "IP", "MAC", "MODEL", "LINK", "SSID", "RSSI", "UPTIME", "FREE HEAP", "CURRENT", "AVAILABLE"}
+	}
+
+	if notes {
+		header = append(header, "NOTE")
+	}
+
+	fmt.Fprintln(w, strings.Join(append(header, "STATUS"), "\t"))
+
+	for _, device := range sorted {
+		status := c.colorize(colorGreen, "up-to-date")
+		if device.CurrentFWVersion != device.NewFWVersion {
+			status = c.colorize(colorYellow, "upgradable")
+		}
+
+		if device.RestartRequired {
+			status = c.colorize(colorYellow, "restart required")
+		}
+
+		row := []string{device.HostName, device.IP.String(), modelWithProfile(device), device.CurrentFWVersion, device.NewFWVersion}
+		if health {
+			link, ssid, rssi, uptime, freeHeap := "-", "-", "-", "-", "-"
+			if device.Link != "" {
+				link = device.Link
+			}
+
+			if device.Status != nil {
+				uptime = device.Status.Uptime.String()
+				freeHeap = fmt.Sprintf("%v", device.Status.FreeHeap)
+
+				// The WiFi network of devices on Ethernet is irrelevant.
+				if device.Link != linkEthernet {
+					ssid = device.Status.SSID
+					rssi = fmt.Sprintf("%v dBm", device.Status.RSSI)
+				}
+			}
+
+			row = []string{device.HostName, device.IP.String(), device.MAC, modelWithProfile(device), link, ssid, rssi, uptime, freeHeap, device.CurrentFWVersion, device.NewFWVersion}
+		}
+
+		if notes {
+			note := device.Note
+			if note == "" {
+				note = "-"
+			}
+
+			row = append(row, note)
+		}
+
+		fmt.Fprintln(w, strings.Join(append(row, status), "\t"))
+	}
+
+	w.Flush()
+}
+
+// PrintChecks prints a table of devices with their current firmware
+// and the one offered by the firmware index, along with the one each
+// device sees itself if it has been asked, highlighting discrepancies.
+func (c *Console) PrintChecks(checks []DeviceCheck, askDevice bool) {
+	if c.quiet {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	header := []string{"DEVICE", "IP", "MODEL", "CURRENT", "AVAILABLE"}
+	if askDevice {
+		header = append(header, "DEVICE SEES")
+	}
+
+	fmt.Fprintln(w, strings.Join(append(header, "STATUS"), "\t"))
+
+	for _, check := range checks {
+		device := check.Device
+
+		offered, seen := check.Offered, check.Seen
+		if offered == "" {
+			offered = "-"
+		}
+
+		if seen == "" {
+			seen = "-"
+		}
+
+		var status string
+		switch {
+		case check.Err != nil:
+			status = c.colorize(colorYellow, check.Err.Error())
+		case check.DeviceErr != nil:
+			status = c.colorize(colorYellow, fmt.Sprintf("device check failed: %v", check.DeviceErr))
+		case check.Differs() && compareFirmwareVersions(check.Seen, check.Offered) > 0:
+			status = c.colorize(colorYellow, "differs: device sees a newer firmware")
+		case check.Differs():
+			status = c.colorize(colorYellow, "differs: device sees an older firmware")
+		case device.CurrentFWVersion != check.Offered:
+			status = c.colorize(colorYellow, "upgradable")
+		default:
+			status = c.colorize(colorGreen, "up-to-date")
+		}
+
+		row := []string{device.HostName, device.IP.String(), modelWithProfile(device), device.CurrentFWVersion, offered}
+		if askDevice {
+			row = append(row, seen)
+		}
+
+		fmt.Fprintln(w, strings.Join(append(row, status), "\t"))
+	}
+
+	w.Flush()
+}
+
+// PrintConfigChanges prints the settings of an upgraded device changed,
+// lost or added by the upgrade.
+func (c *Console) PrintConfigChanges(device *Device, changes []ConfigChange) {
+	if c.quiet {
+		return
+	}
+
+	if len(changes) == 0 {
+		c.printf("%v (%v) kept its configuration\n", device.ModelName(), device.IP)
+		return
+	}
+
+	c.printf("%v (%v) configuration changed by the upgrade:\n", device.ModelName(), device.IP)
+
+	for _, change := range changes {
+		switch {
+		case change.After == "":
+			c.printf("  %v %v: %v\n", c.colorize(colorRed, "- lost"), change.Key, change.Before)
+		case change.Before == "":
+			c.printf("  %v %v: %v\n", c.colorize(colorGreen, "+ added"), change.Key, change.After)
+		default:
+			c.printf("  %v %v: %v -> %v\n", c.colorize(colorYellow, "~ changed"), change.Key, change.Before, change.After)
+		}
+	}
+}
+
+// modelWithProfile returns the model name of a device followed by its
+// profile, for devices supporting several (e.g. Shelly 2.5 (roller)).
+func modelWithProfile(device *Device) string {
+	if device.Profile == "" {
+		return device.ModelName()
+	}
+
+	return fmt.Sprintf("%v (%v)", device.ModelName(), device.Profile)
+}
+
+// PrintBLEDevices prints the Shelly devices found over Bluetooth.
+func (c *Console) PrintBLEDevices(devices []BLEDevice) {
+	if c.quiet || len(devices) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(c.out, "\n%v device(s) found over Bluetooth:\n", len(devices))
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tMAC\tMODEL ID\tRSSI\tFIRMWARE")
+
+	for _, device := range devices {
+		mac, modelID, firmware := "-", "-", "-"
+		if device.MAC != "" {
+			mac = device.MAC
+		}
+
+		if device.ModelID != 0 {
+			modelID = fmt.Sprintf("0x%04X", device.ModelID)
+		}
+
+		if device.FWVersion != "" {
+			firmware = device.FWVersion
+		} else if device.Encrypted {
+			firmware = "encrypted"
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v dBm\t%v\n", device.Name, device.Address, mac, modelID, device.RSSI, firmware)
+	}
+
+	w.Flush()
+}
+
+// PrintUnauthenticated prints the devices found with authentication
+// disabled, which anyone on the network can control and reconfigure,
+// along with how to set a password on them.
+func (c *Console) PrintUnauthenticated(devices map[string]*Device) {
+	if c.quiet {
+		return
+	}
+
+	var unauthenticated []*Device
+	for _, device := range sortedDevices(devices) {
+		if device.AuthDisabled {
+			unauthenticated = append(unauthenticated, device)
+		}
+	}
+
+	if len(unauthenticated) == 0 {
+		return
+	}
+
+	c.printf("\n%v device(s) have authentication disabled:\n", len(unauthenticated))
+
+	var ids []string
+	for _, device := range unauthenticated {
+		c.printf("  %v %v (%v)\n", c.colorize(colorRed, "!"), device.ModelName(), device.IP)
+		ids = append(ids, device.ID())
+	}
+
+	c.printf("    Set a password on them with --set-password or mota auth rotate --new-password=<password> --device=%v\n", strings.Join(ids, ","))
+}
+
+// PrintChanges prints, for each upgradable device, how many known
+// releases are skipped and the breaking changes crossed by the upgrade.
+func (c *Console) PrintChanges(devices map[string]*Device) {
+	if c.quiet {
+		return
+	}
+
+	for _, device := range sortedDevices(devices) {
+		if device.CurrentFWVersion == device.NewFWVersion {
+			continue
+		}
+
+		diff := changelog.Diff(device.Generation, device.Profile, device.CurrentFWVersion, device.NewFWVersion)
+		if diff.Skipped == 0 && len(diff.Breaking) == 0 {
+			continue
+		}
+
+		c.printf("%v (%v): %v -> %v skips %v release(s)\n", device.ModelName(), device.IP, releaseVersion(device.CurrentFWVersion), releaseVersion(device.NewFWVersion), diff.Skipped)
+
+		for _, entry := range diff.Breaking {
+			if len(entry.Profiles) > 0 {
+				c.printf("  %v %v (%v profile): %v\n", c.colorize(colorYellow, "breaking change in"), entry.Version, strings.Join(entry.Profiles, "/"), entry.Breaking)
+				continue
+			}
+
+			c.printf("  %v %v: %v\n", c.colorize(colorYellow, "breaking change in"), entry.Version, entry.Breaking)
+		}
+	}
+}
+
+// Upgraded prints a successful upgrade request, which took the given
+// duration.
+func (c *Console) Upgraded(device *Device, duration time.Duration) {
+	if c.quiet {
+		return
+	}
+
+	if c.templates != nil && c.templates.Upgraded != nil {
+		c.render(c.templates.Upgraded, Notification{
+			Event:       "upgraded",
+			Device:      device,
+			FromVersion: device.CurrentFWVersion,
+			ToVersion:   device.NewFWVersion,
+			Duration:    duration,
+		})
+		return
+	}
+
+	c.printf("%v %v (%v) is upgrading to %v\n", c.colorize(colorGreen, "✔"), device.ModelName(), device.IP, device.NewFWVersion)
+}
+
+// Failed prints a failed upgrade request, which took the given
+// duration.
+func (c *Console) Failed(device *Device, err error, duration time.Duration) {
+	// The device is already part of the message.
+	var deviceErr *DeviceError
+	if errors.As(err, &deviceErr) {
+		err = deviceErr.Err
+	}
+
+	if c.templates != nil && c.templates.Failed != nil {
+		c.render(c.templates.Failed, Notification{
+			Event:       "failed",
+			Device:      device,
+			FromVersion: device.CurrentFWVersion,
+			ToVersion:   device.NewFWVersion,
+			Duration:    duration,
+			Error:       err.Error(),
+		})
+		return
+	}
+
+	c.printf("%v %v (%v) failed to upgrade: %v\n", c.colorize(colorRed, "✘"), device.ModelName(), device.IP, err)
+}
+
+// render prints a custom template, falling back to logging the error
+// if it cannot be rendered.
+func (c *Console) render(tmpl *template.Template, notification Notification) {
+	line, err := renderTemplate(tmpl, notification)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	c.printf("%v\n", strings.TrimSuffix(line, "\n"))
+}
+
+// Unavailable prints a device that cannot be checked for upgrades as
+// its firmware information could not be fetched.
+func (c *Console) Unavailable(device *Device) {
+	if c.quiet {
+		return
+	}
+
+	c.printf("%v %v (%v) skipped: firmware info unavailable for %v\n", c.colorize(colorYellow, "!"), device.ModelName(), device.IP, device.Model)
+}
+
+// NotIndexed prints a device that cannot be checked for upgrades as its
+// model is listed in the firmware index without any version.
+func (c *Console) NotIndexed(device *Device) {
+	if c.quiet {
+		return
+	}
+
+	c.printf("%v %v (%v) skipped: %v is unknown to the firmware index\n", c.colorize(colorYellow, "!"), device.ModelName(), device.IP, device.Model)
+}
+
+// AheadOfStable prints a device that is not upgraded as it runs a
+// firmware newer than the stable one.
+func (c *Console) AheadOfStable(device *Device, err error) {
+	if c.quiet {
+		return
+	}
+
+	c.printf("%v %v (%v) skipped: firmware %v is %v\n", c.colorize(colorGreen, "✔"), device.ModelName(), device.IP, releaseVersion(device.CurrentFWVersion), err)
+}
+
+// PrintSummary prints why each device that was not upgraded was
+// skipped, along with what can be done about it.
+func (c *Console) PrintSummary(skipped []SkippedDevice) {
+	if c.quiet || len(skipped) == 0 {
+		return
+	}
+
+	c.printf("\n%v device(s) were not upgraded:\n", len(skipped))
+
+	for _, entry := range skipped {
+		name := entry.Device.String()
+		if entry.Device.Model != "" {
+			name = fmt.Sprintf("%v (%v)", entry.Device.ModelName(), entry.Device.IP)
+		}
+
+		c.printf("  %v %v: %v\n    %v\n", c.colorize(colorYellow, "!"), name, entry.Err, nextStep(entry.Device, entry.Err))
+	}
+}
+
+// PrintFailedModels prints the models whose firmware information could
+// not be fetched, along with the reason why.
+func (c *Console) PrintFailedModels(failed map[string]error) {
+	if c.quiet || len(failed) == 0 {
+		return
+	}
+
+	var models []string
+	for model := range failed {
+		models = append(models, model)
+	}
+
+	sort.Strings(models)
+
+	c.printf("\nFirmware information could not be fetched for %v model(s):\n", len(models))
+
+	for _, model := range models {
+		c.printf("  %v %v: %v\n", c.colorize(colorYellow, "!"), model, failed[model])
+	}
+}
+
+func (c *Console) printf(format string, args ...interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(c.out, format, args...)
+}
+
+func (c *Console) colorize(color string, text string) string {
+	if !c.color {
+		return text
+	}
+
+	return fmt.Sprintf("\x1b[%vm%v\x1b[0m", color, text)
+}
+
+func (c *Console) isSpinning() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.spinning
+}
+
+// sortedDevices returns devices sorted by IP address.
+func sortedDevices(devices map[string]*Device) []*Device {
+	sorted := make([]*Device, 0, len(devices))
+	for _, device := range devices {
+		sorted = append(sorted, device)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].IP.To16(), sorted[j].IP.To16()) < 0
+	})
+
+	return sorted
+}
+
+// consoleHandler returns a log handler writing entries to out as plain
+// messages, highlighting warnings and errors, for use when verbose mode
+// is disabled.
+func consoleHandler(console *Console, out io.Writer) slog.Handler {
+	return messageHandler(func(level slog.Level, message string) error {
+		var prefix string
+
+		switch {
+		case level >= slog.LevelError:
+			prefix = console.colorize(colorRed, "error: ")
+		case level >= slog.LevelWarn:
+			prefix = console.colorize(colorYellow, "warning: ")
+		}
+
+		// Clear the spinner line so that messages are not appended to it.
+		if console.isSpinning() {
+			prefix = "\r\x1b[K" + prefix
+		}
+
+		_, err := io.WriteString(out, prefix+message+"\n")
+		return err
+	})
+}
+
+// isTerminal returns true if w is a character device, such as a
+// terminal.
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Controller aggregates the inventories reported by agents running on
+// remote sites and queues upgrades for them, which agents pick up the
+// next time they report.
+type Controller struct {
+	listenAddress string
+	mutex         sync.Mutex
+	sites         map[string]*Site
+	token         string
+}
+
+// Site describes the devices found by the agent of a remote site on its
+// last report, and the upgrades queued for it.
+type Site struct {
+	Name       string       `json:"name"`
+	LastSeenAt time.Time    `json:"last_seen_at"`
+	Devices    []SiteDevice `json:"devices"`
+	Queued     []string     `json:"queued"`
+}
+
+// SiteDevice describes a device found on a remote site, along with its
+// health if its status has been fetched and the result of its last
+// upgrade, if any.
+type SiteDevice struct {
+	Device           string `json:"device"`
+	HostName         string `json:"hostname"`
+	IP               string `json:"ip"`
+	MAC              string `json:"mac,omitempty"`
+	Model            string `json:"model"`
+	Profile          string `json:"profile,omitempty"`
+	CurrentFWVersion string `json:"current_version"`
+	NewFWVersion     string `json:"new_version"`
+	SSID             string `json:"ssid,omitempty"`
+	RSSI             int    `json:"rssi,omitempty"`
+	Uptime           int64  `json:"uptime,omitempty"`
+	FreeHeap         int    `json:"free_heap,omitempty"`
+	RestartRequired  bool   `json:"restart_required,omitempty"`
+	Status           string `json:"status,omitempty"`
+}
+
+// newSiteDevice returns the description of a device reported by agents
+// and the daemon. The uptime is given in seconds.
+func newSiteDevice(device *Device) SiteDevice {
+	siteDevice := SiteDevice{
+		Device:           device.ID(),
+		HostName:         device.HostName,
+		IP:               device.IP.String(),
+		MAC:              device.MAC,
+		Model:            device.Model,
+		Profile:          device.Profile,
+		CurrentFWVersion: device.CurrentFWVersion,
+		NewFWVersion:     device.NewFWVersion,
+		RestartRequired:  device.RestartRequired,
+	}
+
+	if device.Status != nil {
+		siteDevice.SSID = device.Status.SSID
+		siteDevice.RSSI = device.Status.RSSI
+		siteDevice.Uptime = int64(device.Status.Uptime / time.Second)
+		siteDevice.FreeHeap = device.Status.FreeHeap
+	}
+
+	return siteDevice
+}
+
+// SiteReport is sent by agents to the controller with the devices found
+// and the result of the upgrades requested on the previous report.
+type SiteReport struct {
+	Site     string       `json:"site"`
+	Devices  []SiteDevice `json:"devices"`
+	Upgraded []string     `json:"upgraded,omitempty"`
+	Failed   []string     `json:"failed,omitempty"`
+}
+
+// SiteCommands is returned by the controller to agents with the devices
+// to upgrade.
+type SiteCommands struct {
+	Upgrade []string `json:"upgrade"`
+}
+
+// ControllerOption is an option interface for Controller.
+type ControllerOption func(*Controller)
+
+// WithControllerAddress is a Controller option that sets the address to
+// listen for agents and API requests on.
+func WithControllerAddress(listenAddress string) ControllerOption {
+	return func(c *Controller) {
+		c.listenAddress = listenAddress
+	}
+}
+
+// WithControllerToken is a Controller option that requires agents and
+// API requests to authenticate with a bearer token.
+func WithControllerToken(token string) ControllerOption {
+	return func(c *Controller) {
+		c.token = token
+	}
+}
+
+// NewController returns an instance of Controller with the default
+// options.
+func NewController(options ...ControllerOption) *Controller {
+	controller := &Controller{
+		listenAddress: ":8082",
+		sites:         map[string]*Site{},
+	}
+
+	for _, option := range options {
+		option(controller)
+	}
+
+	return controller
+}
+
+// ListenAndServe serves agent reports and the controller API.
+func (c *Controller) ListenAndServe() error {
+	log.Infof("Listening for agents on %v", c.listenAddress)
+
+	return http.ListenAndServe(c.listenAddress, c.Handler())
+}
+
+// Handler returns an http.Handler serving POST /agents/report, where
+// agents report their devices and receive the upgrades queued for them,
+// GET /sites, with the aggregated inventory of every site, and POST
+// /sites/<name>/upgrade, which queues upgrades for the devices given or
+// for every out-of-date device of a site.
+func (c *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/agents/report", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var report SiteReport
+		err := json.NewDecoder(r.Body).Decode(&report)
+		if err != nil || report.Site == "" {
+			http.Error(w, "invalid report", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Report(report))
+	})
+
+	mux.HandleFunc("/sites", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Sites())
+	})
+
+	mux.HandleFunc("/sites/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sites/"), "/upgrade")
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/upgrade") {
+			http.NotFound(w, r)
+			return
+		}
+
+		var request struct {
+			Devices []string `json:"devices"`
+		}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		queued, ok := c.QueueUpgrades(name, request.Devices)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(SiteCommands{Upgrade: queued})
+	})
+
+	return c.authenticate(mux)
+}
+
+// authenticate rejects requests without the bearer token, if set.
+func (c *Controller) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.token != "" && r.Header.Get("Authorization") != "Bearer "+c.token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Report records the devices found by an agent and returns the upgrades
+// queued for its site, which are then removed from the queue.
+func (c *Controller) Report(report SiteReport) SiteCommands {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	site, ok := c.sites[report.Site]
+	if !ok {
+		log.Infof("Agent for site %v has connected", report.Site)
+
+		site = &Site{Name: report.Site}
+		c.sites[report.Site] = site
+	}
+
+	for _, id := range report.Upgraded {
+		log.Infof("Upgraded %v on site %v", id, report.Site)
+	}
+
+	for _, id := range report.Failed {
+		log.Errorf("Failed to upgrade %v on site %v", id, report.Site)
+	}
+
+	site.LastSeenAt = time.Now()
+	site.Devices = report.Devices
+
+	commands := SiteCommands{Upgrade: site.Queued}
+	if commands.Upgrade == nil {
+		commands.Upgrade = []string{}
+	}
+	site.Queued = nil
+
+	return commands
+}
+
+// QueueUpgrades queues upgrades for the given devices of a site, or for
+// every out-of-date device if none are given, and returns the devices
+// queued. It returns false if the site is unknown.
+func (c *Controller) QueueUpgrades(name string, devices []string) ([]string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	site, ok := c.sites[name]
+	if !ok {
+		return nil, false
+	}
+
+	if len(devices) == 0 {
+		for _, device := range site.Devices {
+			if device.CurrentFWVersion != device.NewFWVersion {
+				devices = append(devices, device.Device)
+			}
+		}
+	}
+
+	queued := map[string]bool{}
+	for _, id := range site.Queued {
+		queued[id] = true
+	}
+
+	for _, id := range devices {
+		if !queued[id] {
+			site.Queued = append(site.Queued, id)
+			queued[id] = true
+		}
+	}
+
+	log.Infof("Queued %v upgrade(s) for site %v", len(site.Queued), name)
+
+	return append([]string{}, site.Queued...), true
+}
+
+// Sites returns every site that has reported to the controller, sorted
+// by name.
+func (c *Controller) Sites() []Site {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	sites := []Site{}
+	for _, site := range c.sites {
+		sites = append(sites, *site)
+	}
+
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Name < sites[j].Name
+	})
+
+	return sites
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2"
+)
+
+// isCritical returns true if a device is listed as critical in the
+// configuration file, by IP address, hostname, MAC address, model or
+// the name of one of its groups.
+func (o *OTAUpdater) isCritical(device *Device) bool {
+	for _, identifier := range o.critical {
+		if device.Matches(identifier) || strings.EqualFold(identifier, device.Model) {
+			return true
+		}
+
+		for _, group := range o.groups {
+			if group.Name != identifier {
+				continue
+			}
+
+			for _, member := range group.Devices {
+				if device.Matches(member) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// confirm asks whether an action should be carried out on a device.
+// Critical devices must be confirmed by typing their name rather than
+// answering y/N, so that they are not restarted by accident.
+func (o *OTAUpdater) confirm(device *Device, message string) (bool, error) {
+	if !o.isCritical(device) {
+		confirmed := false
+		prompt := &survey.Confirm{
+			Message: message,
+		}
+
+		err := survey.AskOne(prompt, &confirmed)
+
+		return confirmed, err
+	}
+
+	answer := ""
+	prompt := &survey.Input{
+		Message: fmt.Sprintf("%v %v is a critical device, type its name (%v) to confirm:", message, device.ModelName(), device.Name()),
+	}
+
+	err := survey.AskOne(prompt, &answer)
+	if err != nil {
+		return false, err
+	}
+
+	if !criticalConfirmed(device, answer) {
+		upgradeLog.Warnf("%v (%v) was not confirmed, the name typed does not match %v", device.ModelName(), device.IP, device.Name())
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// criticalConfirmed returns true if the answer typed to confirm an
+// action on a critical device is its name.
+func criticalConfirmed(device *Device, answer string) bool {
+	return strings.TrimSpace(answer) == device.Name()
+}
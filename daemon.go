@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Daemon periodically discovers devices and upgrades them when forced
+// upgrades are enabled. Devices which are not rediscovered after being
+// upgraded raise an alert, as this often indicates a bricked device or
+// a Wi-Fi misconfiguration.
+type Daemon struct {
+	devices          []SiteDevice
+	grpcAddress      string
+	homeAssistant    *HomeAssistant
+	interval         time.Duration
+	missingAfter     time.Duration
+	mutex            sync.RWMutex
+	options          []OTAUpdaterOption
+	pending          map[string]*pendingDevice
+	snapshotInterval time.Duration
+	startedAt        time.Time
+	status           DaemonStatus
+	statusAddress    string
+	subscribers      map[chan DaemonEvent]bool
+	tracer           *Tracer
+	trigger          chan []string
+	webhookTemplate  *template.Template
+	webhookURL       string
+}
+
+// DaemonEvent describes the progress of the daemon, such as the start
+// and end of discovery runs and the result of each upgrade.
+type DaemonEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Device  string    `json:"device,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// serveGRPC serves the daemon control operations over gRPC. It is only
+// set when mota is built with gRPC support.
+var serveGRPC func(d *Daemon, address string) error
+
+// DaemonStatus describes the state of the daemon, as reported by the
+// status server.
+type DaemonStatus struct {
+	Uptime          string          `json:"uptime"`
+	LastRunAt       *time.Time      `json:"last_run_at,omitempty"`
+	LastRunDuration string          `json:"last_run_duration,omitempty"`
+	LastSuccessAt   *time.Time      `json:"last_success_at,omitempty"`
+	LastError       string          `json:"last_error,omitempty"`
+	LastErrorAt     *time.Time      `json:"last_error_at,omitempty"`
+	Devices         int             `json:"devices"`
+	PendingUpdates  []PendingUpdate `json:"pending_updates"`
+	MissingDevices  []string        `json:"missing_devices"`
+}
+
+// PendingUpdate describes a device with a firmware upgrade available.
+type PendingUpdate struct {
+	Device           string `json:"device"`
+	HostName         string `json:"hostname"`
+	IP               string `json:"ip"`
+	Model            string `json:"model"`
+	CurrentFWVersion string `json:"current_version"`
+	NewFWVersion     string `json:"new_version"`
+}
+
+// pendingDevice holds information about an upgraded device which has
+// not been rediscovered yet.
+type pendingDevice struct {
+	device     Device
+	upgradedAt time.Time
+	alerted    bool
+}
+
+// DaemonOption is an option interface for Daemon.
+type DaemonOption func(*Daemon)
+
+// WithInterval is a Daemon option that sets the time between
+// discovery runs.
+func WithInterval(interval time.Duration) DaemonOption {
+	return func(d *Daemon) {
+		d.interval = interval
+	}
+}
+
+// WithMissingAfter is a Daemon option that sets how long an upgraded
+// device may be missing from discovery before an alert is raised.
+func WithMissingAfter(missingAfter time.Duration) DaemonOption {
+	return func(d *Daemon) {
+		d.missingAfter = missingAfter
+	}
+}
+
+// WithDaemonTracer is a Daemon option that sets the tracer recording a
+// trace of each discovery run.
+func WithDaemonTracer(tracer *Tracer) DaemonOption {
+	return func(d *Daemon) {
+		d.tracer = tracer
+	}
+}
+
+// WithWebhook is a Daemon option that sets a URL to POST alerts to.
+func WithWebhook(webhookURL string) DaemonOption {
+	return func(d *Daemon) {
+		d.webhookURL = webhookURL
+	}
+}
+
+// WithWebhookTemplate is a Daemon option that sets a custom template
+// for the payload POSTed to the webhook.
+func WithWebhookTemplate(webhookTemplate *template.Template) DaemonOption {
+	return func(d *Daemon) {
+		d.webhookTemplate = webhookTemplate
+	}
+}
+
+// WithSnapshotInterval is a Daemon option that sets how often the
+// firmware versions of the devices found are recorded in the history
+// (0 disables snapshots).
+func WithSnapshotInterval(snapshotInterval time.Duration) DaemonOption {
+	return func(d *Daemon) {
+		d.snapshotInterval = snapshotInterval
+	}
+}
+
+// WithStatusAddress is a Daemon option that sets the address to serve
+// the /healthz and /status endpoints on.
+func WithStatusAddress(statusAddress string) DaemonOption {
+	return func(d *Daemon) {
+		d.statusAddress = statusAddress
+	}
+}
+
+// WithGRPCAddress is a Daemon option that sets the address to serve
+// the control operations over gRPC on.
+func WithGRPCAddress(grpcAddress string) DaemonOption {
+	return func(d *Daemon) {
+		d.grpcAddress = grpcAddress
+	}
+}
+
+// WithHomeAssistant is a Daemon option that sends alerts and failed
+// upgrades to Home Assistant as persistent notifications.
+func WithHomeAssistant(homeAssistant *HomeAssistant) DaemonOption {
+	return func(d *Daemon) {
+		d.homeAssistant = homeAssistant
+	}
+}
+
+// WithUpdaterOptions is a Daemon option that sets the options used to
+// create the OTAUpdater on each run.
+func WithUpdaterOptions(options ...OTAUpdaterOption) DaemonOption {
+	return func(d *Daemon) {
+		d.options = options
+	}
+}
+
+// NewDaemon returns an instance of Daemon with the default options.
+func NewDaemon(options ...DaemonOption) *Daemon {
+	daemon := &Daemon{
+		interval:         time.Hour,
+		missingAfter:     15 * time.Minute,
+		devices:          []SiteDevice{},
+		pending:          map[string]*pendingDevice{},
+		snapshotInterval: 24 * time.Hour,
+		startedAt:        time.Now(),
+		subscribers:      map[chan DaemonEvent]bool{},
+		trigger:          make(chan []string, 1),
+		status: DaemonStatus{
+			PendingUpdates: []PendingUpdate{},
+			MissingDevices: []string{},
+		},
+	}
+
+	for _, option := range options {
+		option(daemon)
+	}
+
+	return daemon
+}
+
+// Run executes discovery runs forever, waiting for the configured
+// interval between them, unless a run is requested earlier.
+func (d *Daemon) Run() {
+	if d.statusAddress != "" {
+		go func() {
+			log.Infof("Serving daemon status on %v", d.statusAddress)
+
+			err := http.ListenAndServe(d.statusAddress, ingressHandler(d.Handler()))
+			if err != nil {
+				log.Errorf("Unable to serve daemon status (%v)", err)
+			}
+		}()
+	}
+
+	if d.grpcAddress != "" {
+		if serveGRPC == nil {
+			log.Fatal("Unable to serve gRPC as mota was built without gRPC support")
+		}
+
+		go func() {
+			log.Infof("Serving gRPC on %v", d.grpcAddress)
+
+			err := serveGRPC(d, d.grpcAddress)
+			if err != nil {
+				log.Errorf("Unable to serve gRPC (%v)", err)
+			}
+		}()
+	}
+
+	var upgrade []string
+	for {
+		startedAt := time.Now()
+		d.publish(DaemonEvent{Type: "run_started"})
+
+		err := d.runOnce(upgrade)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		d.recordRun(startedAt, time.Now(), err)
+
+		if err != nil {
+			d.publish(DaemonEvent{Type: "run_failed", Message: err.Error()})
+		} else {
+			d.publish(DaemonEvent{Type: "run_finished"})
+		}
+
+		log.Infof("Next run in %v", d.interval)
+
+		select {
+		case <-time.After(d.interval):
+			upgrade = nil
+		case upgrade = <-d.trigger:
+			log.Info("Run requested")
+		}
+	}
+}
+
+// RunOnce discovers devices, upgrades them if forced upgrades are
+// enabled and checks for devices missing since a previous upgrade.
+func (d *Daemon) RunOnce() error {
+	return d.runOnce(nil)
+}
+
+// runOnce performs a discovery run, upgrading the given devices (by ID)
+// even if forced upgrades are disabled.
+func (d *Daemon) runOnce(upgrade []string) (err error) {
+	d.tracer.StartRun("daemon.run")
+	defer func() { endTrace(d.tracer, err) }()
+
+	otaUpdater, err := NewOTAUpdater(d.options...)
+	if err != nil {
+		return err
+	}
+	defer otaUpdater.Close()
+
+	err = otaUpdater.Start()
+	if err != nil {
+		return err
+	}
+
+	devices, err := otaUpdater.Devices()
+	if err != nil {
+		return err
+	}
+
+	d.checkMissing(devices, time.Now())
+	d.recordDevices(devices)
+
+	snapshotErr := d.snapshot(otaUpdater.historyPath, devices, time.Now())
+	if snapshotErr != nil {
+		log.Warnf("Unable to record the firmware versions of the devices found (%v)", snapshotErr)
+	}
+
+	switch {
+	case otaUpdater.force:
+		err = otaUpdater.Upgrade()
+	case len(upgrade) > 0:
+		var selected []*Device
+		for _, device := range sortedDevices(devices) {
+			for _, id := range upgrade {
+				if device.Matches(id) {
+					selected = append(selected, device)
+				}
+			}
+		}
+
+		err = otaUpdater.UpgradeDevices(selected)
+	default:
+		for _, device := range devices {
+			if device.CurrentFWVersion != device.NewFWVersion {
+				log.Infof("Upgrade available for %v (%v) from %v to %v", device.ModelName(), device.IP, device.CurrentFWVersion, device.NewFWVersion)
+			}
+		}
+
+		return nil
+	}
+
+	for _, device := range otaUpdater.UpgradedDevices() {
+		d.pending[device.ID()] = &pendingDevice{device: *device, upgradedAt: time.Now()}
+		d.publish(DaemonEvent{Type: "upgraded", Device: device.ID(), Message: device.NewFWVersion})
+	}
+
+	for _, device := range otaUpdater.FailedDevices() {
+		d.publish(DaemonEvent{Type: "failed", Device: device.ID(), Message: device.NewFWVersion})
+		d.notify("mota_failed_"+device.ID(), fmt.Sprintf("%v (%v) failed to upgrade to %v.", device.ModelName(), device.IP, device.NewFWVersion))
+	}
+
+	return err
+}
+
+// Trigger requests a discovery run right away, after which the given
+// devices (by IP address, hostname or MAC address) are upgraded. It
+// returns false if a run has already been requested.
+func (d *Daemon) Trigger(upgrade []string) bool {
+	select {
+	case d.trigger <- upgrade:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscribe returns a channel receiving the progress of the daemon,
+// until the returned function is called. Events are dropped for
+// subscribers that do not keep up.
+func (d *Daemon) Subscribe() (<-chan DaemonEvent, func()) {
+	events := make(chan DaemonEvent, 16)
+
+	d.mutex.Lock()
+	d.subscribers[events] = true
+	d.mutex.Unlock()
+
+	return events, func() {
+		d.mutex.Lock()
+		delete(d.subscribers, events)
+		d.mutex.Unlock()
+	}
+}
+
+// publish sends an event to every subscriber.
+func (d *Daemon) publish(event DaemonEvent) {
+	event.Time = time.Now()
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	for events := range d.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// recordRun updates the status with the result of a discovery run.
+func (d *Daemon) recordRun(startedAt time.Time, finishedAt time.Time, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.status.LastRunAt = &startedAt
+	d.status.LastRunDuration = finishedAt.Sub(startedAt).Round(time.Millisecond).String()
+
+	if err != nil {
+		d.status.LastError = err.Error()
+		d.status.LastErrorAt = &finishedAt
+		return
+	}
+
+	d.status.LastSuccessAt = &finishedAt
+}
+
+// recordDevices updates the status with the discovered devices, the
+// ones with upgrades available and the ones missing since an upgrade.
+func (d *Daemon) recordDevices(devices map[string]*Device) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.status.Devices = len(devices)
+	d.status.PendingUpdates = []PendingUpdate{}
+	d.devices = []SiteDevice{}
+	for _, device := range sortedDevices(devices) {
+		d.devices = append(d.devices, newSiteDevice(device))
+
+		if device.CurrentFWVersion == device.NewFWVersion {
+			continue
+		}
+
+		d.status.PendingUpdates = append(d.status.PendingUpdates, PendingUpdate{
+			Device:           device.ID(),
+			HostName:         device.HostName,
+			IP:               device.IP.String(),
+			Model:            device.Model,
+			CurrentFWVersion: device.CurrentFWVersion,
+			NewFWVersion:     device.NewFWVersion,
+		})
+	}
+
+	d.status.MissingDevices = []string{}
+	for id, pending := range d.pending {
+		if pending.alerted {
+			d.status.MissingDevices = append(d.status.MissingDevices, id)
+		}
+	}
+	sort.Strings(d.status.MissingDevices)
+}
+
+// Status returns the current status of the daemon.
+func (d *Daemon) Status() DaemonStatus {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	status := d.status
+	status.Uptime = time.Since(d.startedAt).Round(time.Second).String()
+
+	return status
+}
+
+// Devices returns the devices found on the last discovery run, along
+// with their available upgrades.
+func (d *Daemon) Devices() []SiteDevice {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.devices
+}
+
+// Handler returns an http.Handler serving /healthz, which fails if no
+// discovery run has succeeded for two intervals, /status, with the
+// details of the last run, /devices, with the devices found, /run, which
+// requests a discovery run upgrading the devices given, and /events,
+// streaming the progress of the daemon as server-sent events.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := d.Status()
+
+		lastSuccess := d.startedAt
+		if status.LastSuccessAt != nil {
+			lastSuccess = *status.LastSuccessAt
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if time.Since(lastSuccess) > 2*d.interval {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "unhealthy", "error": status.LastError})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Status())
+	})
+
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Devices())
+	})
+
+	mux.HandleFunc("/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Upgrade []string `json:"upgrade"`
+		}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !d.Trigger(request.Upgrade) {
+			http.Error(w, "a run has already been requested", http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		events, unsubscribe := d.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher.Flush()
+
+		for {
+			select {
+			case event := <-events:
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event.Type, data)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	return mux
+}
+
+// checkMissing compares the discovered devices against the devices
+// upgraded in previous runs, raising an alert for those missing for
+// longer than allowed.
+func (d *Daemon) checkMissing(devices map[string]*Device, now time.Time) {
+	discovered := map[string]bool{}
+	for _, device := range devices {
+		discovered[device.ID()] = true
+	}
+
+	for id, pending := range d.pending {
+		if discovered[id] {
+			if pending.alerted {
+				log.Infof("%v (%v) has reappeared after being missing", pending.device.ModelName(), pending.device.String())
+			}
+
+			delete(d.pending, id)
+			continue
+		}
+
+		missingFor := now.Sub(pending.upgradedAt)
+		if pending.alerted || missingFor < d.missingAfter {
+			continue
+		}
+
+		pending.alerted = true
+		d.alert(pending, missingFor)
+	}
+}
+
+// alert logs and optionally POSTs a webhook notification about a device
+// that has not been rediscovered after being upgraded.
+func (d *Daemon) alert(pending *pendingDevice, missingFor time.Duration) {
+	log.Errorf("%v (%v) has not been rediscovered %v after being upgraded to %v", pending.device.ModelName(), pending.device.String(), missingFor.Round(time.Second), pending.device.NewFWVersion)
+
+	d.notify("mota_missing_"+pending.device.ID(), fmt.Sprintf("%v (%v) has not been rediscovered %v after being upgraded to %v.", pending.device.ModelName(), pending.device.String(), missingFor.Round(time.Second), pending.device.NewFWVersion))
+
+	if d.webhookURL == "" {
+		return
+	}
+
+	payload, err := d.webhookPayload(pending, missingFor)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	response, err := client.Post(d.webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Errorf("Unable to send webhook notification (%v)", err)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		log.Errorf("Unable to send webhook notification (unexpected status %v)", response.StatusCode)
+	}
+}
+
+// notify creates a Home Assistant notification, if running as an add-on.
+func (d *Daemon) notify(id string, message string) {
+	if d.homeAssistant == nil {
+		return
+	}
+
+	err := d.homeAssistant.Notify(id, "mota", message)
+	if err != nil {
+		log.Errorf("Unable to send Home Assistant notification (%v)", err)
+	}
+}
+
+// webhookPayload returns the payload of an alert about a missing device,
+// rendered with the custom webhook template if set.
+func (d *Daemon) webhookPayload(pending *pendingDevice, missingFor time.Duration) ([]byte, error) {
+	if d.webhookTemplate != nil {
+		payload, err := renderTemplate(d.webhookTemplate, Notification{
+			Event:       "device_missing",
+			Device:      &pending.device,
+			FromVersion: pending.device.CurrentFWVersion,
+			ToVersion:   pending.device.NewFWVersion,
+			Duration:    missingFor,
+		})
+
+		return []byte(payload), err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"event":       "device_missing",
+		"device":      pending.device.ID(),
+		"hostname":    pending.device.HostName,
+		"ip":          pending.device.IP.String(),
+		"model":       pending.device.Model,
+		"version":     pending.device.NewFWVersion,
+		"upgraded_at": pending.upgradedAt,
+		"missing_for": missingFor.String(),
+	})
+}
@@ -1,91 +1,411 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var shellies = map[string]string{
-	"SH2LED-1":   "Shelly 2 LED",
-	"SHAIR-1":    "Shelly Air",
-	"SHBDUO-1":   "Shelly Bulb Duo",
-	"SHBLB-1":    "Shelly Bulb",
-	"SHBTN-1":    "Shelly Button 1",
-	"SHBTN-2":    "Shelly Button 1 (Rev. 2)",
-	"SHCB-1":     "Shelly Color Bulb RGBW GU10",
-	"SHCL-255":   "Shelly Color",
-	"SHDIMW-1":   "Shelly Dimmer W1",
-	"SHDM-1":     "Shelly Dimmer",
-	"SHDM-2":     "Shelly Dimmer 2",
-	"SHDW-1":     "Shelly Door/Window Sensor",
-	"SHDW-2":     "Shelly Door/Window Sensor 2",
-	"SHEM-3":     "Shelly 3EM",
-	"SHEM":       "Shelly EM",
-	"SHGS-1":     "Shelly Gas",
-	"SHHT-1":     "Shelly H&T",
-	"SHIX3-1":    "Shelly i3",
-	"SHMOS-01":   "Shelly Motion",
-	"SHPLG-1":    "Shelly Plug 1",
-	"SHPLG-S":    "Shelly Plug S",
-	"SHPLG-U1":   "Shelly Plug US",
-	"SHPLG2-1":   "Shelly Plug 2",
-	"SHRGBW2":    "Shelly RGBW2",
-	"SHRGBWW-01": "Shelly RGBW",
-	"SHSEN-1":    "Shelly Sense",
-	"SHSM-01":    "Shelly Smoke",
-	"SHSM-02":    "Shelly Smoke",
-	"SHSPOT-1":   "Shelly Spot",
-	"SHSPOT-2":   "Shelly Spot 2",
-	"SHSW-1":     "Shelly 1",
-	"SHSW-21":    "Shelly 2",
-	"SHSW-22":    "Shelly HD",
-	"SHSW-25":    "Shelly 2.5",
-	"SHSW-44":    "Shelly 4 Pro",
-	"SHSW-L":     "Shelly 1L",
-	"SHSW-PM":    "Shelly 1PM",
-	"SHUNI-1":    "Shelly Uni",
-	"SHVIN-1":    "Shelly Vintage",
-	"SHWT-1":     "Shelly Flood",
-}
+// ecoModeTimeoutFactor is how much longer devices in eco mode, which
+// respond more slowly, are given to answer requests.
+const ecoModeTimeoutFactor = 3
 
 // Device holds information about the device location, authentication
 // requirements and firmware versions.
 type Device struct {
+	AuthDisabled     bool
+	CloudDisabled    bool
 	CurrentFWVersion string
+	EcoMode          bool
+	ExtenderClients  []string
+	Generation       int
 	HostName         string
+	Insecure         bool
 	IP               net.IP
+	Link             string
+	MAC              string
 	Model            string
 	NewFWVersion     string
+	Note             string
 	Password         string
 	Port             int
+	Profile          string
+	RangeExtender    bool
+	RestartRequired  bool
+	Scheme           string
+	Status           *DeviceStatus
 	Username         string
 }
 
+// Links devices are connected to the network with, as reported by Gen2
+// devices in their status. Only Pro devices support Ethernet.
+const (
+	linkEthernet = "eth"
+	linkWiFi     = "wifi"
+)
+
+// DeviceStatus is a snapshot of the health of a device, fetched during
+// discovery if requested.
+type DeviceStatus struct {
+	FreeHeap int
+	RSSI     int
+	SSID     string
+	Uptime   time.Duration
+}
+
 // Settings is the structure holding information about the device
 // model type and current firmware version.
 type Settings struct {
 	Device struct {
 		Type string `json:"type"`
+		MAC  string `json:"mac"`
 	} `json:"device"`
-	FW string `json:"fw"`
+	FW    string `json:"fw"`
+	Cloud struct {
+		Enabled *bool `json:"enabled"`
+	} `json:"cloud"`
+	Login struct {
+		Enabled *bool `json:"enabled"`
+	} `json:"login"`
+	EcoModeEnabled bool `json:"eco_mode_enabled"`
+
+	// Mode is the profile of devices supporting several, such as relay
+	// or roller on the Shelly 2.5 and color or white on the RGBW2.
+	Mode string `json:"mode"`
+}
+
+// OTAStatus is the structure returned by the /ota endpoint on Gen1
+// devices, describing the state of a firmware update.
+type OTAStatus struct {
+	Status     string `json:"status"`
+	HasUpdate  bool   `json:"has_update"`
+	NewVersion string `json:"new_version"`
+	OldVersion string `json:"old_version"`
+}
+
+// DeviceInfo is the structure returned by the Shelly.GetDeviceInfo
+// RPC method available on Gen2 devices.
+type DeviceInfo struct {
+	ID    string `json:"id"`
+	MAC   string `json:"mac"`
+	Model string `json:"model"`
+	Gen   int    `json:"gen"`
+	FWID  string `json:"fw_id"`
+	Ver   string `json:"ver"`
+	App   string `json:"app"`
+	Auth  bool   `json:"auth_en"`
+
+	// Profile is the profile of devices supporting several, such as
+	// switch or cover on the Shelly Plus 2PM.
+	Profile string `json:"profile"`
+}
+
+// ShellyInfo is the structure returned by the /shelly endpoint, which
+// is available without authentication on every generation. Gen1 devices
+// do not report a generation, and report their model, firmware version
+// and whether authentication is enabled under different fields.
+type ShellyInfo struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	App    string `json:"app"`
+	MAC    string `json:"mac"`
+	Gen    int    `json:"gen"`
+	FW     string `json:"fw"`
+	Ver    string `json:"ver"`
+	Auth   bool   `json:"auth"`
+	AuthEn bool   `json:"auth_en"`
+}
+
+// Generation returns the generation of the device.
+func (i ShellyInfo) Generation() int {
+	if i.Gen == 0 {
+		return 1
+	}
+
+	return i.Gen
+}
+
+// AuthRequired returns true if the device requires a username/password
+// for every endpoint other than /shelly.
+func (i ShellyInfo) AuthRequired() bool {
+	return i.Auth || i.AuthEn
+}
+
+// DeviceConfig is the structure returned by the Shelly.GetConfig RPC
+// method available on Gen2 devices, limited to the settings that affect
+// upgrades.
+type DeviceConfig struct {
+	Sys struct {
+		Device struct {
+			EcoMode bool `json:"eco_mode"`
+		} `json:"device"`
+	} `json:"sys"`
+	Cloud struct {
+		Enable *bool `json:"enable"`
+	} `json:"cloud"`
+	WiFi struct {
+		AP struct {
+			Enable        bool `json:"enable"`
+			RangeExtender struct {
+				Enable bool `json:"enable"`
+			} `json:"range_extender"`
+		} `json:"ap"`
+	} `json:"wifi"`
+}
+
+// Gen1Status is the structure returned by the /status endpoint on Gen1
+// devices, limited to the fields describing the health of the device and
+// those used as a fallback for settings missing on very old firmwares.
+type Gen1Status struct {
+	MAC    string `json:"mac"`
+	Update struct {
+		OldVersion string `json:"old_version"`
+	} `json:"update"`
+	WiFi struct {
+		SSID string `json:"ssid"`
+		RSSI int    `json:"rssi"`
+	} `json:"wifi_sta"`
+	Uptime  int64 `json:"uptime"`
+	RAMFree int   `json:"ram_free"`
+}
+
+// Gen2Status is the structure returned by the Shelly.GetStatus RPC
+// method available on Gen2 devices, limited to the fields describing the
+// health of the device, the link it is connected with and whether it must
+// be restarted to apply a previous upgrade.
+type Gen2Status struct {
+	Sys struct {
+		Uptime          int64  `json:"uptime"`
+		RAMFree         int    `json:"ram_free"`
+		RestartRequired bool   `json:"restart_required"`
+		FSSize          int64  `json:"fs_size"`
+		FSFree          *int64 `json:"fs_free"`
+
+		AvailableUpdates Gen2UpdateCheck `json:"available_updates"`
+	} `json:"sys"`
+	WiFi struct {
+		StaIP string `json:"sta_ip"`
+		SSID  string `json:"ssid"`
+		RSSI  int    `json:"rssi"`
+	} `json:"wifi"`
+	Eth struct {
+		IP string `json:"ip"`
+	} `json:"eth"`
+}
+
+// gen2Link returns the link a Gen2 device reached at ip is connected
+// with, preferring the one holding that address when both Ethernet and
+// Wi-Fi are connected.
+func gen2Link(status Gen2Status, ip string) string {
+	switch {
+	case status.WiFi.StaIP != "" && status.WiFi.StaIP == ip:
+		return linkWiFi
+	case status.Eth.IP != "":
+		return linkEthernet
+	case status.WiFi.StaIP != "":
+		return linkWiFi
+	}
+
+	return ""
+}
+
+// generationPattern matches the name prefix of Gen3 devices and newer
+// (e.g. shelly1g3-, shelly1pmminig4-).
+var generationPattern = regexp.MustCompile(`^shelly[a-z0-9]*g([3-9])-`)
+
+// inferGeneration guesses the generation of a device from its mDNS
+// instance name or hostname, returning 0 if it cannot be determined.
+func inferGeneration(name string) int {
+	name = strings.ToLower(name)
+
+	if matches := generationPattern.FindStringSubmatch(name); matches != nil {
+		generation, _ := strconv.Atoi(matches[1])
+		return generation
+	}
+
+	for _, prefix := range []string{"shellyplus", "shellypro", "shellywalldisplay"} {
+		if strings.HasPrefix(name, prefix) {
+			return 2
+		}
+	}
+
+	return 0
+}
+
+// splitScheme splits the scheme off a host entry (e.g.
+// https://proxy.lan:8443), returning an empty scheme if there is none.
+func splitScheme(entry string) (string, string) {
+	if index := strings.Index(entry, "://"); index >= 0 {
+		return strings.ToLower(entry[:index]), strings.TrimSuffix(entry[index+3:], "/")
+	}
+
+	return "", entry
 }
 
 // GetBaseURL returns the full URL required for API authentication,
 // if needed.
 func (d *Device) GetBaseURL() string {
-	return fmt.Sprintf("http://%v:%v@%v:%v", d.Username, d.Password, d.IP.String(), d.Port)
+	baseURL := url.URL{
+		Scheme: d.scheme(),
+		User:   url.UserPassword(d.Username, d.Password),
+		Host:   net.JoinHostPort(d.address(), strconv.Itoa(d.port())),
+	}
+
+	return baseURL.String()
+}
+
+// URL returns the URL of a path on the device, without authentication.
+func (d *Device) URL(path string) string {
+	return fmt.Sprintf("%v://%v%v", d.scheme(), net.JoinHostPort(d.address(), strconv.Itoa(d.port())), path)
+}
+
+// port returns the port of the device web server, as announced in its
+// SRV record or given with its host, defaulting to the port of its
+// scheme if unknown.
+func (d *Device) port() int {
+	if d.Port != 0 {
+		return d.Port
+	}
+
+	if d.scheme() == "https" {
+		return 443
+	}
+
+	return 80
+}
+
+// scheme returns the scheme used to reach the device, which is https
+// for devices behind a TLS-terminating reverse proxy.
+func (d *Device) scheme() string {
+	if d.Scheme == "" {
+		return "http"
+	}
+
+	return d.Scheme
+}
+
+// address returns the address used to reach the device. Devices behind
+// a reverse proxy are reached by hostname so that its certificate can
+// be verified.
+func (d *Device) address() string {
+	if d.Scheme == "https" && d.HostName != "" {
+		return strings.TrimSuffix(d.HostName, ".")
+	}
+
+	return d.IP.String()
+}
+
+// HTTPClient returns a client for requests to the device with the given
+// timeout, which is extended for devices in eco mode. Certificates are
+// not verified for devices marked as insecure, devices at a remote site
+// are reached through the tunnel, Gen2 devices are authenticated with
+// digest authentication and, in read-only mode, requests that would
+// change the state of the device are rejected.
+func (d *Device) HTTPClient(timeout time.Duration) *http.Client {
+	client := &http.Client{
+		Timeout: d.Timeout(timeout),
+	}
+
+	if d.Insecure || deviceDial != nil {
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial:  deviceDial,
+		}
+
+		if d.Insecure {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+
+		client.Transport = transport
+	}
+
+	if d.IsGen2() {
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+
+		client.Transport = digestTransport{base: base}
+	}
+
+	if readOnlyMode {
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+
+		client.Transport = readOnlyTransport{base: base}
+	}
+
+	return client
+}
+
+// IsGen2 returns true if the device speaks the Gen2 RPC protocol
+// (Plus and Pro lines and newer).
+func (d *Device) IsGen2() bool {
+	return d.Generation >= 2
+}
+
+// Timeout returns the timeout for a request to the device, which is
+// extended for devices in eco mode.
+func (d *Device) Timeout(timeout time.Duration) time.Duration {
+	if d.EcoMode {
+		return timeout * ecoModeTimeoutFactor
+	}
+
+	return timeout
 }
 
 // ModelName returns a human-friendly version of the device's model,
 // if available.
 func (d *Device) ModelName() string {
-	if d.Model != "" && shellies[d.Model] != "" {
-		return shellies[d.Model]
+	if entry, ok := registry.Lookup(d.Model); ok {
+		return entry.Name
 	}
 
 	return d.Model
 }
 
+// Matches returns true if identifier is the device's IP address (with
+// or without its port), hostname (with or without the .local domain or
+// a scheme) or MAC address (with or without colons).
+func (d *Device) Matches(identifier string) bool {
+	_, identifier = splitScheme(identifier)
+	hostName := strings.TrimSuffix(strings.TrimSuffix(d.HostName, "."), ".local")
+
+	return identifier == d.IP.String() ||
+		identifier == net.JoinHostPort(d.IP.String(), strconv.Itoa(d.port())) ||
+		strings.EqualFold(identifier, d.HostName) ||
+		strings.EqualFold(identifier, hostName) ||
+		(d.MAC != "" && strings.EqualFold(strings.Replace(identifier, ":", "", -1), d.MAC))
+}
+
+// Name returns the device's hostname without the local domain, or its
+// IP address if the hostname is unknown.
+func (d *Device) Name() string {
+	if name := strings.TrimSuffix(strings.TrimSuffix(d.HostName, "."), ".local"); name != "" {
+		return name
+	}
+
+	return d.IP.String()
+}
+
+// ID returns a stable identifier for the device, which is its MAC
+// address if known or its IP address otherwise.
+func (d *Device) ID() string {
+	if d.MAC != "" {
+		return d.MAC
+	}
+
+	return d.IP.String()
+}
+
 func (d *Device) String() string {
-	return fmt.Sprintf("%v (%v:%v)", d.HostName, d.IP.String(), d.Port)
+	return fmt.Sprintf("%v (%v)", d.HostName, net.JoinHostPort(d.IP.String(), strconv.Itoa(d.port())))
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// digestChallenge is the digest authentication challenge of a device,
+// kept between requests so that its nonce is reused rather than
+// negotiated again on every request.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	count     int
+}
+
+// digestChallenges caches the last challenge of each device, by host,
+// shared by every client of the device.
+var digestChallenges = struct {
+	sync.Mutex
+	byHost map[string]*digestChallenge
+}{byHost: map[string]*digestChallenge{}}
+
+// digestTransport authenticates requests to Gen2 devices with HTTP
+// digest authentication (SHA-256, with the realm given by the device,
+// e.g. its ID or shelly since firmware 1.4.0), using the credentials of
+// the request URL. The nonce of the last challenge is reused with an
+// increasing nonce count, and requests rejected because the nonce is
+// stale (e.g. during long verification polls) are retried once with the
+// new challenge. Devices without authentication are not affected.
+type digestTransport struct {
+	base http.RoundTripper
+}
+
+func (t digestTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.User == nil || request.URL.User.Username() == "" {
+		return t.base.RoundTrip(request)
+	}
+
+	host := request.URL.Host
+
+	var authorization string
+
+	digestChallenges.Lock()
+	if challenge, ok := digestChallenges.byHost[host]; ok {
+		authorization = challenge.authorize(request)
+	}
+	digestChallenges.Unlock()
+
+	response, err := t.send(request, authorization)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	challenge, ok := parseDigestChallenge(response.Header.Get("WWW-Authenticate"))
+	if !ok || (request.Body != nil && request.GetBody == nil) {
+		return response, nil
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	digestChallenges.Lock()
+	digestChallenges.byHost[host] = challenge
+	authorization = challenge.authorize(request)
+	digestChallenges.Unlock()
+
+	discoveryLog.Debugf("Authenticating to %v with a new digest challenge (realm %v)", host, challenge.realm)
+
+	return t.send(request, authorization)
+}
+
+// send sends a copy of a request with the given Authorization header,
+// if any, rewinding its body. The Basic Authorization header added by
+// http.Client from the credentials of the URL is always removed, so
+// that the password is never sent in cleartext.
+func (t digestTransport) send(request *http.Request, authorization string) (*http.Response, error) {
+	clone := request.Clone(request.Context())
+	clone.Header.Del("Authorization")
+	if authorization != "" {
+		clone.Header.Set("Authorization", authorization)
+	}
+
+	if request.Body != nil && request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+
+		clone.Body = body
+	}
+
+	return t.base.RoundTrip(clone)
+}
+
+// parseDigestChallenge parses a Digest WWW-Authenticate header,
+// returning false for other authentication schemes.
+func parseDigestChallenge(header string) (*digestChallenge, bool) {
+	if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+		return nil, false
+	}
+
+	challenge := &digestChallenge{algorithm: "MD5"}
+
+	for _, parameter := range splitDigestParameters(header[len("digest "):]) {
+		index := strings.Index(parameter, "=")
+		if index < 0 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(parameter[:index]))
+		value := strings.Trim(strings.TrimSpace(parameter[index+1:]), `"`)
+
+		switch key {
+		case "realm":
+			challenge.realm = value
+		case "nonce":
+			challenge.nonce = value
+		case "opaque":
+			challenge.opaque = value
+		case "algorithm":
+			challenge.algorithm = strings.ToUpper(value)
+		case "qop":
+			for _, qop := range strings.Split(value, ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					challenge.qop = "auth"
+				}
+			}
+		}
+	}
+
+	if challenge.nonce == "" {
+		return nil, false
+	}
+
+	return challenge, true
+}
+
+// splitDigestParameters splits the comma-separated parameters of a
+// challenge, ignoring commas within quoted values (e.g. qop="auth,
+// auth-int").
+func splitDigestParameters(parameters string) []string {
+	var split []string
+
+	quoted := false
+	start := 0
+	for index, char := range parameters {
+		switch {
+		case char == '"':
+			quoted = !quoted
+		case char == ',' && !quoted:
+			split = append(split, parameters[start:index])
+			start = index + 1
+		}
+	}
+
+	return append(split, parameters[start:])
+}
+
+// authorize returns the Authorization header of a request answering
+// the challenge, incrementing its nonce count.
+func (c *digestChallenge) authorize(request *http.Request) string {
+	newHash := md5.New
+	if c.algorithm == "SHA-256" {
+		newHash = sha256.New
+	}
+
+	username := request.URL.User.Username()
+	password, _ := request.URL.User.Password()
+	uri := request.URL.RequestURI()
+
+	ha1 := digestHash(newHash, username, c.realm, password)
+	ha2 := digestHash(newHash, request.Method, uri)
+
+	parameters := []string{
+		fmt.Sprintf(`username="%v"`, username),
+		fmt.Sprintf(`realm="%v"`, c.realm),
+		fmt.Sprintf(`nonce="%v"`, c.nonce),
+		fmt.Sprintf(`uri="%v"`, uri),
+		fmt.Sprintf("algorithm=%v", c.algorithm),
+	}
+
+	if c.qop == "" {
+		parameters = append(parameters, fmt.Sprintf(`response="%v"`, digestHash(newHash, ha1, c.nonce, ha2)))
+	} else {
+		c.count++
+		count := fmt.Sprintf("%08x", c.count)
+		cnonce := digestNonce()
+
+		parameters = append(parameters,
+			fmt.Sprintf("qop=%v", c.qop),
+			fmt.Sprintf("nc=%v", count),
+			fmt.Sprintf(`cnonce="%v"`, cnonce),
+			fmt.Sprintf(`response="%v"`, digestHash(newHash, ha1, c.nonce, count, cnonce, c.qop, ha2)),
+		)
+	}
+
+	if c.opaque != "" {
+		parameters = append(parameters, fmt.Sprintf(`opaque="%v"`, c.opaque))
+	}
+
+	return "Digest " + strings.Join(parameters, ", ")
+}
+
+func digestHash(newHash func() hash.Hash, values ...string) string {
+	h := newHash()
+	h.Write([]byte(strings.Join(values, ":")))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestNonce returns a random client nonce.
+func digestNonce() string {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+
+	return hex.EncodeToString(nonce)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	zeroconf "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+// isMulticastDomain returns true if services in domain are announced via
+// multicast DNS rather than published on a unicast DNS server.
+func isMulticastDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	return domain == "local" || strings.HasSuffix(domain, ".local")
+}
+
+// systemNameservers returns the DNS servers configured on the system.
+func systemNameservers() ([]string, error) {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read DNS configuration (%v)", err)
+	}
+
+	var nameservers []string
+	for _, server := range config.Servers {
+		nameservers = append(nameservers, net.JoinHostPort(server, config.Port))
+	}
+
+	return nameservers, nil
+}
+
+// browseUnicast performs wide-area DNS-SD (RFC 6763) discovery of a
+// service in a unicast DNS domain, sending each instance found to
+// entries, which is closed once all instances have been resolved.
+func browseUnicast(ctx context.Context, nameservers []string, service string, domain string, entries chan<- *zeroconf.ServiceEntry) {
+	defer close(entries)
+
+	resolver := &unicastResolver{nameservers: nameservers}
+	serviceName := dns.Fqdn(fmt.Sprintf("%v.%v", strings.Trim(service, "."), strings.Trim(domain, ".")))
+
+	answers, err := resolver.query(ctx, serviceName, dns.TypePTR)
+	if err != nil {
+		discoveryLog.Errorf("Unable to browse %v (%v)", serviceName, err)
+		return
+	}
+
+	for _, answer := range answers {
+		ptr, ok := answer.(*dns.PTR)
+		if !ok {
+			continue
+		}
+
+		entry, err := resolver.resolveInstance(ctx, ptr.Ptr, service, domain)
+		if err != nil {
+			discoveryLog.Debugf("Unable to resolve %v (%v)", ptr.Ptr, err)
+			continue
+		}
+
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// unicastResolver queries the given DNS servers in order until one of
+// them answers.
+type unicastResolver struct {
+	nameservers []string
+}
+
+// resolveInstance looks up the SRV, TXT and A records of a service
+// instance.
+func (r *unicastResolver) resolveInstance(ctx context.Context, instanceName string, service string, domain string) (*zeroconf.ServiceEntry, error) {
+	instance := strings.TrimSuffix(instanceName, "."+dns.Fqdn(fmt.Sprintf("%v.%v", strings.Trim(service, "."), strings.Trim(domain, "."))))
+	entry := zeroconf.NewServiceEntry(instance, service, domain)
+
+	answers, err := r.query(ctx, instanceName, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, answer := range answers {
+		if srv, ok := answer.(*dns.SRV); ok {
+			entry.HostName = srv.Target
+			entry.Port = int(srv.Port)
+			break
+		}
+	}
+
+	if entry.HostName == "" {
+		return nil, fmt.Errorf("no SRV record for %v", instanceName)
+	}
+
+	answers, err = r.query(ctx, instanceName, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, answer := range answers {
+		if txt, ok := answer.(*dns.TXT); ok {
+			entry.Text = append(entry.Text, txt.Txt...)
+		}
+	}
+
+	answers, err = r.query(ctx, entry.HostName, dns.TypeA)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, answer := range answers {
+		if a, ok := answer.(*dns.A); ok {
+			entry.AddrIPv4 = append(entry.AddrIPv4, a.A)
+		}
+	}
+
+	if len(entry.AddrIPv4) == 0 {
+		return nil, fmt.Errorf("no A record for %v", entry.HostName)
+	}
+
+	return entry, nil
+}
+
+func (r *unicastResolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	message := new(dns.Msg)
+	message.SetQuestion(name, qtype)
+
+	client := new(dns.Client)
+
+	err := fmt.Errorf("no DNS servers configured")
+	for _, nameserver := range r.nameservers {
+		var response *dns.Msg
+		response, _, err = client.ExchangeContext(ctx, message, nameserver)
+		if err != nil {
+			continue
+		}
+
+		if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("DNS query for %v failed (%v)", name, dns.RcodeToString[response.Rcode])
+			continue
+		}
+
+		return response.Answer, nil
+	}
+
+	return nil, err
+}
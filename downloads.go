@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogEntry describes a request made to the local OTA server.
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteIP   string    `json:"remote_ip"`
+	Device     string    `json:"device,omitempty"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// deviceIDKey is the context key of the ID of the device requesting a
+// firmware file under /fw/<id>/<model>.
+type deviceIDKey struct{}
+
+// downloadTracker keeps track of the firmware downloads made by each
+// device from the local OTA server, keyed by device ID or, for requests
+// that do not identify the device, by IP address.
+type downloadTracker struct {
+	mutex     sync.Mutex
+	active    map[string]int
+	completed map[string]int64
+	devices   map[string]*Device
+	accessLog []AccessLogEntry
+}
+
+func newDownloadTracker() *downloadTracker {
+	return &downloadTracker{
+		active:    map[string]int{},
+		completed: map[string]int64{},
+		devices:   map[string]*Device{},
+	}
+}
+
+// expect records a device about to be asked to upgrade, so that its
+// requests are matched to it by ID or IP address.
+func (t *downloadTracker) expect(device *Device) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.devices[device.ID()] = device
+	t.devices[device.IP.String()] = device
+}
+
+// key returns the key a request is accounted under: the ID of the
+// device given in its path, or of the device at its IP address.
+func (t *downloadTracker) key(id string, ip string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if id != "" {
+		return id
+	}
+
+	if device, found := t.devices[ip]; found {
+		return device.ID()
+	}
+
+	return ip
+}
+
+func (t *downloadTracker) start(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.active[key]++
+}
+
+func (t *downloadTracker) finish(key string, entry AccessLogEntry, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.active[key]--
+	if t.active[key] == 0 {
+		delete(t.active, key)
+	}
+
+	if ok {
+		t.completed[key] += entry.Bytes
+	}
+
+	deviceName := "unknown device"
+	if device, found := t.devices[key]; found {
+		entry.Device = device.ID()
+		deviceName = device.ModelName()
+
+		if ok {
+			progress.DeviceDownload(device, entry.Bytes)
+		}
+	} else if key != entry.RemoteIP {
+		entry.Device = key
+	}
+
+	t.accessLog = append(t.accessLog, entry)
+
+	serverLog.Infof("Served %v to %v (%v) with status %v: %v bytes in %v", entry.Path, deviceName, entry.RemoteIP, entry.Status, entry.Bytes, time.Duration(entry.DurationMS)*time.Millisecond)
+}
+
+// completedBy returns the bytes downloaded by a device and whether it
+// has completed a download.
+func (t *downloadTracker) completedBy(key string) (int64, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	written, ok := t.completed[key]
+
+	return written, ok && t.active[key] == 0
+}
+
+// countingResponseWriter records the status and number of bytes of a
+// response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+
+	return n, err
+}
+
+// serveDeviceFirmware serves the firmware of a model under a path that
+// identifies the device requesting it (/fw/<id>/<model>, with an
+// optional /beta suffix).
+func (o *OTAUpdater) serveDeviceFirmware(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/fw/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	modelURL := *r.URL
+	modelURL.Path = "/" + parts[1]
+	modelURL.RawPath = ""
+
+	request := r.WithContext(context.WithValue(r.Context(), deviceIDKey{}, parts[0]))
+	request.URL = &modelURL
+
+	o.mux.ServeHTTP(w, request)
+}
+
+// trackDownloads wraps a firmware handler of the local OTA server so
+// that downloads are accounted to the device making them.
+func (o *OTAUpdater) trackDownloads(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		id, _ := r.Context().Value(deviceIDKey{}).(string)
+		key := o.downloads.key(id, ip)
+
+		o.downloads.start(key)
+
+		startedAt := time.Now()
+		writer := &countingResponseWriter{ResponseWriter: w}
+		handler(writer, r)
+
+		o.downloads.finish(key, AccessLogEntry{
+			Time:       startedAt,
+			RemoteIP:   ip,
+			Path:       r.URL.Path,
+			Status:     writer.status,
+			Bytes:      writer.written,
+			DurationMS: time.Since(startedAt).Milliseconds(),
+		}, writer.status >= 200 && writer.status < 300 && r.Context().Err() == nil)
+	}
+}
+
+// AccessLog returns the requests made to the local OTA server during
+// this run.
+func (o *OTAUpdater) AccessLog() []AccessLogEntry {
+	o.downloads.mutex.Lock()
+	defer o.downloads.mutex.Unlock()
+
+	return append([]AccessLogEntry{}, o.downloads.accessLog...)
+}
+
+// SaveAccessLog adds the requests made to the local OTA server during
+// this run to the history file.
+func (o *OTAUpdater) SaveAccessLog() error {
+	accessLog := o.AccessLog()
+	if len(accessLog) == 0 {
+		return nil
+	}
+
+	history, err := LoadHistory(o.historyPath)
+	if err != nil {
+		return err
+	}
+
+	history.Downloads = append(history.Downloads, accessLog...)
+
+	return history.Save()
+}
+
+// WaitForDownloads waits up to the OTA timeout for every device asked
+// to upgrade from the local OTA server to finish downloading its
+// firmware, so that the run does not end while a slow device is still
+// fetching it. It returns the devices that did not finish in time.
+func (o *OTAUpdater) WaitForDownloads() []*Device {
+	var pending []*Device
+	for _, device := range o.upgraded {
+		if o.servesLocally(device) {
+			pending = append(pending, device)
+		}
+	}
+
+	deadline := o.clock.Now().Add(o.otaTimeout)
+
+	for {
+		var remaining []*Device
+		for _, device := range pending {
+			written, ok := o.downloads.completedBy(device.ID())
+			if !ok {
+				remaining = append(remaining, device)
+				continue
+			}
+
+			serverLog.Infof("%v (%v) finished downloading its firmware (%v bytes)", device.ModelName(), device.IP, written)
+		}
+
+		pending = remaining
+		if len(pending) == 0 || !o.clock.Now().Before(deadline) {
+			break
+		}
+
+		o.clock.Sleep(time.Second)
+	}
+
+	for _, device := range pending {
+		serverLog.Warnf("%v (%v) did not finish downloading its firmware within %v", device.ModelName(), device.IP, o.otaTimeout)
+	}
+
+	return pending
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by mota, wrapped with additional context, which can
+// be matched with errors.Is.
+var (
+	// ErrDeviceUnreachable is returned when a device cannot be
+	// contacted over the network.
+	ErrDeviceUnreachable = errors.New("device unreachable")
+
+	// ErrAuthRequired is returned when a device rejects the request
+	// due to an incorrect or missing username/password.
+	ErrAuthRequired = errors.New("incorrect or missing username/password")
+
+	// ErrFirmwareNotFound is returned when no firmware is published
+	// for a device model.
+	ErrFirmwareNotFound = errors.New("firmware not found")
+
+	// ErrUnknownModel is returned when the model of a device could not
+	// be determined, such as on Gen1 devices with very old firmwares.
+	ErrUnknownModel = errors.New("unknown model")
+
+	// ErrModelNotIndexed is returned when the firmware index lists a
+	// device model without any version, as happens with models newer
+	// than the index.
+	ErrModelNotIndexed = errors.New("unknown to firmware index")
+
+	// ErrFirmwareInfoUnavailable is returned when firmware information
+	// for a device model could not be fetched from the Shelly Cloud.
+	ErrFirmwareInfoUnavailable = errors.New("firmware info unavailable")
+
+	// ErrFirmwareBlocked is returned when every firmware version
+	// available for a device model is in the blocklist.
+	ErrFirmwareBlocked = errors.New("firmware blocked")
+
+	// ErrAheadOfStable is returned when a device runs a firmware newer
+	// than the one offered for its model, which would downgrade it.
+	ErrAheadOfStable = errors.New("ahead of stable")
+
+	// ErrRolloutDeferred is returned when upgrading a device is deferred
+	// to a later run as the rollout limit for its model has been
+	// reached.
+	ErrRolloutDeferred = errors.New("rollout limit reached")
+
+	// ErrUnderLoad is returned when upgrading a device is deferred to a
+	// later run as it is delivering more power than the maximum load.
+	ErrUnderLoad = errors.New("device under load")
+
+	// ErrSkipRule is returned when upgrading a device is deferred to a
+	// later run as one of the skip rules holds for it.
+	ErrSkipRule = errors.New("skip rule matched")
+
+	// ErrUpdateInProgress is returned when a device is already
+	// installing a firmware update.
+	ErrUpdateInProgress = errors.New("update already in progress")
+
+	// ErrInsufficientSpace is returned when a device has less free space
+	// on its filesystem than the firmware it is about to install.
+	ErrInsufficientSpace = errors.New("not enough free space")
+
+	// ErrUpdateNotStarted is returned when a Gen1 device does not start
+	// updating despite repeated OTA requests.
+	ErrUpdateNotStarted = errors.New("update did not start")
+
+	// ErrDeviceDeadlineExceeded is returned when upgrading a device
+	// takes longer than its time budget.
+	ErrDeviceDeadlineExceeded = errors.New("device deadline exceeded")
+
+	// ErrSoakFailed is returned when an upgraded device restarts or
+	// becomes unreachable during the soak period.
+	ErrSoakFailed = errors.New("soak test failed")
+
+	// ErrManualUpgradeRequired is returned when a device rejects an
+	// over-the-air upgrade request and must be upgraded manually.
+	ErrManualUpgradeRequired = errors.New("manual upgrade required")
+
+	// ErrReadOnly is returned when a request would change the state of
+	// a device in read-only mode.
+	ErrReadOnly = errors.New("read-only mode")
+
+	// ErrUnexpectedModel is returned when a device is not the model it
+	// is expected to be in the hosts file.
+	ErrUnexpectedModel = errors.New("unexpected model")
+)
+
+// DeviceError wraps an error with the device and the operation that
+// caused it.
+type DeviceError struct {
+	Device *Device
+	Op     string
+	Err    error
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("%v %v: %v", e.Op, e.Device.String(), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
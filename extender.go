@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APClients is the structure returned by the WiFi.ListAPClients RPC
+// method on Gen2 devices, listing the devices connected to their access
+// point.
+type APClients struct {
+	Clients []struct {
+		MAC string `json:"mac"`
+		IP  string `json:"ip"`
+	} `json:"ap_clients"`
+}
+
+// fetchExtenderClients retrieves the MAC addresses of the devices
+// connected to a Gen2 device acting as a WiFi range extender via the
+// WiFi.ListAPClients RPC method.
+func fetchExtenderClients(client *http.Client, device *Device) error {
+	response, err := client.Get(device.GetBaseURL() + "/rpc/WiFi.ListAPClients")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v fetching access point clients", response.StatusCode)
+	}
+
+	var clients APClients
+	err = json.NewDecoder(response.Body).Decode(&clients)
+	if err != nil {
+		return fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	device.ExtenderClients = nil
+	for _, apClient := range clients.Clients {
+		device.ExtenderClients = append(device.ExtenderClients, strings.ToUpper(strings.Replace(apClient.MAC, ":", "", -1)))
+	}
+
+	return nil
+}
+
+// orderExtenders moves the devices acting as range extenders after the
+// devices connected through them, so that an extender rebooting into
+// its new firmware does not cut off clients in the middle of their own
+// upgrade. Devices are otherwise kept in the same order, with extenders
+// of other extenders upgraded last.
+func orderExtenders(devices []*Device) {
+	byMAC := map[string]*Device{}
+	for _, device := range devices {
+		if device.MAC != "" {
+			byMAC[device.MAC] = device
+		}
+	}
+
+	heights := map[*Device]int{}
+	for _, device := range devices {
+		heights[device] = extenderHeight(device, byMAC, map[*Device]bool{})
+
+		if heights[device] > 0 {
+			discoveryLog.Infof("Upgrading %v (%v) after the devices connected through it, as it is a range extender", device.ModelName(), device.IP)
+		}
+	}
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		return heights[devices[i]] < heights[devices[j]]
+	})
+}
+
+// extenderHeight returns how many range extenders deep the devices
+// connected through a device go, or 0 if none of them are to be
+// upgraded. Loops in the reported clients are ignored.
+func extenderHeight(device *Device, byMAC map[string]*Device, visited map[*Device]bool) int {
+	visited[device] = true
+	defer delete(visited, device)
+
+	height := 0
+	for _, mac := range device.ExtenderClients {
+		client, ok := byMAC[mac]
+		if !ok || visited[client] {
+			continue
+		}
+
+		if clientHeight := extenderHeight(client, byMAC, visited) + 1; clientHeight > height {
+			height = clientHeight
+		}
+	}
+
+	return height
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// zipMagic is the signature at the start of ZIP archives, used by Gen1
+// firmware packages.
+var zipMagic = []byte("PK\x03\x04")
+
+// firmwareFilename returns the local filename of a firmware file. Gen1
+// firmware is published as ZIP archives, while Gen2 CDN URLs often point
+// to raw images without an extension, in which case the extension is
+// derived from the first bytes of the file (if known) and defaults to
+// .bin.
+func firmwareFilename(model string, version string, rawURL string, header []byte) string {
+	extension := ""
+	if parsed, err := url.Parse(rawURL); err == nil {
+		extension = strings.ToLower(path.Ext(parsed.Path))
+	}
+
+	// URLs ending in a version number (e.g. /update/Plus1PM/1.0.3) do not
+	// have a meaningful extension.
+	if extension != ".zip" && extension != ".bin" {
+		extension = ".bin"
+		if bytes.HasPrefix(header, zipMagic) {
+			extension = ".zip"
+		}
+	}
+
+	return fmt.Sprintf("%v-%v%v", model, strings.Replace(version, "/", "-", -1), extension)
+}
+
+// serveFirmwareFile serves a firmware file with the Content-Type and
+// filename matching its format, as Gen1 devices expect ZIP archives and
+// Gen2 devices raw images. The Content-Length is set by http.ServeFile.
+func serveFirmwareFile(w http.ResponseWriter, r *http.Request, filename string) {
+	contentType := "application/octet-stream"
+	if filepath.Ext(filename) == ".zip" {
+		contentType = "application/zip"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(filename)))
+
+	serverLog.Debugf("Serving file %v to %v", filename, r.RemoteAddr)
+	http.ServeFile(w, r, filename)
+}
+
+// firmwareFetches deduplicates downloads of the same firmware URL, as
+// some models share their firmware (e.g. SHBTN-1 and SHBTN-2), so that
+// it is only fetched and stored once per run.
+type firmwareFetches struct {
+	mutex   sync.Mutex
+	fetches map[string]*firmwareFetch
+}
+
+type firmwareFetch struct {
+	done     chan struct{}
+	filename string
+	err      error
+}
+
+func newFirmwareFetches() *firmwareFetches {
+	return &firmwareFetches{fetches: map[string]*firmwareFetch{}}
+}
+
+// do returns the file a firmware URL was downloaded to, calling fetch
+// only for the first request of the URL. Concurrent requests wait for
+// it to finish, and failed downloads are attempted again by later
+// requests.
+func (f *firmwareFetches) do(firmwareURL string, fetch func() (string, error)) (string, error) {
+	f.mutex.Lock()
+	if existing, ok := f.fetches[firmwareURL]; ok {
+		f.mutex.Unlock()
+		<-existing.done
+
+		if existing.err == nil {
+			serverLog.Debugf("Reusing firmware %v already downloaded to %v", path.Base(firmwareURL), existing.filename)
+		}
+
+		return existing.filename, existing.err
+	}
+
+	current := &firmwareFetch{done: make(chan struct{})}
+	f.fetches[firmwareURL] = current
+	f.mutex.Unlock()
+
+	current.filename, current.err = fetch()
+	if current.err != nil {
+		f.mutex.Lock()
+		delete(f.fetches, firmwareURL)
+		f.mutex.Unlock()
+	}
+
+	close(current.done)
+
+	return current.filename, current.err
+}
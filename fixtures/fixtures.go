@@ -0,0 +1,213 @@
+// Package fixtures holds HTTP responses of Shelly devices and a server
+// replaying them, so that support for new models can be added and
+// verified without owning the hardware.
+//
+// Each fixture is a JSON file in testdata, named after the device it
+// stands for, holding what mota is expected to report about the device
+// and the response to each request it makes. Fixtures are recorded from
+// real devices with Record, except for the ones shipped so far, which are
+// hand-written approximations based on the Shelly API documentation and
+// say so in their description.
+package fixtures
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Gen1Paths are the requests recorded from Gen1 devices.
+var Gen1Paths = []string{"/shelly", "/settings", "/status", "/ota"}
+
+// Gen2Paths are the requests recorded from Gen2 devices and newer.
+var Gen2Paths = []string{
+	"/shelly",
+	"/rpc/Shelly.GetDeviceInfo",
+	"/rpc/Shelly.GetConfig",
+	"/rpc/Shelly.GetStatus",
+	"/rpc/Shelly.CheckForUpdate",
+	"/rpc/WiFi.ListAPClients",
+}
+
+// Device is what mota is expected to report about the device a fixture
+// was recorded from.
+type Device struct {
+	Model      string `json:"model"`
+	MAC        string `json:"mac"`
+	Version    string `json:"version"`
+	Generation int    `json:"generation"`
+	Link       string `json:"link,omitempty"`
+}
+
+// Fixture is the set of responses recorded from a device, by request
+// path (including the query, if any).
+type Fixture struct {
+	Name        string                     `json:"-"`
+	Description string                     `json:"description"`
+	Device      Device                     `json:"device"`
+	Responses   map[string]json.RawMessage `json:"responses"`
+}
+
+// Dir returns the directory fixtures are stored in.
+func Dir() string {
+	_, filename, _, _ := runtime.Caller(0)
+
+	return filepath.Join(filepath.Dir(filename), "testdata")
+}
+
+// Load reads the fixture with the given name.
+func Load(name string) (Fixture, error) {
+	var fixture Fixture
+
+	data, err := ioutil.ReadFile(filepath.Join(Dir(), name+".json"))
+	if err != nil {
+		return fixture, err
+	}
+
+	err = json.Unmarshal(data, &fixture)
+	if err != nil {
+		return fixture, fmt.Errorf("error parsing fixture %v: %v", name, err)
+	}
+
+	fixture.Name = name
+
+	return fixture, nil
+}
+
+// All reads every fixture, sorted by name.
+func All() ([]Fixture, error) {
+	filenames, err := filepath.Glob(filepath.Join(Dir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(filenames)
+
+	var fixtures []Fixture
+	for _, filename := range filenames {
+		fixture, err := Load(strings.TrimSuffix(filepath.Base(filename), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		fixtures = append(fixtures, fixture)
+	}
+
+	return fixtures, nil
+}
+
+// Save writes the fixture to the fixtures directory, under its name.
+func (f Fixture) Save() error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(Dir(), f.Name+".json"), append(data, '\n'), 0644)
+}
+
+// Handler replays the recorded responses, matching requests by path and
+// query first and then by path alone (e.g. /ota?url=... is answered with
+// the response to /ota). Requests that were not recorded are answered
+// with 404 Not Found, as devices do for unsupported endpoints.
+func (f Fixture) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := f.Responses[r.URL.RequestURI()]
+		if !ok {
+			response, ok = f.Responses[r.URL.Path]
+		}
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	})
+}
+
+// Server starts a server replaying the recorded responses, which must be
+// closed once done.
+func (f Fixture) Server() *httptest.Server {
+	return httptest.NewServer(f.Handler())
+}
+
+// Record fetches the responses of the device at baseURL (e.g.
+// http://192.168.1.10) to the requests made by mota, according to its
+// generation, into a fixture with the given name. The expected device is
+// filled in from /shelly and must be reviewed, as must the responses for
+// personal details such as SSIDs, names and locations. Devices must not
+// require authentication.
+func Record(client *http.Client, baseURL string, name string) (Fixture, error) {
+	fixture := Fixture{Name: name, Responses: map[string]json.RawMessage{}}
+
+	shelly, err := fetch(client, baseURL+"/shelly")
+	if err != nil {
+		return fixture, err
+	}
+
+	var info struct {
+		Type string `json:"type"`
+		App  string `json:"app"`
+		MAC  string `json:"mac"`
+		Gen  int    `json:"gen"`
+		FW   string `json:"fw"`
+		Ver  string `json:"ver"`
+	}
+
+	err = json.Unmarshal(shelly, &info)
+	if err != nil {
+		return fixture, fmt.Errorf("error parsing /shelly: %v", err)
+	}
+
+	paths := Gen2Paths
+	fixture.Device = Device{Model: info.App, MAC: info.MAC, Version: info.Ver, Generation: info.Gen}
+	if info.Gen < 2 {
+		paths = Gen1Paths
+		fixture.Device = Device{Model: info.Type, MAC: info.MAC, Version: info.FW, Generation: 1, Link: "wifi"}
+	}
+
+	for _, path := range paths {
+		response, err := fetch(client, baseURL+path)
+		if err != nil {
+			// Endpoints not supported by the device are left out, and
+			// answered with 404 Not Found when replayed.
+			continue
+		}
+
+		fixture.Responses[path] = response
+	}
+
+	return fixture, nil
+}
+
+func fetch(client *http.Client, url string) (json.RawMessage, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v fetching %v", response.StatusCode, url)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("invalid JSON fetching %v", url)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,67 @@
+package fixtures
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRecord records a fixture from a real device when MOTA_RECORD_HOST
+// is set, e.g.:
+//
+//	MOTA_RECORD_HOST=192.168.1.10 MOTA_RECORD_NAME=shellyplus1pm go test ./fixtures -run TestRecord
+func TestRecord(t *testing.T) {
+	host := os.Getenv("MOTA_RECORD_HOST")
+	if host == "" {
+		t.Skip("MOTA_RECORD_HOST is not set")
+	}
+
+	name := os.Getenv("MOTA_RECORD_NAME")
+	if name == "" {
+		t.Fatal("MOTA_RECORD_NAME is not set")
+	}
+
+	fixture, err := Record(&http.Client{Timeout: 10 * time.Second}, "http://"+host, name)
+	assert.Nil(t, err)
+	assert.Nil(t, fixture.Save())
+}
+
+func TestReplay(t *testing.T) {
+	fixtures, err := All()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, fixtures)
+
+	for _, fixture := range fixtures {
+		assert.Contains(t, fixture.Responses, "/shelly", fixture.Name)
+		assert.NotEmpty(t, fixture.Device.Model, fixture.Name)
+	}
+
+	fixture, err := Load("shellyswitch25")
+	assert.Nil(t, err)
+
+	server := fixture.Server()
+	defer server.Close()
+
+	// Requests are matched by path when the query was not recorded.
+	response, err := http.Get(server.URL + "/ota?url=http://192.168.1.2:8080/SHSW-25")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, string(body), `"status": "idle"`)
+
+	response, err = http.Get(server.URL + "/rpc/Shelly.GetDeviceInfo")
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// Recording a replayed device yields the same fixture.
+	recorded, err := Record(http.DefaultClient, server.URL, fixture.Name)
+	assert.Nil(t, err)
+	assert.Equal(t, fixture.Device, recorded.Device)
+	assert.Equal(t, len(fixture.Responses), len(recorded.Responses))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// flagGroup is a named group of flags shown together in the help output.
+type flagGroup struct {
+	name  string
+	flags []string
+}
+
+var upgradeFlagGroups = []flagGroup{
+	{"Discovery", []string{"ble", "concurrency", "device-timeout", "domain", "early-exit", "expect", "health", "host", "hosts-file", "interface", "no-probe-cache", "via", "wait"}},
+	{"Server", []string{"device-update-server", "download-dir", "http-port", "listen", "no-download", "stage", "update-server"}},
+	{"Upgrade", []string{"beta", "config", "config-diff", "device-deadline", "failures-file", "force", "max-load", "no-lock", "open-docs", "order", "ota-retries", "ota-timeout", "profile", "read-only", "reset-update-server", "restart", "resume", "set-password", "soak", "stream", "sync-to-stable", "under-load", "verify-timeout"}},
+	{"Output", []string{"audit-log", "log-format", "log-level", "otlp-endpoint", "progress", "quiet", "verbose", "version"}},
+}
+
+var daemonFlagGroup = flagGroup{"Daemon", []string{"grpc-address", "interval", "missing-after", "snapshot-interval", "status-address", "webhook"}}
+
+var agentFlagGroup = flagGroup{"Agent", []string{"controller", "interval", "site", "token"}}
+
+var authFlagGroup = flagGroup{"Authentication", []string{"device", "new-password"}}
+
+var checkFlagGroup = flagGroup{"Check", []string{"ask-device"}}
+
+var configFlagGroup = flagGroup{"Configuration", []string{"effective"}}
+
+var provisionFlagGroup = flagGroup{"Provisioning", []string{"password", "ssid", "upgrade"}}
+
+// exclusiveFlags lists pairs of flags that cannot be used together, with
+// the reason why.
+var exclusiveFlags = []struct {
+	a, b   string
+	reason string
+}{
+	{"host", "domain", "the search domain only applies to discovery"},
+	{"host", "early-exit", "early exit only applies to discovery"},
+	{"host", "expect", "the expected number of devices only applies to discovery"},
+	{"host", "interface", "network interfaces only apply to discovery"},
+	{"host", "wait", "the wait time only applies to discovery"},
+	{"hosts-file", "domain", "the search domain only applies to discovery"},
+	{"hosts-file", "early-exit", "early exit only applies to discovery"},
+	{"hosts-file", "expect", "the expected number of devices only applies to discovery"},
+	{"hosts-file", "interface", "network interfaces only apply to discovery"},
+	{"hosts-file", "wait", "the wait time only applies to discovery"},
+	{"no-download", "download-dir", "firmware is not downloaded"},
+	{"no-download", "update-server", "devices fetch firmware from the update server"},
+	{"order", "stream", "devices are upgraded as soon as they are found when streaming"},
+	{"quiet", "verbose", "quiet mode suppresses verbose output"},
+	{"via", "domain", "devices cannot be discovered through a tunnel"},
+	{"via", "interface", "devices cannot be discovered through a tunnel"},
+	{"via", "wait", "devices cannot be discovered through a tunnel"},
+}
+
+// usage returns a function printing the flags of a command, organized
+// in groups. Flags not in any group are listed last.
+func usage(command string, flags *flag.FlagSet, groups []flagGroup) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage of %v:\n", command)
+
+		// Flag usages are rendered together so that their columns are
+		// aligned across groups.
+		lines := map[string]string{}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSuffix(flags.FlagUsages(), "\n"), "\n") {
+			for _, field := range strings.Fields(line) {
+				if strings.HasPrefix(field, "--") {
+					lines[field[2:]] = line
+					names = append(names, field[2:])
+					break
+				}
+			}
+		}
+
+		grouped := map[string]bool{}
+		for _, group := range groups {
+			fmt.Fprintf(os.Stderr, "\n%v:\n", group.name)
+
+			for _, name := range group.flags {
+				fmt.Fprintln(os.Stderr, lines[name])
+				grouped[name] = true
+			}
+		}
+
+		var other []string
+		for _, name := range names {
+			if !grouped[name] {
+				other = append(other, lines[name])
+			}
+		}
+
+		if len(other) > 0 {
+			fmt.Fprintf(os.Stderr, "\nOther:\n%v\n", strings.Join(other, "\n"))
+		}
+	}
+}
+
+// validateFlags returns an error if flags that cannot be used together
+// have been set, rather than silently ignoring some of them.
+func validateFlags(flags *flag.FlagSet) error {
+	var conflicts []string
+
+	for _, exclusive := range exclusiveFlags {
+		// Host globs are expanded via discovery, which the discovery
+		// flags (other than the domain, taken from the glob) apply to.
+		if exclusive.a == "host" && exclusive.b != "domain" && hostGlobsGiven(flags) {
+			continue
+		}
+
+		if flags.Changed(exclusive.a) && flags.Changed(exclusive.b) {
+			conflicts = append(conflicts, fmt.Sprintf("--%v cannot be used with --%v as %v", exclusive.a, exclusive.b, exclusive.reason))
+		}
+	}
+
+	if format := flags.Lookup("progress"); format != nil && format.Value.String() != "" && format.Value.String() != "json" {
+		conflicts = append(conflicts, fmt.Sprintf("--progress does not support the %q format (only json is supported)", format.Value.String()))
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("invalid flags: %v", strings.Join(conflicts, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// firmwareSizes holds the size of the firmware served by the local OTA
+// server under each path (a model, or a model's beta), as firmware is
+// downloaded concurrently.
+type firmwareSizes struct {
+	mutex sync.Mutex
+	sizes map[string]int64
+}
+
+func newFirmwareSizes() *firmwareSizes {
+	return &firmwareSizes{sizes: map[string]int64{}}
+}
+
+// record stores the size of the firmware file served under a path,
+// leaving it unknown if the file cannot be read.
+func (s *firmwareSizes) record(path string, filename string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		serverLog.Debugf("Unable to read the size of %v (%v)", filename, err)
+		return
+	}
+
+	s.set(path, info.Size())
+}
+
+func (s *firmwareSizes) set(path string, size int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sizes[path] = size
+}
+
+// get returns the size of the firmware served under a path, if known.
+func (s *firmwareSizes) get(path string) (int64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	size, ok := s.sizes[path]
+	return size, ok
+}
+
+// checkFreeSpace fails early if a Gen2 device reports less free space on
+// its filesystem than the size of the firmware the local OTA server is
+// about to send it, rather than letting the update fail part way through.
+// Gen1 devices do not report their free space, and the size of firmware
+// fetched from an update server or upstream is unknown, so neither is
+// checked.
+func (o *OTAUpdater) checkFreeSpace(client *http.Client, device *Device) error {
+	if !device.IsGen2() || !o.servesLocally(device) {
+		return nil
+	}
+
+	path := device.Model
+	if o.betaDevices[device.ID()] {
+		path += "/beta"
+	}
+
+	size, ok := o.firmwareSizes.get(path)
+	if !ok {
+		return nil
+	}
+
+	free, err := fetchFreeSpace(client, device)
+	if err != nil {
+		upgradeLog.Debugf("Unable to read the free space of %v, not checking it (%v)", device.String(), err)
+		return nil
+	}
+
+	if free < 0 {
+		return nil
+	}
+
+	upgradeLog.Debugf("%v has %v bytes free for a firmware of %v bytes", device.String(), free, size)
+
+	if free < size {
+		return fmt.Errorf("%w: the firmware takes %v bytes but only %v are free", ErrInsufficientSpace, size, free)
+	}
+
+	return nil
+}
+
+// fetchFreeSpace returns the free space on the filesystem of a Gen2
+// device in bytes, as reported by the Shelly.GetStatus RPC method, or -1
+// if the device does not report it.
+func fetchFreeSpace(client *http.Client, device *Device) (int64, error) {
+	status, err := fetchGen2Status(client, device)
+	if err != nil {
+		return 0, err
+	}
+
+	if status.Sys.FSFree == nil {
+		return -1, nil
+	}
+
+	return *status.Sys.FSFree, nil
+}
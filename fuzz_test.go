@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// FuzzCompareFirmwareVersions checks that any pair of versions a device
+// may report is compared without panicking and consistently, whichever
+// order they are given in:
+//
+//	go test -run ^$ -fuzz FuzzCompareFirmwareVersions
+func FuzzCompareFirmwareVersions(f *testing.F) {
+	seeds := []string{
+		"20191127-095418/v1.5.6@0d769d69",
+		"20230913-112234/v1.14.0-gcb84623",
+		"20231107-162425/v1.14.1-rc1-g0617c15",
+		"20231219-133956/1.1.0-g34b5d4f",
+		"20240911-124508/2.4.4-e74c4b6c",
+		"1.0.0-beta10",
+		"1.4",
+		"v1.10.0",
+		"",
+	}
+
+	for _, a := range seeds {
+		for _, b := range seeds {
+			f.Add(a, b)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, a string, b string) {
+		assert.Equal(t, 0, compareFirmwareVersions(a, a), a)
+
+		ab, ba := compareFirmwareVersions(a, b), compareFirmwareVersions(b, a)
+		assert.Equal(t, ab > 0, ba < 0, "%q and %q", a, b)
+		assert.Equal(t, ab == 0, ba == 0, "%q and %q", a, b)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// fwcdnResponse holds the builds listed by the Gen2 firmware CDN for an
+// application.
+type fwcdnResponse struct {
+	Builds []gen2Release `json:"builds"`
+}
+
+// WithFirmwareCDNURL is an APIClient option that allows overriding the
+// base URL of the Gen2 firmware CDN, used to list every build published
+// for an application.
+func WithFirmwareCDNURL(fwcdnBaseURL string) APIClientOption {
+	return func(client *APIClient) {
+		client.fwcdnBaseURL = fwcdnBaseURL
+	}
+}
+
+// FetchGen2Builds returns every firmware build published for a Gen2
+// application on the firmware CDN, newest first.
+func (client *APIClient) FetchGen2Builds(app string) ([]Firmware, error) {
+	apiResponse, err := client.httpClient.Get(client.fwcdnBaseURL + "/gen2/" + url.PathEscape(app) + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	defer apiResponse.Body.Close()
+
+	if apiResponse.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %v listing firmware builds for %v", apiResponse.StatusCode, app)
+	}
+
+	var decoded fwcdnResponse
+	err = json.NewDecoder(apiResponse.Body).Decode(&decoded)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	builds := make([]Firmware, 0, len(decoded.Builds))
+	for _, build := range decoded.Builds {
+		builds = append(builds, Firmware{
+			Model:   app,
+			URL:     build.URL,
+			Version: build.Version,
+			SHA256:  build.SHA256,
+		})
+	}
+
+	sort.SliceStable(builds, func(i, j int) bool {
+		return compareFirmwareVersions(builds[i].Version, builds[j].Version) > 0
+	})
+
+	return builds, nil
+}
+
+// ResolveGen2Build returns the firmware build of a specific version
+// published for a Gen2 application, so that its download URL does not
+// need to be known in advance.
+func (client *APIClient) ResolveGen2Build(app string, version string) (Firmware, error) {
+	builds, err := client.FetchGen2Builds(app)
+	if err != nil {
+		return Firmware{}, err
+	}
+
+	for _, build := range builds {
+		if build.URL != "" && compareFirmwareVersions(build.Version, version) == 0 {
+			return build, nil
+		}
+	}
+
+	return Firmware{}, fmt.Errorf("%w for %v version %v", ErrFirmwareNotFound, app, version)
+}
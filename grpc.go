@@ -0,0 +1,81 @@
+//go:build grpc || full
+// +build grpc full
+
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/mota.proto
+
+import (
+	"context"
+	"net"
+
+	motapb "github.com/ruimarinho/mota/proto"
+	"google.golang.org/grpc"
+)
+
+func init() {
+	serveGRPC = func(d *Daemon, address string) error {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+
+		server := grpc.NewServer()
+		motapb.RegisterMotaServer(server, &grpcServer{daemon: d})
+
+		return server.Serve(listener)
+	}
+}
+
+// grpcServer implements the Mota gRPC service on top of the daemon.
+type grpcServer struct {
+	motapb.UnimplementedMotaServer
+	daemon *Daemon
+}
+
+func (s *grpcServer) ListDevices(ctx context.Context, request *motapb.ListDevicesRequest) (*motapb.ListDevicesResponse, error) {
+	response := &motapb.ListDevicesResponse{}
+
+	for _, device := range s.daemon.Devices() {
+		response.Devices = append(response.Devices, &motapb.Device{
+			Device:         device.Device,
+			Hostname:       device.HostName,
+			Ip:             device.IP,
+			Model:          device.Model,
+			CurrentVersion: device.CurrentFWVersion,
+			NewVersion:     device.NewFWVersion,
+		})
+	}
+
+	return response, nil
+}
+
+func (s *grpcServer) CheckVersions(ctx context.Context, request *motapb.CheckVersionsRequest) (*motapb.CheckVersionsResponse, error) {
+	return &motapb.CheckVersionsResponse{Accepted: s.daemon.Trigger(nil)}, nil
+}
+
+func (s *grpcServer) Upgrade(ctx context.Context, request *motapb.UpgradeRequest) (*motapb.UpgradeResponse, error) {
+	return &motapb.UpgradeResponse{Accepted: s.daemon.Trigger(request.Devices)}, nil
+}
+
+func (s *grpcServer) StreamProgress(request *motapb.StreamProgressRequest, stream motapb.Mota_StreamProgressServer) error {
+	events, unsubscribe := s.daemon.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case event := <-events:
+			err := stream.Send(&motapb.ProgressEvent{
+				TimeUnix: event.Time.Unix(),
+				Type:     event.Type,
+				Device:   event.Device,
+				Message:  event.Message,
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// History is a persistent record of the upgrades requested by mota,
+// used to track progress across runs, of the firmware downloads served
+// by the local OTA server and of the firmware versions found by the
+// daemon over time.
+type History struct {
+	path      string
+	Upgrades  []HistoryEntry   `json:"upgrades"`
+	Downloads []AccessLogEntry `json:"downloads,omitempty"`
+	Snapshots []FleetSnapshot  `json:"snapshots,omitempty"`
+}
+
+// HistoryEntry holds information about a single upgrade request.
+type HistoryEntry struct {
+	Device      string    `json:"device"`
+	IP          string    `json:"ip"`
+	Model       string    `json:"model"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version"`
+	Time        time.Time `json:"time"`
+}
+
+// LoadHistory reads the history file at path. A missing file results
+// in an empty history.
+func LoadHistory(path string) (*History, error) {
+	history := &History{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, history)
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// Record adds an upgrade request for a device to the history.
+func (h *History) Record(device *Device) {
+	h.Upgrades = append(h.Upgrades, HistoryEntry{
+		Device:      device.ID(),
+		IP:          device.IP.String(),
+		Model:       device.Model,
+		FromVersion: device.CurrentFWVersion,
+		ToVersion:   device.NewFWVersion,
+		Time:        time.Now(),
+	})
+}
+
+// Save writes the history to disk.
+func (h *History) Save() error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(h.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(h.path, data, 0600)
+}
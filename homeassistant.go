@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Home Assistant add-ons are given a token to reach the Supervisor API
+// in SUPERVISOR_TOKEN, read their options from addonOptionsPath and are
+// served through ingress on addonIngressPort by default.
+const (
+	addonOptionsPath = "/data/options.json"
+	addonIngressPort = 8099
+)
+
+// HomeAssistant is a client for the Supervisor API available to mota
+// when running as a Home Assistant add-on, used to send notifications
+// and find the addresses of the host network.
+type HomeAssistant struct {
+	supervisorURL string
+	token         string
+	httpClient    *http.Client
+}
+
+// HomeAssistantOption is an option interface for HomeAssistant.
+type HomeAssistantOption func(*HomeAssistant)
+
+// WithSupervisorURL is a HomeAssistant option that allows overriding the
+// base URL of the Supervisor API.
+func WithSupervisorURL(supervisorURL string) HomeAssistantOption {
+	return func(ha *HomeAssistant) {
+		ha.supervisorURL = supervisorURL
+	}
+}
+
+// NewHomeAssistant returns a new instance of HomeAssistant
+// authenticating with the Supervisor token.
+func NewHomeAssistant(token string, options ...HomeAssistantOption) *HomeAssistant {
+	ha := &HomeAssistant{
+		supervisorURL: "http://supervisor",
+		token:         token,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+
+	for _, option := range options {
+		option(ha)
+	}
+
+	return ha
+}
+
+// runningAsAddon returns the Home Assistant client if mota is running as
+// a Home Assistant add-on, or nil otherwise.
+func runningAsAddon() *HomeAssistant {
+	token := os.Getenv("SUPERVISOR_TOKEN")
+	if token == "" {
+		return nil
+	}
+
+	return NewHomeAssistant(token)
+}
+
+// request makes a request to the Supervisor API, decoding the data of
+// its response into result (if given).
+func (ha *HomeAssistant) request(method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, ha.supervisorURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+ha.token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := ha.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v from the Home Assistant Supervisor", response.StatusCode)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// Notify creates a persistent notification in Home Assistant. Later
+// notifications with the same ID replace earlier ones.
+func (ha *HomeAssistant) Notify(id string, title string, message string) error {
+	return ha.request(http.MethodPost, "/core/api/services/persistent_notification/create", map[string]string{
+		"notification_id": id,
+		"title":           title,
+		"message":         message,
+	}, nil)
+}
+
+// ListenAddresses returns the IPv4 addresses of the connected interfaces
+// of the Home Assistant host, which add-ons share the network of, so
+// that firmware is served on the networks Home Assistant reaches devices
+// on.
+func (ha *HomeAssistant) ListenAddresses() ([]net.IP, error) {
+	var info struct {
+		Data struct {
+			Interfaces []struct {
+				Interface string `json:"interface"`
+				Enabled   bool   `json:"enabled"`
+				Connected bool   `json:"connected"`
+				IPv4      struct {
+					Address []string `json:"address"`
+				} `json:"ipv4"`
+			} `json:"interfaces"`
+		} `json:"data"`
+	}
+
+	err := ha.request(http.MethodGet, "/network/info", nil, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []net.IP
+	for _, iface := range info.Data.Interfaces {
+		if !iface.Enabled || !iface.Connected {
+			continue
+		}
+
+		for _, address := range iface.IPv4.Address {
+			ip, _, err := net.ParseCIDR(address)
+			if err != nil {
+				log.Debugf("Ignoring invalid address %q of %v reported by the Home Assistant Supervisor", address, iface.Interface)
+				continue
+			}
+
+			addresses = append(addresses, ip)
+		}
+	}
+
+	return addresses, nil
+}
+
+// addonEnv returns the environment variable setting a flag as a Home
+// Assistant add-on (e.g. MOTA_MISSING_AFTER for --missing-after).
+func addonEnv(name string) string {
+	return "MOTA_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyAddonOptions sets the flags not given on the command line from
+// MOTA_<FLAG> environment variables (e.g. MOTA_MISSING_AFTER) and then
+// from the add-on options file, whose keys are flag names with
+// underscores (e.g. missing_after). Lists set flags that can be
+// specified multiple times, and unknown keys are ignored with a warning.
+func applyAddonOptions(flags *flag.FlagSet, path string) error {
+	flags.VisitAll(func(f *flag.Flag) {
+		env := addonEnv(f.Name)
+		if value, ok := os.LookupEnv(env); ok && !f.Changed {
+			err := flags.Set(f.Name, value)
+			if err != nil {
+				log.Warnf("Ignoring invalid %v (%v)", env, err)
+			}
+		}
+	})
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var options map[string]interface{}
+	err = json.Unmarshal(data, &options)
+	if err != nil {
+		return fmt.Errorf("unable to parse add-on options %v (%v)", path, err)
+	}
+
+	for key, value := range options {
+		name := strings.Replace(key, "_", "-", -1)
+
+		f := flags.Lookup(name)
+		if f == nil {
+			log.Warnf("Ignoring unknown add-on option %v", key)
+			continue
+		}
+
+		if f.Changed || value == nil {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+
+		for _, value := range values {
+			err := flags.Set(name, fmt.Sprint(value))
+			if err != nil {
+				return fmt.Errorf("invalid add-on option %v (%v)", key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ingressHandler strips the path Home Assistant serves an add-on under
+// through ingress (given in the X-Ingress-Path header) from requests
+// that still carry it, so that the daemon endpoints are reachable both
+// directly and through ingress.
+func ingressHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimSuffix(r.Header.Get("X-Ingress-Path"), "/")
+		if prefix != "" && strings.HasPrefix(r.URL.Path, prefix+"/") {
+			stripped := *r.URL
+			stripped.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			stripped.RawPath = ""
+
+			request := r.WithContext(r.Context())
+			request.URL = &stripped
+			r = request
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	zeroconf "github.com/grandcat/zeroconf"
+	flag "github.com/spf13/pflag"
+)
+
+// maxHostRange caps how many addresses a host range expands to, so that
+// a typo does not start probing a whole network.
+const maxHostRange = 1024
+
+// isHostGlob returns true if a host is a glob (e.g. shelly*.lan) to be
+// matched against the hostnames of the devices discovered.
+func isHostGlob(host string) bool {
+	return strings.ContainsAny(host, "*?[")
+}
+
+// expandHosts expands the host ranges given (e.g. 192.168.1.10-40) into
+// each of their addresses and separates the globs from the remaining
+// hosts. Invalid ranges are skipped with an error.
+func expandHosts(targets []string) ([]string, []string) {
+	var hosts, globs []string
+
+	for _, target := range targets {
+		if isHostGlob(target) {
+			globs = append(globs, strings.ToLower(target))
+			continue
+		}
+
+		expanded, err := expandHostRange(target)
+		if err != nil {
+			discoveryLog.Errorf("Host range %v is invalid (%v), skipping", target, err)
+			continue
+		}
+
+		hosts = append(hosts, expanded...)
+	}
+
+	return hosts, globs
+}
+
+// expandHostRange returns the addresses of a range of IPv4 addresses,
+// given either as first-last (e.g. 192.168.1.10-192.168.1.40) or with
+// the last octet of the last address only (e.g. 192.168.1.10-40),
+// keeping the scheme and port of the target. Targets which are not
+// ranges are returned as is.
+func expandHostRange(target string) ([]string, error) {
+	scheme, host := splitScheme(target)
+
+	port := ""
+	if hostString, portString, err := net.SplitHostPort(host); err == nil {
+		host, port = hostString, portString
+	}
+
+	parts := strings.SplitN(host, "-", 2)
+	if len(parts) != 2 {
+		return []string{target}, nil
+	}
+
+	first := net.ParseIP(parts[0]).To4()
+	if first == nil {
+		// Hostnames may contain dashes too (e.g. shelly1-b929cc).
+		return []string{target}, nil
+	}
+
+	last := net.ParseIP(parts[1]).To4()
+	if last == nil {
+		octet, err := strconv.Atoi(parts[1])
+		if err != nil || octet < 0 || octet > 255 {
+			return nil, fmt.Errorf("%q is neither an IPv4 address nor an octet", parts[1])
+		}
+
+		last = net.IPv4(first[0], first[1], first[2], byte(octet)).To4()
+	}
+
+	start, end := binary.BigEndian.Uint32(first), binary.BigEndian.Uint32(last)
+	if end < start {
+		return nil, fmt.Errorf("%v comes before %v", last, first)
+	}
+
+	if end-start >= maxHostRange {
+		return nil, fmt.Errorf("ranges are limited to %v addresses", maxHostRange)
+	}
+
+	var hosts []string
+	for address := start; address <= end; address++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, address)
+
+		host := ip.String()
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		if scheme != "" {
+			host = scheme + "://" + host
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// globDomains returns the domains browsed for devices matching globs:
+// the domain of each glob (e.g. lan for shelly*.lan), or local for
+// globs without one.
+func globDomains(globs []string) []string {
+	seen := map[string]bool{}
+
+	var domains []string
+	for _, glob := range globs {
+		domain := "local"
+		if index := strings.Index(glob, "."); index >= 0 && !isHostGlob(glob[index+1:]) {
+			domain = strings.TrimSuffix(glob[index+1:], ".")
+		}
+
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
+
+// matchesHostGlob returns true if a hostname (e.g. shelly1-b929cc.local.)
+// matches any of the globs. Globs without a domain match the first label
+// of the hostname.
+func matchesHostGlob(hostName string, globs []string) bool {
+	hostName = strings.ToLower(strings.TrimSuffix(hostName, "."))
+	label := strings.SplitN(hostName, ".", 2)[0]
+
+	for _, glob := range globs {
+		name := hostName
+		if !strings.Contains(glob, ".") {
+			name = label
+		}
+
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterHostGlobs forwards the service entries whose hostname matches any
+// of the globs, closing matchedChan once entriesChan is closed.
+func filterHostGlobs(entriesChan <-chan *zeroconf.ServiceEntry, matchedChan chan<- *zeroconf.ServiceEntry, globs []string) {
+	defer close(matchedChan)
+
+	for entry := range entriesChan {
+		if matchesHostGlob(entry.HostName, globs) {
+			matchedChan <- entry
+			continue
+		}
+
+		discoveryLog.Debugf("Ignoring %v as it does not match %v", entry.HostName, globs)
+	}
+}
+
+// hostGlobsGiven returns true if any of the hosts given on the command
+// line is a glob, which is expanded via discovery.
+func hostGlobsGiven(flags *flag.FlagSet) bool {
+	hosts, err := flags.GetStringSlice("host")
+	if err != nil {
+		return false
+	}
+
+	for _, host := range hosts {
+		if isHostGlob(host) {
+			return true
+		}
+	}
+
+	return false
+}
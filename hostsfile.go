@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// HostEntry is a host read from a hosts file, along with the
+// username/password to authenticate with and the model it is expected
+// to be, if given.
+type HostEntry struct {
+	Host     string
+	Username string
+	Password string
+	Model    string
+}
+
+// ParseHostsFile parses a list of hosts, one per line, optionally
+// followed by the username/password of the device (as user:password)
+// and its expected model, in any order:
+//
+//	192.168.1.10
+//	192.168.1.11 admin:secret SHSW-25
+//
+// Empty lines and lines starting with # are ignored.
+func ParseHostsFile(r io.Reader) ([]HostEntry, error) {
+	var entries []HostEntry
+
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := HostEntry{Host: fields[0]}
+
+		for _, field := range fields[1:] {
+			// Models never contain colons, so the first one separates
+			// the username from the password.
+			if index := strings.Index(field, ":"); index >= 0 {
+				if entry.Username != "" {
+					return nil, fmt.Errorf("line %v: more than one username/password", number)
+				}
+
+				entry.Username, entry.Password = field[:index], field[index+1:]
+				continue
+			}
+
+			if entry.Model != "" {
+				return nil, fmt.Errorf("line %v: more than one model", number)
+			}
+
+			entry.Model = field
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// readHostsFile reads the hosts file at path, or from stdin if path is -.
+func readHostsFile(path string) ([]HostEntry, error) {
+	if path == "-" {
+		return ParseHostsFile(os.Stdin)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries, err := ParseHostsFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse hosts file %v (%v)", path, err)
+	}
+
+	return entries, nil
+}
+
+// matches returns true if a host entry refers to a device, by the IP
+// address or hostname (without port) it was reached at.
+func (e HostEntry) matches(device *Device) bool {
+	_, host := splitScheme(e.Host)
+	if hostString, _, err := net.SplitHostPort(host); err == nil {
+		host = hostString
+	}
+
+	hostName := device.HostName
+	if hostString, _, err := net.SplitHostPort(hostName); err == nil {
+		hostName = hostString
+	}
+
+	return host == device.IP.String() || strings.EqualFold(host, hostName) || device.Matches(host)
+}
+
+// applyHostEntry sets the username/password given for a device in the
+// hosts file, which take precedence over the netrc file, returning its
+// expected model, if given.
+func applyHostEntry(entries []HostEntry, device *Device) string {
+	for _, entry := range entries {
+		if !entry.matches(device) {
+			continue
+		}
+
+		if entry.Username != "" {
+			device.Username = entry.Username
+			device.Password = entry.Password
+		}
+
+		return entry.Model
+	}
+
+	return ""
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DeviceLedger is a persistent record of every device mota has ever
+// found, with when it was first and last seen, the addresses and
+// firmware versions it had over time, the link (Ethernet or WiFi) it was
+// last connected with and notes given with mota note.
+type DeviceLedger struct {
+	path    string
+	Devices map[string]*LedgerEntry `json:"devices"`
+}
+
+// LedgerEntry holds what is known about a single device, by its ID (the
+// MAC address when known).
+type LedgerEntry struct {
+	ID        string         `json:"id"`
+	HostName  string         `json:"hostname"`
+	Model     string         `json:"model"`
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+	IPs       []LedgerChange `json:"ips"`
+	Link      string         `json:"link,omitempty"`
+	Firmwares []LedgerChange `json:"firmwares"`
+	Note      string         `json:"note,omitempty"`
+}
+
+// LedgerChange is a value (an IP address or a firmware version) a
+// device was first seen with at a given time.
+type LedgerChange struct {
+	Value string    `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// LoadLedger reads the ledger file at path. A missing file results in
+// an empty ledger.
+func LoadLedger(path string) (*DeviceLedger, error) {
+	ledger := &DeviceLedger{path: path, Devices: map[string]*LedgerEntry{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ledger, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, ledger)
+	if err != nil {
+		return nil, err
+	}
+
+	if ledger.Devices == nil {
+		ledger.Devices = map[string]*LedgerEntry{}
+	}
+
+	return ledger, nil
+}
+
+// defaultLedgerPath returns the path of the ledger file on the OS cache
+// or temp directories.
+func defaultLedgerPath() string {
+	return filepath.Join(stateDir(), "devices.json")
+}
+
+// Observe records that a device has been seen at the given time, noting
+// any change of address, link or firmware, and sets its note.
+func (l *DeviceLedger) Observe(device *Device, now time.Time) {
+	entry, ok := l.Devices[device.ID()]
+	if !ok {
+		entry = &LedgerEntry{ID: device.ID(), FirstSeen: now}
+		l.Devices[entry.ID] = entry
+	}
+
+	entry.HostName = device.HostName
+	entry.Model = device.Model
+	entry.LastSeen = now
+	entry.IPs = appendLedgerChange(entry.IPs, device.IP.String(), now)
+
+	if device.Link != "" {
+		entry.Link = device.Link
+	}
+
+	entry.Firmwares = appendLedgerChange(entry.Firmwares, device.CurrentFWVersion, now)
+
+	device.Note = entry.Note
+}
+
+// appendLedgerChange appends a value to a history of changes, unless it
+// is the last one recorded.
+func appendLedgerChange(changes []LedgerChange, value string, now time.Time) []LedgerChange {
+	if value == "" || (len(changes) > 0 && changes[len(changes)-1].Value == value) {
+		return changes
+	}
+
+	return append(changes, LedgerChange{Value: value, Time: now})
+}
+
+// Find returns the entry of a device given its ID, MAC address (in any
+// case, with or without separators), hostname or last known IP address.
+func (l *DeviceLedger) Find(id string) (*LedgerEntry, error) {
+	for _, entry := range l.Entries() {
+		if strings.EqualFold(compactMAC(entry.ID), compactMAC(id)) || strings.EqualFold(entry.HostName, id) || entry.IP() == id {
+			return entry, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown device %q, it has not been found by mota yet", id)
+}
+
+// compactMAC removes the separators of a MAC address.
+func compactMAC(mac string) string {
+	return strings.NewReplacer(":", "", "-", "").Replace(mac)
+}
+
+// Entries returns the entries of the ledger, ordered by ID.
+func (l *DeviceLedger) Entries() []*LedgerEntry {
+	var entries []*LedgerEntry
+	for _, entry := range l.Devices {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries
+}
+
+// IP returns the last known IP address of the device.
+func (e *LedgerEntry) IP() string {
+	if len(e.IPs) == 0 {
+		return ""
+	}
+
+	return e.IPs[len(e.IPs)-1].Value
+}
+
+// Firmware returns the last known firmware version of the device.
+func (e *LedgerEntry) Firmware() string {
+	if len(e.Firmwares) == 0 {
+		return ""
+	}
+
+	return e.Firmwares[len(e.Firmwares)-1].Value
+}
+
+// writeLedger prints a table of every device in the ledger, with its
+// last known address, link and firmware, when it was first and last
+// seen and its note.
+func writeLedger(out io.Writer, entries []*LedgerEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "No devices recorded yet, they are recorded when found by mota.")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDEVICE\tIP\tLINK\tMODEL\tFIRMWARE\tFIRST SEEN\tLAST SEEN\tNOTE")
+
+	for _, entry := range entries {
+		link, note := entry.Link, entry.Note
+		if link == "" {
+			link = "-"
+		}
+
+		if note == "" {
+			note = "-"
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", entry.ID, entry.HostName, entry.IP(), link, entry.Model, entry.Firmware(), entry.FirstSeen.Local().Format("2006-01-02 15:04"), entry.LastSeen.Local().Format("2006-01-02 15:04"), note)
+	}
+
+	w.Flush()
+}
+
+// Save writes the ledger to disk.
+func (l *DeviceLedger) Save() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(l.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(l.path, data, 0600)
+}
+
+// AddressWarnings returns warnings about the IP addresses of the devices
+// found compared to the ledger: devices found at a different address
+// than when last seen, addresses now held by another device than when
+// last seen and addresses claimed by several devices at once, as
+// happens with DHCP misconfigurations. Devices without a known MAC
+// address are not compared.
+func (l *DeviceLedger) AddressWarnings(devices []*Device) []string {
+	var warnings []string
+
+	holders := map[string]*LedgerEntry{}
+	for _, entry := range l.Entries() {
+		if entry.IP() != "" && entry.ID != entry.IP() {
+			holders[entry.IP()] = entry
+		}
+	}
+
+	claims := map[string][]string{}
+	claimed := map[string]bool{}
+	for _, device := range devices {
+		if device.MAC == "" {
+			continue
+		}
+
+		// Devices may be found more than once, e.g. on several interfaces.
+		ip := device.IP.String()
+		if claimed[ip+"/"+device.MAC] {
+			continue
+		}
+
+		claimed[ip+"/"+device.MAC] = true
+		claims[ip] = append(claims[ip], device.MAC)
+
+		if entry, ok := l.Devices[device.ID()]; ok && entry.IP() != "" && entry.IP() != ip {
+			warnings = append(warnings, fmt.Sprintf("%v (%v) moved from %v to %v since it was last seen on %v", device.ModelName(), device.MAC, entry.IP(), ip, entry.LastSeen.Local().Format("2006-01-02 15:04")))
+			continue
+		}
+
+		if holder, ok := holders[ip]; ok && holder.ID != device.ID() {
+			warnings = append(warnings, fmt.Sprintf("%v is now held by %v (%v) instead of %v (%v) as when last seen on %v", ip, device.ModelName(), device.MAC, holder.HostName, holder.ID, holder.LastSeen.Local().Format("2006-01-02 15:04")))
+		}
+	}
+
+	var ips []string
+	for ip, claimants := range claims {
+		if len(claimants) > 1 {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+
+	for _, ip := range ips {
+		warnings = append(warnings, fmt.Sprintf("%v is claimed by several devices (%v), check the DHCP reservations of your network", ip, strings.Join(claims[ip], ", ")))
+	}
+
+	return warnings
+}
+
+// recordDevices records the devices found in the ledger, setting their
+// notes. Failing to update the ledger does not prevent upgrades.
+func (o *OTAUpdater) recordDevices(devices []*Device) {
+	if o.ledgerPath == "" {
+		return
+	}
+
+	ledger, err := LoadLedger(o.ledgerPath)
+	if err != nil {
+		discoveryLog.Warnf("Ignoring device ledger %v (%v)", o.ledgerPath, err)
+		return
+	}
+
+	// Stale addresses are a common cause of failed upgrades when
+	// devices are given with --host.
+	for _, warning := range ledger.AddressWarnings(devices) {
+		discoveryLog.Warn(warning)
+	}
+
+	now := o.clock.Now()
+	for _, device := range devices {
+		ledger.Observe(device, now)
+	}
+
+	err = ledger.Save()
+	if err != nil {
+		discoveryLog.Warnf("Unable to save device ledger %v (%v)", o.ledgerPath, err)
+	}
+}
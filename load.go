@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Actions taken on devices under load, given with --under-load.
+const (
+	underLoadSkip = "skip"
+	underLoadWarn = "warn"
+)
+
+// DeviceLoad is the load a device is delivering, as the number of its
+// outputs switched on and the power drawn through it in watts. Devices
+// without power metering always report no power.
+type DeviceLoad struct {
+	Outputs int
+	Power   float64
+}
+
+// Gen1LoadStatus is the structure returned by the /status endpoint on
+// Gen1 devices, limited to the state of relays and power meters.
+type Gen1LoadStatus struct {
+	Relays []struct {
+		IsOn bool `json:"ison"`
+	} `json:"relays"`
+	Meters []struct {
+		Power float64 `json:"power"`
+	} `json:"meters"`
+	EMeters []struct {
+		Power float64 `json:"power"`
+	} `json:"emeters"`
+}
+
+// Gen2LoadComponent is the status of a Gen2 component switching or
+// metering a load (e.g. switch:0, pm1:0, em:0), as returned by the
+// Shelly.GetStatus RPC method.
+type Gen2LoadComponent struct {
+	Output        *bool    `json:"output"`
+	APower        *float64 `json:"apower"`
+	ActPower      *float64 `json:"act_power"`
+	TotalActPower *float64 `json:"total_act_power"`
+}
+
+// gen2LoadComponents are the Gen2 component types reporting the state
+// of an output or the power drawn through it.
+var gen2LoadComponents = []string{"switch:", "cover:", "light:", "pm1:", "em:", "em1:"}
+
+// fetchRawStatus retrieves the status of a device via the /status
+// endpoint (or the Shelly.GetStatus RPC method on Gen2 devices) as
+// returned by the device.
+func fetchRawStatus(client *http.Client, device *Device) ([]byte, error) {
+	path := "/status"
+	if device.IsGen2() {
+		path = "/rpc/Shelly.GetStatus"
+	}
+
+	response, err := client.Get(device.GetBaseURL() + path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %v fetching status", response.StatusCode)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// statusOnce reads the status of a device at most once, so that the
+// checks made right before upgrading it (the load and the skip rules)
+// share a single request.
+type statusOnce struct {
+	client *http.Client
+	device *Device
+	once   sync.Once
+	data   []byte
+	err    error
+}
+
+func newStatusOnce(client *http.Client, device *Device) *statusOnce {
+	return &statusOnce{client: client, device: device}
+}
+
+// Read returns the status of the device, fetching it on the first call.
+func (s *statusOnce) Read() ([]byte, error) {
+	s.once.Do(func() {
+		s.data, s.err = fetchRawStatus(s.client, s.device)
+	})
+
+	return s.data, s.err
+}
+
+// parseDeviceLoad reads the state of the outputs and the power drawn
+// through a device from its raw status.
+func parseDeviceLoad(device *Device, data []byte) (DeviceLoad, error) {
+	var load DeviceLoad
+
+	if !device.IsGen2() {
+		var status Gen1LoadStatus
+		err := json.Unmarshal(data, &status)
+		if err != nil {
+			return load, fmt.Errorf("error parsing JSON: %v", err)
+		}
+
+		for _, relay := range status.Relays {
+			if relay.IsOn {
+				load.Outputs++
+			}
+		}
+
+		for _, meter := range status.Meters {
+			load.Power += math.Abs(meter.Power)
+		}
+
+		for _, meter := range status.EMeters {
+			load.Power += math.Abs(meter.Power)
+		}
+
+		return load, nil
+	}
+
+	var status map[string]json.RawMessage
+	err := json.Unmarshal(data, &status)
+	if err != nil {
+		return load, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	for key, value := range status {
+		if !isGen2LoadComponent(key) {
+			continue
+		}
+
+		var component Gen2LoadComponent
+		err = json.Unmarshal(value, &component)
+		if err != nil {
+			return load, fmt.Errorf("error parsing JSON: %v", err)
+		}
+
+		if component.Output != nil && *component.Output {
+			load.Outputs++
+		}
+
+		for _, power := range []*float64{component.APower, component.ActPower, component.TotalActPower} {
+			if power != nil {
+				load.Power += math.Abs(*power)
+				break
+			}
+		}
+	}
+
+	return load, nil
+}
+
+func isGen2LoadComponent(key string) bool {
+	for _, prefix := range gen2LoadComponents {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validUnderLoad returns true if action is a known action on devices
+// under load.
+func validUnderLoad(action string) bool {
+	return action == underLoadSkip || action == underLoadWarn
+}
+
+// checkLoad defers a device to a later run, returning an error wrapping
+// ErrUnderLoad, if it is delivering more power than the maximum load of
+// the run or its load cannot be read. With the warn action, devices are
+// only warned about.
+func (o *OTAUpdater) checkLoad(device *Device, status *statusOnce) error {
+	if o.maxLoad <= 0 {
+		return nil
+	}
+
+	data, err := status.Read()
+
+	var load DeviceLoad
+	if err == nil {
+		load, err = parseDeviceLoad(device, data)
+	}
+
+	if err != nil {
+		if o.underLoadAction == underLoadWarn {
+			upgradeLog.Warnf("Unable to read the load of %v (%v), it may be interrupted while it restarts (%v)", device.ModelName(), device.IP, err)
+			return nil
+		}
+
+		upgradeLog.Warnf("Deferring %v (%v) to a later run as its load cannot be read (%v)", device.ModelName(), device.IP, err)
+
+		return fmt.Errorf("%w: unable to read its load (%v)", ErrUnderLoad, err)
+	}
+
+	upgradeLog.Debugf("%v (%v) has %v output(s) switched on drawing %.1f W", device.ModelName(), device.IP, load.Outputs, load.Power)
+
+	if load.Power <= o.maxLoad {
+		return nil
+	}
+
+	if o.underLoadAction == underLoadWarn {
+		upgradeLog.Warnf("%v (%v) is delivering %.0f W, its load will be interrupted while it restarts", device.ModelName(), device.IP, load.Power)
+		return nil
+	}
+
+	upgradeLog.Infof("Deferring %v (%v) to a later run as it is delivering %.0f W", device.ModelName(), device.IP, load.Power)
+
+	return fmt.Errorf("%w: delivering %.0f W, more than %v W", ErrUnderLoad, load.Power, o.maxLoad)
+}
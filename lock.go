@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Lock is a file-based lock preventing concurrent mota runs from
+// fighting over the firmware cache and triggering upgrades twice.
+type Lock struct {
+	path string
+}
+
+// AcquireLock creates the lock file at path, holding the current
+// process ID. A lock left behind by a process that is no longer
+// running is considered stale and taken over.
+func AcquireLock(path string) (*Lock, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%v\n", os.Getpid())
+			file.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+
+			return &Lock{path: path}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && processExists(pid) {
+			return nil, fmt.Errorf("another mota instance (pid %v) is already running; if that is not the case, remove %v or use --no-lock", pid, path)
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// Release removes the lock file. Releasing a nil lock is a no-op.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+
+	return os.Remove(l.path)
+}
+
+// defaultLockPath returns the lock file path on the OS cache or temp
+// directories.
+func defaultLockPath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	return filepath.Join(cacheDir, "com.github.ruimarinho.mota", "mota.lock")
+}
+
+// processExists returns true if a process with the given ID is running.
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	// On Windows, finding a process already requires it to exist.
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	err = process.Signal(syscall.Signal(0))
+
+	return err == nil || err == syscall.EPERM
+}
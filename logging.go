@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// levelFatal is the level of entries logged right before exiting, above
+// every level accepted by --log-level.
+const levelFatal = slog.LevelError + 4
+
+// log is the logger for everything outside of the subsystems.
+var log = &Logger{Logger: slog.New(&logHandler{level: rootLevel})}
+
+// Subsystems whose log level can be set on their own with --log-level
+// (e.g. --log-level=info,discovery=debug). Everything else logs via the
+// root logger.
+var (
+	discoveryLog = newSubsystemLogger("discovery")
+	apiLog       = newSubsystemLogger("api")
+	serverLog    = newSubsystemLogger("server")
+	upgradeLog   = newSubsystemLogger("upgrade")
+)
+
+var (
+	rootLevel        = new(slog.LevelVar)
+	subsystemLoggers = map[string]*slog.LevelVar{}
+	subsystemLevels  = map[string]slog.Level{}
+)
+
+// logOutput is where the handlers set by setupLogging and setupLogLevels
+// write entries to.
+var logOutput io.Writer = os.Stderr
+
+var (
+	logSink      slog.Handler = slog.NewTextHandler(logOutput, logHandlerOptions)
+	logSinkMutex sync.RWMutex
+)
+
+var (
+	exitHandlers      []func()
+	exitHandlersMutex sync.Mutex
+)
+
+// logHandlerOptions leaves filtering to the level of each logger and
+// names the fatal level in the text and json formats.
+var logHandlerOptions = &slog.HandlerOptions{
+	Level: slog.LevelDebug,
+	ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+		if attr.Key == slog.LevelKey && len(groups) == 0 && attr.Value.Any() == levelFatal {
+			attr.Value = slog.StringValue("FATAL")
+		}
+
+		return attr
+	},
+}
+
+// logLevels lists the levels accepted by --log-level.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// Logger is a slog.Logger with printf-style helpers, and Fatal methods
+// that exit after running the handlers registered with
+// registerExitHandler.
+type Logger struct {
+	*slog.Logger
+}
+
+// newSubsystemLogger returns a logger for a subsystem, whose entries are
+// tagged with its name. Subsystem loggers write to the same handler as
+// the root logger, at its level unless one is set for the subsystem.
+func newSubsystemLogger(name string) *Logger {
+	level := new(slog.LevelVar)
+	subsystemLoggers[name] = level
+
+	return &Logger{Logger: slog.New(&logHandler{level: level}).With("subsystem", name)}
+}
+
+// Debugf logs a formatted message at the debug level.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(slog.LevelDebug, format, args...)
+}
+
+// Infof logs a formatted message at the info level.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(slog.LevelInfo, format, args...)
+}
+
+// Warnf logs a formatted message at the warn level.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(slog.LevelWarn, format, args...)
+}
+
+// Errorf logs a formatted message at the error level.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(slog.LevelError, format, args...)
+}
+
+// Fatal logs its arguments and exits with exitError.
+func (l *Logger) Fatal(args ...interface{}) {
+	l.Log(context.Background(), levelFatal, fmt.Sprint(args...))
+	exit(exitError)
+}
+
+// Fatalf logs a formatted message and exits with exitError.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.Log(context.Background(), levelFatal, fmt.Sprintf(format, args...))
+	exit(exitError)
+}
+
+func (l *Logger) logf(level slog.Level, format string, args ...interface{}) {
+	if !l.Enabled(context.Background(), level) {
+		return
+	}
+
+	l.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+// registerExitHandler adds a function to be run before exiting due to a
+// fatal error, such as releasing the lock.
+func registerExitHandler(handler func()) {
+	exitHandlersMutex.Lock()
+	defer exitHandlersMutex.Unlock()
+
+	exitHandlers = append(exitHandlers, handler)
+}
+
+// exit runs the registered exit handlers and exits with code.
+func exit(code int) {
+	exitHandlersMutex.Lock()
+	handlers := exitHandlers
+	exitHandlersMutex.Unlock()
+
+	for _, handler := range handlers {
+		handler()
+	}
+
+	os.Exit(code)
+}
+
+// setLogHandler sets the handler every logger writes to.
+func setLogHandler(handler slog.Handler) {
+	logSinkMutex.Lock()
+	defer logSinkMutex.Unlock()
+
+	logSink = handler
+}
+
+func currentLogHandler() slog.Handler {
+	logSinkMutex.RLock()
+	defer logSinkMutex.RUnlock()
+
+	return logSink
+}
+
+// logHandler filters entries by the level of a logger and passes them
+// on to the current handler set with setLogHandler, so that loggers
+// created at startup follow later changes of format and output.
+type logHandler struct {
+	level *slog.LevelVar
+	with  []func(slog.Handler) slog.Handler
+}
+
+// Enabled implements slog.Handler.
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle implements slog.Handler.
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := currentLogHandler()
+	for _, with := range h.with {
+		handler = with(handler)
+	}
+
+	return handler.Handle(ctx, record)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.chain(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+// WithGroup implements slog.Handler.
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.chain(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *logHandler) chain(with func(slog.Handler) slog.Handler) slog.Handler {
+	chained := make([]func(slog.Handler) slog.Handler, len(h.with), len(h.with)+1)
+	copy(chained, h.with)
+
+	return &logHandler{level: h.level, with: append(chained, with)}
+}
+
+// messageHandler is a slog.Handler that only writes the level and
+// message of each entry, for outputs that add their own context, such
+// as the console, the systemd journal and the Windows event log.
+type messageHandler func(level slog.Level, message string) error
+
+// Enabled implements slog.Handler.
+func (h messageHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle implements slog.Handler.
+func (h messageHandler) Handle(_ context.Context, record slog.Record) error {
+	return h(record.Level, record.Message)
+}
+
+// WithAttrs implements slog.Handler.
+func (h messageHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+// WithGroup implements slog.Handler.
+func (h messageHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// parseLogLevels parses a --log-level specification: an optional level
+// for every subsystem followed by levels for specific subsystems, comma
+// separated (e.g. warn,discovery=debug,api=error).
+func parseLogLevels(spec string) (*slog.Level, map[string]slog.Level, error) {
+	var level *slog.Level
+	levels := map[string]slog.Level{}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		subsystem := ""
+		if index := strings.Index(part, "="); index >= 0 {
+			subsystem, part = part[:index], part[index+1:]
+			if _, ok := subsystemLoggers[subsystem]; !ok {
+				return nil, nil, fmt.Errorf("unknown subsystem %q, must be one of %v", subsystem, strings.Join(subsystemNames(), ", "))
+			}
+		}
+
+		parsed, err := parseLogLevel(part)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if subsystem == "" {
+			level = &parsed
+		} else {
+			levels[subsystem] = parsed
+		}
+	}
+
+	return level, levels, nil
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	for _, known := range logLevels {
+		if name == known {
+			return level, level.UnmarshalText([]byte(name))
+		}
+	}
+
+	return level, fmt.Errorf("invalid log level %q, must be one of %v", name, strings.Join(logLevels, ", "))
+}
+
+func subsystemNames() []string {
+	var names []string
+	for name := range subsystemLoggers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// setupLogLevels applies the --log-level and --log-format flags on top
+// of the level and format set by setupLogging. The text and json
+// formats log every entry with its time and fields (such as the
+// subsystem), instead of plain messages.
+func setupLogLevels(spec string, format string) error {
+	level, levels, err := parseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "":
+	case "text":
+		setLogHandler(slog.NewTextHandler(logOutput, logHandlerOptions))
+	case "json":
+		setLogHandler(slog.NewJSONHandler(logOutput, logHandlerOptions))
+	default:
+		return fmt.Errorf("invalid log format %q, must be one of text, json", format)
+	}
+
+	if level != nil {
+		rootLevel.Set(*level)
+	}
+
+	subsystemLevels = levels
+	syncSubsystemLevels()
+
+	return nil
+}
+
+// syncSubsystemLevels sets the level of every subsystem logger to the
+// one given for it, or to the level of the root logger.
+func syncSubsystemLevels() {
+	for name, logger := range subsystemLoggers {
+		level, ok := subsystemLevels[name]
+		if !ok {
+			level = rootLevel.Level()
+		}
+
+		logger.Set(level)
+	}
+}
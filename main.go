@@ -1,11 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -14,26 +22,159 @@ var (
 	date    = "unknown"
 )
 
+// Flags of the upgrade command, which are shared with the daemon
+// command. They are registered by newUpgradeFlagSet.
 var (
-	beta        = flag.Bool("beta", false, "Use beta firmwares if available")
-	domain      = flag.String("domain", "local", "Set the search domain for the local network.")
-	force       = flag.BoolP("force", "f", false, "Force upgrades without asking for confirmation")
-	hosts       = flag.StringSlice("host", []string{}, "Use host/IP address(es) instead of device discovery (can be specified multiple times or be comma-separated)")
-	httpPort    = flag.IntP("http-port", "p", 0, "HTTP port to listen for OTA requests. If not specified, a random port is chosen.")
-	showVersion = flag.BoolP("version", "v", false, "Show version information")
-	verbose     = flag.Bool("verbose", false, "Enable verbose mode.")
-	waitTime    = flag.IntP("wait", "w", 60, "Duration in [s] to run discovery.")
+	auditLog            *string
+	beta                *bool
+	ble                 *bool
+	concurrency         *int
+	configDiff          *bool
+	configFile          *string
+	deviceDeadline      *time.Duration
+	deviceTimeout       *time.Duration
+	deviceUpdateServers *map[string]string
+	downloadDir         *string
+	domains             *[]string
+	earlyExit           *bool
+	expect              *int
+	failuresFile        *string
+	force               *bool
+	health              *bool
+	hosts               *[]string
+	hostsFile           *string
+	httpPort            *int
+	interfaces          *[]string
+	listenAddresses     *[]net.IP
+	logFormat           *string
+	logLevel            *string
+	maxLoad             *float64
+	noDownload          *bool
+	noLock              *bool
+	noProbeCache        *bool
+	openDocs            *bool
+	order               *string
+	otaRetries          *int
+	otaTimeout          *time.Duration
+	otlpEndpoint        *string
+	profile             *string
+	progressFormat      *string
+	quiet               *bool
+	readOnly            *bool
+	resetUpdateServer   *string
+	restart             *bool
+	resume              *bool
+	setPassword         *string
+	showVersion         *bool
+	soak                *time.Duration
+	stage               *string
+	stream              *bool
+	syncToStable        *bool
+	underLoad           *string
+	updateServer        *string
+	verbose             *bool
+	verifyTimeout       *time.Duration
+	via                 *string
+	waitTime            *int
 )
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "mirror" {
+		runMirror(os.Args[2:])
+		return
+	}
 
-	// Only log the warning severity or above when verbose mode is disabled.
-	if *verbose {
-		log.SetFormatter(&log.TextFormatter{DisableColors: true})
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		runDaemon(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "controller" {
+		runController(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		runVersion(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		runSelfUpdate(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "auth" {
+		runAuth(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "apply" {
+		runApply(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "provision" {
+		runProvision(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		runHistory(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		runCheck(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "devices" {
+		runDevices(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "note" {
+		runNote(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "stepping-stone" {
+		runSteppingStone(os.Args[2:])
+		return
+	}
+
+	flags := newUpgradeFlagSet("mota")
+	flags.Usage = usage("mota", flags, upgradeFlagGroups)
+	flags.Parse(os.Args[1:])
+
+	err := validateFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	if *progressFormat == "json" {
+		console = NewConsole(os.Stderr)
+		progress = NewProgress(os.Stdout)
+	}
+
+	setupLogging(*verbose, *quiet)
+
+	err = setupLogLevels(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
 	}
 
 	if *showVersion {
@@ -41,27 +182,1436 @@ func main() {
 		os.Exit(0)
 	}
 
-	otaUpdater, err := NewOTAUpdater(
+	lock := acquireLock()
+
+	config, _ := setupConfig()
+
+	tracer := newTracer()
+
+	otaUpdater, err := NewOTAUpdater(append(updaterOptions(config), WithTracer(tracer))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tracer.StartRun("run")
+	registerExitHandler(func() {
+		endTrace(tracer, errors.New("run failed"))
+	})
+
+	bleDevices := scanBLEDevices(*ble, time.Duration(*waitTime)*time.Second)
+
+	if *stream {
+		err = otaUpdater.StreamUpgrade()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		err = otaUpdater.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		devices, err := otaUpdater.Devices()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		console.PrintDevices(devices)
+		console.PrintBLEDevices(<-bleDevices)
+		console.PrintChanges(devices)
+
+		err = otaUpdater.Upgrade()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *stream {
+		console.PrintBLEDevices(<-bleDevices)
+	}
+
+	// Devices that have just been asked to upgrade may still be
+	// downloading their firmware from the local OTA server.
+	otaUpdater.WaitForDownloads()
+
+	err = otaUpdater.SaveAccessLog()
+	if err != nil {
+		log.Errorf("Unable to save the OTA server access log (%v)", err)
+	}
+
+	err = otaUpdater.Close()
+	if err != nil {
+		log.Errorf("Unable to stop the OTA server (%v)", err)
+	}
+
+	securePasswords(&otaUpdater, *setPassword)
+
+	console.PrintSummary(otaUpdater.SkippedDevices())
+	console.PrintFailedModels(otaUpdater.api.FailedModels())
+
+	// Failed devices are also listed as skipped in the summary.
+	failed := len(otaUpdater.FailedDevices())
+	progress.RunSummary(len(otaUpdater.UpgradedDevices()), failed, len(otaUpdater.SkippedDevices())-failed)
+
+	log.Infof("Done!")
+
+	endTrace(tracer, nil)
+	lock.Release()
+	os.Exit(exitCode(&otaUpdater))
+}
+
+// newUpgradeFlagSet returns a flag set with the flags of the upgrade
+// command, grouped in the help output.
+func newUpgradeFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+
+	auditLog = flags.String("audit-log", "", "Append every decision (devices considered, policies applied, responses to prompts and actions taken) to this file as JSON lines.")
+	beta = flags.Bool("beta", false, "Use beta firmwares if available")
+	ble = flags.Bool("ble", false, "Also scan for Shelly BLU devices and devices not yet on Wi-Fi over Bluetooth during discovery (not yet supported by any build).")
+	concurrency = flags.Int("concurrency", 32, "Maximum number of devices to fetch settings from at the same time.")
+	configFile = flags.String("config", "", "Path to the configuration file (default \"~/.mota.yml\")")
+	configDiff = flags.Bool("config-diff", false, "Print the settings changed or lost by each upgrade, comparing the configuration of devices before upgrading them and once verified.")
+	deviceDeadline = flags.Duration("device-deadline", 0, "Total time budget to upgrade and verify each device, after which it is reported as timed out (0 disables the budget).")
+	deviceTimeout = flags.Duration("device-timeout", 5*time.Second, "HTTP timeout when fetching settings from each device.")
+	deviceUpdateServers = flags.StringToString("device-update-server", map[string]string{}, "Use a custom update server base URL for a specific host/IP address (e.g. 192.168.1.10=http://mirror.lan:8080)")
+	downloadDir = flags.String("download-dir", "", "Directory to store downloaded firmware files (default OS cache directory)")
+	domains = flags.StringSlice("domain", []string{"local"}, "Set the search domain(s) browsed concurrently (can be specified multiple times or be comma-separated). Domains other than local are browsed via unicast DNS-SD.")
+	earlyExit = flags.Bool("early-exit", false, "Stop discovery as soon as every device in the inventory has been found.")
+	expect = flags.Int("expect", 0, "Stop discovery as soon as this number of devices has been found (defaults to the number of devices in the inventory).")
+	failuresFile = flags.String("failures-file", "", "Write devices that did not come back online after upgrading to a file")
+	force = flags.BoolP("force", "f", false, "Force upgrades without asking for confirmation")
+	health = flags.Bool("health", false, "Fetch the WiFi network and signal, uptime and free memory of each device during discovery.")
+	hosts = flags.StringSlice("host", []string{}, "Use host/IP address(es) instead of device discovery (can be specified multiple times or be comma-separated), including ranges (e.g. 192.168.1.10-40) and hostname globs (e.g. shelly*.lan)")
+	hostsFile = flags.String("hosts-file", "", "Read hosts to use instead of device discovery from a file (or stdin if -), one per line, optionally followed by the username:password and expected model of the device")
+	httpPort = flags.IntP("http-port", "p", 0, "HTTP port to listen for OTA requests. If not specified, a random port is chosen.")
+	interfaces = flags.StringSlice("interface", []string{}, "Browse for devices on these network interface(s) (e.g. eth0, can be specified multiple times or be comma-separated) instead of on every interface supporting multicast.")
+	listenAddresses = flags.IPSlice("listen", []net.IP{}, "Local address(es) to serve firmware on (can be specified multiple times or be comma-separated). By default, every interface is used and each device is given the address of the interface that reaches it.")
+	logFormat = flags.String("log-format", "", "Log every entry with its time and fields in this format (text or json) instead of plain messages.")
+	logLevel = flags.String("log-level", "", "Log at this level (debug, info, warn or error), overriding --verbose and --quiet, optionally per subsystem (discovery, api, server or upgrade), e.g. warn,discovery=debug.")
+	noProbeCache = flags.Bool("no-probe-cache", false, "Probe every device instead of reusing the results cached by previous runs.")
+	noDownload = flags.Bool("no-download", false, "Pass the URL firmware is published at (e.g. the Shelly CDN) to devices instead of downloading it and serving it from the local OTA server, for devices with better internet access than this host.")
+	noLock = flags.Bool("no-lock", false, "Allow running concurrently with other mota instances.")
+	openDocs = flags.Bool("open-docs", false, "Offer to open the manual upgrade instructions of devices rejecting over-the-air upgrades in the browser.")
+	maxLoad = flags.Float64("max-load", 0, "Defer devices delivering more than this power in watts (e.g. an EV charger charging) to a later run, reading the state of their outputs and power meters before upgrading them (0 disables the check).")
+	order = flags.String("order", "", "Order upgrades by model, age (furthest behind first), group or priority (as given in the configuration file) instead of by IP address.")
+	otaRetries = flags.Int("ota-retries", 2, "Number of times the OTA request is made again to Gen1 devices that do not start updating, with increasing delays.")
+	otaTimeout = flags.Duration("ota-timeout", 2*time.Minute, "Duration to wait for a device to start updating after requesting an upgrade.")
+	profile = flags.String("profile", "", "Use a named profile of the configuration file, with its own credentials, inventory and policies, and its own history, probe cache and run state.")
+	otlpEndpoint = flags.String("otlp-endpoint", "", "Export traces of each run to an OpenTelemetry collector via OTLP/HTTP (e.g. http://localhost:4318).")
+	progressFormat = flags.String("progress", "", "Write machine-readable progress events to stdout in this format (json, one event per line), moving all other output to stderr.")
+	quiet = flags.BoolP("quiet", "q", false, "Suppress all output except errors.")
+	readOnly = flags.Bool("read-only", false, "Guarantee that no request changing the state of devices (upgrades, restarts, settings) is made, only reporting upgrades available.")
+	resetUpdateServer = flags.String("reset-update-server", "", "Point Gen2 devices whose update server has been overridden back at the Shelly servers (default) or at this mirror URL (after confirmation, unless forced).")
+	restart = flags.Bool("restart", false, "Restart Gen2 devices pending a restart to apply a previous upgrade (after confirmation, unless forced) before evaluating them for upgrades.")
+	resume = flags.Bool("resume", false, "Continue a run interrupted by a crash or Ctrl-C, skipping the devices it already upgraded or declined.")
+	setPassword = flags.String("set-password", "", "Set this admin password on devices found with authentication disabled (after confirmation, unless forced), recording it in the netrc file.")
+	showVersion = flags.BoolP("version", "v", false, "Show version information")
+	soak = flags.Duration("soak", 0, "Keep polling the status of upgraded devices for this duration after upgrades, reporting the ones that restart or become unreachable as failed (0 disables the soak test).")
+	stage = flags.String("stage", "", "Make Gen2 devices update directly from Shelly servers using a release stage (stable or beta)")
+	stream = flags.Bool("stream", false, "Prompt for upgrades as soon as devices are discovered instead of after discovery finishes.")
+	syncToStable = flags.Bool("sync-to-stable", false, "Offer to downgrade devices running a firmware newer than the stable one (e.g. a beta installed previously) instead of reporting them as ahead of stable.")
+	underLoad = flags.String("under-load", "skip", "Skip devices above --max-load, or only warn about them with warn.")
+	updateServer = flags.String("update-server", "", "Use a custom update server base URL instead of the local OTA server")
+	verbose = flags.Bool("verbose", false, "Enable verbose mode.")
+	verifyTimeout = flags.Duration("verify-timeout", 5*time.Minute, "Duration to wait for upgraded devices to come back online with the new firmware (0 disables verification).")
+	via = flags.String("via", "", "Reach devices at a remote site through an SSH jump host (e.g. ssh://user@gateway) or a SOCKS5 proxy (e.g. socks5://gateway:1080)")
+	waitTime = flags.IntP("wait", "w", 60, "Duration in [s] to run discovery.")
+
+	return flags
+}
+
+// acquireLock prevents concurrent runs unless disabled via --no-lock.
+// The lock is also released when exiting due to a fatal error.
+func acquireLock() *Lock {
+	if *noLock {
+		return nil
+	}
+
+	lock, err := AcquireLock(defaultLockPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	registerExitHandler(func() {
+		lock.Release()
+	})
+
+	return lock
+}
+
+// openTunnel connects to a remote site, routing every request made to
+// devices through it. The tunnel is also closed when exiting due to a
+// fatal error.
+func openTunnel(via string) *Tunnel {
+	tunnel, err := OpenTunnel(via)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Connected to remote site via %v", tunnel)
+
+	deviceDial = tunnel.Dial
+
+	registerExitHandler(func() {
+		tunnel.Close()
+	})
+
+	return tunnel
+}
+
+// newTracer returns a tracer exporting traces to the OpenTelemetry
+// collector given with --otlp-endpoint, or nil if tracing is disabled.
+func newTracer() *Tracer {
+	if *otlpEndpoint == "" {
+		return nil
+	}
+
+	provider, err := NewOTLPTracerProvider(*otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return NewTracer(provider)
+}
+
+// endTrace ends the trace of the current run, if tracing is enabled,
+// and exports it.
+func endTrace(tracer *Tracer, err error) {
+	err = tracer.EndRun(err)
+	if err != nil {
+		log.Warn(err.Error())
+	}
+}
+
+// Exit codes returned by mota, so that scripts can branch on the
+// result of a run. Errors exit with exitError via log.Fatal.
+const (
+	exitNothingToDo       = 0
+	exitError             = 1
+	exitUpgradesPerformed = 2
+	exitUpgradesSkipped   = 3
+)
+
+// scanBLEDevices scans for Shelly devices over Bluetooth in the
+// background alongside discovery, if enabled. Failures are not fatal as
+// devices on Wi-Fi are still discovered.
+func scanBLEDevices(enabled bool, duration time.Duration) <-chan []BLEDevice {
+	devices := make(chan []BLEDevice, 1)
+
+	if !enabled {
+		devices <- nil
+		return devices
+	}
+
+	go func() {
+		found, err := ScanBLEDevices(duration)
+		if err != nil {
+			log.Errorf("Unable to scan for devices over Bluetooth (%v)", err)
+		}
+
+		devices <- found
+	}()
+
+	return devices
+}
+
+// securePasswords reports the devices found with authentication
+// disabled and, if a password is given, sets it on them.
+func securePasswords(o *OTAUpdater, password string) {
+	devices, err := o.Devices()
+	if err != nil {
+		return
+	}
+
+	unauthenticated := map[string]*Device{}
+	for key, device := range devices {
+		if device.AuthDisabled {
+			unauthenticated[key] = device
+		}
+	}
+
+	if password == "" || len(unauthenticated) == 0 {
+		console.PrintUnauthenticated(unauthenticated)
+		return
+	}
+
+	_, _, err = o.RotatePasswords(unauthenticated, nil, password)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	console.PrintUnauthenticated(unauthenticated)
+}
+
+// exitCode returns the exit code for a completed run: an error if any
+// device failed to upgrade, otherwise whether upgrades were performed,
+// skipped (declined or deferred) or not needed at all.
+func exitCode(o *OTAUpdater) int {
+	if len(o.FailedDevices()) > 0 {
+		return exitError
+	}
+
+	if len(o.UpgradedDevices()) > 0 {
+		return exitUpgradesPerformed
+	}
+
+	devices, err := o.Devices()
+	if err != nil {
+		return exitError
+	}
+
+	for _, device := range devices {
+		if device.CurrentFWVersion != device.NewFWVersion {
+			return exitUpgradesSkipped
+		}
+	}
+
+	return exitNothingToDo
+}
+
+// setupConfig reads the configuration file and sets the custom
+// templates used for the console output, which are also returned.
+func setupConfig() (Config, *Templates) {
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *profile != "" {
+		config, err = config.Profile(*profile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		activeProfile = *profile
+		log.Debugf("Using profile %v, keeping its state in %v", activeProfile, stateDir())
+	}
+
+	if config.Netrc != "" {
+		netrcFile = config.Netrc
+	}
+
+	auditPath := config.AuditLog
+	if *auditLog != "" {
+		auditPath = *auditLog
+	}
+
+	if auditPath != "" {
+		audit, err = OpenAuditLog(auditPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	templates, err := ParseTemplates(config.Templates)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	console.SetTemplates(templates)
+
+	return config, templates
+}
+
+// updaterOptions returns the OTAUpdater options set via flags and the
+// configuration file.
+func updaterOptions(config Config) []OTAUpdaterOption {
+	if *readOnly {
+		readOnlyMode = true
+	}
+
+	if config.Registry != "" {
+		refreshRegistry(config.Registry)
+	}
+
+	if config.Changelog != "" {
+		refreshChangelog(config.Changelog)
+	}
+
+	options := []OTAUpdaterOption{
+		WithAPIClient(newAPIClient(config)),
 		WithBetaVersions(*beta),
-		WithDomain(*domain),
+		WithCanaries(config.Canaries),
+		WithConcurrency(*concurrency),
+		WithConfigDiff(*configDiff),
+		WithCritical(config.Critical),
+		WithDeviceDeadline(*deviceDeadline),
+		WithDeviceStatus(*health),
+		WithDeviceTimeout(*deviceTimeout),
+		WithDeviceUpdateServers(*deviceUpdateServers),
+		WithDomains(*domains),
+		WithEarlyExit(*earlyExit),
+		WithExpectedDevices(*expect),
+		WithFailuresFile(*failuresFile),
 		WithForcedUpgrades(*force),
+		WithGroups(config.Groups),
 		WithHosts(*hosts),
+		WithInterfaces(*interfaces),
+		WithInventory(config.Inventory),
+		WithOpenDocs(*openDocs),
+		WithMaxLoad(*maxLoad),
+		WithNoDownload(*noDownload),
+		WithOrder(*order),
+		WithOTARetries(*otaRetries),
+		WithOTATimeout(*otaTimeout),
+		WithPriorities(config.Priorities),
+		WithResetUpdateServer(*resetUpdateServer),
+		WithRestarts(*restart),
+		WithResume(*resume),
+		WithRollout(config.Rollout),
+		WithSkipRules(config.SkipIf),
+		WithSoak(*soak),
+		WithUnderLoad(*underLoad),
 		WithServerPort(*httpPort),
+		WithListenAddresses(*listenAddresses),
+		WithStage(*stage),
+		WithStreaming(*stream),
+		WithSyncToStable(*syncToStable),
+		WithUpdateServer(*updateServer),
+		WithVerifyTimeout(*verifyTimeout),
 		WithWaitTimeInSeconds(*waitTime),
+	}
+
+	if *downloadDir != "" {
+		options = append(options, WithDownloadDir(*downloadDir))
+	}
+
+	if *noProbeCache {
+		options = append(options, WithProbeCache(""))
+	}
+
+	if config.Cloud.Server != "" && config.Cloud.AuthKey != "" {
+		options = append(options, WithCloud(NewCloudClient(WithCloudServer(config.Cloud.Server), WithCloudAuthKey(config.Cloud.AuthKey))))
+	}
+
+	if *hostsFile != "" {
+		entries, err := readHostsFile(*hostsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		options = append(options, WithHostEntries(entries))
+	}
+
+	if *via != "" {
+		options = append(options, WithTunnel(openTunnel(*via)))
+	}
+
+	if config.CanarySoak != "" {
+		canarySoak, err := time.ParseDuration(config.CanarySoak)
+		if err != nil {
+			log.Fatalf("Invalid canary soak duration %q (%v)", config.CanarySoak, err)
+		}
+		options = append(options, WithCanarySoak(canarySoak))
+	}
+
+	return options
+}
+
+// runDaemon runs mota continuously, discovering devices periodically
+// and upgrading them if forced upgrades are enabled. The install and
+// uninstall subcommands register the daemon as a systemd service with
+// the given flags.
+func runDaemon(args []string) {
+	command := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := newUpgradeFlagSet("daemon")
+	grpcAddress := flags.String("grpc-address", "", "Address to serve the control operations over gRPC on (e.g. :8083), if built with gRPC support.")
+	interval := flags.Duration("interval", time.Hour, "Duration between discovery runs.")
+	missingAfter := flags.Duration("missing-after", 15*time.Minute, "Alert when an upgraded device has not been rediscovered after this duration.")
+	snapshotInterval := flags.Duration("snapshot-interval", 24*time.Hour, "Duration between snapshots of the firmware versions of the devices found, recorded in the history for mota history (0 disables snapshots).")
+	statusAddress := flags.String("status-address", "", "Address to serve the /healthz and /status endpoints on (e.g. :8081).")
+	webhook := flags.String("webhook", "", "URL to POST alerts to as JSON.")
+	flags.Usage = usage("mota daemon [install|uninstall|run]", flags, append([]flagGroup{daemonFlagGroup}, upgradeFlagGroups...))
+	flags.Parse(args)
+
+	// As a Home Assistant add-on, flags are also read from the add-on
+	// options and the daemon endpoints are served through ingress.
+	homeAssistant := runningAsAddon()
+	if homeAssistant != nil {
+		err := applyAddonOptions(flags, addonOptionsPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+
+		if *statusAddress == "" {
+			*statusAddress = fmt.Sprintf(":%v", addonIngressPort)
+		}
+	}
+
+	err := validateFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	setupLogging(*verbose, *quiet)
+
+	err = setupLogLevels(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	switch command {
+	case "install":
+		err = installService(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "uninstall":
+		err = uninstallService()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "run":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown daemon command %q, must be one of install, uninstall or run\n", command)
+		os.Exit(exitError)
+	}
+
+	lock := acquireLock()
+	defer lock.Release()
+
+	config, templates := setupConfig()
+
+	tracer := newTracer()
+
+	options := append(updaterOptions(config), WithTracer(tracer))
+	if homeAssistant != nil && len(*listenAddresses) == 0 {
+		addresses, err := homeAssistant.ListenAddresses()
+		if err != nil {
+			log.Warnf("Unable to find the addresses of the Home Assistant host, serving firmware on every interface (%v)", err)
+		} else if len(addresses) > 0 {
+			log.Infof("Serving firmware on the Home Assistant host addresses %v", addresses)
+			options = append(options, WithListenAddresses(addresses))
+		}
+	}
+
+	daemon := NewDaemon(
+		WithDaemonTracer(tracer),
+		WithGRPCAddress(*grpcAddress),
+		WithHomeAssistant(homeAssistant),
+		WithInterval(*interval),
+		WithMissingAfter(*missingAfter),
+		WithSnapshotInterval(*snapshotInterval),
+		WithStatusAddress(*statusAddress),
+		WithUpdaterOptions(options...),
+		WithWebhook(*webhook),
+		WithWebhookTemplate(templates.Webhook),
 	)
+
+	err = runService(daemon.Run)
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	err = otaUpdater.Start()
+// runAgent runs mota on a remote site, reporting the devices found to a
+// controller and upgrading the ones it asks for.
+func runAgent(args []string) {
+	flags := newUpgradeFlagSet("agent")
+	controllerURL := flags.String("controller", "", "Base URL of the controller to report to (e.g. http://controller.example.com:8082).")
+	interval := flags.Duration("interval", time.Minute, "Duration between reports to the controller.")
+	site := flags.String("site", "", "Name of the site reported to the controller (default hostname).")
+	token := flags.String("token", "", "Bearer token to authenticate with the controller.")
+	flags.Usage = usage("mota agent", flags, append([]flagGroup{agentFlagGroup}, upgradeFlagGroups...))
+	flags.Parse(args)
+
+	err := validateFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	setupLogging(*verbose, *quiet)
+
+	err = setupLogLevels(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	if *site == "" {
+		*site, _ = os.Hostname()
+	}
+
+	lock := acquireLock()
+	defer lock.Release()
+
+	config, _ := setupConfig()
+
+	tracer := newTracer()
+
+	agent, err := NewAgent(
+		WithAgentInterval(*interval),
+		WithAgentToken(*token),
+		WithAgentTracer(tracer),
+		WithAgentUpdaterOptions(append(updaterOptions(config), WithTracer(tracer))...),
+		WithControllerURL(*controllerURL),
+		WithSite(*site),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = otaUpdater.Upgrade()
+	agent.Run()
+}
+
+// runController runs mota as a controller aggregating the inventories
+// of agents running on remote sites.
+func runController(args []string) {
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	listen := flags.String("listen", ":8082", "Address to listen for agents and API requests.")
+	token := flags.String("token", "", "Bearer token required from agents and API requests.")
+	verbose := flags.Bool("verbose", false, "Enable verbose mode.")
+	flags.Parse(args)
+
+	setupLogging(*verbose, false)
+
+	controller := NewController(
+		WithControllerAddress(*listen),
+		WithControllerToken(*token),
+	)
+
+	err := controller.ListenAndServe()
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	log.Infof("Done!")
+// runVersion prints the version of mota and, with --check, whether a
+// newer release is available. Plain --version never goes online.
+func runVersion(args []string) {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	check := flags.Bool("check", false, "Also check whether a newer release is available, unless disabled in the configuration file.")
+	configFile := flags.String("config", "", "Path to the configuration file (default \"~/.mota.yml\")")
+	verbose := flags.Bool("verbose", false, "Enable verbose mode.")
+	flags.Parse(args)
+
+	setupLogging(*verbose, false)
+
+	fmt.Printf("mota %s (%s %s)\n", version, commit, date)
+
+	if *check {
+		checkForNewerRelease(*configFile)
+	}
+}
+
+// checkForNewerRelease prints the latest mota release if it is newer
+// than the running version, unless disabled in the configuration file.
+// Failures are only logged in verbose mode, as they do not affect the
+// version shown.
+func checkForNewerRelease(configFile string) {
+	config, err := loadConfig(configFile)
+	if err != nil || (config.UpdateCheck != nil && !*config.UpdateCheck) {
+		return
+	}
+
+	selfUpdater, err := NewSelfUpdater(WithSelfUpdaterTimeout(5 * time.Second))
+	if err == nil {
+		err = printNewerRelease(os.Stdout, selfUpdater)
+	}
+
+	if err != nil {
+		log.Debugf("Unable to check for a newer mota release (%v)", err)
+	}
+}
+
+// runSelfUpdate replaces the mota binary with the latest release.
+func runSelfUpdate(args []string) {
+	flags := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := flags.Bool("check", false, "Only check whether a newer release is available.")
+	verbose := flags.Bool("verbose", false, "Enable verbose mode.")
+	flags.Parse(args)
+
+	setupLogging(*verbose, false)
+
+	selfUpdater, err := NewSelfUpdater()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	release, available, err := selfUpdater.LatestRelease()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !available {
+		log.Infof("mota %v is up-to-date", version)
+		return
+	}
+
+	log.Infof("mota %v is available (running %v)", release.Version(), version)
+
+	if *check {
+		return
+	}
+
+	err = selfUpdater.Update(release)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Updated mota to %v", release.Version())
+}
+
+// runAuth sets or rotates the admin password of the devices found,
+// recording it in the netrc file.
+func runAuth(args []string) {
+	flags := newUpgradeFlagSet("auth")
+	identifiers := flags.StringSlice("device", []string{}, "Device(s) to set the password of, by IP address, hostname or MAC address (can be specified multiple times or be comma-separated). If not specified, every device found is selected.")
+	newPassword := flags.String("new-password", "", "Admin password to set on devices.")
+	flags.Usage = usage("mota auth rotate", flags, append([]flagGroup{authFlagGroup}, upgradeFlagGroups...))
+	flags.Parse(args)
+
+	err := validateFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	if flags.NArg() != 1 || flags.Arg(0) != "rotate" || *newPassword == "" {
+		flags.Usage()
+		os.Exit(exitError)
+	}
+
+	setupLogging(*verbose, *quiet)
+
+	err = setupLogLevels(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	lock := acquireLock()
+	defer lock.Release()
+
+	config, _ := setupConfig()
+
+	otaUpdater, err := NewOTAUpdater(updaterOptions(config)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	devices, err := otaUpdater.Devices()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rotated, failed, err := otaUpdater.RotatePasswords(devices, *identifiers, *newPassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Set the password of %v device(s), %v failed", len(rotated), len(failed))
+
+	if len(failed) > 0 {
+		lock.Release()
+		os.Exit(exitError)
+	}
+}
+
+// runCheck prints the firmware offered to each device found without
+// upgrading any of them, optionally cross-referenced with the update
+// each device sees itself.
+func runCheck(args []string) {
+	flags := newUpgradeFlagSet("check")
+	askDevice := flags.Bool("ask-device", false, "Also ask each device which update it sees (via /ota/check on Gen1 devices and Shelly.CheckForUpdate on Gen2 devices), highlighting the ones that differ from the firmware index.")
+	flags.Usage = usage("mota check", flags, append([]flagGroup{checkFlagGroup}, upgradeFlagGroups...))
+	flags.Parse(args)
+
+	err := validateFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	setupLogging(*verbose, *quiet)
+
+	err = setupLogLevels(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	config, _ := setupConfig()
+
+	otaUpdater, err := NewOTAUpdater(updaterOptions(config)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	devices, err := otaUpdater.Devices()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	checks, err := otaUpdater.CheckDevices(devices, *askDevice)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	console.PrintChecks(checks, *askDevice)
+}
+
+// runApply pushes the settings in the configuration file to the
+// devices found.
+func runApply(args []string) {
+	flags := newUpgradeFlagSet("apply")
+	flags.Usage = usage("mota apply", flags, upgradeFlagGroups)
+	flags.Parse(args)
+
+	err := validateFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	setupLogging(*verbose, *quiet)
+
+	err = setupLogLevels(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	lock := acquireLock()
+	defer lock.Release()
+
+	config, _ := setupConfig()
+
+	otaUpdater, err := NewOTAUpdater(updaterOptions(config)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	devices, err := otaUpdater.Devices()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	applied, failed, err := otaUpdater.ApplySettings(devices, config.Settings)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Applied settings to %v device(s), %v failed", len(applied), len(failed))
+
+	if len(failed) > 0 {
+		lock.Release()
+		os.Exit(exitError)
+	}
+}
+
+// runProvision brings factory-new devices in AP mode onto a Wi-Fi
+// network and, optionally, upgrades them once they have joined it.
+func runProvision(args []string) {
+	flags := newUpgradeFlagSet("provision")
+	password := flags.String("password", "", "Password of the Wi-Fi network to join devices to.")
+	ssid := flags.String("ssid", "", "SSID of the Wi-Fi network to join devices to.")
+	upgrade := flags.Bool("upgrade", false, "Upgrade devices as soon as they have joined the Wi-Fi network.")
+	flags.Usage = usage("mota provision", flags, append([]flagGroup{provisionFlagGroup}, upgradeFlagGroups...))
+	flags.Parse(args)
+
+	err := validateFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	if *ssid == "" {
+		fmt.Fprintln(os.Stderr, "--ssid is required")
+		os.Exit(exitError)
+	}
+
+	setupLogging(*verbose, *quiet)
+
+	err = setupLogLevels(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	lock := acquireLock()
+	defer lock.Release()
+
+	if *ble {
+		bleDevices, err := ScanBLEDevices(time.Duration(*waitTime) * time.Second)
+		if err != nil {
+			log.Errorf("Unable to scan for devices over Bluetooth (%v)", err)
+		}
+
+		if len(bleDevices) > 0 {
+			console.PrintBLEDevices(bleDevices)
+			log.Warn("Devices found over Bluetooth cannot be provisioned by mota yet, use the Shelly app to set up their Wi-Fi network")
+		}
+	}
+
+	devices, err := Provision(*ssid, *password, *deviceTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !*upgrade || len(devices) == 0 {
+		return
+	}
+
+	var macs []string
+	for _, device := range devices {
+		macs = append(macs, device.MAC)
+	}
+
+	config, _ := setupConfig()
+
+	otaUpdater, err := NewOTAUpdater(append(updaterOptions(config), WithInventory(macs), WithEarlyExit(true))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = otaUpdater.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	found, err := otaUpdater.Devices()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var selected []*Device
+	for _, device := range sortedDevices(found) {
+		for _, mac := range macs {
+			if device.Matches(mac) {
+				selected = append(selected, device)
+			}
+		}
+	}
+
+	err = otaUpdater.UpgradeDevices(selected)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	otaUpdater.WaitForDownloads()
+
+	err = otaUpdater.SaveAccessLog()
+	if err != nil {
+		log.Errorf("Unable to save the OTA server access log (%v)", err)
+	}
+
+	err = otaUpdater.Close()
+	if err != nil {
+		log.Errorf("Unable to stop the OTA server (%v)", err)
+	}
+
+	console.PrintSummary(otaUpdater.SkippedDevices())
+	console.PrintFailedModels(otaUpdater.api.FailedModels())
+}
+
+// runSteppingStone verifies a candidate stepping-stone image for a model
+// and prints its table entry, ready to be submitted.
+func runSteppingStone(args []string) {
+	flags := flag.NewFlagSet("stepping-stone", flag.ExitOnError)
+	registryURL := flags.String("registry", "", "URL of a remote device registry to merge with the built-in one.")
+	steppingVersion := flags.String("version", steppingStoneVersion, "Firmware version expected in the image.")
+	verbose := flags.Bool("verbose", false, "Enable verbose mode.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of mota stepping-stone:\n  mota stepping-stone verify <model> [<url>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 2 || flags.NArg() > 3 || flags.Arg(0) != "verify" {
+		flags.Usage()
+		os.Exit(exitError)
+	}
+
+	setupLogging(*verbose, false)
+
+	if *registryURL != "" {
+		refreshRegistry(*registryURL)
+	}
+
+	imageURL := flags.Arg(2)
+	if imageURL == "" {
+		var err error
+		imageURL, err = steppingStoneURL(NewAPIClient(), flags.Arg(1), *steppingVersion)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	steppingStone, err := verifySteppingStone(&http.Client{Timeout: 5 * time.Minute}, flags.Arg(1), imageURL, *steppingVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(steppingStone)
+}
+
+// runHistory prints the adoption of firmware versions over time, from
+// the snapshots recorded by the daemon, as a graph or as JSON.
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	historyPath := flags.String("history", "", "Path to the history file (default OS cache directory)")
+	model := flags.String("model", "", "Only include devices of this model or Gen2+ application.")
+	profileName := flags.String("profile", "", "Use the history of a configuration profile.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of mota history:\n  mota history graph|export")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (flags.Arg(0) != "graph" && flags.Arg(0) != "export") {
+		flags.Usage()
+		os.Exit(exitError)
+	}
+
+	activeProfile = *profileName
+	if *historyPath == "" {
+		*historyPath = defaultHistoryPath()
+	}
+
+	history, err := LoadHistory(*historyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	points := history.Adoption(*model)
+
+	if flags.Arg(0) == "export" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(points)
+		return
+	}
+
+	writeAdoptionGraph(os.Stdout, points)
+}
+
+// runConfig runs the subcommands managing the configuration file:
+// validate, init and show.
+func runConfig(args []string) {
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "validate":
+		runConfigValidate(args)
+	case "init":
+		runConfigInit(args)
+	case "show":
+		runConfigShow(args)
+	default:
+		fmt.Fprintln(os.Stderr, "Usage of mota config:\n  mota config validate|init|show")
+		os.Exit(exitError)
+	}
+}
+
+// resolveConfigPath returns the configuration file path given, or the
+// default one.
+func resolveConfigPath(path string) string {
+	if path != "" {
+		return path
+	}
+
+	path, err := configPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return path
+}
+
+// runConfigInit writes an example configuration file listing every
+// supported key with its default value.
+func runConfigInit(args []string) {
+	flags := flag.NewFlagSet("config init", flag.ExitOnError)
+	configFile := flags.String("config", "", "Path to write the configuration file to (default \"~/.mota.yml\")")
+	force := flags.BoolP("force", "f", false, "Overwrite the configuration file if it already exists.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of mota config init:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	path := resolveConfigPath(*configFile)
+
+	err := writeExampleConfig(path, *force)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	fmt.Printf("Wrote an example configuration to %v\n", path)
+}
+
+// runConfigShow prints the configuration file or, with --effective, the
+// configuration actually in use, merging the flags (and, as a Home
+// Assistant add-on, the environment variables and add-on options) with
+// the configuration file and the profile.
+func runConfigShow(args []string) {
+	flags := newUpgradeFlagSet("config show")
+	effective := flags.Bool("effective", false, "Print the configuration actually in use, merging flags, environment variables, the configuration file and the profile, with where each value was set.")
+	flags.Usage = usage("mota config show", flags, append([]flagGroup{configFlagGroup}, upgradeFlagGroups...))
+	flags.Parse(args)
+
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	if runningAsAddon() != nil {
+		err := applyAddonOptions(flags, addonOptionsPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+	}
+
+	path := resolveConfigPath(*configFile)
+
+	if !*effective {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Stdout.Write(data)
+		return
+	}
+
+	files := []effectiveFile{{Name: "config", Path: path}, {Name: "netrc"}}
+	switch {
+	case *configFile != "":
+		files[0].Source = "--config"
+	case os.Getenv("MOTA_CONFIG") != "":
+		files[0].Source = "MOTA_CONFIG"
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *profile != "" {
+		config, err = config.Profile(*profile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config.Profiles = nil
+	}
+
+	switch {
+	case config.Netrc != "":
+		netrcFile = config.Netrc
+		files[1].Source = "netrc in " + path
+	case os.Getenv("NETRC") != "":
+		files[1].Source = "NETRC"
+	}
+
+	files[1].Path, err = netrcPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	output, err := EffectiveConfig(files, flags, config, flagSources(flags, given))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Stdout.Write(output)
+}
+
+// runConfigValidate validates the configuration file (and a hosts file,
+// if given), reporting unknown keys, invalid values, missing credentials
+// and conflicting rules, and prints the effective configuration.
+func runConfigValidate(args []string) {
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configFile := flags.String("config", "", "Path to the configuration file (default \"~/.mota.yml\")")
+	hostsFile := flags.String("hosts-file", "", "Also validate this hosts file.")
+	profileName := flags.String("profile", "", "Print the effective configuration of a profile.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of mota config validate:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	path := resolveConfigPath(*configFile)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
+	problems, err := ValidateConfig(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+		os.Exit(exitError)
+	}
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+
+	if *hostsFile != "" {
+		entries, err := readHostsFile(*hostsFile)
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+
+		messages = append(messages, checkHostsFile(entries)...)
+	}
+
+	config, err := parseConfig(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *profileName != "" {
+		config, err = config.Profile(*profileName)
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+
+		config.Profiles = nil
+	}
+
+	effective, err := yaml.Marshal(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("# Effective configuration of %v\n%s", path, effective)
+
+	for _, message := range messages {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", path, message)
+	}
+
+	if len(messages) > 0 {
+		os.Exit(exitError)
+	}
+}
+
+// runDevices prints every device ever found by mota, as a table or as
+// JSON along with the addresses and firmware versions they had over
+// time.
+func runDevices(args []string) {
+	flags := flag.NewFlagSet("devices", flag.ExitOnError)
+	profileName := flags.String("profile", "", "Use the devices of a configuration profile.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of mota devices:\n  mota devices [export]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() > 1 || (flags.NArg() == 1 && flags.Arg(0) != "export") {
+		flags.Usage()
+		os.Exit(exitError)
+	}
+
+	activeProfile = *profileName
+
+	ledger, err := LoadLedger(defaultLedgerPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flags.Arg(0) == "export" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(ledger.Entries())
+		return
+	}
+
+	writeLedger(os.Stdout, ledger.Entries())
+}
+
+// runNote sets the note of a device ever found by mota (e.g. where it
+// is installed), shown along with it when listing devices. An empty
+// note clears it.
+func runNote(args []string) {
+	flags := flag.NewFlagSet("note", flag.ExitOnError)
+	profileName := flags.String("profile", "", "Use the devices of a configuration profile.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of mota note:\n  mota note <device> <note>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(exitError)
+	}
+
+	activeProfile = *profileName
+
+	ledger, err := LoadLedger(defaultLedgerPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	entry, err := ledger.Find(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	entry.Note = flags.Arg(1)
+
+	err = ledger.Save()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runMirror runs mota as a local firmware mirror.
+func runMirror(args []string) {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	advertise := flags.Bool("advertise", false, "Advertise the mirror and the firmware versions it serves via mDNS.")
+	beta := flags.Bool("beta", false, "Mirror beta firmwares if available")
+	configFile := flags.String("config", "", "Path to the configuration file (default \"~/.mota.yml\")")
+	downloadDir := flags.String("download-dir", "", "Directory to store mirrored firmware files (default OS cache directory)")
+	listen := flags.String("listen", ":8080", "Address to listen for firmware requests.")
+	models := flags.StringSlice("model", []string{}, "Model(s) or Gen2+ application(s) to mirror (can be specified multiple times or be comma-separated). If not specified, all Gen1 models are mirrored.")
+	verbose := flags.Bool("verbose", false, "Enable verbose mode.")
+	flags.Parse(args)
+
+	setupLogging(*verbose, false)
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := []MirrorOption{
+		WithListenAddress(*listen),
+		WithMirrorAdvertise(*advertise),
+		WithMirrorAPIClient(newAPIClient(config)),
+		WithMirrorBetas(*beta),
+		WithMirrorModels(*models),
+	}
+
+	if *downloadDir != "" {
+		options = append(options, WithMirrorDownloadDir(*downloadDir))
+	}
+
+	mirror, err := NewMirror(options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = mirror.ListenAndServe()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadConfig reads the configuration file at path, or at the default
+// location if no path is given.
+func loadConfig(path string) (Config, error) {
+	if path == "" {
+		defaultPath, err := configPath()
+		if err != nil {
+			return Config{}, nil
+		}
+		path = defaultPath
+	}
+
+	return LoadConfig(path)
+}
+
+// newAPIClient returns an APIClient that fetches firmware from the
+// configured upstream mota mirror, if any, or the Shelly Cloud.
+func newAPIClient(config Config) *APIClient {
+	options := []APIClientOption{
+		WithIndexCache(defaultIndexCachePath()),
+	}
+
+	if len(config.Blocklist) > 0 {
+		options = append(options, WithBlocklist(config.Blocklist))
+	}
+
+	if len(config.Pins) > 0 {
+		options = append(options, WithPinnedKeys(config.Pins))
+	}
+
+	if config.Upstream == "" {
+		return NewAPIClient(options...)
+	}
+
+	log.Infof("Using upstream mirror %v", config.Upstream)
+
+	upstream := strings.TrimSuffix(config.Upstream, "/")
+
+	return NewAPIClient(append(options, WithBaseURL(upstream), WithGen2BaseURL(upstream))...)
+}
+
+// refreshRegistry merges a remote device registry into the built-in
+// one. Failures are not fatal as the built-in registry still applies.
+func refreshRegistry(url string) {
+	log.Debugf("Refreshing device registry from %v", url)
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	err := registry.Refresh(client, url)
+	if err != nil {
+		log.Warnf("Unable to refresh device registry from %v (%v)", url, err)
+	}
+}
+
+// refreshChangelog replaces the built-in firmware changelog with a
+// remote manifest. Failures are not fatal as the built-in changelog
+// still applies.
+func refreshChangelog(url string) {
+	log.Debugf("Refreshing firmware changelog from %v", url)
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	err := changelog.Refresh(client, url)
+	if err != nil {
+		log.Warnf("Unable to refresh firmware changelog from %v (%v)", url, err)
+	}
+}
+
+// setupLogging configures the log level and format. Quiet mode only
+// logs errors and takes precedence over verbose mode.
+func setupLogging(verbose bool, quiet bool) {
+	// Only log the warning severity or above when verbose mode is disabled.
+	if verbose {
+		setLogHandler(slog.NewTextHandler(logOutput, logHandlerOptions))
+		rootLevel.Set(slog.LevelDebug)
+	} else {
+		setLogHandler(consoleHandler(console, logOutput))
+		rootLevel.Set(slog.LevelInfo)
+	}
+
+	// The journal adds its own timestamps and supports log priorities.
+	if underSystemd() {
+		setLogHandler(journalHandler(logOutput))
+	}
+
+	if quiet {
+		rootLevel.Set(slog.LevelError)
+	}
+
+	console.SetQuiet(quiet)
+	console.SetVerbose(verbose)
+
+	syncSubsystemLevels()
 }
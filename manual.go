@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+
+	"github.com/AlecAivazis/survey/v2"
+)
+
+// Documentation of over-the-air updates for each generation, used for
+// models without manual upgrade instructions in the registry.
+const (
+	gen1UpgradeDocsURL = "https://shelly-api-docs.shelly.cloud/gen1/#ota"
+	gen2UpgradeDocsURL = "https://shelly-api-docs.shelly.cloud/gen2/ComponentsAndServices/Shelly#shellyupdate"
+)
+
+// manualUpgradeURL returns the URL of the manual upgrade instructions
+// for the model of a device.
+func manualUpgradeURL(device *Device) string {
+	if entry, ok := registry.Lookup(device.Model); ok && entry.Docs != "" {
+		return entry.Docs
+	}
+
+	if device.IsGen2() {
+		return gen2UpgradeDocsURL
+	}
+
+	return gen1UpgradeDocsURL
+}
+
+// manualUpgrade points to the manual upgrade instructions of a device
+// that rejected an over-the-air upgrade and, if enabled and running
+// interactively, offers to open them in the browser.
+func (o *OTAUpdater) manualUpgrade(device *Device) {
+	docsURL := manualUpgradeURL(device)
+
+	log.Warnf("%v (%v) must be upgraded manually, see %v", device.ModelName(), device.IP, docsURL)
+
+	if !o.openDocs || o.force {
+		return
+	}
+
+	open := false
+	prompt := &survey.Confirm{
+		Message: fmt.Sprintf("Would you like to open the manual upgrade instructions for %v in your browser?", device.ModelName()),
+	}
+
+	err := survey.AskOne(prompt, &open)
+	if err != nil || !open {
+		return
+	}
+
+	err = openBrowser(docsURL)
+	if err != nil {
+		log.Errorf("Unable to open %v in the browser (%v)", docsURL, err)
+	}
+}
+
+// openBrowser opens a URL in the default browser.
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	}
+
+	return exec.Command("xdg-open", url).Start()
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Mirror is a local firmware mirror that pre-downloads firmware files
+// from the Shelly Cloud and serves them using the same API shape, so
+// that devices and other mota instances can update without internet.
+type Mirror struct {
+	advertise    bool
+	api          *APIClient
+	downloadDir  string
+	files        map[string]string
+	firmwares    map[string]Firmware
+	includeBetas bool
+	listen       string
+	mirrored     map[string]mirroredFile
+	models       []string
+	mutex        sync.RWMutex
+}
+
+// mirroredFile is a firmware file stored by the mirror, along with its
+// checksum.
+type mirroredFile struct {
+	filename string
+	checksum string
+}
+
+// MirrorOption is an option interface for Mirror.
+type MirrorOption func(*Mirror)
+
+// WithMirrorAPIClient is a Mirror option that allows overriding the
+// APIClient used to fetch firmware from upstream.
+func WithMirrorAPIClient(api *APIClient) MirrorOption {
+	return func(m *Mirror) {
+		m.api = api
+	}
+}
+
+// WithMirrorAdvertise is a Mirror option that advertises the mirror via
+// mDNS, along with the firmware versions it serves.
+func WithMirrorAdvertise(advertise bool) MirrorOption {
+	return func(m *Mirror) {
+		m.advertise = advertise
+	}
+}
+
+// WithMirrorBetas is a Mirror option that enables mirroring of beta
+// firmware files, if available.
+func WithMirrorBetas(includeBetas bool) MirrorOption {
+	return func(m *Mirror) {
+		m.includeBetas = includeBetas
+	}
+}
+
+// WithMirrorModels is a Mirror option that restricts the mirrored
+// firmware files to a list of models (or Gen2 application names).
+func WithMirrorModels(models []string) MirrorOption {
+	return func(m *Mirror) {
+		m.models = models
+	}
+}
+
+// WithMirrorDownloadDir is a Mirror option that sets the directory
+// where mirrored firmware files are stored.
+func WithMirrorDownloadDir(downloadDir string) MirrorOption {
+	return func(m *Mirror) {
+		m.downloadDir = downloadDir
+	}
+}
+
+// WithListenAddress is a Mirror option that sets the address the
+// mirror HTTP server listens on.
+func WithListenAddress(listen string) MirrorOption {
+	return func(m *Mirror) {
+		m.listen = listen
+	}
+}
+
+// NewMirror returns an instance of Mirror with the default options.
+// Firmware downloads are stored on the OS cache or temp directories.
+func NewMirror(options ...MirrorOption) (*Mirror, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	mirror := &Mirror{
+		api:         NewAPIClient(),
+		downloadDir: filepath.Join(cacheDir, "com.github.ruimarinho.mota", "mirror"),
+		files:       map[string]string{},
+		firmwares:   map[string]Firmware{},
+		listen:      ":8080",
+		mirrored:    map[string]mirroredFile{},
+	}
+
+	for _, option := range options {
+		option(mirror)
+	}
+
+	return mirror, nil
+}
+
+// Sync fetches the most recent firmware information and downloads
+// every firmware file that should be mirrored. Models that are not
+// part of the Gen1 firmware list are looked up as Gen2 applications.
+func (m *Mirror) Sync() error {
+	gen1Firmwares, err := m.api.FetchVersions()
+	if err != nil {
+		return err
+	}
+
+	models := m.models
+	if len(models) == 0 {
+		for model := range gen1Firmwares {
+			models = append(models, model)
+		}
+	} else {
+		models = make([]string, 0, len(m.models))
+		for _, model := range m.models {
+			if _, ok := gen1Firmwares[model]; !ok {
+				// Gen2 devices and newer may also be given by hardware
+				// model (e.g. S3SW-001X8EU for Mini1G3).
+				if app := registry.App(model); app != "" {
+					model = app
+				}
+
+				m.api.AddGen2App(model)
+			}
+
+			models = append(models, model)
+		}
+	}
+
+	firmwares, err := m.api.FetchVersions()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(m.downloadDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	for _, model := range models {
+		firmware, ok := firmwares[model]
+		if !ok || firmware.URL == "" {
+			log.Warnf("No firmware available upstream for model %v, skipping", model)
+			continue
+		}
+
+		mirrored := Firmware{Model: firmware.Model, Version: firmware.Version}
+
+		filename, checksum, err := m.download(model, firmware.Version, firmware.URL, firmware.SHA256)
+		if err != nil {
+			log.Errorf("Unable to mirror firmware for %v (%v)", model, err)
+			continue
+		}
+		mirrored.URL = filename
+		mirrored.SHA256 = checksum
+
+		if m.includeBetas && firmware.BetaURL != "" {
+			betaFilename, betaChecksum, err := m.download(model, firmware.BetaVersion, firmware.BetaURL, firmware.BetaSHA256)
+			if err != nil {
+				log.Errorf("Unable to mirror beta firmware for %v (%v)", model, err)
+			} else {
+				mirrored.BetaURL = betaFilename
+				mirrored.BetaVersion = firmware.BetaVersion
+				mirrored.BetaSHA256 = betaChecksum
+			}
+		}
+
+		m.mutex.Lock()
+		m.firmwares[model] = mirrored
+		m.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// download stores a remote firmware file on the mirror directory and
+// returns its filename and SHA-256 checksum. If the upstream publishes
+// a checksum, the downloaded file is verified against it. Firmware
+// shared by several models is only stored once.
+func (m *Mirror) download(model string, version string, url string, expectedChecksum string) (string, string, error) {
+	m.mutex.RLock()
+	shared, ok := m.mirrored[url]
+	m.mutex.RUnlock()
+
+	if ok {
+		log.Debugf("Firmware %v for %v is already mirrored as %v", version, model, shared.filename)
+		return shared.filename, shared.checksum, nil
+	}
+
+	filename := firmwareFilename(model, version, url, nil)
+	destination := filepath.Join(m.downloadDir, filename)
+
+	if _, err := os.Stat(destination); err == nil {
+		log.Debugf("Firmware %v is already mirrored", filename)
+	} else {
+		response, err := m.api.httpClient.Get(securePinnedURL(url, m.api.pins))
+		if err != nil {
+			return "", "", err
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return "", "", fmt.Errorf("unexpected status %v while downloading %v", response.StatusCode, url)
+		}
+
+		// Firmware is downloaded to a temporary file renamed once
+		// complete, so that interrupted downloads are not taken as
+		// mirrored by later runs.
+		out, err := ioutil.TempFile(m.downloadDir, "."+filename+"-")
+		if err != nil {
+			return "", "", err
+		}
+		defer os.Remove(out.Name())
+
+		_, err = io.Copy(out, response.Body)
+		if err != nil {
+			out.Close()
+			return "", "", err
+		}
+
+		err = out.Close()
+		if err != nil {
+			return "", "", err
+		}
+
+		err = os.Chmod(out.Name(), 0644)
+		if err != nil {
+			return "", "", err
+		}
+
+		err = os.Rename(out.Name(), destination)
+		if err != nil {
+			return "", "", err
+		}
+
+		log.Infof("Mirrored firmware %v for %v", version, model)
+	}
+
+	checksum, err := fileChecksum(destination)
+	if err != nil {
+		return "", "", err
+	}
+
+	if expectedChecksum != "" && expectedChecksum != checksum {
+		os.Remove(destination)
+		return "", "", fmt.Errorf("checksum mismatch for %v (expected %v, got %v)", filename, expectedChecksum, checksum)
+	}
+
+	m.mutex.Lock()
+	m.files[filename] = destination
+	m.mirrored[url] = mirroredFile{filename: filename, checksum: checksum}
+	m.mutex.Unlock()
+
+	return filename, checksum, nil
+}
+
+// Handler returns an http.Handler that serves the Gen1 firmware list
+// (/files/firmware), the Gen2 update information (/update/<app>), the
+// firmware files themselves (/firmware/<file>) and the OTA paths used
+// by mota (/<model>), so the mirror can be used as an update server.
+func (m *Mirror) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/files/firmware", func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]Firmware{}
+
+		m.mutex.RLock()
+		for model, firmware := range m.firmwares {
+			data[model] = m.absolute(r, firmware)
+		}
+		m.mutex.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response{IsOk: true, Data: data})
+	})
+
+	mux.HandleFunc("/update/", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.RLock()
+		firmware, ok := m.firmwares[strings.TrimPrefix(r.URL.Path, "/update/")]
+		m.mutex.RUnlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		firmware = m.absolute(r, firmware)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gen2Response{
+			Stable: gen2Release{Version: firmware.Version, URL: firmware.URL, SHA256: firmware.SHA256},
+			Beta:   gen2Release{Version: firmware.BetaVersion, URL: firmware.BetaURL, SHA256: firmware.BetaSHA256},
+		})
+	})
+
+	mux.HandleFunc("/firmware/", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.RLock()
+		filename, ok := m.files[strings.TrimPrefix(r.URL.Path, "/firmware/")]
+		m.mutex.RUnlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		serveFirmwareFile(w, r, filename)
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.RLock()
+		firmware, ok := m.firmwares[strings.TrimPrefix(r.URL.Path, "/")]
+		m.mutex.RUnlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		filename := firmware.URL
+		if m.includeBetas && firmware.BetaURL != "" {
+			filename = firmware.BetaURL
+		}
+
+		m.mutex.RLock()
+		filename = m.files[filename]
+		m.mutex.RUnlock()
+
+		serveFirmwareFile(w, r, filename)
+	})
+
+	return mux
+}
+
+// absolute rewrites the mirrored firmware filenames to URLs reachable
+// through the host used by the requester.
+func (m *Mirror) absolute(r *http.Request, firmware Firmware) Firmware {
+	baseURL := fmt.Sprintf("http://%s/firmware/", r.Host)
+
+	firmware.URL = baseURL + firmware.URL
+	if firmware.BetaURL != "" {
+		firmware.BetaURL = baseURL + firmware.BetaURL
+	}
+
+	return firmware
+}
+
+// ListenAndServe synchronizes the mirror and starts serving it.
+func (m *Mirror) ListenAndServe() error {
+	err := m.Sync()
+	if err != nil {
+		return err
+	}
+
+	if m.advertise {
+		m.mutex.RLock()
+		server, err := advertiseMirror(m.listen, m.firmwares)
+		m.mutex.RUnlock()
+
+		if err != nil {
+			log.Warnf("Unable to advertise the firmware mirror via mDNS (%v)", err)
+		} else {
+			defer server.Shutdown()
+		}
+	}
+
+	log.Infof("Serving firmware mirror on %v", m.listen)
+
+	return http.ListenAndServe(m.listen, m.Handler())
+}
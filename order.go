@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Upgrade ordering strategies, given with --order. Without one, devices
+// are upgraded by IP address.
+const (
+	orderByModel    = "model"
+	orderByAge      = "age"
+	orderByGroup    = "group"
+	orderByPriority = "priority"
+)
+
+var orderStrategies = []string{orderByModel, orderByAge, orderByGroup, orderByPriority}
+
+// DeviceGroup is a named group of devices (by IP address, hostname or
+// MAC address).
+type DeviceGroup struct {
+	Name    string   `yaml:"name"`
+	Devices []string `yaml:"devices"`
+}
+
+// validOrder returns true if order is empty or a known strategy.
+func validOrder(order string) bool {
+	if order == "" {
+		return true
+	}
+
+	for _, strategy := range orderStrategies {
+		if order == strategy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// orderDevices sorts devices by IP address and then by the ordering
+// strategy of the run, if any, upgrading range extenders after the
+// devices connected through them regardless of the strategy:
+//
+//   - model upgrades devices of the same model together, by model name.
+//   - age upgrades the devices furthest behind first, by the number of
+//     known releases between their firmware and the one offered.
+//   - group upgrades devices in the order of their groups in the
+//     configuration file, followed by the devices in no group.
+//   - priority upgrades devices in ascending priority, as given for them
+//     or their model in the configuration file (0 otherwise).
+func (o *OTAUpdater) orderDevices(devices []*Device) {
+	sort.SliceStable(devices, func(i, j int) bool {
+		return bytes.Compare(devices[i].IP.To16(), devices[j].IP.To16()) < 0
+	})
+
+	var less func(a *Device, b *Device) bool
+
+	switch o.order {
+	case orderByModel:
+		less = func(a *Device, b *Device) bool {
+			return a.Model < b.Model
+		}
+	case orderByAge:
+		less = func(a *Device, b *Device) bool {
+			return releasesBehind(a) > releasesBehind(b)
+		}
+	case orderByGroup:
+		less = func(a *Device, b *Device) bool {
+			return o.groupIndex(a) < o.groupIndex(b)
+		}
+	case orderByPriority:
+		less = func(a *Device, b *Device) bool {
+			return o.priority(a) < o.priority(b)
+		}
+	}
+
+	if less != nil {
+		upgradeLog.Debugf("Ordering upgrades by %v", o.order)
+
+		sort.SliceStable(devices, func(i, j int) bool {
+			return less(devices[i], devices[j])
+		})
+	}
+
+	orderExtenders(devices)
+}
+
+// releasesBehind returns how many known releases a device is behind the
+// firmware version offered, including the one offered.
+func releasesBehind(device *Device) int {
+	if device.CurrentFWVersion == device.NewFWVersion {
+		return 0
+	}
+
+	return changelog.Diff(device.Generation, device.Profile, device.CurrentFWVersion, device.NewFWVersion).Skipped + 1
+}
+
+// groupIndex returns the position of the first group a device belongs
+// to, or the number of groups if it belongs to none.
+func (o *OTAUpdater) groupIndex(device *Device) int {
+	for index, group := range o.groups {
+		for _, identifier := range group.Devices {
+			if device.Matches(identifier) {
+				return index
+			}
+		}
+	}
+
+	return len(o.groups)
+}
+
+// priority returns the priority given for a device or, if none, for its
+// model.
+func (o *OTAUpdater) priority(device *Device) int {
+	priority := 0
+
+	for key, value := range o.priorities {
+		if device.Matches(key) {
+			return value
+		}
+
+		if strings.EqualFold(key, device.Model) {
+			priority = value
+		}
+	}
+
+	return priority
+}
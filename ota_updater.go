@@ -1,38 +1,100 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/AlecAivazis/survey/v2/terminal"
-	log "github.com/sirupsen/logrus"
 )
 
 // OTAUpdater is the structure that keeps a cache of the discovered
 // devices and allows orchestration of upgrades.
 type OTAUpdater struct {
-	api               *APIClient
-	browser           Browser
-	devices           map[string]*Device
-	domain            string
-	downloadDir       string
-	force             bool
-	serverPort        int
-	includeBetas      bool
-	hosts             []string
-	serverIP          net.IP
-	service           string
-	waitTimeInSeconds int
+	api                 *APIClient
+	betaDevices         map[string]bool
+	browser             DeviceDiscoverer
+	configDiff          bool
+	configs             map[string]map[string]string
+	deadlines           map[string]time.Time
+	deviceDeadline      time.Duration
+	devices             map[string]*Device
+	downloads           *downloadTracker
+	deviceUpdateServers map[string]string
+	domains             []string
+	earlyExit           bool
+	expected            int
+	downloadDir         string
+	failed              []*Device
+	failuresFile        string
+	fetchStatus         bool
+	fetches             *firmwareFetches
+	firmwareSizes       *firmwareSizes
+	force               bool
+	groups              []DeviceGroup
+	historyPath         string
+	interfaces          []string
+	ledgerPath          string
+	maxLoad             float64
+	noDownload          bool
+	openDocs            bool
+	order               string
+	otaRetries          int
+	otaTimeout          time.Duration
+	priorities          map[string]int
+	probeCachePath      string
+	resetUpdateServer   string
+	restart             bool
+	resume              bool
+	runState            *RunState
+	runStatePath        string
+	serverPort          int
+	skipIf              []string
+	skipRules           []*SkipRule
+	soak                time.Duration
+	syncToStable        bool
+	underLoadAction     string
+	includeBetas        bool
+	listenAddresses     []net.IP
+	hosts               []string
+	hostEntries         []HostEntry
+	inventory           []string
+	canaries            []string
+	canarySoak          time.Duration
+	cloud               *CloudClient
+	critical            []string
+	clock               Clock
+	concurrency         int
+	deviceTimeout       time.Duration
+	rollout             map[string]string
+	mux                 *http.ServeMux
+	server              *http.Server
+	servedBeta          map[string]bool
+	skipped             []SkippedDevice
+	serverIP            net.IP
+	service             string
+	stage               string
+	stream              bool
+	tracer              *Tracer
+	tunnel              *Tunnel
+	updateServer        string
+	upgraded            []*Device
+	verifyTimeout       time.Duration
+	waitTimeInSeconds   int
 }
 
 // OTAUpdaterOption is an option interface for OTAUpdater.
@@ -46,6 +108,31 @@ func WithAPIClient(api *APIClient) OTAUpdaterOption {
 	}
 }
 
+// WithBrowser is an OTAUpdater option that allows overriding the
+// DeviceDiscoverer used to find devices on the network.
+func WithBrowser(browser DeviceDiscoverer) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.browser = browser
+	}
+}
+
+// WithTracer is an OTAUpdater option that records spans of the upgrade
+// pipeline with a tracer, which is shared with the APIClient and the
+// Browser of the updater.
+func WithTracer(tracer *Tracer) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.tracer = tracer
+	}
+}
+
+// WithClock is an OTAUpdater option that allows overriding the Clock
+// used to wait between upgrade steps.
+func WithClock(clock Clock) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.clock = clock
+	}
+}
+
 // WithWaitTimeInSeconds
 func WithWaitTimeInSeconds(waitTimeInSeconds int) OTAUpdaterOption {
 	return func(o *OTAUpdater) {
@@ -53,6 +140,118 @@ func WithWaitTimeInSeconds(waitTimeInSeconds int) OTAUpdaterOption {
 	}
 }
 
+// WithConcurrency is an OTAUpdater option that sets how many devices
+// are queried for their settings at the same time.
+func WithConcurrency(concurrency int) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.concurrency = concurrency
+	}
+}
+
+// WithDeviceTimeout is an OTAUpdater option that sets the HTTP timeout
+// used when querying each device for its settings.
+func WithDeviceTimeout(deviceTimeout time.Duration) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.deviceTimeout = deviceTimeout
+	}
+}
+
+// WithDeviceStatus is an OTAUpdater option that fetches the WiFi signal,
+// uptime and free memory of each device during discovery.
+func WithDeviceStatus(fetchStatus bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.fetchStatus = fetchStatus
+	}
+}
+
+// WithConfigDiff is an OTAUpdater option that fetches the configuration
+// of each device before upgrading it and once verified, printing the
+// settings changed or lost by the upgrade.
+func WithConfigDiff(configDiff bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.configDiff = configDiff
+	}
+}
+
+// WithDeviceDeadline is an OTAUpdater option that sets the total time
+// budget for upgrading and verifying each device. Devices exceeding it
+// are reported as timed out so that the rest of the run can continue.
+func WithDeviceDeadline(deviceDeadline time.Duration) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.deviceDeadline = deviceDeadline
+	}
+}
+
+// WithInventory is an OTAUpdater option that sets the devices (by IP
+// address, hostname or MAC address) expected to be found on the network.
+func WithInventory(inventory []string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.inventory = inventory
+	}
+}
+
+// WithEarlyExit is an OTAUpdater option that stops discovery as soon as
+// every device in the inventory has been found.
+func WithEarlyExit(earlyExit bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.earlyExit = earlyExit
+	}
+}
+
+// WithExpectedDevices is an OTAUpdater option that stops discovery as
+// soon as the given number of devices has been found. If not set, it
+// defaults to the number of devices in the inventory, unless early exit
+// is enabled.
+func WithExpectedDevices(expected int) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.expected = expected
+	}
+}
+
+// WithStreaming is an OTAUpdater option that upgrades devices as soon
+// as they are discovered, instead of after discovery finishes.
+func WithStreaming(stream bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.stream = stream
+	}
+}
+
+// WithResetUpdateServer is an OTAUpdater option that offers to point
+// devices whose update server has been overridden back at the default
+// Shelly servers (with default) or at the given mirror URL.
+func WithResetUpdateServer(server string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.resetUpdateServer = server
+	}
+}
+
+// WithSoak is an OTAUpdater option that keeps polling the status of
+// upgraded devices for the given duration after upgrades, reporting the
+// ones that restart or become unreachable as failed.
+func WithSoak(soak time.Duration) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.soak = soak
+	}
+}
+
+// WithSyncToStable is an OTAUpdater option that offers to downgrade
+// devices running a firmware newer than the stable one (e.g. a beta
+// installed previously) to the stable firmware, instead of skipping them.
+func WithSyncToStable(sync bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.syncToStable = sync
+	}
+}
+
+// WithDownloadDir is an OTAUpdater option that sets the directory
+// where firmware files are downloaded to, instead of the OS cache
+// directory.
+func WithDownloadDir(downloadDir string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.downloadDir = downloadDir
+	}
+}
+
 // WithForcedUpgrades is an OTAUpdater option that allows overriding
 // the default behaviour of confirming upgrades interactively.
 func WithForcedUpgrades(force bool) OTAUpdaterOption {
@@ -61,6 +260,41 @@ func WithForcedUpgrades(force bool) OTAUpdaterOption {
 	}
 }
 
+// WithOpenDocs is an OTAUpdater option that offers to open the manual
+// upgrade instructions of devices rejecting over-the-air upgrades in the
+// browser.
+func WithOpenDocs(openDocs bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.openDocs = openDocs
+	}
+}
+
+// WithOTARetries is an OTAUpdater option that sets how many times the
+// OTA request is made again to Gen1 devices that do not start updating.
+func WithOTARetries(otaRetries int) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.otaRetries = otaRetries
+	}
+}
+
+// WithProbeCache is an OTAUpdater option that sets the path of the file
+// caching the results of probing devices between runs. An empty path
+// disables the cache, so that every device is probed.
+func WithProbeCache(probeCachePath string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.probeCachePath = probeCachePath
+	}
+}
+
+// WithRestarts is an OTAUpdater option that restarts devices pending a
+// restart to apply a previous upgrade before evaluating them for further
+// upgrades.
+func WithRestarts(restart bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.restart = restart
+	}
+}
+
 // WithBeta is an OTAUpdater option that enables beta
 // versions, if available.
 func WithBetaVersions(beta bool) OTAUpdaterOption {
@@ -76,10 +310,29 @@ func WithService(service string) OTAUpdaterOption {
 	}
 }
 
-// WithDomain
-func WithDomain(domain string) OTAUpdaterOption {
+// WithDomains
+func WithDomains(domains []string) OTAUpdaterOption {
 	return func(o *OTAUpdater) {
-		o.domain = domain
+		o.domains = domains
+	}
+}
+
+// WithInterfaces is an OTAUpdater option that browses the local domain
+// on the network interfaces with the given names (e.g. eth0) instead of
+// on every interface supporting multicast.
+func WithInterfaces(interfaces []string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.interfaces = interfaces
+	}
+}
+
+// WithNoDownload is an OTAUpdater option that passes the URL firmware is
+// published at by the firmware index (e.g. the Shelly CDN) to devices
+// in OTA requests, instead of downloading it and serving it from the
+// local OTA server.
+func WithNoDownload(noDownload bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.noDownload = noDownload
 	}
 }
 
@@ -97,6 +350,214 @@ func WithHosts(hosts []string) OTAUpdaterOption {
 	}
 }
 
+// WithHostEntries is an OTAUpdater option that adds the hosts read from
+// a hosts file, using the username/password and checking the model given
+// for each of them.
+func WithHostEntries(entries []HostEntry) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.hostEntries = append(o.hostEntries, entries...)
+		for _, entry := range entries {
+			o.hosts = append(o.hosts, entry.Host)
+		}
+	}
+}
+
+// WithStage is an OTAUpdater option that makes Gen2 devices update
+// directly from the Shelly servers using the given release stage
+// (stable or beta) instead of the local OTA server.
+func WithStage(stage string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.stage = stage
+	}
+}
+
+// WithTunnel is an OTAUpdater option that upgrades devices at a remote
+// site through an SSH jump host or a SOCKS5 proxy. As mDNS discovery
+// does not cross the tunnel, devices are taken from the hosts or the
+// inventory.
+func WithTunnel(tunnel *Tunnel) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.tunnel = tunnel
+	}
+}
+
+// WithUpdateServer is an OTAUpdater option that allows overriding the
+// base URL advertised to devices when requesting an upgrade, such as
+// a self-hosted firmware mirror.
+func WithUpdateServer(updateServer string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.updateServer = updateServer
+	}
+}
+
+// WithDeviceUpdateServers is an OTAUpdater option that allows
+// overriding the update server base URL per device, keyed by IP
+// address or hostname.
+func WithDeviceUpdateServers(deviceUpdateServers map[string]string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.deviceUpdateServers = deviceUpdateServers
+	}
+}
+
+// WithRollout is an OTAUpdater option that limits how many devices of
+// a model are upgraded per run, either as a percentage (e.g. 20%) or as
+// an absolute count (e.g. 5), so firmware can be rolled out gradually.
+func WithRollout(rollout map[string]string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.rollout = rollout
+	}
+}
+
+// WithCanaries is an OTAUpdater option that designates devices (by IP
+// address, hostname or MAC address) to be upgraded before all others.
+func WithCanaries(canaries []string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.canaries = canaries
+	}
+}
+
+// WithCanarySoak is an OTAUpdater option that sets how long canaries
+// must remain healthy after being upgraded before the remaining devices
+// are upgraded.
+func WithCanarySoak(canarySoak time.Duration) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.canarySoak = canarySoak
+	}
+}
+
+// WithCloud is an OTAUpdater option that sets the Shelly Cloud account
+// whose firmware state is reconciled with the devices found.
+func WithCloud(cloud *CloudClient) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.cloud = cloud
+	}
+}
+
+// WithCritical is an OTAUpdater option that designates devices (by IP
+// address, hostname, MAC address, model or group name) whose upgrades
+// and restarts must be confirmed by typing their name.
+func WithCritical(critical []string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.critical = critical
+	}
+}
+
+// WithVerifyTimeout is an OTAUpdater option that sets how long to wait
+// for upgraded devices to come back online with the new firmware. A zero
+// timeout disables verification.
+func WithVerifyTimeout(verifyTimeout time.Duration) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.verifyTimeout = verifyTimeout
+	}
+}
+
+// WithListenAddresses is an OTAUpdater option that binds the local OTA
+// server to the given local addresses only, instead of every interface.
+func WithListenAddresses(listenAddresses []net.IP) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.listenAddresses = listenAddresses
+	}
+}
+
+// WithOTATimeout is an OTAUpdater option that sets how long to wait
+// for a device to start updating after an OTA request.
+func WithOTATimeout(otaTimeout time.Duration) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.otaTimeout = otaTimeout
+	}
+}
+
+// WithFailuresFile is an OTAUpdater option that writes the devices which
+// failed verification to a file for follow-up.
+func WithFailuresFile(failuresFile string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.failuresFile = failuresFile
+	}
+}
+
+// WithOrder is an OTAUpdater option that sets the strategy (model, age,
+// group or priority) used to order upgrades.
+func WithOrder(order string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.order = order
+	}
+}
+
+// WithMaxLoad is an OTAUpdater option that sets the power in watts
+// above which devices are considered under load. A zero maximum load
+// disables the check.
+func WithMaxLoad(maxLoad float64) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.maxLoad = maxLoad
+	}
+}
+
+// WithUnderLoad is an OTAUpdater option that sets whether devices under
+// load are skipped or only warned about.
+func WithUnderLoad(action string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.underLoadAction = action
+	}
+}
+
+// WithSkipRules is an OTAUpdater option that sets the expressions
+// deferring devices for which they hold to a later run.
+func WithSkipRules(rules []string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.skipIf = rules
+	}
+}
+
+// WithGroups is an OTAUpdater option that sets the groups of devices
+// upgrades are ordered by with the group strategy.
+func WithGroups(groups []DeviceGroup) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.groups = groups
+	}
+}
+
+// WithPriorities is an OTAUpdater option that sets the priorities of
+// devices or models upgrades are ordered by with the priority strategy.
+func WithPriorities(priorities map[string]int) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.priorities = priorities
+	}
+}
+
+// WithResume is an OTAUpdater option that resumes an interrupted run,
+// skipping the devices it already upgraded or declined.
+func WithResume(resume bool) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.resume = resume
+	}
+}
+
+// WithRunStatePath is an OTAUpdater option that allows overriding the
+// path of the file where the working state of a run is kept. An empty
+// path disables it.
+func WithRunStatePath(runStatePath string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.runStatePath = runStatePath
+	}
+}
+
+// WithHistoryPath is an OTAUpdater option that allows overriding the
+// path of the file where upgrade history is recorded.
+func WithHistoryPath(historyPath string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.historyPath = historyPath
+	}
+}
+
+// WithLedgerPath is an OTAUpdater option that allows overriding the
+// path of the file where every device found is recorded, or disables
+// recording devices if empty.
+func WithLedgerPath(ledgerPath string) OTAUpdaterOption {
+	return func(o *OTAUpdater) {
+		o.ledgerPath = ledgerPath
+	}
+}
+
 // NewOTAUpdater returns an instance of OTAUpdater with the default
 // options. Firmware downloads are stored on the OS cache or temp
 // directories.
@@ -104,7 +565,13 @@ func NewOTAUpdater(options ...OTAUpdaterOption) (OTAUpdater, error) {
 	const (
 		defaultDomain            = "local"
 		defaultIncludeBetas      = false
+		defaultOTARetries        = 2
+		defaultOTATimeout        = 2 * time.Minute
+		defaultCanarySoak        = 5 * time.Minute
+		defaultConcurrency       = 32
+		defaultDeviceTimeout     = 5 * time.Second
 		defaultService           = "_http._tcp."
+		defaultVerifyTimeout     = 5 * time.Minute
 		defaultWaitTimeInSeconds = 60
 	)
 
@@ -119,10 +586,30 @@ func NewOTAUpdater(options ...OTAUpdaterOption) (OTAUpdater, error) {
 	}
 
 	updater := OTAUpdater{
-		api:          NewAPIClient(),
-		downloadDir:  filepath.Join(cacheDir, "com.github.ruimarinho.mota"),
-		includeBetas: defaultIncludeBetas,
-		serverIP:     serverIP,
+		api:             NewAPIClient(),
+		betaDevices:     map[string]bool{},
+		canarySoak:      defaultCanarySoak,
+		clock:           realClock{},
+		concurrency:     defaultConcurrency,
+		configs:         map[string]map[string]string{},
+		deadlines:       map[string]time.Time{},
+		deviceTimeout:   defaultDeviceTimeout,
+		domains:         []string{defaultDomain},
+		downloadDir:     filepath.Join(cacheDir, "com.github.ruimarinho.mota"),
+		downloads:       newDownloadTracker(),
+		fetches:         newFirmwareFetches(),
+		firmwareSizes:   newFirmwareSizes(),
+		historyPath:     defaultHistoryPath(),
+		ledgerPath:      defaultLedgerPath(),
+		probeCachePath:  filepath.Join(stateDir(), "probes.json"),
+		runStatePath:    filepath.Join(stateDir(), "run.json"),
+		includeBetas:    defaultIncludeBetas,
+		otaRetries:      defaultOTARetries,
+		otaTimeout:      defaultOTATimeout,
+		servedBeta:      map[string]bool{},
+		underLoadAction: underLoadSkip,
+		serverIP:        serverIP,
+		verifyTimeout:   defaultVerifyTimeout,
 	}
 
 	// Apply custom OTAUpdaterOptions.
@@ -130,6 +617,73 @@ func NewOTAUpdater(options ...OTAUpdaterOption) (OTAUpdater, error) {
 		option(&updater)
 	}
 
+	if updater.stage != "" && updater.stage != "stable" && updater.stage != "beta" {
+		return OTAUpdater{}, fmt.Errorf("invalid stage %q, must be one of stable or beta", updater.stage)
+	}
+
+	if !validOrder(updater.order) {
+		return OTAUpdater{}, fmt.Errorf("invalid order %q, must be one of %v", updater.order, strings.Join(orderStrategies, ", "))
+	}
+
+	if updater.resetUpdateServer != "" && updater.resetUpdateServer != resetUpdateServerDefault && !strings.HasPrefix(updater.resetUpdateServer, "http://") && !strings.HasPrefix(updater.resetUpdateServer, "https://") {
+		return OTAUpdater{}, fmt.Errorf("invalid update server %q, must be %v or an http(s) URL", updater.resetUpdateServer, resetUpdateServerDefault)
+	}
+
+	if !validUnderLoad(updater.underLoadAction) {
+		return OTAUpdater{}, fmt.Errorf("invalid under-load action %q, must be one of %v, %v", updater.underLoadAction, underLoadSkip, underLoadWarn)
+	}
+
+	updater.skipRules, err = parseSkipRules(updater.skipIf)
+	if err != nil {
+		return OTAUpdater{}, err
+	}
+
+	if updater.stream && (len(updater.canaries) > 0 || len(updater.rollout) > 0) {
+		return OTAUpdater{}, errors.New("canaries and staged rollouts require the full list of devices and cannot be used when streaming")
+	}
+
+	if updater.earlyExit && len(updater.inventory) == 0 {
+		return OTAUpdater{}, errors.New("early exit requires an inventory of expected devices")
+	}
+
+	if updater.expected < 0 {
+		return OTAUpdater{}, fmt.Errorf("invalid number of expected devices %v", updater.expected)
+	}
+
+	// Early exit waits for the specific devices in the inventory rather
+	// than for their count.
+	if updater.expected == 0 && !updater.earlyExit {
+		updater.expected = len(updater.inventory)
+	}
+
+	for model, policy := range updater.rollout {
+		if _, err := rolloutLimit(policy, 0); err != nil {
+			return OTAUpdater{}, fmt.Errorf("invalid rollout policy for %v: %v", model, err)
+		}
+	}
+
+	if updater.tunnel != nil {
+		if len(updater.hosts) == 0 {
+			updater.hosts = updater.inventory
+		}
+
+		if len(updater.hosts) == 0 {
+			return OTAUpdater{}, errors.New("devices at a remote site must be listed as hosts or in the inventory, as they cannot be discovered through a tunnel")
+		}
+
+		if updater.tunnel.Advertise() == nil && updater.updateServer == "" && !updater.noDownload {
+			return OTAUpdater{}, errors.New("SOCKS5 proxies cannot forward the OTA server to devices, use a custom update server, --no-download or an SSH jump host")
+		}
+
+		if updater.tunnel.Advertise() != nil {
+			updater.serverIP = updater.tunnel.Advertise()
+		}
+	}
+
+	if updater.tracer != nil {
+		updater.api.tracer = updater.tracer
+	}
+
 	if updater.serverPort == 0 {
 		serverPort, err := ServerPort()
 		updater.serverPort = serverPort
@@ -139,7 +693,36 @@ func NewOTAUpdater(options ...OTAUpdaterOption) (OTAUpdater, error) {
 		}
 	}
 
-	updater.browser = Browser{updater.domain, updater.service, updater.waitTimeInSeconds}
+	var interfaces []net.Interface
+	if len(updater.interfaces) > 0 {
+		interfaces, err = multicastInterfaces(updater.interfaces)
+		if err != nil {
+			return OTAUpdater{}, err
+		}
+	}
+
+	if updater.browser == nil {
+		var probeCache *ProbeCache
+		if updater.probeCachePath != "" {
+			probeCache, err = LoadProbeCache(updater.probeCachePath)
+			if err != nil {
+				discoveryLog.Warnf("Ignoring probe cache %v (%v)", updater.probeCachePath, err)
+			}
+		}
+
+		updater.browser = &Browser{
+			concurrency:   updater.concurrency,
+			deviceTimeout: updater.deviceTimeout,
+			domains:       updater.domains,
+			fetchStatus:   updater.fetchStatus,
+			hostEntries:   updater.hostEntries,
+			interfaces:    interfaces,
+			probeCache:    probeCache,
+			service:       updater.service,
+			tracer:        updater.tracer,
+			waitTime:      updater.waitTimeInSeconds,
+		}
+	}
 
 	if updater.includeBetas {
 		updater.api.includeBetas = true
@@ -155,16 +738,32 @@ func NewOTAUpdater(options ...OTAUpdaterOption) (OTAUpdater, error) {
 // a handler on the local OTA server to serve it when requested by the
 // device OTA service.
 func (o *OTAUpdater) Start() error {
-	log.Infof("Listening for HTTP server on port %v", o.serverPort)
-	mux := http.NewServeMux()
-	server := &http.Server{Addr: fmt.Sprintf(":%v", o.serverPort), Handler: mux}
-	go server.ListenAndServe()
+	err := o.listen()
+	if err != nil {
+		return err
+	}
 
 	devices, err := o.Devices()
 	if err != nil {
 		return err
 	}
 
+	err = o.restartPending(devices)
+	if err != nil {
+		return err
+	}
+
+	err = o.overriddenUpdateServers(devices)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if device.IsGen2() {
+			o.api.AddGen2App(device.Model)
+		}
+	}
+
 	firmwares, err := o.api.FetchVersions()
 	if err != nil {
 		return err
@@ -172,22 +771,32 @@ func (o *OTAUpdater) Start() error {
 
 	models := make(map[string]bool)
 	for _, device := range devices {
-		newFWVersion, err := o.api.GetVersion(device.Model)
-		if err != nil {
+		newFWVersion, err := o.newVersionFor(device)
+		if skipped(device, err) {
+			audit.Skipped(auditUpgrade, device, "firmware", err.Error())
+			o.skipped = append(o.skipped, SkippedDevice{Device: device, Err: err})
+			delete(o.devices, device.IP.String())
+			continue
+		} else if err != nil {
 			return err
 		}
 
 		o.devices[device.IP.String()].NewFWVersion = newFWVersion
 
+		if device.IsGen2() && o.stage != "" && device.CloudDisabled {
+			upgradeLog.Warnf("%v (%v) has cloud access disabled and cannot update from the Shelly servers, serving firmware locally instead", device.ModelName(), device.IP)
+		}
+
 		// If a model has already been marked as seen or out-of-date, make sure to respect
 		// the flag independently of what future devices may suggest.
 		if models[device.Model] {
 			continue
 		}
 
-		// Only set the model flag if a discovered device has an out-of-date firmware,
-		// otherwise its firmware will be downloaded and not used.
-		if o.devices[device.IP.String()].CurrentFWVersion != newFWVersion {
+		// Only set the model flag if a discovered device has an out-of-date firmware
+		// and is going to fetch it from the local OTA server, otherwise its firmware
+		// will be downloaded and not used, as is always the case in read-only mode.
+		if o.devices[device.IP.String()].CurrentFWVersion != newFWVersion && o.servesLocally(device) && !readOnlyMode {
 			models[device.Model] = true
 		}
 	}
@@ -195,7 +804,7 @@ func (o *OTAUpdater) Start() error {
 	var wg sync.WaitGroup
 	for model, firmware := range firmwares {
 		if !models[model] {
-			log.Debugf("Skipping model %v as devices of this type have not been found on the local network or firmware is up-to-date", model)
+			upgradeLog.Debugf("Skipping model %v as devices of this type have not been found on the local network or firmware is up-to-date", model)
 			continue
 		}
 
@@ -203,18 +812,10 @@ func (o *OTAUpdater) Start() error {
 		go func(model string, firmware Firmware) {
 			defer wg.Done()
 
-			filename, err := o.DownloadFirmware(model, firmware)
+			err := o.serveFirmware(model, firmware)
 			if err != nil {
-				log.Errorf("Unable to download firmware for %v (%v)", firmware.Model, err)
-				return
+				upgradeLog.Errorf("Unable to download firmware for %v (%v)", firmware.Model, err)
 			}
-
-			log.Debugf("Adding HTTP handler for /%v", model)
-
-			mux.HandleFunc("/"+model, func(w http.ResponseWriter, r *http.Request) {
-				log.Debugf("Serving file %v to %v", filename, r.RemoteAddr)
-				http.ServeFile(w, r, filename)
-			})
 		}(model, firmware)
 	}
 	wg.Wait()
@@ -222,21 +823,194 @@ func (o *OTAUpdater) Start() error {
 	return nil
 }
 
-// DownloadFirmware returns the final destination of the firmware that
-// it has been requested to download for a particular model.
-func (o *OTAUpdater) DownloadFirmware(model string, firmware Firmware) (string, error) {
-	body, err := o.api.FetchFirmware(model)
+// newVersionFor returns the firmware version a device should be
+// upgraded to. If the newest version is blocked and the alternative is
+// older than the running firmware, the device is kept as is.
+func (o *OTAUpdater) newVersionFor(device *Device) (string, error) {
+	if device.Model == "" {
+		return "", ErrUnknownModel
+	}
+
+	newFWVersion, err := o.api.GetVersion(device.Model)
 	if err != nil {
 		return "", err
 	}
 
-	defer body.Close()
+	if o.api.replaced[device.Model] && compareFirmwareVersions(newFWVersion, device.CurrentFWVersion) < 0 {
+		upgradeLog.Infof("Keeping %v (%v) on firmware %v as the newest non-blocked firmware is %v", device.ModelName(), device.IP, device.CurrentFWVersion, newFWVersion)
+		return device.CurrentFWVersion, nil
+	}
 
-	err = os.MkdirAll(o.downloadDir, 0700)
+	// Devices running a newer firmware than the one offered (e.g. a beta
+	// installed previously, or an index lagging behind a release) are
+	// not downgraded unless asked to.
+	if !o.syncToStable && compareFirmwareVersions(newFWVersion, device.CurrentFWVersion) < 0 {
+		return "", fmt.Errorf("%w (%v)", ErrAheadOfStable, releaseVersion(newFWVersion))
+	}
+
+	return newFWVersion, nil
+}
+
+// skipped returns true if a device must be skipped because no firmware
+// can be offered for its model, reporting the reason.
+func skipped(device *Device, err error) bool {
+	switch {
+	case errors.Is(err, ErrUnknownModel):
+		upgradeLog.Warnf("Skipping %v running firmware %q as its model could not be determined", device.String(), device.CurrentFWVersion)
+	case errors.Is(err, ErrFirmwareNotFound):
+		upgradeLog.Warnf("Skipping %v (%v) as no firmware is published for %v", device.ModelName(), device.IP, device.Model)
+	case errors.Is(err, ErrFirmwareBlocked):
+		upgradeLog.Warnf("Skipping %v (%v) as every available firmware for %v is blocked", device.ModelName(), device.IP, device.Model)
+	case errors.Is(err, ErrModelNotIndexed):
+		console.NotIndexed(device)
+	case errors.Is(err, ErrFirmwareInfoUnavailable):
+		console.Unavailable(device)
+	case errors.Is(err, ErrAheadOfStable):
+		console.AheadOfStable(device, err)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// listen starts the local OTA server, returning an error if its port
+// cannot be bound. When upgrading devices through a tunnel, the server
+// listens on the jump host instead.
+func (o *OTAUpdater) listen() error {
+	serverLog.Infof("Listening for HTTP server on port %v", o.serverPort)
+	o.mux = http.NewServeMux()
+	o.mux.HandleFunc("/fw/", o.serveDeviceFirmware)
+	o.server = &http.Server{Addr: fmt.Sprintf(":%v", o.serverPort), Handler: o.mux}
+
+	var listeners []net.Listener
+
+	switch {
+	case o.tunnel != nil:
+		listener, err := o.tunnel.Listen(o.serverPort)
+		if err != nil {
+			serverLog.Debugf("Not forwarding the OTA server through %v (%v)", o.tunnel, err)
+			return nil
+		}
+
+		listeners = append(listeners, listener)
+	case len(o.listenAddresses) > 0:
+		for _, address := range o.listenAddresses {
+			listener, err := net.Listen("tcp", net.JoinHostPort(address.String(), strconv.Itoa(o.serverPort)))
+			if err != nil {
+				for _, listener := range listeners {
+					listener.Close()
+				}
+
+				return fmt.Errorf("unable to listen for OTA requests on %v port %v (%v)", address, o.serverPort, err)
+			}
+
+			listeners = append(listeners, listener)
+		}
+	default:
+		listener, err := net.Listen("tcp", o.server.Addr)
+		if err != nil {
+			return fmt.Errorf("unable to listen for OTA requests on port %v (%v)", o.serverPort, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			err := o.server.Serve(listener)
+			if err != nil && err != http.ErrServerClosed {
+				serverLog.Errorf("OTA server stopped unexpectedly (%v)", err)
+			}
+		}(listener)
+	}
+
+	return nil
+}
+
+// advertisedIP returns the address of the local OTA server given to a
+// device: the local address that reaches it, so that devices on
+// different networks (e.g. VLANs) are each given an address they can
+// reach. When the server is bound to specific addresses, the one on the
+// network of the device is used.
+func (o *OTAUpdater) advertisedIP(device *Device) net.IP {
+	if o.tunnel != nil || device.IP == nil {
+		return o.serverIP
+	}
+
+	local, err := localAddressFor(device.IP)
+
+	if len(o.listenAddresses) == 0 {
+		if err != nil {
+			return o.serverIP
+		}
+
+		return local
+	}
+
+	for _, address := range o.listenAddresses {
+		if address.Equal(local) || onSameNetwork(address, device.IP) {
+			return address
+		}
+	}
+
+	return o.listenAddresses[0]
+}
+
+// serveFirmware downloads the firmware for a model and installs a
+// handler on the local OTA server to serve it.
+func (o *OTAUpdater) serveFirmware(model string, firmware Firmware) error {
+	filename, err := o.DownloadFirmware(model, firmware)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	o.firmwareSizes.record(model, filename)
+
+	serverLog.Debugf("Adding HTTP handler for /%v", model)
+
+	o.mux.HandleFunc("/"+model, o.trackDownloads(func(w http.ResponseWriter, r *http.Request) {
+		serveFirmwareFile(w, r, filename)
+	}))
+
+	return nil
+}
+
+// Close gracefully stops the local OTA server, waiting up to the OTA
+// timeout for firmware downloads in progress to complete before closing
+// their connections.
+func (o *OTAUpdater) Close() error {
+	if o.server == nil {
+		return nil
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), o.otaTimeout)
+	defer cancel()
+
+	err := o.server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		serverLog.Warnf("Stopping the OTA server with firmware downloads still in progress after %v", o.otaTimeout)
+		return o.server.Close()
+	}
+
+	return err
+}
+
+// UpgradedDevices returns the devices that have been requested to
+// upgrade during this run.
+func (o *OTAUpdater) UpgradedDevices() []*Device {
+	return o.upgraded
+}
+
+// FailedDevices returns the devices that failed to upgrade or did not
+// come back online with the new firmware during this run.
+func (o *OTAUpdater) FailedDevices() []*Device {
+	return o.failed
+}
+
+// DownloadFirmware returns the final destination of the firmware that
+// it has been requested to download for a particular model.
+func (o *OTAUpdater) DownloadFirmware(model string, firmware Firmware) (string, error) {
 	newFWVersion, err := o.api.GetVersion(model)
 	if err != nil {
 		return "", err
@@ -247,21 +1021,72 @@ func (o *OTAUpdater) DownloadFirmware(model string, firmware Firmware) (string,
 		return "", err
 	}
 
-	filename := strings.Join([]string{strings.Join([]string{model, strings.Replace(newFWVersion, "/", "-", -1)}, "-"), path.Ext(newFWURL)}, "")
-	out, err := os.Create(filepath.Join(o.downloadDir, filename))
+	expectedChecksum, err := o.api.GetChecksum(model)
+	if err != nil {
+		return "", err
+	}
+
+	return o.download(model, newFWVersion, newFWURL, expectedChecksum)
+}
+
+// download stores a firmware file on the download directory and returns
+// its path. Firmware fetched from an upstream mota mirror is verified
+// against the checksum it publishes. Firmware shared by several models
+// is only downloaded once.
+func (o *OTAUpdater) download(model string, version string, firmwareURL string, expectedChecksum string) (string, error) {
+	return o.fetches.do(firmwareURL, func() (string, error) {
+		return o.downloadFile(model, version, firmwareURL, expectedChecksum)
+	})
+}
+
+func (o *OTAUpdater) downloadFile(model string, version string, firmwareURL string, expectedChecksum string) (filename string, err error) {
+	span := o.tracer.StartSpan("download", "model", model, "version", version, "url", firmwareURL)
+	defer func() { span.End(err) }()
+
+	body, err := o.api.FetchFirmwareURL(firmwareURL)
+	if err != nil {
+		return "", err
+	}
+
+	defer body.Close()
+
+	err = os.MkdirAll(o.downloadDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// Peek at the first bytes to tell ZIP archives from raw images when
+	// the URL has no extension.
+	reader := bufio.NewReader(body)
+	header, _ := reader.Peek(len(zipMagic))
+
+	filename = filepath.Join(o.downloadDir, firmwareFilename(model, version, firmwareURL, header))
+	out, err := os.Create(filename)
 	if err != nil {
 		return "", err
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, body)
+	_, err = io.Copy(out, &progressReader{Reader: reader, model: model, version: version})
 	if err != nil {
 		return "", err
 	}
 
-	log.Debugf("Downloaded firmware %v to %v\n", path.Base(newFWURL), filepath.Join(o.downloadDir, filename))
+	if expectedChecksum != "" {
+		checksum, err := fileChecksum(filename)
+		if err != nil {
+			return "", err
+		}
+
+		if checksum != expectedChecksum {
+			os.Remove(filename)
+			return "", fmt.Errorf("checksum mismatch for %v (expected %v, got %v)", filepath.Base(filename), expectedChecksum, checksum)
+		}
+	}
 
-	return filepath.Join(o.downloadDir, filename), nil
+	serverLog.Debugf("Downloaded firmware %v to %v\n", path.Base(firmwareURL), filename)
+
+	return filename, nil
 }
 
 // Devices returns a list of discovered devices on the local network
@@ -271,47 +1096,357 @@ func (o *OTAUpdater) Devices() (map[string]*Device, error) {
 		return o.devices, nil
 	}
 
-	devices, err := o.browser.DiscoverDevices(o.hosts)
+	progress.DiscoveryStarted()
+	stopSpinner := console.StartSpinner("Discovering devices...")
+	span := o.tracer.StartSpan("discovery")
+	devices, err := o.discover()
+	span.SetAttribute("devices", strconv.Itoa(len(devices)))
+	span.End(err)
+	stopSpinner()
 	if err != nil {
 		return nil, err
 	}
 
+	// Every device found is recorded, including the ones claiming the
+	// same address as another.
+	found := make([]*Device, len(devices))
+	for i := range devices {
+		found[i] = &devices[i]
+	}
+	o.recordDevices(found)
+
 	o.devices = map[string]*Device{}
 	for i, device := range devices {
 		o.devices[device.IP.String()] = &devices[i]
+		progress.DeviceFound(&devices[i])
 	}
 
 	return o.devices, nil
 }
 
+// updateServerFor returns the custom update server base URL configured
+// for a device, if any.
+func (o *OTAUpdater) updateServerFor(device *Device) string {
+	for _, key := range []string{device.IP.String(), device.HostName} {
+		if updateServer, ok := o.deviceUpdateServers[key]; ok {
+			return strings.TrimSuffix(updateServer, "/")
+		}
+	}
+
+	return strings.TrimSuffix(o.updateServer, "/")
+}
+
+// servesLocally returns true if a device is going to fetch its firmware
+// from the local OTA server.
+func (o *OTAUpdater) servesLocally(device *Device) bool {
+	if o.pullsFromCloud(device) || o.fetchesUpstream(device) {
+		return false
+	}
+
+	return o.updateServerFor(device) == ""
+}
+
+// fetchesUpstream returns true if a device is going to fetch its
+// firmware from the URL it is published at by the firmware index, as
+// downloads are disabled.
+func (o *OTAUpdater) fetchesUpstream(device *Device) bool {
+	return o.noDownload && !o.pullsFromCloud(device) && o.updateServerFor(device) == "" && o.upstreamURL(device) != ""
+}
+
+// upstreamURL returns the URL the firmware a device is upgraded to is
+// published at by the firmware index, if known.
+func (o *OTAUpdater) upstreamURL(device *Device) string {
+	firmwares, err := o.api.FetchVersions()
+	if err != nil {
+		return ""
+	}
+
+	if o.betaDevices[device.ID()] && firmwares[device.Model].BetaURL != "" {
+		return firmwares[device.Model].BetaURL
+	}
+
+	firmwareURL, err := o.api.GetURL(device.Model)
+	if err != nil {
+		return ""
+	}
+
+	return firmwareURL
+}
+
+// pullsFromCloud returns true if a Gen2 device is going to update
+// directly from the Shelly servers using a release stage.
+func (o *OTAUpdater) pullsFromCloud(device *Device) bool {
+	// Devices updating from a release stage would install a blocked
+	// version, so the non-blocked alternative is served instead.
+	// Devices with cloud access disabled cannot reach the Shelly servers
+	// either.
+	return device.IsGen2() && o.stage != "" && !o.api.replaced[device.Model] && !device.CloudDisabled
+}
+
+// FirmwareURL returns the URL advertised to a device to fetch its
+// firmware from, which is either the local OTA server, a custom update
+// server or, if downloads are disabled, the URL the firmware is
+// published at.
+func (o *OTAUpdater) FirmwareURL(device *Device) string {
+	if updateServer := o.updateServerFor(device); updateServer != "" {
+		return fmt.Sprintf("%s/%s", updateServer, device.Model)
+	}
+
+	if o.fetchesUpstream(device) {
+		return o.upstreamURL(device)
+	}
+
+	// The path identifies the device, so that downloads are accounted to
+	// it regardless of the address it connects from.
+	firmwareURL := fmt.Sprintf("http://%s/fw/%s/%s", net.JoinHostPort(o.advertisedIP(device).String(), strconv.Itoa(o.serverPort)), url.PathEscape(device.ID()), device.Model)
+	if o.betaDevices[device.ID()] {
+		firmwareURL += "/beta"
+	}
+
+	return firmwareURL
+}
+
 // UpgradeDevice requests a device to be upgraded by asking it
 // to contact the OTA server for the most recent firmware version.
-func (o *OTAUpdater) UpgradeDevice(device *Device) error {
-	url := fmt.Sprintf("%s/ota?url=http://%s:%d/%s", device.GetBaseURL(), o.serverIP.String(), o.serverPort, device.Model)
+// Gen2 devices are upgraded via the Shelly.Update RPC method, either
+// from a firmware URL or from a Shelly release stage.
+func (o *OTAUpdater) UpgradeDevice(device *Device) (err error) {
+	span := o.tracer.StartSpan("upgrade", "device", device.String(), "model", device.Model, "from", device.CurrentFWVersion, "to", device.NewFWVersion)
+	defer func() { span.End(err) }()
+
+	otaURL := fmt.Sprintf("%s/ota?url=%s", device.GetBaseURL(), url.QueryEscape(o.FirmwareURL(device)))
+
+	if device.IsGen2() {
+		if o.pullsFromCloud(device) {
+			otaURL = fmt.Sprintf("%s/rpc/Shelly.Update?stage=%s", device.GetBaseURL(), o.stage)
+		} else {
+			otaURL = fmt.Sprintf("%s/rpc/Shelly.Update?url=%s", device.GetBaseURL(), url.QueryEscape(o.FirmwareURL(device)))
+		}
+	}
 
-	log.Debugf("Making OTA request to %s", url)
+	client := device.HTTPClient(10 * time.Second)
 
-	response, err := http.Get(url)
+	if !device.IsGen2() {
+		status, err := fetchOTAStatus(client, device)
+		if err != nil {
+			return &DeviceError{Device: device, Op: "upgrade", Err: err}
+		}
+
+		if status.Status == "updating" {
+			return &DeviceError{Device: device, Op: "upgrade", Err: ErrUpdateInProgress}
+		}
+	}
+
+	err = o.checkFreeSpace(client, device)
 	if err != nil {
-		log.Debug(err)
-		return err
+		return &DeviceError{Device: device, Op: "upgrade", Err: err}
 	}
 
-	responseData, err := ioutil.ReadAll(response.Body)
+	err = requestUpgrade(client, otaURL)
 	if err != nil {
-		log.Error(err)
-		return err
+		return &DeviceError{Device: device, Op: "upgrade", Err: err}
+	}
+
+	if !device.IsGen2() {
+		err = o.ensureStarted(client, device, otaURL)
+		if err != nil {
+			return &DeviceError{Device: device, Op: "upgrade", Err: err}
+		}
+	}
+
+	err = o.waitForUpdate(device)
+	if err != nil {
+		return &DeviceError{Device: device, Op: "upgrade", Err: err}
 	}
 
-	log.Debugf("Received OTA response: %s", string(responseData))
+	return nil
+}
+
+// requestUpgrade makes an OTA request to a device.
+func requestUpgrade(client *http.Client, otaURL string) error {
+	upgradeLog.Debugf("Making OTA request to %s", otaURL)
+
+	response, err := client.Get(otaURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
 
 	defer response.Body.Close()
 
-	time.Sleep(10 * time.Second)
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	upgradeLog.Debugf("Received OTA response: %s", string(responseData))
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		return ErrAuthRequired
+	case response.StatusCode != http.StatusOK:
+		return fmt.Errorf("%w (status %v: %s)", ErrManualUpgradeRequired, response.StatusCode, strings.TrimSpace(string(responseData)))
+	}
 
 	return nil
 }
 
+// waitForUpdate polls a device after an OTA request until the update
+// is underway, which is when the device reboots into the new firmware
+// or already reports it. Gen1 devices are polled on their /ota endpoint
+// and Gen2 devices on the Shelly.GetStatus RPC method, whose uptime going
+// backwards tells a reboot. Devices becoming unreachable are only taken
+// to be rebooting once they were seen updating, as they may as well have
+// never started.
+func (o *OTAUpdater) waitForUpdate(device *Device) error {
+	client := device.HTTPClient(2 * time.Second)
+
+	deadline, limited := o.deadlineFor(device, o.otaTimeout)
+
+	updating := false
+	uptime := int64(-1)
+
+	for o.clock.Now().Before(deadline) {
+		o.clock.Sleep(time.Second)
+
+		var err error
+		if device.IsGen2() {
+			var status Gen2Status
+			status, err = fetchGen2Status(client, device)
+			if err == nil {
+				if status.Sys.Uptime < uptime {
+					upgradeLog.Debugf("Device %v has rebooted", device.String())
+					return nil
+				}
+
+				uptime = status.Sys.Uptime
+
+				// Devices still offered the new firmware are running the
+				// previous one, downloading the update.
+				if offersVersion(status.Sys.AvailableUpdates, device.NewFWVersion) {
+					upgradeLog.Debugf("Device %v is updating", device.String())
+					updating = true
+					continue
+				}
+			}
+		} else {
+			var status OTAStatus
+			status, err = fetchOTAStatus(client, device)
+			if err == nil && status.Status == "updating" {
+				upgradeLog.Debugf("Device %v is updating", device.String())
+				updating = true
+				continue
+			}
+		}
+
+		if err == nil {
+			current := *device
+			err = fetchDeviceSettings(client, &current)
+			if err == nil && current.CurrentFWVersion == device.NewFWVersion {
+				return nil
+			}
+		}
+
+		if errors.Is(err, ErrDeviceUnreachable) {
+			if updating {
+				upgradeLog.Debugf("Device %v is rebooting (%v)", device.String(), err)
+				return nil
+			}
+
+			upgradeLog.Debugf("Device %v is unreachable before it was seen updating (%v)", device.String(), err)
+		}
+	}
+
+	if limited {
+		return fmt.Errorf("%w (%v) before the device started updating", ErrDeviceDeadlineExceeded, o.deviceDeadline)
+	}
+
+	return fmt.Errorf("device did not start updating within %v", o.otaTimeout)
+}
+
+// offersVersion returns true if a Gen2 device reports an update to the
+// given version among its available updates.
+func offersVersion(updates Gen2UpdateCheck, version string) bool {
+	return version != "" && (updates.Stable.Version == version || updates.Beta.Version == version)
+}
+
+// Busy Gen1 devices sometimes ignore OTA requests, so they are given
+// otaStartTimeout to start updating before the request is made again,
+// waiting otaRetryBackoff (doubled on each retry) in between.
+const (
+	otaStartTimeout = 10 * time.Second
+	otaRetryBackoff = 5 * time.Second
+)
+
+// ensureStarted polls the /ota endpoint of a Gen1 device after an OTA
+// request until it reports an update in progress (or reboots), making
+// the request again with exponential backoff up to the configured number
+// of retries.
+func (o *OTAUpdater) ensureStarted(client *http.Client, device *Device, otaURL string) error {
+	backoff := otaRetryBackoff
+
+	for retry := 0; ; retry++ {
+		if o.startedUpdating(client, device) {
+			return nil
+		}
+
+		deadline, limited := o.deadlineFor(device, backoff)
+		if limited && !o.clock.Now().Before(deadline) {
+			return fmt.Errorf("%w (%v) before the device started updating", ErrDeviceDeadlineExceeded, o.deviceDeadline)
+		}
+
+		if retry >= o.otaRetries {
+			return fmt.Errorf("%w after %v request(s)", ErrUpdateNotStarted, retry+1)
+		}
+
+		upgradeLog.Warnf("%v (%v) has not started updating, requesting the upgrade again in %v (retry %v of %v)", device.ModelName(), device.IP, backoff, retry+1, o.otaRetries)
+
+		o.clock.Sleep(backoff)
+		backoff *= 2
+
+		err := requestUpgrade(client, otaURL)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// startedUpdating polls the /ota endpoint of a Gen1 device for up to
+// otaStartTimeout, returning true once it reports an update in progress,
+// becomes unreachable while rebooting or already runs the new firmware.
+func (o *OTAUpdater) startedUpdating(client *http.Client, device *Device) bool {
+	deadline, _ := o.deadlineFor(device, otaStartTimeout)
+
+	for o.clock.Now().Before(deadline) {
+		o.clock.Sleep(time.Second)
+
+		status, err := fetchOTAStatus(client, device)
+		if errors.Is(err, ErrDeviceUnreachable) || status.Status == "updating" {
+			return true
+		}
+
+		current := *device
+		err = fetchDeviceSettings(client, &current)
+		if errors.Is(err, ErrDeviceUnreachable) || current.CurrentFWVersion == device.NewFWVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deadlineFor returns when a device step with the given timeout must
+// end, which is earlier if the device's time budget runs out first. The
+// second return value reports whether the device budget applies.
+func (o *OTAUpdater) deadlineFor(device *Device, timeout time.Duration) (time.Time, bool) {
+	deadline := o.clock.Now().Add(timeout)
+
+	if deviceDeadline, ok := o.deadlines[device.ID()]; ok && deviceDeadline.Before(deadline) {
+		return deviceDeadline, true
+	}
+
+	return deadline, false
+}
+
 // Upgrade prompts the end-user to decide whether or not to
 // perform an upgrade of a device.
 func (o *OTAUpdater) Upgrade() error {
@@ -320,33 +1455,317 @@ func (o *OTAUpdater) Upgrade() error {
 		return err
 	}
 
+	o.reconcileCloud(devices)
+
+	history, err := LoadHistory(o.historyPath)
+	if err != nil {
+		return err
+	}
+
+	limits, err := o.rolloutLimits(devices)
+	if err != nil {
+		return err
+	}
+
+	err = o.startRun()
+	if err != nil {
+		return err
+	}
+
+	upgraded := map[string]int{}
+
+	canaries, others := o.partitionCanaries(devices)
+	o.orderDevices(canaries)
+	o.orderDevices(others)
+
+	// Canaries are upgraded first and must remain healthy for the whole
+	// soak period before the remaining devices are upgraded.
+	upgradedCanaries, err := o.upgradeDevices(canaries, history, limits, upgraded)
+	if err == errInterrupted {
+		o.finishRun(true)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = o.soakCanaries(upgradedCanaries)
+	if err != nil {
+		return err
+	}
+
+	upgradedDevices, err := o.upgradeDevices(others, history, limits, upgraded)
+	if err != nil && err != errInterrupted {
+		return err
+	}
+
+	interrupted := err == errInterrupted
+	o.finishRun(interrupted)
+
+	// Canaries have already been verified during the soak period.
+	if o.verifyTimeout > 0 {
+		err = o.reportVerificationFailures(o.VerifyDevices(upgradedDevices))
+		if err != nil {
+			return err
+		}
+	}
+
+	if !interrupted {
+		o.soakDevices(append(upgradedCanaries, upgradedDevices...))
+	}
+
+	return nil
+}
+
+// upgradeDevices prompts for and upgrades each out-of-date device,
+// respecting rollout limits, and returns the devices upgraded.
+func (o *OTAUpdater) upgradeDevices(devices []*Device, history *History, limits map[string]int, upgraded map[string]int) ([]*Device, error) {
+	var upgradedDevices []*Device
+
 	for _, device := range devices {
+		audit.Considered(device)
+
 		if device.CurrentFWVersion == device.NewFWVersion {
-			log.Infof("Skipping %v (%v) as firmware version is up-to-date (%v)", device.ModelName(), device.IP, device.CurrentFWVersion)
+			upgradeLog.Infof("Skipping %v (%v) as firmware version is up-to-date (%v)", device.ModelName(), device.IP, device.CurrentFWVersion)
+			audit.Skipped(auditUpgrade, device, "up-to-date", "firmware version is up-to-date")
 			continue
 		}
 
-		upgrade := false
+		if entry, ok := o.runState.Handled(device); ok {
+			upgradeLog.Infof("Skipping %v (%v) as it was already %v by the interrupted run", device.ModelName(), device.IP, entry.Outcome)
+			audit.Skipped(auditUpgrade, device, "resume", fmt.Sprintf("already %v by the interrupted run", entry.Outcome))
+			continue
+		}
 
-		if !o.force {
-			prompt := &survey.Confirm{
-				Message: fmt.Sprintf("Would you like to upgrade %v (%v) from %v to %v?", device.ModelName(), device.IP, device.CurrentFWVersion, device.NewFWVersion),
-			}
+		if readOnlyMode {
+			upgradeLog.Infof("Not upgrading %v (%v) to %v in read-only mode", device.ModelName(), device.IP, device.NewFWVersion)
+			audit.Skipped(auditUpgrade, device, "read-only", "read-only mode")
+			o.skipped = append(o.skipped, SkippedDevice{Device: device, Err: ErrReadOnly})
+			continue
+		}
+
+		if limit, ok := limits[device.Model]; ok && upgraded[device.Model] >= limit {
+			upgradeLog.Infof("Deferring %v (%v) to a later run as the rollout limit for %v has been reached", device.ModelName(), device.IP, device.Model)
+			audit.Skipped(auditUpgrade, device, "rollout", fmt.Sprintf("rollout limit of %v for %v reached", limit, device.Model))
+			o.skipped = append(o.skipped, SkippedDevice{Device: device, Err: ErrRolloutDeferred})
+			continue
+		}
 
-			err := survey.AskOne(prompt, &upgrade)
+		status := newStatusOnce(device.HTTPClient(o.deviceTimeout), device)
+
+		if err := o.checkLoad(device, status); err != nil {
+			audit.Skipped(auditUpgrade, device, "max-load", err.Error())
+			o.skipped = append(o.skipped, SkippedDevice{Device: device, Err: err})
+			continue
+		}
+
+		rule, err := o.skipRule(device, status)
+		if err != nil {
+			upgradeLog.Warnf("Deferring %v (%v) to a later run as its skip rules cannot be evaluated (%v)", device.ModelName(), device.IP, err)
+			audit.Skipped(auditUpgrade, device, "skip_if", err.Error())
+			o.skipped = append(o.skipped, SkippedDevice{Device: device, Err: err})
+			continue
+		}
+
+		if rule != nil {
+			upgradeLog.Infof("Deferring %v (%v) to a later run as it matches the skip rule %q", device.ModelName(), device.IP, rule.Source)
+			audit.Skipped(auditUpgrade, device, "skip_if", rule.Source)
+			o.skipped = append(o.skipped, SkippedDevice{Device: device, Err: ErrSkipRule})
+			continue
+		}
+
+		o.warnProfileChanges(device)
+
+		if !o.force {
+			upgrade, err := o.promptUpgrade(device)
 			if err == terminal.InterruptErr {
-				break
+				return upgradedDevices, errInterrupted
 			} else if err != nil {
-				return err
+				return upgradedDevices, err
 			}
 
+			audit.Prompted(auditUpgrade, device, upgrade, false)
+
 			if !upgrade {
+				o.recordRun(device, runOutcomeDeclined)
 				continue
 			}
+		} else {
+			audit.Prompted(auditUpgrade, device, true, true)
+		}
+
+		if o.deviceDeadline > 0 {
+			o.deadlines[device.ID()] = o.clock.Now().Add(o.deviceDeadline)
+		}
+
+		startedAt := o.clock.Now()
+
+		o.snapshotConfig(device)
+
+		o.downloads.expect(device)
+		progress.UpgradeStarted(device)
+
+		err = o.UpgradeDevice(device)
+		audit.Acted(auditUpgrade, device, err)
+		if err != nil {
+			console.Failed(device, err, o.clock.Now().Sub(startedAt))
+			progress.UpgradeFailed(device, err)
+			o.failed = append(o.failed, device)
+			o.skipped = append(o.skipped, SkippedDevice{Device: device, Err: err})
+
+			if errors.Is(err, ErrManualUpgradeRequired) {
+				o.manualUpgrade(device)
+			}
+
+			continue
+		}
+
+		console.Upgraded(device, o.clock.Now().Sub(startedAt))
+
+		upgraded[device.Model]++
+		upgradedDevices = append(upgradedDevices, device)
+		o.upgraded = append(o.upgraded, device)
+
+		o.recordRun(device, runOutcomeUpgraded)
+
+		history.Record(device)
+		err = history.Save()
+		if err != nil {
+			return upgradedDevices, err
+		}
+	}
+
+	return upgradedDevices, nil
+}
+
+// warnProfileChanges warns about the breaking changes crossed by the
+// upgrade of a device that are specific to its profile, such as the
+// loss of roller calibration, before it is upgraded.
+func (o *OTAUpdater) warnProfileChanges(device *Device) {
+	diff := changelog.Diff(device.Generation, device.Profile, device.CurrentFWVersion, device.NewFWVersion)
+
+	for _, entry := range diff.Breaking {
+		if len(entry.Profiles) == 0 {
+			continue
+		}
+
+		profile := device.Profile
+		if profile == "" {
+			profile = "unknown"
+		}
+
+		upgradeLog.Warnf("%v (%v) running the %v profile is affected by a breaking change in %v: %v", device.ModelName(), device.IP, profile, entry.Version, entry.Breaking)
+	}
+}
+
+// promptUpgrade asks whether a device should be upgraded. If the model
+// has a beta firmware newer than the stable one and betas have not been
+// enabled for the whole run, the choice between both is offered.
+func (o *OTAUpdater) promptUpgrade(device *Device) (bool, error) {
+	betaFWVersion := ""
+	if !o.includeBetas && (o.servesLocally(device) || o.fetchesUpstream(device)) {
+		betaFWVersion = o.api.GetBetaVersion(device.Model)
+	}
+
+	if betaFWVersion == "" {
+		return o.confirm(device, fmt.Sprintf("Would you like to upgrade %v (%v) from %v to %v?", device.ModelName(), device.IP, device.CurrentFWVersion, device.NewFWVersion))
+	}
+
+	stable := fmt.Sprintf("Upgrade to %v (stable)", releaseVersion(device.NewFWVersion))
+	beta := fmt.Sprintf("Upgrade to %v (beta)", releaseVersion(betaFWVersion))
+	prompt := &survey.Select{
+		Message: fmt.Sprintf("Would you like to upgrade %v (%v) from %v?", device.ModelName(), device.IP, device.CurrentFWVersion),
+		Options: []string{stable, beta, "Skip"},
+	}
+
+	var answer string
+	err := survey.AskOne(prompt, &answer)
+	if err != nil {
+		return false, err
+	}
+
+	if answer != "Skip" && o.isCritical(device) {
+		confirmed, err := o.confirm(device, fmt.Sprintf("%v for %v (%v).", answer, device.ModelName(), device.IP))
+		if err != nil || !confirmed {
+			return false, err
+		}
+	}
+
+	switch answer {
+	case stable:
+		return true, nil
+	case beta:
+		err = o.serveBetaFirmware(device.Model)
+		if err != nil {
+			return false, err
 		}
 
-		o.UpgradeDevice(device)
+		device.NewFWVersion = betaFWVersion
+		o.betaDevices[device.ID()] = true
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// serveBetaFirmware downloads the beta firmware for a model, if not
+// already done, and serves it on the local OTA server under
+// /<model>/beta.
+func (o *OTAUpdater) serveBetaFirmware(model string) error {
+	if o.servedBeta[model] {
+		return nil
 	}
 
+	firmwares, err := o.api.FetchVersions()
+	if err != nil {
+		return err
+	}
+
+	firmware := firmwares[model]
+	filename, err := o.download(model, firmware.BetaVersion, firmware.BetaURL, firmware.BetaSHA256)
+	if err != nil {
+		return err
+	}
+
+	o.firmwareSizes.record(model+"/beta", filename)
+
+	serverLog.Debugf("Adding HTTP handler for /%v/beta", model)
+
+	o.mux.HandleFunc("/"+model+"/beta", o.trackDownloads(func(w http.ResponseWriter, r *http.Request) {
+		serveFirmwareFile(w, r, filename)
+	}))
+	o.servedBeta[model] = true
+
 	return nil
 }
+
+// rolloutLimits returns the maximum number of devices to upgrade in
+// this run for each model with a rollout policy.
+func (o *OTAUpdater) rolloutLimits(devices map[string]*Device) (map[string]int, error) {
+	totals := map[string]int{}
+	outdated := map[string]int{}
+	for _, device := range devices {
+		totals[device.Model]++
+		if device.CurrentFWVersion != device.NewFWVersion {
+			outdated[device.Model]++
+		}
+	}
+
+	limits := map[string]int{}
+	for model, policy := range o.rollout {
+		if totals[model] == 0 {
+			continue
+		}
+
+		limit, err := rolloutLimit(policy, totals[model])
+		if err != nil {
+			return nil, err
+		}
+
+		upgradeLog.Infof("Rolling out firmware for %v: %v of %v devices up-to-date, upgrading up to %v in this run", model, totals[model]-outdated[model], totals[model], limit)
+
+		limits[model] = limit
+	}
+
+	return limits, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errPinMismatch = errors.New("certificate does not match any pinned public key")
+
+// pinnedHTTPClient returns an HTTP client that, in addition to the
+// regular certificate verification, requires the certificate chain of
+// pinned hosts to contain one of their pinned public keys. Pins are the
+// base64-encoded SHA-256 hashes of a certificate's SubjectPublicKeyInfo
+// (as used by HPKP), optionally prefixed by "sha256/". Pins are checked
+// on every TLS handshake, including the ones made through a proxy.
+func pinnedHTTPClient(pins map[string][]string, base *tls.Config) *http.Client {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		hostPins, ok := pins[state.ServerName]
+		if !ok {
+			return nil
+		}
+
+		return verifyPins(state.ServerName, hostPins, state.VerifiedChains)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+	}
+}
+
+// verifyPins checks that a verified certificate chain contains one of
+// the pinned public keys.
+func verifyPins(host string, pins []string, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, certificate := range chain {
+			sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+			pin := base64.StdEncoding.EncodeToString(sum[:])
+
+			for _, expected := range pins {
+				if strings.TrimPrefix(expected, "sha256/") == pin {
+					return nil
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("%v: %w", host, errPinMismatch)
+}
+
+// securePinnedURL upgrades plain HTTP URLs of pinned hosts to HTTPS, as
+// pinning would otherwise be bypassed by firmware download links.
+func securePinnedURL(rawURL string, pins map[string][]string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "http" {
+		return rawURL
+	}
+
+	if _, ok := pins[parsed.Hostname()]; !ok {
+		return rawURL
+	}
+
+	parsed.Scheme = "https"
+
+	return parsed.String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ProbeCache is a persistent record of the results of probing devices
+// via /shelly, keyed by MAC address, so that repeated runs and daemon
+// cycles skip probing devices that have not changed. A nil ProbeCache
+// is disabled.
+type ProbeCache struct {
+	mutex   sync.Mutex
+	path    string
+	Entries map[string]ProbeResult `json:"entries"`
+}
+
+// ProbeResult holds the results of probing a device, along with the
+// address it was reached at.
+type ProbeResult struct {
+	IP         string    `json:"ip"`
+	Port       int       `json:"port"`
+	HostName   string    `json:"hostname"`
+	Model      string    `json:"model"`
+	Generation int       `json:"generation"`
+	Auth       bool      `json:"auth"`
+	ProbedAt   time.Time `json:"probed_at"`
+}
+
+// LoadProbeCache reads the probe cache file at path. A missing file
+// results in an empty cache.
+func LoadProbeCache(path string) (*ProbeCache, error) {
+	cache := &ProbeCache{path: path, Entries: map[string]ProbeResult{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache.Entries == nil {
+		cache.Entries = map[string]ProbeResult{}
+	}
+
+	return cache, nil
+}
+
+// Lookup returns the probe results of a device found at the same
+// address and with the same hostname as when it was last probed.
+func (c *ProbeCache) Lookup(device *Device) (ProbeResult, bool) {
+	if c == nil {
+		return ProbeResult{}, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, result := range c.Entries {
+		if result.IP == device.IP.String() && result.Port == device.Port && result.HostName == device.HostName {
+			return result, true
+		}
+	}
+
+	return ProbeResult{}, false
+}
+
+// Store records the probe results of a device under its MAC address.
+func (c *ProbeCache) Store(device *Device, info ShellyInfo) {
+	if c == nil || device.MAC == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Entries[device.MAC] = ProbeResult{
+		IP:         device.IP.String(),
+		Port:       device.Port,
+		HostName:   device.HostName,
+		Model:      device.Model,
+		Generation: device.Generation,
+		Auth:       info.AuthRequired(),
+		ProbedAt:   time.Now(),
+	}
+}
+
+// Forget removes the probe results of a device, so that it is probed
+// again on the next run.
+func (c *ProbeCache) Forget(device *Device) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for mac, result := range c.Entries {
+		if result.IP == device.IP.String() && result.Port == device.Port && result.HostName == device.HostName {
+			delete(c.Entries, mac)
+		}
+	}
+}
+
+// Save writes the probe cache to disk.
+func (c *ProbeCache) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(c.path, data, 0600)
+}
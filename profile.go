@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// activeProfile is the configuration profile given with --profile, whose
+// state is kept apart from the state of other profiles.
+var activeProfile string
+
+// Profile returns the configuration of a named profile: the settings of
+// the configuration file, overridden by the ones given for the profile.
+// Maps (e.g. rollout) are merged with the ones of the configuration
+// file, while lists (e.g. inventory) replace them.
+func (c Config) Profile(name string) (Config, error) {
+	node, ok := c.Profiles[name]
+	if !ok {
+		var names []string
+		for profile := range c.Profiles {
+			names = append(names, profile)
+		}
+		sort.Strings(names)
+
+		if len(names) == 0 {
+			return Config{}, fmt.Errorf("unknown profile %q, no profiles are configured", name)
+		}
+
+		return Config{}, fmt.Errorf("unknown profile %q, must be one of %v", name, strings.Join(names, ", "))
+	}
+
+	// The configuration file is decoded again, so that the maps of the
+	// profile are not shared with the ones of the configuration file.
+	profile, err := parseConfig(c.data)
+	if err != nil {
+		return Config{}, err
+	}
+
+	err = node.Decode(&profile)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid profile %q (%v)", name, err)
+	}
+
+	return profile, nil
+}
+
+// stateDir returns the directory where mota keeps its state (upgrade
+// history, probe cache and run state) on the OS cache or temp
+// directories, in a subdirectory per profile. Firmware files and the
+// firmware index are shared by every profile.
+func stateDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	dir := filepath.Join(cacheDir, "com.github.ruimarinho.mota")
+	if activeProfile != "" {
+		dir = filepath.Join(dir, "profiles", activeProfile)
+	}
+
+	return dir
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress event names, as emitted in the event field.
+const (
+	eventDiscoveryStarted = "discovery_started"
+	eventDeviceFound      = "device_found"
+	eventDownloadProgress = "download_progress"
+	eventUpgradeStarted   = "upgrade_started"
+	eventUpgradeFailed    = "upgrade_failed"
+	eventUpgradeVerified  = "upgrade_verified"
+	eventRunSummary       = "run_summary"
+)
+
+// downloadProgressStep is how many bytes of a firmware file are
+// downloaded between download_progress events.
+const downloadProgressStep = 256 << 10
+
+var progress = NewProgress(nil)
+
+// ProgressEvent is a machine-readable progress event. Fields that do not
+// apply to an event are omitted.
+type ProgressEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Device      string    `json:"device,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	Model       string    `json:"model,omitempty"`
+	FromVersion string    `json:"from_version,omitempty"`
+	ToVersion   string    `json:"to_version,omitempty"`
+	Bytes       int64     `json:"bytes,omitempty"`
+	Upgraded    *int      `json:"upgraded,omitempty"`
+	Failed      *int      `json:"failed,omitempty"`
+	Skipped     *int      `json:"skipped,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Progress writes progress events as newline-delimited JSON (one event
+// per line), so that GUIs and wrappers can render the progress of a run
+// without parsing its log output. A Progress without a writer discards
+// every event.
+type Progress struct {
+	out   io.Writer
+	mutex sync.Mutex
+}
+
+// NewProgress returns a Progress writing events to out, or discarding
+// them if out is nil.
+func NewProgress(out io.Writer) *Progress {
+	return &Progress{out: out}
+}
+
+func (p *Progress) emit(event ProgressEvent) {
+	if p.out == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.out.Write(append(data, '\n'))
+}
+
+// deviceEvent returns an event about a device.
+func deviceEvent(name string, device *Device) ProgressEvent {
+	return ProgressEvent{
+		Event:       name,
+		Device:      device.ID(),
+		IP:          device.IP.String(),
+		Model:       device.Model,
+		FromVersion: device.CurrentFWVersion,
+		ToVersion:   device.NewFWVersion,
+	}
+}
+
+// DiscoveryStarted reports that device discovery has started.
+func (p *Progress) DiscoveryStarted() {
+	p.emit(ProgressEvent{Event: eventDiscoveryStarted})
+}
+
+// DeviceFound reports a device found during discovery.
+func (p *Progress) DeviceFound(device *Device) {
+	p.emit(deviceEvent(eventDeviceFound, device))
+}
+
+// FirmwareDownload reports the bytes of a firmware file downloaded so
+// far by mota.
+func (p *Progress) FirmwareDownload(model string, version string, written int64) {
+	p.emit(ProgressEvent{Event: eventDownloadProgress, Model: model, ToVersion: version, Bytes: written})
+}
+
+// DeviceDownload reports the bytes of firmware downloaded by a device
+// from the local OTA server.
+func (p *Progress) DeviceDownload(device *Device, written int64) {
+	event := deviceEvent(eventDownloadProgress, device)
+	event.Bytes = written
+
+	p.emit(event)
+}
+
+// UpgradeStarted reports that a device is being asked to upgrade.
+func (p *Progress) UpgradeStarted(device *Device) {
+	p.emit(deviceEvent(eventUpgradeStarted, device))
+}
+
+// UpgradeFailed reports a device that failed to upgrade.
+func (p *Progress) UpgradeFailed(device *Device, err error) {
+	event := deviceEvent(eventUpgradeFailed, device)
+	event.Error = err.Error()
+
+	p.emit(event)
+}
+
+// UpgradeVerified reports an upgraded device that came back online with
+// its new firmware.
+func (p *Progress) UpgradeVerified(device *Device) {
+	p.emit(deviceEvent(eventUpgradeVerified, device))
+}
+
+// RunSummary reports how many devices were upgraded, failed to upgrade
+// or were skipped at the end of a run.
+func (p *Progress) RunSummary(upgraded int, failed int, skipped int) {
+	p.emit(ProgressEvent{Event: eventRunSummary, Upgraded: &upgraded, Failed: &failed, Skipped: &skipped})
+}
+
+// progressReader reports the progress of a firmware download every
+// downloadProgressStep bytes and once it completes.
+type progressReader struct {
+	io.Reader
+	model    string
+	version  string
+	written  int64
+	reported int64
+}
+
+func (r *progressReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	r.written += int64(n)
+
+	if r.written-r.reported >= downloadProgressStep || (err == io.EOF && r.written > r.reported) {
+		r.reported = r.written
+		progress.FirmwareDownload(r.model, r.version, r.written)
+	}
+
+	return n, err
+}
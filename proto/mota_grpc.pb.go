@@ -0,0 +1,262 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: proto/mota.proto
+
+package motapb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Mota_ListDevices_FullMethodName    = "/mota.v1.Mota/ListDevices"
+	Mota_CheckVersions_FullMethodName  = "/mota.v1.Mota/CheckVersions"
+	Mota_Upgrade_FullMethodName        = "/mota.v1.Mota/Upgrade"
+	Mota_StreamProgress_FullMethodName = "/mota.v1.Mota/StreamProgress"
+)
+
+// MotaClient is the client API for Mota service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MotaClient interface {
+	// ListDevices returns the devices found on the last discovery run.
+	ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error)
+	// CheckVersions requests a discovery run right away, refreshing the
+	// firmware versions available for each device.
+	CheckVersions(ctx context.Context, in *CheckVersionsRequest, opts ...grpc.CallOption) (*CheckVersionsResponse, error)
+	// Upgrade requests a discovery run right away, after which the given
+	// devices (by IP address, hostname or MAC address) are upgraded.
+	Upgrade(ctx context.Context, in *UpgradeRequest, opts ...grpc.CallOption) (*UpgradeResponse, error)
+	// StreamProgress streams the progress of the daemon, such as the start
+	// and end of discovery runs and the result of each upgrade.
+	StreamProgress(ctx context.Context, in *StreamProgressRequest, opts ...grpc.CallOption) (Mota_StreamProgressClient, error)
+}
+
+type motaClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMotaClient(cc grpc.ClientConnInterface) MotaClient {
+	return &motaClient{cc}
+}
+
+func (c *motaClient) ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error) {
+	out := new(ListDevicesResponse)
+	err := c.cc.Invoke(ctx, Mota_ListDevices_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *motaClient) CheckVersions(ctx context.Context, in *CheckVersionsRequest, opts ...grpc.CallOption) (*CheckVersionsResponse, error) {
+	out := new(CheckVersionsResponse)
+	err := c.cc.Invoke(ctx, Mota_CheckVersions_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *motaClient) Upgrade(ctx context.Context, in *UpgradeRequest, opts ...grpc.CallOption) (*UpgradeResponse, error) {
+	out := new(UpgradeResponse)
+	err := c.cc.Invoke(ctx, Mota_Upgrade_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *motaClient) StreamProgress(ctx context.Context, in *StreamProgressRequest, opts ...grpc.CallOption) (Mota_StreamProgressClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Mota_ServiceDesc.Streams[0], Mota_StreamProgress_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &motaStreamProgressClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Mota_StreamProgressClient interface {
+	Recv() (*ProgressEvent, error)
+	grpc.ClientStream
+}
+
+type motaStreamProgressClient struct {
+	grpc.ClientStream
+}
+
+func (x *motaStreamProgressClient) Recv() (*ProgressEvent, error) {
+	m := new(ProgressEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MotaServer is the server API for Mota service.
+// All implementations must embed UnimplementedMotaServer
+// for forward compatibility
+type MotaServer interface {
+	// ListDevices returns the devices found on the last discovery run.
+	ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error)
+	// CheckVersions requests a discovery run right away, refreshing the
+	// firmware versions available for each device.
+	CheckVersions(context.Context, *CheckVersionsRequest) (*CheckVersionsResponse, error)
+	// Upgrade requests a discovery run right away, after which the given
+	// devices (by IP address, hostname or MAC address) are upgraded.
+	Upgrade(context.Context, *UpgradeRequest) (*UpgradeResponse, error)
+	// StreamProgress streams the progress of the daemon, such as the start
+	// and end of discovery runs and the result of each upgrade.
+	StreamProgress(*StreamProgressRequest, Mota_StreamProgressServer) error
+	mustEmbedUnimplementedMotaServer()
+}
+
+// UnimplementedMotaServer must be embedded to have forward compatible implementations.
+type UnimplementedMotaServer struct {
+}
+
+func (UnimplementedMotaServer) ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDevices not implemented")
+}
+func (UnimplementedMotaServer) CheckVersions(context.Context, *CheckVersionsRequest) (*CheckVersionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckVersions not implemented")
+}
+func (UnimplementedMotaServer) Upgrade(context.Context, *UpgradeRequest) (*UpgradeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Upgrade not implemented")
+}
+func (UnimplementedMotaServer) StreamProgress(*StreamProgressRequest, Mota_StreamProgressServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamProgress not implemented")
+}
+func (UnimplementedMotaServer) mustEmbedUnimplementedMotaServer() {}
+
+// UnsafeMotaServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MotaServer will
+// result in compilation errors.
+type UnsafeMotaServer interface {
+	mustEmbedUnimplementedMotaServer()
+}
+
+func RegisterMotaServer(s grpc.ServiceRegistrar, srv MotaServer) {
+	s.RegisterService(&Mota_ServiceDesc, srv)
+}
+
+func _Mota_ListDevices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDevicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MotaServer).ListDevices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mota_ListDevices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MotaServer).ListDevices(ctx, req.(*ListDevicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mota_CheckVersions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckVersionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MotaServer).CheckVersions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mota_CheckVersions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MotaServer).CheckVersions(ctx, req.(*CheckVersionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mota_Upgrade_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpgradeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MotaServer).Upgrade(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mota_Upgrade_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MotaServer).Upgrade(ctx, req.(*UpgradeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mota_StreamProgress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamProgressRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MotaServer).StreamProgress(m, &motaStreamProgressServer{stream})
+}
+
+type Mota_StreamProgressServer interface {
+	Send(*ProgressEvent) error
+	grpc.ServerStream
+}
+
+type motaStreamProgressServer struct {
+	grpc.ServerStream
+}
+
+func (x *motaStreamProgressServer) Send(m *ProgressEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Mota_ServiceDesc is the grpc.ServiceDesc for Mota service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Mota_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mota.v1.Mota",
+	HandlerType: (*MotaServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListDevices",
+			Handler:    _Mota_ListDevices_Handler,
+		},
+		{
+			MethodName: "CheckVersions",
+			Handler:    _Mota_CheckVersions_Handler,
+		},
+		{
+			MethodName: "Upgrade",
+			Handler:    _Mota_Upgrade_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamProgress",
+			Handler:       _Mota_StreamProgress_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/mota.proto",
+}
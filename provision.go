@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// accessPointAddress is the address of Shelly devices on their own
+// access point, which factory-new devices start in.
+const accessPointAddress = "192.168.33.1"
+
+// WiFiConfig is the configuration of the Gen2 WiFi.SetConfig RPC method,
+// limited to the station (client) settings.
+type WiFiConfig struct {
+	STA struct {
+		SSID   string `json:"ssid"`
+		Pass   string `json:"pass"`
+		Enable bool   `json:"enable"`
+	} `json:"sta"`
+}
+
+// scanAccessPoints returns the SSIDs of the Wi-Fi networks in range. It
+// relies on NetworkManager and fails on hosts without it.
+var scanAccessPoints = func() ([]string, error) {
+	output, err := exec.Command("nmcli", "-t", "-f", "SSID", "device", "wifi", "list", "--rescan", "yes").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan for Wi-Fi networks with nmcli (%v)", err)
+	}
+
+	var ssids []string
+	for _, ssid := range strings.Split(string(output), "\n") {
+		if ssid = strings.TrimSpace(ssid); ssid != "" {
+			ssids = append(ssids, ssid)
+		}
+	}
+
+	return ssids, nil
+}
+
+// joinAccessPoint connects the host to a Wi-Fi network via
+// NetworkManager, with an empty password for open networks.
+var joinAccessPoint = func(ssid string, password string) error {
+	args := []string{"device", "wifi", "connect", ssid}
+	if password != "" {
+		args = append(args, "password", password)
+	}
+
+	output, err := exec.Command("nmcli", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to join %v (%v: %v)", ssid, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// isShellyAccessPoint returns true if an SSID is the access point of a
+// Shelly device in AP mode, such as shelly1-A1B2C3 or
+// ShellyPlus1PM-A1B2C3D4E5F6.
+func isShellyAccessPoint(ssid string) bool {
+	return strings.HasPrefix(strings.ToLower(ssid), "shelly")
+}
+
+// shellyAccessPoints returns the SSIDs of the Shelly devices in AP mode
+// in range.
+func shellyAccessPoints() ([]string, error) {
+	ssids, err := scanAccessPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	var accessPoints []string
+	for _, ssid := range ssids {
+		if isShellyAccessPoint(ssid) {
+			accessPoints = append(accessPoints, ssid)
+		}
+	}
+
+	return accessPoints, nil
+}
+
+// ProvisionDevice configures a device in AP mode to join a Wi-Fi network,
+// filling in its generation, model and MAC address so that it can be
+// found once it joins the network.
+func ProvisionDevice(client *http.Client, device *Device, ssid string, password string) error {
+	info, err := probeDevice(client, device)
+	if err != nil {
+		return &DeviceError{Device: device, Op: "provision", Err: err}
+	}
+
+	device.Generation = info.Generation()
+	device.MAC = strings.ToUpper(info.MAC)
+	device.Model = info.Type
+	if device.IsGen2() {
+		device.Model = info.App
+	}
+
+	if info.AuthRequired() && device.Password == "" {
+		return &DeviceError{Device: device, Op: "provision", Err: ErrAuthRequired}
+	}
+
+	var settingsURL string
+	if device.IsGen2() {
+		var config WiFiConfig
+		config.STA.SSID = ssid
+		config.STA.Pass = password
+		config.STA.Enable = true
+
+		encoded, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+
+		settingsURL = fmt.Sprintf("%s/rpc/WiFi.SetConfig?config=%s", device.GetBaseURL(), url.QueryEscape(string(encoded)))
+	} else {
+		settingsURL = fmt.Sprintf("%s/settings/sta?enabled=1&ssid=%s&key=%s", device.GetBaseURL(), url.QueryEscape(ssid), url.QueryEscape(password))
+	}
+
+	response, err := client.Get(settingsURL)
+	if err != nil {
+		return &DeviceError{Device: device, Op: "provision", Err: fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)}
+	}
+
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		return &DeviceError{Device: device, Op: "provision", Err: ErrAuthRequired}
+	case response.StatusCode != http.StatusOK:
+		return &DeviceError{Device: device, Op: "provision", Err: fmt.Errorf("unexpected status %v", response.StatusCode)}
+	}
+
+	return nil
+}
+
+// Provision finds the Shelly devices in AP mode in range, joins each of
+// their access points in turn and configures them to join a Wi-Fi
+// network, rejoining that network afterwards. On hosts where access
+// points cannot be scanned for, the device whose access point the host
+// is connected to is provisioned instead. It returns the provisioned
+// devices.
+func Provision(ssid string, password string, timeout time.Duration) ([]*Device, error) {
+	accessPoints, err := shellyAccessPoints()
+	if err != nil {
+		log.Warnf("%v, provisioning the device whose access point this host is connected to", err)
+		accessPoints = []string{""}
+	} else if len(accessPoints) == 0 {
+		return nil, errors.New("no Shelly devices in AP mode found")
+	}
+
+	var provisioned []*Device
+	for _, accessPoint := range accessPoints {
+		if accessPoint != "" {
+			log.Infof("Joining %v", accessPoint)
+
+			err := joinAccessPoint(accessPoint, "")
+			if err != nil {
+				log.Error(err.Error())
+				continue
+			}
+		}
+
+		device := &Device{IP: net.ParseIP(accessPointAddress), Port: 80}
+
+		err := ProvisionDevice(device.HTTPClient(timeout), device, ssid, password)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		log.Infof("Configured %v (%v) to join %v", device.ModelName(), device.MAC, ssid)
+
+		provisioned = append(provisioned, device)
+	}
+
+	if accessPoints[0] != "" {
+		log.Infof("Rejoining %v", ssid)
+
+		err := joinAccessPoint(ssid, password)
+		if err != nil {
+			return provisioned, err
+		}
+	}
+
+	return provisioned, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// readOnlyMode guarantees that no request changing the state of a
+// device (upgrades, reboots, settings) is made. It is enabled via
+// --read-only or, so that it cannot be turned off, by building mota with
+// the readonly tag.
+var readOnlyMode bool
+
+// readOnlyTransport rejects every request to a device other than the
+// ones known to only read its state.
+type readOnlyTransport struct {
+	base http.RoundTripper
+}
+
+func (t readOnlyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !isReadOnlyRequest(request) {
+		return nil, fmt.Errorf("%w: refusing to request %v", ErrReadOnly, request.URL.Path)
+	}
+
+	return t.base.RoundTrip(request)
+}
+
+// isReadOnlyRequest returns true if a request only reads the state of a
+// device: the /shelly, /status, /settings and /ota endpoints without
+// parameters (which would change settings or start an update), the RPC
+// methods getting or listing state and the checks for updates, which
+// do not install them.
+func isReadOnlyRequest(request *http.Request) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+
+	switch request.URL.Path {
+	case "/shelly", "/status", "/ota/check":
+		return true
+	case "/settings", "/ota":
+		return request.URL.RawQuery == ""
+	}
+
+	if !strings.HasPrefix(request.URL.Path, "/rpc/") {
+		return false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/rpc/"), ".", 2)
+
+	return len(parts) == 2 && (strings.HasPrefix(parts[1], "Get") || strings.HasPrefix(parts[1], "List") || parts[1] == "CheckForUpdate")
+}
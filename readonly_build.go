@@ -0,0 +1,8 @@
+//go:build readonly
+// +build readonly
+
+package main
+
+func init() {
+	readOnlyMode = true
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// registryJSON is the built-in list of known Shelly products. It can
+// be complemented at runtime with a remote registry in the same format.
+const registryJSON = `{
+	"devices": [
+		{"model": "SH2LED-1", "name": "Shelly 2 LED", "gen": 1},
+		{"model": "SHAIR-1", "name": "Shelly Air", "gen": 1},
+		{"model": "SHBDUO-1", "name": "Shelly Bulb Duo", "gen": 1},
+		{"model": "SHBLB-1", "name": "Shelly Bulb", "gen": 1},
+		{"model": "SHBTN-1", "name": "Shelly Button 1", "gen": 1},
+		{"model": "SHBTN-2", "name": "Shelly Button 1 (Rev. 2)", "gen": 1},
+		{"model": "SHCB-1", "name": "Shelly Color Bulb RGBW GU10", "gen": 1},
+		{"model": "SHCL-255", "name": "Shelly Color", "gen": 1},
+		{"model": "SHDIMW-1", "name": "Shelly Dimmer W1", "gen": 1},
+		{"model": "SHDM-1", "name": "Shelly Dimmer", "gen": 1},
+		{"model": "SHDM-2", "name": "Shelly Dimmer 2", "gen": 1},
+		{"model": "SHDW-1", "name": "Shelly Door/Window Sensor", "gen": 1},
+		{"model": "SHDW-2", "name": "Shelly Door/Window Sensor 2", "gen": 1},
+		{"model": "SHEM-3", "name": "Shelly 3EM", "gen": 1},
+		{"model": "SHEM", "name": "Shelly EM", "gen": 1},
+		{"model": "SHGS-1", "name": "Shelly Gas", "gen": 1},
+		{"model": "SHHT-1", "name": "Shelly H&T", "gen": 1},
+		{"model": "SHIX3-1", "name": "Shelly i3", "gen": 1},
+		{"model": "SHMOS-01", "name": "Shelly Motion", "gen": 1},
+		{"model": "SHPLG-1", "name": "Shelly Plug 1", "gen": 1},
+		{"model": "SHPLG-S", "name": "Shelly Plug S", "gen": 1},
+		{"model": "SHPLG-U1", "name": "Shelly Plug US", "gen": 1},
+		{"model": "SHPLG2-1", "name": "Shelly Plug 2", "gen": 1},
+		{"model": "SHRGBW2", "name": "Shelly RGBW2", "gen": 1},
+		{"model": "SHRGBWW-01", "name": "Shelly RGBW", "gen": 1},
+		{"model": "SHSEN-1", "name": "Shelly Sense", "gen": 1},
+		{"model": "SHSM-01", "name": "Shelly Smoke", "gen": 1},
+		{"model": "SHSM-02", "name": "Shelly Smoke", "gen": 1},
+		{"model": "SHSPOT-1", "name": "Shelly Spot", "gen": 1},
+		{"model": "SHSPOT-2", "name": "Shelly Spot 2", "gen": 1},
+		{"model": "SHSW-1", "name": "Shelly 1", "gen": 1},
+		{"model": "SHSW-21", "name": "Shelly 2", "gen": 1},
+		{"model": "SHSW-22", "name": "Shelly HD", "gen": 1},
+		{"model": "SHSW-25", "name": "Shelly 2.5", "gen": 1},
+		{"model": "SHSW-44", "name": "Shelly 4 Pro", "gen": 1},
+		{"model": "SHSW-L", "name": "Shelly 1L", "gen": 1},
+		{"model": "SHSW-PM", "name": "Shelly 1PM", "gen": 1},
+		{"model": "SHUNI-1", "name": "Shelly Uni", "gen": 1},
+		{"model": "SHVIN-1", "name": "Shelly Vintage", "gen": 1},
+		{"model": "SHWT-1", "name": "Shelly Flood", "gen": 1},
+		{"model": "SNSW-001X16EU", "name": "Shelly Plus 1", "gen": 2, "app": "Plus1"},
+		{"model": "SNSW-001P16EU", "name": "Shelly Plus 1PM", "gen": 2, "app": "Plus1PM"},
+		{"model": "SNSW-001X8EU", "name": "Shelly Plus 1 Mini", "gen": 2, "app": "Plus1Mini"},
+		{"model": "SNSW-001P8EU", "name": "Shelly Plus 1PM Mini", "gen": 2, "app": "Plus1PMMini"},
+		{"model": "SNSW-102P16EU", "name": "Shelly Plus 2PM", "gen": 2, "app": "Plus2PM"},
+		{"model": "SNDM-00100WW", "name": "Shelly Plus 0-10V Dimmer", "gen": 2, "app": "Plus10V"},
+		{"model": "SNSN-0013A", "name": "Shelly Plus H&T", "gen": 2, "app": "PlusHT"},
+		{"model": "SNSN-0024X", "name": "Shelly Plus i4", "gen": 2, "app": "PlusI4"},
+		{"model": "SNPL-00110IT", "name": "Shelly Plus Plug IT", "gen": 2, "app": "PlusPlugIT"},
+		{"model": "SNPL-00112EU", "name": "Shelly Plus Plug S", "gen": 2, "app": "PlusPlugS"},
+		{"model": "SNPL-00112UK", "name": "Shelly Plus Plug UK", "gen": 2, "app": "PlusPlugUK"},
+		{"model": "SNPL-00116US", "name": "Shelly Plus Plug US", "gen": 2, "app": "PlusPlugUS"},
+		{"model": "SNPM-001PCEU16", "name": "Shelly Plus PM Mini", "gen": 2, "app": "PlusPMMini"},
+		{"model": "SNDC-0D4P10WW", "name": "Shelly Plus RGBW PM", "gen": 2, "app": "PlusRGBWPM"},
+		{"model": "SNSN-0031Z", "name": "Shelly Plus Smoke", "gen": 2, "app": "PlusSmoke"},
+		{"model": "SNSN-0043X", "name": "Shelly Plus Uni", "gen": 2, "app": "PlusUni"},
+		{"model": "SNDM-0013US", "name": "Shelly Plus Wall Dimmer", "gen": 2, "app": "PlusWallDimmer"},
+		{"model": "SPSW-001XE16EU", "name": "Shelly Pro 1", "gen": 2, "app": "Pro1"},
+		{"model": "SPSW-001PE16EU", "name": "Shelly Pro 1PM", "gen": 2, "app": "Pro1PM"},
+		{"model": "SPSW-002XE16EU", "name": "Shelly Pro 2", "gen": 2, "app": "Pro2"},
+		{"model": "SPSW-002PE16EU", "name": "Shelly Pro 2PM", "gen": 2, "app": "Pro2PM"},
+		{"model": "SPSW-003XE16EU", "name": "Shelly Pro 3", "gen": 2, "app": "Pro3"},
+		{"model": "SPEM-003CEBEU", "name": "Shelly Pro 3EM", "gen": 2, "app": "Pro3EM"},
+		{"model": "SPSW-004PE16EU", "name": "Shelly Pro 4PM", "gen": 2, "app": "Pro4PM"},
+		{"model": "SPDM-001PE01EU", "name": "Shelly Pro Dimmer 1PM", "gen": 2, "app": "ProDimmer1PM"},
+		{"model": "SPDM-002PE01EU", "name": "Shelly Pro Dimmer 2PM", "gen": 2, "app": "ProDimmer2PM"},
+		{"model": "SPSH-002PE16EU", "name": "Shelly Pro Dual Cover PM", "gen": 2, "app": "ProDualCoverPM"},
+		{"model": "SPEM-002CEBEU50", "name": "Shelly Pro EM-50", "gen": 2, "app": "ProEM"},
+		{"model": "S3SW-001X16EU", "name": "Shelly 1 Gen3", "gen": 3, "app": "S1G3"},
+		{"model": "S3SW-001P16EU", "name": "Shelly 1PM Gen3", "gen": 3, "app": "S1PMG3"},
+		{"model": "S3SW-002P16EU", "name": "Shelly 2PM Gen3", "gen": 3, "app": "S2PMG3"},
+		{"model": "S3DM-0010WW", "name": "Shelly Dimmer 0/1-10V PM Gen3", "gen": 3, "app": "Dimmer0110VPMG3"},
+		{"model": "S3EM-002CXCEU", "name": "Shelly EM Gen3", "gen": 3, "app": "EMG3"},
+		{"model": "S3SN-0U12A", "name": "Shelly H&T Gen3", "gen": 3, "app": "HTG3"},
+		{"model": "S3SN-0024X", "name": "Shelly i4 Gen3", "gen": 3, "app": "I4G3"},
+		{"model": "S3SW-001X8EU", "name": "Shelly 1 Mini Gen3", "gen": 3, "app": "Mini1G3"},
+		{"model": "S3SW-001P8EU", "name": "Shelly 1PM Mini Gen3", "gen": 3, "app": "Mini1PMG3"},
+		{"model": "S3PM-001PCEU16", "name": "Shelly PM Mini Gen3", "gen": 3, "app": "MiniPMG3"},
+		{"model": "S3PL-00112EU", "name": "Shelly Plug S Gen3", "gen": 3, "app": "PlugSG3"},
+		{"model": "S3PL-20112EU", "name": "Shelly Outdoor Plug S Gen3", "gen": 3, "app": "OutdoorPlugSG3"},
+		{"model": "S3DM-0A101WWL", "name": "Shelly Dimmer Gen3", "gen": 3, "app": "DimmerG3"},
+		{"model": "S3GW-1DBT001", "name": "Shelly BLU Gateway Gen3", "gen": 3, "app": "BluGwG3"},
+		{"model": "S4SW-001X16EU", "name": "Shelly 1 Gen4", "gen": 4, "app": "S1G4"},
+		{"model": "S4SW-001P16EU", "name": "Shelly 1PM Gen4", "gen": 4, "app": "S1PMG4"},
+		{"model": "S4SW-002P16EU", "name": "Shelly 2PM Gen4", "gen": 4, "app": "S2PMG4"},
+		{"model": "S4SW-001X8EU", "name": "Shelly 1 Mini Gen4", "gen": 4, "app": "Mini1G4"},
+		{"model": "S4SW-001P8EU", "name": "Shelly 1PM Mini Gen4", "gen": 4, "app": "Mini1PMG4"},
+		{"model": "S4EM-001PXCEU16", "name": "Shelly EM Mini Gen4", "gen": 4, "app": "EMMiniG4"},
+		{"model": "S4PL-00116US", "name": "Shelly Plug US Gen4", "gen": 4, "app": "PlugUSG4"},
+		{"model": "S4SN-0071A", "name": "Shelly Flood Gen4", "gen": 4, "app": "FloodG4"}
+	]
+}`
+
+var registry = mustParseRegistry(registryJSON)
+
+// RegistryEntry describes a Shelly product: its hardware model, a
+// human-friendly name, the device generation, for Gen2 devices and
+// newer, the application name used to publish firmware and, optionally,
+// the URL of its manual upgrade instructions.
+type RegistryEntry struct {
+	Model      string `json:"model"`
+	Name       string `json:"name"`
+	Generation int    `json:"gen"`
+	App        string `json:"app,omitempty"`
+	Docs       string `json:"docs,omitempty"`
+}
+
+// Registry holds the known Shelly products, indexed by both hardware
+// model and application name.
+type Registry struct {
+	entries map[string]RegistryEntry
+	mutex   sync.RWMutex
+}
+
+// ParseRegistry parses a registry in JSON format.
+func ParseRegistry(data []byte) (*Registry, error) {
+	var document struct {
+		Devices []RegistryEntry `json:"devices"`
+	}
+
+	err := json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing registry: %v", err)
+	}
+
+	registry := &Registry{entries: map[string]RegistryEntry{}}
+	for _, entry := range document.Devices {
+		registry.add(entry)
+	}
+
+	return registry, nil
+}
+
+func mustParseRegistry(data string) *Registry {
+	registry, err := ParseRegistry([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+
+	return registry
+}
+
+// Lookup returns the entry for a hardware model or application name.
+func (r *Registry) Lookup(key string) (RegistryEntry, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entry, ok := r.entries[registryKey(key)]
+
+	return entry, ok
+}
+
+// App returns the application name used to publish firmware for a
+// hardware model or application name of a Gen2 device or newer, as
+// spelled in the registry, or an empty string if it is unknown.
+func (r *Registry) App(key string) string {
+	entry, _ := r.Lookup(key)
+
+	return entry.App
+}
+
+// Merge adds all entries of another registry, replacing existing
+// entries for the same model or application name.
+func (r *Registry) Merge(other *Registry) {
+	other.mutex.RLock()
+	defer other.mutex.RUnlock()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, entry := range other.entries {
+		r.entries[key] = entry
+	}
+}
+
+// Refresh fetches a remote registry and merges it into this one.
+func (r *Registry) Refresh(client *http.Client, url string) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %v fetching registry", response.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	other, err := ParseRegistry(data)
+	if err != nil {
+		return err
+	}
+
+	r.Merge(other)
+
+	return nil
+}
+
+func (r *Registry) add(entry RegistryEntry) {
+	if entry.Model != "" {
+		r.entries[registryKey(entry.Model)] = entry
+	}
+
+	if entry.App != "" {
+		r.entries[registryKey(entry.App)] = entry
+	}
+}
+
+// registryKey normalizes a model or application name for lookups, so
+// that variations in case and separators (e.g. "Plus1PM", "plus-1pm")
+// resolve to the same entry.
+func registryKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+
+		return -1
+	}, key)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// restartPending reports the devices that require a restart to apply a
+// previous upgrade and, if restarts are enabled, restarts them (after
+// confirmation, unless forced) so that they are evaluated for further
+// upgrades with the firmware they are actually running.
+func (o *OTAUpdater) restartPending(devices map[string]*Device) error {
+	for _, device := range sortedDevices(devices) {
+		if !device.RestartRequired {
+			continue
+		}
+
+		if readOnlyMode {
+			upgradeLog.Warnf("%v (%v) requires a restart to apply a previous upgrade", device.ModelName(), device.IP)
+			audit.Skipped(auditRestart, device, "read-only", "read-only mode")
+			continue
+		}
+
+		if !o.restart {
+			upgradeLog.Warnf("%v (%v) requires a restart to apply a previous upgrade (use --restart to restart it)", device.ModelName(), device.IP)
+			audit.Skipped(auditRestart, device, "restart", "restarts not enabled with --restart")
+			continue
+		}
+
+		if !o.force {
+			restart, err := o.confirm(device, fmt.Sprintf("%v (%v) requires a restart to apply a previous upgrade. Would you like to restart it now?", device.ModelName(), device.IP))
+			if err != nil {
+				return err
+			}
+
+			audit.Prompted(auditRestart, device, restart, false)
+
+			if !restart {
+				continue
+			}
+		} else {
+			audit.Prompted(auditRestart, device, true, true)
+		}
+
+		err := o.RestartDevice(device)
+		audit.Acted(auditRestart, device, err)
+		if err != nil {
+			upgradeLog.Error(err.Error())
+			continue
+		}
+
+		upgradeLog.Infof("Restarted %v (%v), which is now running firmware %v", device.ModelName(), device.IP, device.CurrentFWVersion)
+	}
+
+	return nil
+}
+
+// RestartDevice restarts a Gen2 device via the Shelly.Reboot RPC method
+// and waits for it to come back online without a restart pending,
+// refreshing its current firmware version.
+func (o *OTAUpdater) RestartDevice(device *Device) error {
+	response, err := device.HTTPClient(10 * time.Second).Get(device.GetBaseURL() + "/rpc/Shelly.Reboot")
+	if err != nil {
+		return &DeviceError{Device: device, Op: "restart", Err: fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)}
+	}
+
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		return &DeviceError{Device: device, Op: "restart", Err: ErrAuthRequired}
+	case response.StatusCode != http.StatusOK:
+		return &DeviceError{Device: device, Op: "restart", Err: fmt.Errorf("unexpected status %v", response.StatusCode)}
+	}
+
+	client := device.HTTPClient(2 * time.Second)
+	deadline := o.clock.Now().Add(o.otaTimeout)
+
+	for o.clock.Now().Before(deadline) {
+		o.clock.Sleep(time.Second)
+
+		current := *device
+		err := fetchDeviceStatus(client, &current)
+		if err != nil || current.RestartRequired {
+			upgradeLog.Debugf("Device %v is restarting", device.String())
+			continue
+		}
+
+		err = fetchDeviceSettings(client, &current)
+		if err != nil {
+			continue
+		}
+
+		device.CurrentFWVersion = current.CurrentFWVersion
+		device.RestartRequired = false
+
+		return nil
+	}
+
+	return &DeviceError{Device: device, Op: "restart", Err: fmt.Errorf("device did not come back online within %v", o.otaTimeout)}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// rolloutLimit returns how many devices of a model may be upgraded in
+// a single run according to a rollout policy, given the total number
+// of devices of that model. Policies are either a percentage of the
+// devices (e.g. 20%) or an absolute count (e.g. 5).
+func rolloutLimit(policy string, total int) (int, error) {
+	policy = strings.TrimSpace(policy)
+
+	if strings.HasSuffix(policy, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(policy, "%"), 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return 0, fmt.Errorf("invalid rollout percentage %q", policy)
+		}
+
+		limit := int(math.Ceil(float64(total) * percentage / 100))
+
+		// Always make progress on non-zero percentages, even on small fleets.
+		if limit == 0 && percentage > 0 && total > 0 {
+			limit = 1
+		}
+
+		return limit, nil
+	}
+
+	count, err := strconv.Atoi(policy)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid rollout count %q", policy)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SkipRule is a user-defined expression, given with skip_if in the
+// configuration file, deferring devices for which it holds to a later
+// run. Rules are evaluated right before upgrading a device against its
+// status (status.*, as returned by /status or Shelly.GetStatus) and its
+// details (device.model, device.generation, device.version and
+// device.name), e.g.:
+//
+//	status.switch0.apower > 100 && device.model == "SPSW-002XE16EU"
+//
+// Rules support the ==, !=, <, <=, >, >=, &&, || and ! operators,
+// parentheses, numbers, double-quoted strings, true and false. Path
+// segments may omit the colon of Gen2 component keys (switch0 for
+// switch:0) and index arrays (status.relays.0.ison). Paths missing from
+// the status evaluate to nothing, which is false and never equal to
+// anything.
+type SkipRule struct {
+	Source string
+	expr   ruleNode
+}
+
+// ruleNode is a node of the syntax tree of a rule.
+type ruleNode interface {
+	eval(env map[string]interface{}) interface{}
+}
+
+type ruleLiteral struct {
+	value interface{}
+}
+
+type rulePath struct {
+	segments []string
+}
+
+type ruleNot struct {
+	operand ruleNode
+}
+
+type ruleBinary struct {
+	operator string
+	left     ruleNode
+	right    ruleNode
+}
+
+// ParseSkipRule parses the expression of a skip rule.
+func ParseSkipRule(source string) (*SkipRule, error) {
+	tokens, err := tokenizeRule(source)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &ruleParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q", parser.tokens[parser.position])
+	}
+
+	return &SkipRule{Source: source, expr: expr}, nil
+}
+
+// Matches returns true if the rule holds for a device with the given
+// status.
+func (r *SkipRule) Matches(device *Device, status map[string]interface{}) bool {
+	env := map[string]interface{}{
+		"status": status,
+		"device": map[string]interface{}{
+			"model":      device.Model,
+			"generation": float64(device.Generation),
+			"version":    device.CurrentFWVersion,
+			"name":       device.Name(),
+		},
+	}
+
+	return truthy(r.expr.eval(env))
+}
+
+// tokenizeRule splits a rule into operators, parentheses, numbers,
+// strings (kept with their quotes) and paths.
+func tokenizeRule(source string) ([]string, error) {
+	var tokens []string
+
+	runes := []rune(source)
+	for index := 0; index < len(runes); {
+		char := runes[index]
+
+		switch {
+		case unicode.IsSpace(char):
+			index++
+		case char == '(' || char == ')':
+			tokens = append(tokens, string(char))
+			index++
+		case strings.ContainsRune("=!<>&|", char):
+			if index+1 < len(runes) {
+				operator := string(runes[index : index+2])
+				switch operator {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					tokens = append(tokens, operator)
+					index += 2
+					continue
+				}
+			}
+
+			if char != '!' && char != '<' && char != '>' {
+				return nil, fmt.Errorf("unexpected %q", string(char))
+			}
+
+			tokens = append(tokens, string(char))
+			index++
+		case char == '"':
+			end := index + 1
+			for end < len(runes) && runes[end] != '"' {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+
+			tokens = append(tokens, string(runes[index:end+1]))
+			index = end + 1
+		case unicode.IsDigit(char) || char == '-' || char == '.':
+			end := index + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+
+			tokens = append(tokens, string(runes[index:end]))
+			index = end
+		case unicode.IsLetter(char) || char == '_':
+			end := index + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || strings.ContainsRune("_:-.", runes[end])) {
+				end++
+			}
+
+			tokens = append(tokens, string(runes[index:end]))
+			index = end
+		default:
+			return nil, fmt.Errorf("unexpected %q", string(char))
+		}
+	}
+
+	return tokens, nil
+}
+
+// ruleParser is a recursive descent parser of rules, where || binds
+// looser than &&, which binds looser than !, which binds looser than
+// comparisons.
+type ruleParser struct {
+	tokens   []string
+	position int
+}
+
+func (p *ruleParser) peek() string {
+	if p.position < len(p.tokens) {
+		return p.tokens[p.position]
+	}
+
+	return ""
+}
+
+func (p *ruleParser) next() string {
+	token := p.peek()
+	p.position++
+
+	return token
+}
+
+func (p *ruleParser) parseOr() (ruleNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "||" {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = ruleBinary{operator: "||", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "&&" {
+		p.next()
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = ruleBinary{operator: "&&", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) parseNot() (ruleNode, error) {
+	if p.peek() == "!" {
+		p.next()
+
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return ruleNot{operand: operand}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *ruleParser) parseComparison() (ruleNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator := p.peek(); operator {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		return ruleBinary{operator: operator, left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) parseOperand() (ruleNode, error) {
+	token := p.next()
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of rule")
+	case token == "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+
+		return expr, nil
+	case token == "true" || token == "false":
+		return ruleLiteral{value: token == "true"}, nil
+	case strings.HasPrefix(token, `"`):
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %v", token)
+		}
+
+		return ruleLiteral{value: value}, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '-' || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+
+		return ruleLiteral{value: value}, nil
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		segments := strings.Split(token, ".")
+		if segments[0] != "status" && segments[0] != "device" {
+			return nil, fmt.Errorf("unknown %q, paths must start with status or device", segments[0])
+		}
+
+		return rulePath{segments: segments}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+func (n ruleLiteral) eval(env map[string]interface{}) interface{} {
+	return n.value
+}
+
+func (n rulePath) eval(env map[string]interface{}) interface{} {
+	var value interface{} = env
+
+	for _, segment := range n.segments {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			field, ok := container[segment]
+			if !ok {
+				field = componentField(container, segment)
+			}
+
+			value = field
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(container) {
+				return nil
+			}
+
+			value = container[index]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+// componentField returns the field of a Gen2 status matching a path
+// segment without the colon of component keys (e.g. switch0 for
+// switch:0), or nil if there is none.
+func componentField(container map[string]interface{}, segment string) interface{} {
+	for key, field := range container {
+		if strings.Replace(key, ":", "", 1) == segment {
+			return field
+		}
+	}
+
+	return nil
+}
+
+func (n ruleNot) eval(env map[string]interface{}) interface{} {
+	return !truthy(n.operand.eval(env))
+}
+
+func (n ruleBinary) eval(env map[string]interface{}) interface{} {
+	switch n.operator {
+	case "&&":
+		return truthy(n.left.eval(env)) && truthy(n.right.eval(env))
+	case "||":
+		return truthy(n.left.eval(env)) || truthy(n.right.eval(env))
+	}
+
+	left, right := n.left.eval(env), n.right.eval(env)
+	if !scalar(left) || !scalar(right) {
+		return false
+	}
+
+	switch n.operator {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	}
+
+	if leftNumber, ok := left.(float64); ok {
+		rightNumber, ok := right.(float64)
+		if !ok {
+			return false
+		}
+
+		return compareOrdered(n.operator, leftNumber < rightNumber, leftNumber == rightNumber)
+	}
+
+	if leftString, ok := left.(string); ok {
+		rightString, ok := right.(string)
+		if !ok {
+			return false
+		}
+
+		return compareOrdered(n.operator, leftString < rightString, leftString == rightString)
+	}
+
+	return false
+}
+
+func compareOrdered(operator string, less bool, equal bool) bool {
+	switch operator {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+
+	return false
+}
+
+// scalar returns true for the values rules can compare: booleans,
+// numbers and strings.
+func scalar(value interface{}) bool {
+	switch value.(type) {
+	case bool, float64, string:
+		return true
+	}
+
+	return false
+}
+
+// truthy returns whether a value holds: true, non-zero numbers and
+// non-empty strings hold, while missing paths, objects and arrays do
+// not.
+func truthy(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	}
+
+	return false
+}
+
+// parseSkipRules parses the skip rules of the configuration file.
+func parseSkipRules(sources []string) ([]*SkipRule, error) {
+	var rules []*SkipRule
+
+	for _, source := range sources {
+		rule, err := ParseSkipRule(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid skip_if rule %q (%v)", source, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// skipRule returns the first skip rule holding for a device, reading
+// its status right before upgrading it, or nil if none does. Devices
+// whose status cannot be read are deferred, returning an error wrapping
+// ErrSkipRule, as the rules cannot be evaluated.
+func (o *OTAUpdater) skipRule(device *Device, status *statusOnce) (*SkipRule, error) {
+	if len(o.skipRules) == 0 {
+		return nil, nil
+	}
+
+	data, err := status.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to read its status (%v)", ErrSkipRule, err)
+	}
+
+	var values map[string]interface{}
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to parse its status (%v)", ErrSkipRule, err)
+	}
+
+	for _, rule := range o.skipRules {
+		if rule.Matches(device, values) {
+			return rule, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Outcomes of the devices handled by a run.
+const (
+	runOutcomeUpgraded = "upgraded"
+	runOutcomeDeclined = "declined"
+)
+
+// RunState is the working state of a run, written as each device is
+// upgraded or declined and removed once the run completes, so that a run
+// interrupted by a crash or Ctrl-C can be resumed without prompting for
+// the devices it already handled.
+type RunState struct {
+	path    string
+	Started time.Time                `json:"started"`
+	Devices map[string]RunStateEntry `json:"devices"`
+}
+
+// RunStateEntry holds the outcome of a device handled by a run.
+type RunStateEntry struct {
+	IP        string    `json:"ip"`
+	Model     string    `json:"model"`
+	ToVersion string    `json:"to_version"`
+	Outcome   string    `json:"outcome"`
+	Time      time.Time `json:"time"`
+}
+
+// NewRunState returns the empty state of a run starting now, written to
+// path.
+func NewRunState(path string) *RunState {
+	return &RunState{path: path, Started: time.Now(), Devices: map[string]RunStateEntry{}}
+}
+
+// LoadRunState reads the state of an interrupted run at path, returning
+// nil if there is none.
+func LoadRunState(path string) (*RunState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := NewRunState(path)
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Handled returns the outcome of a device already handled by the run for
+// the version it is to be upgraded to. Devices offered a different
+// version since are handled again.
+func (s *RunState) Handled(device *Device) (RunStateEntry, bool) {
+	if s == nil {
+		return RunStateEntry{}, false
+	}
+
+	entry, ok := s.Devices[device.ID()]
+	if !ok || entry.ToVersion != device.NewFWVersion {
+		return RunStateEntry{}, false
+	}
+
+	return entry, true
+}
+
+// Record saves the outcome of a device handled by the run.
+func (s *RunState) Record(device *Device, outcome string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.Devices[device.ID()] = RunStateEntry{
+		IP:        device.IP.String(),
+		Model:     device.Model,
+		ToVersion: device.NewFWVersion,
+		Outcome:   outcome,
+		Time:      time.Now(),
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.path, data, 0600)
+}
+
+// Remove deletes the state of a completed run.
+func (s *RunState) Remove() error {
+	if s == nil {
+		return nil
+	}
+
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// startRun loads the state of the interrupted run to resume or starts
+// a new one, warning if an interrupted run is being started over.
+func (o *OTAUpdater) startRun() error {
+	if o.runStatePath == "" {
+		return nil
+	}
+
+	state, err := LoadRunState(o.runStatePath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case o.resume && state != nil:
+		upgradeLog.Infof("Resuming the run interrupted on %v, skipping the %v device(s) it handled", state.Started.Format(time.RFC1123), len(state.Devices))
+		o.runState = state
+		return nil
+	case o.resume:
+		upgradeLog.Warn("There is no interrupted run to resume, starting a new one")
+	case state != nil && len(state.Devices) > 0:
+		upgradeLog.Warnf("Starting over the run interrupted on %v, use --resume to continue it instead", state.Started.Format(time.RFC1123))
+	}
+
+	o.runState = NewRunState(o.runStatePath)
+
+	return nil
+}
+
+// recordRun records the outcome of a device in the state of the run.
+func (o *OTAUpdater) recordRun(device *Device, outcome string) {
+	err := o.runState.Record(device, outcome)
+	if err != nil {
+		upgradeLog.Warnf("Unable to save the state of the run to %v (%v)", o.runStatePath, err)
+	}
+}
+
+// finishRun removes the state of a run that was not interrupted, or
+// explains how to resume it otherwise.
+func (o *OTAUpdater) finishRun(interrupted bool) {
+	if interrupted {
+		if o.runState != nil && len(o.runState.Devices) > 0 {
+			upgradeLog.Info("Run mota again with --resume to continue where this run left off")
+		}
+
+		return
+	}
+
+	err := o.runState.Remove()
+	if err != nil {
+		upgradeLog.Warnf("Unable to remove the state of the run from %v (%v)", o.runStatePath, err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Release holds information about a mota release published on GitHub.
+type Release struct {
+	TagName string `json:"tag_name"`
+	Body    string `json:"body"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// Version returns the release version without the leading "v".
+func (r *Release) Version() string {
+	return strings.TrimPrefix(r.TagName, "v")
+}
+
+// Highlights returns up to max lines of the release notes, skipping
+// blank lines and headings.
+func (r *Release) Highlights(max int) []string {
+	var highlights []string
+	for _, line := range strings.Split(r.Body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if len(highlights) == max {
+			break
+		}
+
+		highlights = append(highlights, line)
+	}
+
+	return highlights
+}
+
+// AssetURL returns the download URL of a release asset.
+func (r *Release) AssetURL(name string) (string, error) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+
+	return "", fmt.Errorf("release %v has no asset %v", r.TagName, name)
+}
+
+// SelfUpdater replaces the running mota binary with the latest release
+// published on GitHub, after verifying its checksum.
+type SelfUpdater struct {
+	currentVersion string
+	executable     string
+	httpClient     *http.Client
+	releasesURL    string
+}
+
+// SelfUpdaterOption is an option interface for SelfUpdater.
+type SelfUpdaterOption func(*SelfUpdater)
+
+// WithReleasesURL is a SelfUpdater option that allows overriding the
+// GitHub releases API URL.
+func WithReleasesURL(releasesURL string) SelfUpdaterOption {
+	return func(s *SelfUpdater) {
+		s.releasesURL = releasesURL
+	}
+}
+
+// WithExecutable is a SelfUpdater option that sets the path of the
+// binary to replace, which defaults to the running executable.
+func WithExecutable(executable string) SelfUpdaterOption {
+	return func(s *SelfUpdater) {
+		s.executable = executable
+	}
+}
+
+// WithSelfUpdaterTimeout is a SelfUpdater option that sets the timeout
+// of requests to GitHub.
+func WithSelfUpdaterTimeout(timeout time.Duration) SelfUpdaterOption {
+	return func(s *SelfUpdater) {
+		s.httpClient.Timeout = timeout
+	}
+}
+
+// WithCurrentVersion is a SelfUpdater option that sets the version of
+// the binary being replaced.
+func WithCurrentVersion(currentVersion string) SelfUpdaterOption {
+	return func(s *SelfUpdater) {
+		s.currentVersion = currentVersion
+	}
+}
+
+// NewSelfUpdater returns an instance of SelfUpdater with the default
+// options.
+func NewSelfUpdater(options ...SelfUpdaterOption) (*SelfUpdater, error) {
+	updater := &SelfUpdater{
+		currentVersion: version,
+		httpClient: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+		releasesURL: "https://api.github.com/repos/ruimarinho/mota/releases",
+	}
+
+	for _, option := range options {
+		option(updater)
+	}
+
+	if updater.executable == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+
+		executable, err = filepath.EvalSymlinks(executable)
+		if err != nil {
+			return nil, err
+		}
+
+		updater.executable = executable
+	}
+
+	return updater, nil
+}
+
+// LatestRelease fetches the latest release and reports whether it is
+// newer than the running version. Development builds are never reported
+// as outdated, and neither are releases older than the running version.
+func (s *SelfUpdater) LatestRelease() (*Release, bool, error) {
+	response, err := s.httpClient.Get(s.releasesURL + "/latest")
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, false, fmt.Errorf("unexpected status %v fetching latest release", response.StatusCode)
+	}
+
+	var release Release
+	err = json.NewDecoder(response.Body).Decode(&release)
+	if err != nil {
+		return nil, false, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	if s.currentVersion == "master" {
+		return &release, false, nil
+	}
+
+	return &release, compareFirmwareVersions(release.Version(), strings.TrimPrefix(s.currentVersion, "v")) > 0, nil
+}
+
+// NewerRelease returns the latest release if it is newer than the
+// running version, or nil otherwise.
+func (s *SelfUpdater) NewerRelease() (*Release, error) {
+	release, available, err := s.LatestRelease()
+	if err != nil || !available {
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// printNewerRelease prints the latest release, along with the start of
+// its release notes, if it is newer than the running version.
+func printNewerRelease(out io.Writer, s *SelfUpdater) error {
+	release, err := s.NewerRelease()
+	if err != nil || release == nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nmota %v is available (run mota self-update to upgrade):\n", release.Version())
+
+	for _, line := range release.Highlights(5) {
+		fmt.Fprintf(out, "  %v\n", line)
+	}
+
+	return nil
+}
+
+// Update downloads the release archive for the current platform,
+// verifies it against the published checksums and replaces the binary.
+func (s *SelfUpdater) Update(release *Release) error {
+	archiveName := releaseArchiveName(release.Version(), runtime.GOOS, runtime.GOARCH)
+
+	checksum, err := s.fetchChecksum(release, archiveName)
+	if err != nil {
+		return err
+	}
+
+	archiveURL, err := release.AssetURL(archiveName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Downloading %v", archiveURL)
+
+	archive, err := s.fetch(archiveURL)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(archive)
+	if hex.EncodeToString(sum[:]) != checksum {
+		return fmt.Errorf("checksum mismatch for %v (expected %v, got %x)", archiveName, checksum, sum)
+	}
+
+	binary, err := extractBinary(archiveName, archive)
+	if err != nil {
+		return err
+	}
+
+	return s.replace(binary)
+}
+
+// fetchChecksum returns the SHA-256 checksum of a release asset from
+// the checksums file published with the release.
+func (s *SelfUpdater) fetchChecksum(release *Release, name string) (string, error) {
+	checksumsURL, err := release.AssetURL(fmt.Sprintf("mota_%v_checksums.txt", release.Version()))
+	if err != nil {
+		return "", err
+	}
+
+	checksums, err := s.fetch(checksumsURL)
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+
+	return "", fmt.Errorf("no checksum published for %v", name)
+}
+
+func (s *SelfUpdater) fetch(url string) ([]byte, error) {
+	response, err := s.httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %v fetching %v", response.StatusCode, url)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// replace writes the new binary next to the executable and renames it
+// over the original. Windows does not allow replacing a running
+// executable, so it is moved aside first.
+func (s *SelfUpdater) replace(binary []byte) error {
+	dir := filepath.Dir(s.executable)
+
+	file, err := ioutil.TempFile(dir, ".mota-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(binary)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(file.Name(), 0755)
+	if err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		old := s.executable + ".old"
+		os.Remove(old)
+
+		err = os.Rename(s.executable, old)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(file.Name(), s.executable)
+}
+
+// releaseArchiveName returns the name of the release archive for a
+// platform, following the naming scheme in .goreleaser.yml.
+func releaseArchiveName(version string, goos string, goarch string) string {
+	osNames := map[string]string{"darwin": "macOS", "linux": "Linux", "windows": "Windows"}
+	archNames := map[string]string{"amd64": "x86_64"}
+
+	osName := osNames[goos]
+	if osName == "" {
+		osName = goos
+	}
+
+	archName := archNames[goarch]
+	if archName == "" {
+		archName = goarch
+	}
+
+	// macOS releases are published as universal binaries.
+	if goos == "darwin" {
+		archName = "all"
+	}
+
+	extension := "tar.gz"
+	if goos == "windows" {
+		extension = "zip"
+	}
+
+	return fmt.Sprintf("mota_%v_%v_%v.%v", version, osName, archName, extension)
+}
+
+// extractBinary returns the mota binary contained in a release archive.
+func extractBinary(name string, archive []byte) ([]byte, error) {
+	if strings.HasSuffix(name, ".zip") {
+		reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range reader.File {
+			if filepath.Base(file.Name) != "mota.exe" {
+				continue
+			}
+
+			contents, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer contents.Close()
+
+			return ioutil.ReadAll(contents)
+		}
+
+		return nil, fmt.Errorf("archive %v does not contain mota.exe", name)
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag == tar.TypeReg && filepath.Base(header.Name) == "mota" {
+			return ioutil.ReadAll(tarReader)
+		}
+	}
+
+	return nil, fmt.Errorf("archive %v does not contain mota", name)
+}
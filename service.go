@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	serviceName     = "mota"
+	systemdUnitPath = "/etc/systemd/system/mota.service"
+)
+
+var errServiceUnsupported = errors.New("installing mota as a service is only supported on Linux with systemd and on Windows")
+
+// systemdUnit returns a systemd unit running the daemon with the given
+// arguments.
+func systemdUnit(executable string, args []string) string {
+	command := []string{systemdQuote(executable), "daemon", "run"}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+
+	return fmt.Sprintf(`[Unit]
+Description=Shelly firmware updater
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%v
+Restart=on-failure
+RestartSec=30
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(command, " "))
+}
+
+// systemdQuote quotes an argument for the ExecStart line of a systemd
+// unit, if needed.
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// installSystemdService registers the daemon as a systemd service
+// started on boot, passing it the given daemon arguments.
+func installSystemdService(args []string) error {
+	if runtime.GOOS != "linux" {
+		return errServiceUnsupported
+	}
+
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return errServiceUnsupported
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(systemdUnitPath, []byte(systemdUnit(executable, args)), 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Installed systemd unit %v", systemdUnitPath)
+
+	err = systemctl("daemon-reload")
+	if err != nil {
+		return err
+	}
+
+	return systemctl("enable", "--now", serviceName)
+}
+
+// uninstallSystemdService stops and removes the systemd service.
+func uninstallSystemdService() error {
+	if runtime.GOOS != "linux" {
+		return errServiceUnsupported
+	}
+
+	err := systemctl("disable", "--now", serviceName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(systemdUnitPath)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Removed systemd unit %v", systemdUnitPath)
+
+	return systemctl("daemon-reload")
+}
+
+func systemctl(args ...string) error {
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %v failed: %v (%v)", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// underSystemd returns true if mota is running as a systemd service,
+// with its output connected to the journal.
+func underSystemd() bool {
+	return os.Getenv("JOURNAL_STREAM") != "" && os.Getenv("INVOCATION_ID") != ""
+}
+
+// journalHandler returns a log handler writing entries to out for the
+// systemd journal, which adds its own timestamps and reads the priority
+// from a prefix.
+func journalHandler(out io.Writer) slog.Handler {
+	return messageHandler(func(level slog.Level, message string) error {
+		// Syslog priorities, as documented in sd-daemon(3).
+		priority := 6
+		switch {
+		case level >= levelFatal:
+			priority = 2
+		case level >= slog.LevelError:
+			priority = 3
+		case level >= slog.LevelWarn:
+			priority = 4
+		case level < slog.LevelInfo:
+			priority = 7
+		}
+
+		_, err := fmt.Fprintf(out, "<%v>%v\n", priority, message)
+		return err
+	})
+}
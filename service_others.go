@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// installService registers the daemon as a service started on boot,
+// passing it the given daemon arguments.
+func installService(args []string) error {
+	return installSystemdService(args)
+}
+
+// uninstallService stops and removes the service.
+func uninstallService() error {
+	return uninstallSystemdService()
+}
+
+// runService runs the daemon. Under systemd, its output already goes to
+// the journal.
+func runService(run func()) error {
+	run()
+
+	return nil
+}
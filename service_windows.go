@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/kardianos/service"
+)
+
+// windowsService runs the daemon under the Windows service manager,
+// which stops it by ending the process once Stop returns.
+type windowsService struct {
+	run func()
+}
+
+// Start implements service.Interface.
+func (s *windowsService) Start(service.Service) error {
+	go s.run()
+
+	return nil
+}
+
+// Stop implements service.Interface.
+func (s *windowsService) Stop(service.Service) error {
+	return nil
+}
+
+// newWindowsService returns the Windows service running the daemon with
+// the given arguments.
+func newWindowsService(run func(), args []string) (service.Service, error) {
+	return service.New(&windowsService{run: run}, &service.Config{
+		Name:        serviceName,
+		DisplayName: serviceName,
+		Description: "Shelly firmware updater",
+		Arguments:   append([]string{"daemon", "run"}, args...),
+	})
+}
+
+// installService registers the daemon as a Windows service started on
+// boot, passing it the given daemon arguments, and starts it.
+func installService(args []string) error {
+	s, err := newWindowsService(nil, args)
+	if err != nil {
+		return err
+	}
+
+	err = s.Install()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Installed Windows service %v", serviceName)
+
+	return s.Start()
+}
+
+// uninstallService stops and removes the Windows service.
+func uninstallService() error {
+	s, err := newWindowsService(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	err = s.Stop()
+	if err != nil {
+		log.Warnf("Unable to stop the Windows service %v (%v)", serviceName, err)
+	}
+
+	err = s.Uninstall()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Removed Windows service %v", serviceName)
+
+	return nil
+}
+
+// runService runs the daemon, under the Windows service manager if
+// started by it, in which case its output goes to the event log.
+func runService(run func()) error {
+	if service.Interactive() {
+		run()
+		return nil
+	}
+
+	s, err := newWindowsService(run, nil)
+	if err != nil {
+		return err
+	}
+
+	logger, err := s.Logger(nil)
+	if err != nil {
+		return err
+	}
+
+	setLogHandler(eventLogHandler(logger))
+
+	return s.Run()
+}
+
+// eventLogHandler returns a log handler writing entries to the Windows
+// event log, with the matching event types.
+func eventLogHandler(logger service.Logger) slog.Handler {
+	return messageHandler(func(level slog.Level, message string) error {
+		switch {
+		case level >= slog.LevelError:
+			return logger.Error(message)
+		case level >= slog.LevelWarn:
+			return logger.Warning(message)
+		}
+
+		return logger.Info(message)
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SoakIssue holds what went wrong with an upgraded device during the
+// soak period: restarts (its uptime going back, as after a reboot or a
+// crash) and outages.
+type SoakIssue struct {
+	Device *Device
+	Events []string
+}
+
+// SoakDevices keeps polling the status of upgraded devices for the soak
+// period, and returns the devices that restarted or became unreachable
+// in the meantime.
+func (o *OTAUpdater) SoakDevices(devices []*Device) []SoakIssue {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	upgradeLog.Infof("Soaking %v upgraded device(s) for %v", len(devices), o.soak)
+
+	interval := 30 * time.Second
+	if o.soak < interval {
+		interval = o.soak
+	}
+
+	uptimes := map[string]time.Duration{}
+	unreachable := map[string]bool{}
+	events := map[string][]string{}
+	start := o.clock.Now()
+	deadline := start.Add(o.soak)
+
+	for {
+		elapsed := o.clock.Now().Sub(start).Round(time.Second)
+
+		for _, device := range devices {
+			current := *device
+
+			err := fetchDeviceStatus(device.HTTPClient(5*time.Second), &current)
+			if err != nil {
+				// Outages are reported once, until the device is reachable again.
+				if !unreachable[device.ID()] {
+					upgradeLog.Warnf("%v (%v) became unreachable after %v of soak (%v)", device.ModelName(), device.IP, elapsed, err)
+					events[device.ID()] = append(events[device.ID()], fmt.Sprintf("unreachable after %v", elapsed))
+				}
+
+				unreachable[device.ID()] = true
+				continue
+			}
+
+			unreachable[device.ID()] = false
+
+			if previous, ok := uptimes[device.ID()]; ok && current.Status.Uptime < previous {
+				upgradeLog.Warnf("%v (%v) restarted after %v of soak, with an uptime of %v", device.ModelName(), device.IP, elapsed, previous)
+				events[device.ID()] = append(events[device.ID()], fmt.Sprintf("restarted after %v", elapsed))
+			}
+
+			uptimes[device.ID()] = current.Status.Uptime
+		}
+
+		if !o.clock.Now().Before(deadline) {
+			break
+		}
+
+		o.clock.Sleep(interval)
+	}
+
+	var issues []SoakIssue
+	for _, device := range devices {
+		if len(events[device.ID()]) > 0 {
+			issues = append(issues, SoakIssue{Device: device, Events: events[device.ID()]})
+		}
+	}
+
+	return issues
+}
+
+// soakDevices soaks the upgraded devices that have not failed, if a soak
+// period is set, and reports whether the rollout passed. Devices that
+// restarted or became unreachable are reported as failed.
+func (o *OTAUpdater) soakDevices(devices []*Device) {
+	if o.soak == 0 {
+		return
+	}
+
+	failed := map[*Device]bool{}
+	for _, device := range o.failed {
+		failed[device] = true
+	}
+
+	var soaked []*Device
+	for _, device := range devices {
+		if !failed[device] {
+			soaked = append(soaked, device)
+		}
+	}
+
+	if len(soaked) == 0 {
+		return
+	}
+
+	issues := o.SoakDevices(soaked)
+
+	for _, issue := range issues {
+		reason := strings.Join(issue.Events, ", ")
+
+		o.failed = append(o.failed, issue.Device)
+		o.skipped = append(o.skipped, SkippedDevice{Device: issue.Device, Err: fmt.Errorf("%w (%v)", ErrSoakFailed, reason)})
+		audit.Acted(auditSoak, issue.Device, errors.New(reason))
+
+		upgradeLog.Errorf("%v (%v) was not stable on firmware %v during the soak period (%v)", issue.Device.ModelName(), issue.Device.String(), issue.Device.NewFWVersion, reason)
+	}
+
+	if len(issues) > 0 {
+		upgradeLog.Errorf("Soak test failed: %v of %v upgraded device(s) were not stable for %v", len(issues), len(soaked), o.soak)
+		return
+	}
+
+	for _, device := range soaked {
+		audit.Acted(auditSoak, device, nil)
+	}
+
+	upgradeLog.Infof("Soak test passed: %v upgraded device(s) were stable for %v", len(soaked), o.soak)
+}
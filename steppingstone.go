@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+)
+
+// steppingStoneVersion is the Gen2 firmware version that devices running
+// older firmware must be upgraded to before newer versions.
+const steppingStoneVersion = "1.3.3"
+
+// SteppingStone describes a firmware image that devices of a model are
+// upgraded to before newer versions, identified by its SHA-256 checksum.
+type SteppingStone struct {
+	Model   string
+	Version string
+	URL     string
+	SHA256  string
+}
+
+// String returns the stepping-stone as a table entry, ready to be
+// submitted.
+func (s SteppingStone) String() string {
+	return fmt.Sprintf("{Model: %q, Version: %q, URL: %q, SHA256: %q},", s.Model, s.Version, s.URL, s.SHA256)
+}
+
+// FirmwareManifest holds the manifest.json embedded in Gen2 firmware
+// packages.
+type FirmwareManifest struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	BuildID  string `json:"build_id"`
+}
+
+// verifySteppingStone downloads a candidate stepping-stone image for a
+// model, verifies that its embedded manifest matches the model and the
+// expected version and computes its checksum.
+func verifySteppingStone(client *http.Client, model string, url string, version string) (SteppingStone, error) {
+	entry, ok := registry.Lookup(model)
+	if !ok || entry.App == "" {
+		return SteppingStone{}, fmt.Errorf("%w: %v is not a known Gen2 model or application", ErrUnknownModel, model)
+	}
+
+	response, err := client.Get(url)
+	if err != nil {
+		return SteppingStone{}, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return SteppingStone{}, fmt.Errorf("unexpected status %v downloading %v", response.StatusCode, url)
+	}
+
+	image, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return SteppingStone{}, err
+	}
+
+	manifest, err := readFirmwareManifest(image)
+	if err != nil {
+		return SteppingStone{}, err
+	}
+
+	if registryKey(manifest.Name) != registryKey(entry.App) {
+		return SteppingStone{}, fmt.Errorf("image is built for %v, not %v (%v)", manifest.Name, entry.Name, entry.App)
+	}
+
+	if manifest.Version != version {
+		return SteppingStone{}, fmt.Errorf("image is version %v, not %v", manifest.Version, version)
+	}
+
+	sum := sha256.Sum256(image)
+
+	return SteppingStone{
+		Model:   entry.Model,
+		Version: manifest.Version,
+		URL:     url,
+		SHA256:  hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// steppingStoneURL returns the download URL of a firmware version for a
+// model, as listed by the firmware CDN.
+func steppingStoneURL(client *APIClient, model string, version string) (string, error) {
+	entry, ok := registry.Lookup(model)
+	if !ok || entry.App == "" {
+		return "", fmt.Errorf("%w: %v is not a known Gen2 model or application", ErrUnknownModel, model)
+	}
+
+	build, err := client.ResolveGen2Build(entry.App, version)
+	if err != nil {
+		return "", err
+	}
+
+	return build.URL, nil
+}
+
+// readFirmwareManifest returns the manifest embedded in a Gen2 firmware
+// package.
+func readFirmwareManifest(image []byte) (FirmwareManifest, error) {
+	reader, err := zip.NewReader(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		return FirmwareManifest{}, fmt.Errorf("image is not a firmware package: %v", err)
+	}
+
+	for _, file := range reader.File {
+		if path.Base(file.Name) != "manifest.json" {
+			continue
+		}
+
+		contents, err := file.Open()
+		if err != nil {
+			return FirmwareManifest{}, err
+		}
+
+		defer contents.Close()
+
+		var manifest FirmwareManifest
+		err = json.NewDecoder(contents).Decode(&manifest)
+		if err != nil {
+			return FirmwareManifest{}, fmt.Errorf("error parsing manifest: %v", err)
+		}
+
+		return manifest, nil
+	}
+
+	return FirmwareManifest{}, fmt.Errorf("image has no embedded manifest")
+}
@@ -0,0 +1,216 @@
+package main
+
+// discover finds devices on the network. Discovery stops as soon as
+// the expected number of devices or, if early exit is enabled, every
+// device in the inventory is found.
+func (o *OTAUpdater) discover() ([]Device, error) {
+	streamer, ok := o.browser.(DeviceStreamer)
+	if (o.expected == 0 && !o.earlyExit) || !ok {
+		return o.browser.DiscoverDevices(o.hosts)
+	}
+
+	devicesChan, cancel, err := streamer.StreamDevices(o.hosts)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	devices := make([]Device, 0)
+	stopped := false
+
+	for device := range devicesChan {
+		devices = append(devices, device)
+
+		if !stopped && o.discoveryComplete(devices) {
+			cancel()
+			stopped = true
+		}
+	}
+
+	return devices, nil
+}
+
+// discoveryComplete returns true if discovery can stop before the
+// wait time elapses.
+func (o *OTAUpdater) discoveryComplete(devices []Device) bool {
+	if o.expected > 0 && len(devices) >= o.expected {
+		discoveryLog.Infof("All %v expected devices have been found, stopping discovery", o.expected)
+		return true
+	}
+
+	if o.earlyExit && o.inventoryComplete(devices) {
+		discoveryLog.Info("All devices in the inventory have been found, stopping discovery")
+		return true
+	}
+
+	return false
+}
+
+// inventoryComplete returns true if every device in the inventory has
+// been found.
+func (o *OTAUpdater) inventoryComplete(devices []Device) bool {
+	if len(o.inventory) == 0 {
+		return false
+	}
+
+	for _, identifier := range o.inventory {
+		found := false
+		for i := range devices {
+			if devices[i].Matches(identifier) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// StreamUpgrade discovers devices and prompts for (or performs) the
+// upgrade of each one as soon as its settings are fetched, rather than
+// waiting for discovery to finish. Firmware is downloaded the first
+// time an out-of-date device of each model is found.
+func (o *OTAUpdater) StreamUpgrade() error {
+	streamer, ok := o.browser.(DeviceStreamer)
+	if !ok {
+		err := o.Start()
+		if err != nil {
+			return err
+		}
+
+		return o.Upgrade()
+	}
+
+	err := o.listen()
+	if err != nil {
+		return err
+	}
+
+	history, err := LoadHistory(o.historyPath)
+	if err != nil {
+		return err
+	}
+
+	err = o.startRun()
+	if err != nil {
+		return err
+	}
+
+	progress.DiscoveryStarted()
+
+	devicesChan, cancel, err := streamer.StreamDevices(o.hosts)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	o.devices = map[string]*Device{}
+
+	var found []Device
+	var upgradedDevices []*Device
+	interrupted := false
+	served := map[string]bool{}
+	upgraded := map[string]int{}
+	stopped := false
+
+	for discovered := range devicesChan {
+		device := discovered
+		o.devices[device.IP.String()] = &device
+		progress.DeviceFound(&device)
+
+		found = append(found, device)
+		if !stopped && o.discoveryComplete(found) {
+			cancel()
+			stopped = true
+		}
+
+		err := o.prepareDevice(&device, served)
+		if skipped(&device, err) {
+			audit.Skipped(auditUpgrade, &device, "firmware", err.Error())
+			o.skipped = append(o.skipped, SkippedDevice{Device: &device, Err: err})
+			delete(o.devices, device.IP.String())
+			continue
+		} else if err != nil {
+			console.Failed(&device, err, 0)
+			progress.UpgradeFailed(&device, err)
+			o.failed = append(o.failed, &device)
+			o.skipped = append(o.skipped, SkippedDevice{Device: &device, Err: err})
+			continue
+		}
+
+		devices, err := o.upgradeDevices([]*Device{&device}, history, nil, upgraded)
+		upgradedDevices = append(upgradedDevices, devices...)
+
+		if err == errInterrupted {
+			interrupted = true
+			cancel()
+
+			// Let in-flight settings requests finish.
+			for range devicesChan {
+			}
+
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	recorded := make([]*Device, len(found))
+	for i := range found {
+		recorded[i] = &found[i]
+	}
+	o.recordDevices(recorded)
+
+	o.finishRun(interrupted)
+
+	if o.verifyTimeout > 0 {
+		err = o.reportVerificationFailures(o.VerifyDevices(upgradedDevices))
+		if err != nil {
+			return err
+		}
+	}
+
+	if !interrupted {
+		o.soakDevices(upgradedDevices)
+	}
+
+	return nil
+}
+
+// prepareDevice fetches the most recent firmware version for a device
+// and, if it is out-of-date, makes its firmware available on the local
+// OTA server.
+func (o *OTAUpdater) prepareDevice(device *Device, served map[string]bool) error {
+	if device.IsGen2() {
+		o.api.AddGen2App(device.Model)
+	}
+
+	newFWVersion, err := o.newVersionFor(device)
+	if err != nil {
+		return err
+	}
+
+	device.NewFWVersion = newFWVersion
+
+	if device.CurrentFWVersion == newFWVersion || !o.servesLocally(device) || served[device.Model] || readOnlyMode {
+		return nil
+	}
+
+	firmwares, err := o.api.FetchVersions()
+	if err != nil {
+		return err
+	}
+
+	err = o.serveFirmware(device.Model, firmwares[device.Model])
+	if err != nil {
+		return err
+	}
+
+	served[device.Model] = true
+
+	return nil
+}
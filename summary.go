@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SkippedDevice holds information about a device that was not upgraded,
+// along with the reason why.
+type SkippedDevice struct {
+	Device *Device
+	Err    error
+}
+
+// SkippedReporter is the interface implemented by discoverers that can
+// report the devices found but left out, such as those requiring a
+// missing username/password.
+type SkippedReporter interface {
+	SkippedDevices() []SkippedDevice
+}
+
+// skip records a device found during discovery but left out due to
+// err.
+func (b *Browser) skip(device Device, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.skipped = append(b.skipped, SkippedDevice{Device: &device, Err: err})
+}
+
+// SkippedDevices returns the devices found during discovery but left
+// out, such as those that are unreachable or require a missing
+// username/password.
+func (b *Browser) SkippedDevices() []SkippedDevice {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]SkippedDevice{}, b.skipped...)
+}
+
+// SkippedDevices returns every device that was not upgraded on this
+// run, whether it was left out during discovery, skipped when checked
+// for upgrades, deferred or failed to upgrade.
+func (o *OTAUpdater) SkippedDevices() []SkippedDevice {
+	var skipped []SkippedDevice
+
+	if reporter, ok := o.browser.(SkippedReporter); ok {
+		skipped = append(skipped, reporter.SkippedDevices()...)
+	}
+
+	return append(skipped, o.skipped...)
+}
+
+// nextStep returns what the user can do about a device that was not
+// upgraded due to err.
+func nextStep(device *Device, err error) string {
+	switch {
+	case errors.Is(err, ErrAuthRequired):
+		return "Add its username/password to your netrc file."
+	case errors.Is(err, ErrDeviceUnreachable):
+		return "Check that it is online, or give its address with --host."
+	case errors.Is(err, ErrManualUpgradeRequired):
+		return fmt.Sprintf("Upgrade it manually from its web interface at %v following %v.", device.URL("/"), manualUpgradeURL(device))
+	case errors.Is(err, ErrUnknownModel):
+		return fmt.Sprintf("Upgrade it manually from its web interface at %v.", device.URL("/"))
+	case errors.Is(err, ErrFirmwareBlocked):
+		return "Every available firmware is blocked by the blocklist of your configuration file."
+	case errors.Is(err, ErrAheadOfStable):
+		return "Its firmware is newer than the stable one, run mota with --sync-to-stable to downgrade it deliberately."
+	case errors.Is(err, ErrRolloutDeferred):
+		return "Run mota again to continue the rollout."
+	case errors.Is(err, ErrUnderLoad):
+		return "Run mota again once its load is switched off, or raise --max-load."
+	case errors.Is(err, ErrSkipRule):
+		return "Run mota again once the skip_if rule of your configuration file no longer holds."
+	case errors.Is(err, ErrFirmwareNotFound):
+		return "No firmware is published for its model, check whether it is supported by the Shelly Cloud."
+	case errors.Is(err, ErrModelNotIndexed):
+		return "Its model is too new for the firmware index, check for a newer mota release or upgrade it from its web interface."
+	case errors.Is(err, ErrFirmwareInfoUnavailable):
+		return "The Shelly Cloud could not be reached, run mota again later."
+	case errors.Is(err, ErrInsufficientSpace):
+		return "Free up space on the device (e.g. by deleting scripts) and run mota again."
+	case errors.Is(err, ErrUpdateInProgress):
+		return "Wait for the update in progress to finish and run mota again."
+	case errors.Is(err, ErrUpdateNotStarted):
+		return "Restart the device or increase --ota-retries."
+	case errors.Is(err, ErrDeviceDeadlineExceeded):
+		return "Increase --device-deadline."
+	case errors.Is(err, ErrSoakFailed):
+		return "Check its power supply and Wi-Fi signal, and consider blocking its new firmware with the blocklist of your configuration file."
+	case errors.Is(err, ErrReadOnly):
+		return "Run mota without read-only mode to upgrade it."
+	case errors.Is(err, ErrUnexpectedModel):
+		return "Check that its address in the hosts file is correct."
+	}
+
+	return "Run mota with --verbose for details."
+}
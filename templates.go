@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateNames lists the templates that can be customized, which are
+// the lines printed for upgraded and failed devices and the payload of
+// webhook alerts.
+var templateNames = []string{"failed", "upgraded", "webhook"}
+
+// Notification holds the fields available to report and notification
+// templates (e.g. {{.Device.Name}} upgraded to {{.ToVersion}}).
+type Notification struct {
+	Event       string
+	Device      *Device
+	FromVersion string
+	ToVersion   string
+	Duration    time.Duration
+	Error       string
+}
+
+// Templates holds the custom templates set in the configuration file.
+// Templates not set are nil and the default output is used instead.
+type Templates struct {
+	Failed   *template.Template
+	Upgraded *template.Template
+	Webhook  *template.Template
+}
+
+// ParseTemplates parses the templates set in the configuration file,
+// keyed by name.
+func ParseTemplates(sources map[string]string) (*Templates, error) {
+	templates := &Templates{}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(sources[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v template (%v)", name, err)
+		}
+
+		switch name {
+		case "failed":
+			templates.Failed = tmpl
+		case "upgraded":
+			templates.Upgraded = tmpl
+		case "webhook":
+			templates.Webhook = tmpl
+		default:
+			return nil, fmt.Errorf("unknown template %q, must be one of %v", name, strings.Join(templateNames, ", "))
+		}
+	}
+
+	return templates, nil
+}
+
+// renderTemplate executes a template with the given notification.
+func renderTemplate(tmpl *template.Template, notification Notification) (string, error) {
+	var buffer bytes.Buffer
+
+	err := tmpl.Execute(&buffer, notification)
+	if err != nil {
+		return "", fmt.Errorf("unable to render %v template (%v)", tmpl.Name(), err)
+	}
+
+	return buffer.String(), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer records spans of the upgrade pipeline (discovery, settings
+// fetches, cloud API calls, downloads and upgrades) with an OpenTelemetry
+// tracer provider. Every span belongs to the trace of the current run.
+// Methods on a nil Tracer do nothing, so that code can be instrumented
+// regardless of whether tracing is enabled.
+type Tracer struct {
+	provider trace.TracerProvider
+	tracer   trace.Tracer
+	mutex    sync.Mutex
+	run      context.Context
+	root     trace.Span
+}
+
+// Span is a timed operation of a trace. Methods on a nil Span do
+// nothing.
+type Span struct {
+	span trace.Span
+}
+
+// NewTracer returns a Tracer recording spans with a tracer provider.
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{
+		provider: provider,
+		tracer:   provider.Tracer("github.com/ruimarinho/mota"),
+	}
+}
+
+// NewOTLPTracerProvider returns a tracer provider exporting spans to the
+// OTLP/HTTP endpoint of a collector (e.g. http://localhost:4318).
+func NewOTLPTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	endpointURL, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/v1/traces")
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(endpointURL.String()),
+		otlptracehttp.WithTimeout(10*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("mota"),
+			semconv.ServiceVersion(version),
+		)),
+	), nil
+}
+
+// StartRun starts a new trace, whose root span covers a whole run.
+func (t *Tracer) StartRun(name string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.run, t.root = t.tracer.Start(context.Background(), name, trace.WithNewRoot())
+}
+
+// EndRun ends the trace of the current run and exports its spans, if
+// the tracer provider supports flushing them.
+func (t *Tracer) EndRun(err error) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	root := t.root
+	t.run, t.root = nil, nil
+	t.mutex.Unlock()
+
+	if root == nil {
+		return nil
+	}
+
+	(&Span{span: root}).End(err)
+
+	flusher, ok := t.provider.(interface{ ForceFlush(context.Context) error })
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = flusher.ForceFlush(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to export traces (%v)", err)
+	}
+
+	return nil
+}
+
+// StartSpan starts a span as a child of the root span of the current
+// run. It returns nil if tracing is disabled or no run has started.
+// Attributes are given as key and value pairs.
+func (t *Tracer) StartSpan(name string, attributes ...string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	run := t.run
+	t.mutex.Unlock()
+
+	if run == nil {
+		return nil
+	}
+
+	var attrs []attribute.KeyValue
+	for i := 0; i+1 < len(attributes); i += 2 {
+		attrs = append(attrs, attribute.String(attributes[i], attributes[i+1]))
+	}
+
+	_, span := t.tracer.Start(run, name, trace.WithAttributes(attrs...))
+
+	return &Span{span: span}
+}
+
+// SetAttribute adds an attribute to the span.
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// End ends the span, marking it as failed if err is not nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	} else {
+		s.span.SetStatus(codes.Ok, "")
+	}
+
+	s.span.End()
+}
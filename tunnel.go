@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// deviceDial, if set, is used to connect to devices instead of dialing
+// them directly, such as through a tunnel to a remote site.
+var deviceDial func(network string, addr string) (net.Conn, error)
+
+// Tunnel reaches devices at a remote site through an SSH jump host or a
+// SOCKS5 proxy. Only SSH jump hosts can forward the local OTA server to
+// the remote site, via a remote port forward.
+type Tunnel struct {
+	via       *url.URL
+	client    *ssh.Client
+	dialer    proxy.Dialer
+	advertise net.IP
+}
+
+// OpenTunnel connects to a jump host (e.g. ssh://user@gateway) or a
+// SOCKS5 proxy (e.g. socks5://gateway:1080). SSH jump hosts are
+// authenticated with the SSH agent or the default private keys and
+// verified against the known hosts. The address devices use to reach
+// the jump host can be set with the advertise parameter (e.g.
+// ssh://user@gateway?advertise=192.168.1.2), and defaults to the
+// address of the jump host itself.
+func OpenTunnel(via string) (*Tunnel, error) {
+	viaURL, err := url.Parse(via)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel %v (%v)", via, err)
+	}
+
+	tunnel := &Tunnel{via: viaURL}
+
+	switch viaURL.Scheme {
+	case "ssh":
+		tunnel.client, err = dialSSH(viaURL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to jump host %v (%v)", viaURL.Host, err)
+		}
+
+		advertise := viaURL.Query().Get("advertise")
+		if advertise == "" {
+			advertise = viaURL.Hostname()
+		}
+
+		addresses, err := net.LookupIP(advertise)
+		if err != nil || len(addresses) == 0 {
+			tunnel.client.Close()
+			return nil, fmt.Errorf("unable to resolve address %v advertised to devices (%v)", advertise, err)
+		}
+
+		tunnel.advertise = addresses[0]
+	case "socks5":
+		tunnel.dialer, err = proxy.FromURL(viaURL, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOCKS5 proxy %v (%v)", viaURL.Host, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid tunnel %v, must be an ssh:// jump host or a socks5:// proxy", via)
+	}
+
+	return tunnel, nil
+}
+
+// dialSSH connects to an SSH jump host.
+func dialSSH(viaURL *url.URL) (*ssh.Client, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			continue
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if password, ok := viaURL.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	user := viaURL.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	host := viaURL.Host
+	if viaURL.Port() == "" {
+		host = net.JoinHostPort(viaURL.Hostname(), "22")
+	}
+
+	return ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+}
+
+// Dial connects to an address at the remote site.
+func (t *Tunnel) Dial(network string, addr string) (net.Conn, error) {
+	if t.client != nil {
+		return t.client.Dial(network, addr)
+	}
+
+	return t.dialer.Dial(network, addr)
+}
+
+// Listen forwards a port on all interfaces of the jump host to the
+// returned listener, so that devices at the remote site can reach the
+// local OTA server. The jump host must allow it via GatewayPorts.
+func (t *Tunnel) Listen(port int) (net.Listener, error) {
+	if t.client == nil {
+		return nil, errors.New("SOCKS5 proxies cannot forward ports")
+	}
+
+	return t.client.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+}
+
+// Advertise returns the address devices use to reach the jump host, or
+// nil if the OTA server cannot be forwarded.
+func (t *Tunnel) Advertise() net.IP {
+	return t.advertise
+}
+
+// Close disconnects from the jump host.
+func (t *Tunnel) Close() error {
+	if t.client == nil {
+		return nil
+	}
+
+	return t.client.Close()
+}
+
+func (t *Tunnel) String() string {
+	return fmt.Sprintf("%v://%v", t.via.Scheme, t.via.Host)
+}
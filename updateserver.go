@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// resetUpdateServerDefault resets overridden update servers to the
+// default Shelly servers rather than to a mirror.
+const resetUpdateServerDefault = "default"
+
+// UpdateConfig is the update section of the system configuration of Gen2
+// devices, as returned by the Config.Get RPC method, whose URL overrides
+// the server the device checks for updates.
+type UpdateConfig struct {
+	URL string `json:"url"`
+}
+
+// fetchUpdateServer returns the update server a Gen2 device has been
+// pointed at, or an empty string if it uses the default Shelly servers
+// or does not support overriding it. Gen1 devices have no persistent
+// update server setting.
+func fetchUpdateServer(client *http.Client, device *Device) (string, error) {
+	if !device.IsGen2() {
+		return "", nil
+	}
+
+	response, err := client.Get(device.GetBaseURL() + "/rpc/Config.Get?key=update")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return "", nil
+	case response.StatusCode == http.StatusUnauthorized:
+		return "", ErrAuthRequired
+	case response.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("unexpected status %v fetching update configuration", response.StatusCode)
+	}
+
+	var config UpdateConfig
+	err = json.NewDecoder(response.Body).Decode(&config)
+	if err != nil {
+		return "", fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return config.URL, nil
+}
+
+// overriddenUpdateServers reports the devices whose update server has
+// been overridden, as they silently never see updates once it goes
+// stale, and, if resetting them is enabled, points them back at the
+// default Shelly servers or at the given mirror (after confirmation,
+// unless forced).
+func (o *OTAUpdater) overriddenUpdateServers(devices map[string]*Device) error {
+	for _, device := range sortedDevices(devices) {
+		server, err := fetchUpdateServer(device.HTTPClient(o.deviceTimeout), device)
+		if err != nil {
+			upgradeLog.Debugf("Unable to read the update server of %v (%v)", device.String(), err)
+			continue
+		}
+
+		if server == "" || server == o.resetUpdateServer {
+			continue
+		}
+
+		if readOnlyMode {
+			upgradeLog.Warnf("%v (%v) checks for updates on %v instead of the Shelly servers", device.ModelName(), device.IP, server)
+			audit.Skipped(auditResetUpdateServer, device, "read-only", "read-only mode")
+			continue
+		}
+
+		if o.resetUpdateServer == "" {
+			upgradeLog.Warnf("%v (%v) checks for updates on %v instead of the Shelly servers (use --reset-update-server to reset it)", device.ModelName(), device.IP, server)
+			audit.Skipped(auditResetUpdateServer, device, "reset-update-server", "resets not enabled with --reset-update-server")
+			continue
+		}
+
+		target := o.resetUpdateServer
+		if target == resetUpdateServerDefault {
+			target = ""
+		}
+
+		if !o.force {
+			destination := "the Shelly servers"
+			if target != "" {
+				destination = target
+			}
+
+			reset, err := o.confirm(device, fmt.Sprintf("%v (%v) checks for updates on %v. Would you like to point it at %v?", device.ModelName(), device.IP, server, destination))
+			if err != nil {
+				return err
+			}
+
+			audit.Prompted(auditResetUpdateServer, device, reset, false)
+
+			if !reset {
+				continue
+			}
+		} else {
+			audit.Prompted(auditResetUpdateServer, device, true, true)
+		}
+
+		err = setUpdateServer(device.HTTPClient(10*time.Second), device, target)
+		audit.Acted(auditResetUpdateServer, device, err)
+		if err != nil {
+			upgradeLog.Error(err.Error())
+			continue
+		}
+
+		upgradeLog.Infof("Reset the update server of %v (%v), which was %v", device.ModelName(), device.IP, server)
+	}
+
+	return nil
+}
+
+// setUpdateServer points a Gen2 device at an update server, or back at
+// the default Shelly servers if empty, via the Config.Set RPC method.
+func setUpdateServer(client *http.Client, device *Device, server string) error {
+	request := gen2SetConfig(device, "Config.Set", map[string]interface{}{
+		"update": map[string]interface{}{"url": server},
+	}) + "&save=true"
+
+	_, err := requestSettings(client, request)
+	if err != nil {
+		return &DeviceError{Device: device, Op: "reset update server", Err: err}
+	}
+
+	return nil
+}
@@ -1,6 +1,12 @@
 package main
 
-import "net"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+)
 
 // ServerIP attempts to get the local device IP to
 // expose as the OTA server.
@@ -16,6 +22,37 @@ func ServerIP() (net.IP, error) {
 	return localAddr.IP, nil
 }
 
+// localAddressFor returns the address of the local interface that
+// reaches an IP address, according to the routing table. No packets are
+// sent.
+func localAddressFor(ip net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "80"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// onSameNetwork returns true if an IP address is on the network of the
+// local interface with a given address.
+func onSameNetwork(local net.IP, ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		network, ok := addr.(*net.IPNet)
+		if ok && network.IP.Equal(local) && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // ServerPort attempts to retrieve a free open port.
 func ServerPort() (int, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
@@ -30,3 +67,18 @@ func ServerPort() (int, error) {
 	defer l.Close()
 	return l.Addr().(*net.TCPAddr).Port, nil
 }
+
+// fileChecksum returns the hex-encoded SHA-256 checksum of a file.
+func fileChecksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
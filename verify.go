@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// VerificationFailure holds information about an upgraded device that
+// did not come back online with the new firmware.
+type VerificationFailure struct {
+	Device *Device
+	Reason string
+}
+
+// VerifyDevices polls every upgraded device until it is reachable and
+// reports the new firmware version, or until the verification timeout
+// elapses, and returns the devices that did not come back.
+func (o *OTAUpdater) VerifyDevices(devices []*Device) []VerificationFailure {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	upgradeLog.Infof("Verifying %v upgraded device(s) for up to %v", len(devices), o.verifyTimeout)
+
+	interval := 10 * time.Second
+	if o.verifyTimeout < interval {
+		interval = o.verifyTimeout
+	}
+
+	pending := devices
+	reasons := map[string]string{}
+	var timedOut []*Device
+	deadline := o.clock.Now().Add(o.verifyTimeout)
+
+	for {
+		var stillPending []*Device
+		for _, device := range pending {
+			err := checkHealth(device.HTTPClient(5*time.Second), device)
+			if err != nil {
+				// Devices out of time budget are not polled any further.
+				if deviceDeadline, ok := o.deadlines[device.ID()]; ok && !o.clock.Now().Before(deviceDeadline) {
+					reasons[device.ID()] = fmt.Sprintf("timed out, %v of %v (%v)", ErrDeviceDeadlineExceeded, o.deviceDeadline, err)
+					timedOut = append(timedOut, device)
+					continue
+				}
+
+				reasons[device.ID()] = err.Error()
+				stillPending = append(stillPending, device)
+				continue
+			}
+
+			upgradeLog.Infof("Verified %v (%v) is running firmware %v", device.ModelName(), device.IP, device.NewFWVersion)
+			progress.UpgradeVerified(device)
+			audit.Acted(auditVerify, device, nil)
+			o.compareConfig(device)
+		}
+
+		pending = stillPending
+
+		if len(pending) == 0 || !o.clock.Now().Before(deadline) {
+			break
+		}
+
+		o.clock.Sleep(interval)
+	}
+
+	var failures []VerificationFailure
+	for _, device := range append(timedOut, pending...) {
+		failures = append(failures, VerificationFailure{Device: device, Reason: reasons[device.ID()]})
+	}
+
+	return failures
+}
+
+// reportVerificationFailures lists the devices that did not come back
+// online and optionally writes them to the failures file.
+func (o *OTAUpdater) reportVerificationFailures(failures []VerificationFailure) error {
+	if len(failures) == 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, failure := range failures {
+		o.failed = append(o.failed, failure.Device)
+		audit.Acted(auditVerify, failure.Device, errors.New(failure.Reason))
+
+		upgradeLog.Errorf("%v (%v) did not come back with firmware %v within %v (%v)", failure.Device.ModelName(), failure.Device.String(), failure.Device.NewFWVersion, o.verifyTimeout, failure.Reason)
+
+		lines = append(lines, fmt.Sprintf("%v\t%v\t%v\t%v\t%v", failure.Device.IP, failure.Device.HostName, failure.Device.Model, failure.Device.NewFWVersion, failure.Reason))
+	}
+
+	if o.failuresFile == "" {
+		return nil
+	}
+
+	upgradeLog.Infof("Writing verification failures to %v", o.failuresFile)
+
+	return ioutil.WriteFile(o.failuresFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}